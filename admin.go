@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The admin socket speaks newline delimited JSON: every line sent by the
+// client is an adminRequest, answered by exactly one adminResponse line.
+type (
+	adminRequest struct {
+		Command string   `json:"command"`
+		Args    []string `json:"args,omitempty"`
+	}
+
+	adminResponse struct {
+		Error string          `json:"error,omitempty"`
+		Data  json.RawMessage `json:"data,omitempty"`
+	}
+
+	proxyStatus struct {
+		Socket      string `json:"socket"`
+		Locked      bool   `json:"locked"`
+		Backends    int    `json:"backends"`
+		BackendsUp  int    `json:"backends_up"`
+		Clients     int64  `json:"clients"`
+		PeakClients int64  `json:"peak_clients"`
+
+		Latencies []latencySummary `json:"latencies,omitempty"`
+	}
+
+	adminCommand func(args []string) (any, error)
+)
+
+var adminCommands = map[string]adminCommand{
+	"status": func(args []string) (any, error) {
+		return currentStatus(), nil
+	},
+	"list-backends": func(args []string) (any, error) {
+		return pkr.Status(), nil
+	},
+	"list-keys": func(args []string) (any, error) {
+		return pkr.Keys()
+	},
+	"add-backend": func(args []string) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("usage: add-backend [name=]<socket>")
+		}
+		return nil, pkr.AddBackend(parseBackendArg(args[0]))
+	},
+	"remove-backend": func(args []string) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("usage: remove-backend <name|socket>")
+		}
+		return nil, pkr.RemoveBackend(args[0])
+	},
+	"enable-backend": func(args []string) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("usage: enable-backend <name|socket>")
+		}
+		return nil, pkr.SetEnabled(args[0], true)
+	},
+	"disable-backend": func(args []string) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("usage: disable-backend <name|socket>")
+		}
+		return nil, pkr.SetEnabled(args[0], false)
+	},
+	"recent-events": func(args []string) (any, error) {
+		return latestEvents(), nil
+	},
+	"lock": func(args []string) (any, error) {
+		pkr.SetLocked(true)
+		fireEvent(hookEvent{Event: "lock"})
+		return nil, nil
+	},
+	"unlock": func(args []string) (any, error) {
+		pkr.SetLocked(false)
+		fireEvent(hookEvent{Event: "unlock"})
+		return nil, nil
+	},
+	"flush-cache": func(args []string) (any, error) {
+		pkr.cache.invalidate()
+		return nil, nil
+	},
+	"shutdown": func(args []string) (any, error) {
+		slog.Info("shutdown requested")
+		requestShutdown()
+		return nil, nil
+	},
+}
+
+// Sums up the state of the proxy.
+func currentStatus() proxyStatus {
+	st := proxyStatus{
+		Socket:      authSock,
+		Locked:      pkr.locked.Load(),
+		Clients:     clientCount.Load(),
+		PeakClients: clientPeak.Load(),
+		Latencies:   latencySummaries(),
+	}
+	for _, b := range pkr.Status() {
+		st.Backends++
+		if b.Up {
+			st.BackendsUp++
+		}
+	}
+
+	return st
+}
+
+// Returns the admin socket path used when none is given on the command line:
+// beside the default agent socket, or in a directory of the user's own in
+// the temporary directory.
+func defaultAdminSocket() string {
+	if agentSocket := defaultAgentSocket(); agentSocket != "" {
+		return filepath.Join(filepath.Dir(agentSocket), "admin.sock")
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ssh-agent-proxy-%d", os.Getuid()), "admin.sock")
+}
+
+// Listens on the admin socket, replacing a stale one. It is made in a
+// private directory, only its owner may connect, and connections from
+// other users are turned away.
+func listenAdmin(name string) (net.Listener, error) {
+	if l := takeInherited(name); l != nil {
+		return ownerListener{l}, nil
+	}
+
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := checkSocketDir(dir); err != nil {
+		return nil, err
+	}
+
+	if err := removeStaleSocket(name); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(name, 0o600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return ownerListener{l}, nil
+}
+
+// Refuses a directory where another user could replace the socket: one
+// belonging to them, or that they may write to without the sticky bit.
+func checkSocketDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() && st.Uid != 0 {
+		return fmt.Errorf("%s belongs to another user", dir)
+	}
+
+	if info.Mode().Perm()&0o022 != 0 && info.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("%s is writable by other users", dir)
+	}
+
+	return nil
+}
+
+// A listener accepting only connections from the user running the proxy.
+type ownerListener struct {
+	net.Listener
+}
+
+func (l ownerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		peer, err := getPeerCred(conn)
+		if err == nil && peer.uid == os.Getuid() {
+			return conn, nil
+		}
+
+		slog.Warn("admin connection from another user rejected", "socket", l.Addr().String(), "uid", peer.uid, "pid", peer.pid, "exe", peer.exe, "error", err)
+		_ = conn.Close()
+	}
+}
+
+// Hands the socket over to an upgraded proxy.
+func (l ownerListener) File() (*os.File, error) {
+	fl, ok := l.Listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	return fl.File()
+}
+
+// Leaves the socket to an upgraded proxy on close.
+func (l ownerListener) SetUnlinkOnClose(unlink bool) {
+	if ul, ok := l.Listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(unlink)
+	}
+}
+
+func serveAdmin(socket net.Listener) {
+	for {
+		if conn, err := socket.Accept(); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("admin accept", "error", err)
+		} else {
+			go adminHandler(conn)
+		}
+	}
+}
+
+func adminHandler(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	enc := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+
+	for scanner.Scan() {
+		var req adminRequest
+		var res adminResponse
+
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			res.Error = fmt.Sprintf("bad request: %v", err)
+		} else if cmd, ok := adminCommands[req.Command]; !ok {
+			res.Error = fmt.Sprintf("unknown command %q", req.Command)
+		} else {
+			slog.Info("admin command", "command", req.Command, "args", req.Args)
+
+			if data, err := cmd(req.Args); err != nil {
+				res.Error = err.Error()
+			} else if data != nil {
+				if res.Data, err = json.Marshal(data); err != nil {
+					res.Error = err.Error()
+				}
+			}
+		}
+
+		if err := enc.Encode(res); err != nil {
+			slog.Error("admin reply", "error", err)
+			return
+		}
+	}
+}
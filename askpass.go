@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"golang.org/x/term"
+)
+
+var (
+	askpassProgram = flag.String("askpass", "", "program asking for confirmations and passphrases: an ssh-askpass compatible one, pinentry or zenity; $SSH_ASKPASS or ssh-askpass by default")
+	confirmPrompt  = flag.String("confirm-prompt", "Allow {{.Op}} by {{.Client}}{{with .Key}} with key {{.}}{{end}}?", "template of the prompt confirming requests, with .Op, .Client and .Key")
+
+	confirmTemplate *template.Template
+)
+
+// What the confirm prompt template is given.
+type confirmRequest struct {
+	Op     string
+	Client string
+	Key    string
+}
+
+func setupAskpass() error {
+	t, err := template.New("confirm").Parse(*confirmPrompt)
+	if err != nil {
+		return fmt.Errorf("bad --confirm-prompt: %w", err)
+	}
+	confirmTemplate = t
+
+	return nil
+}
+
+// Returns the program to ask the user with, "" if there is none.
+func askpass() string {
+	if *askpassProgram != "" {
+		return *askpassProgram
+	}
+
+	return os.Getenv("SSH_ASKPASS")
+}
+
+// Asks the user for a passphrase, following ssh-add's conventions: the
+// askpass program is used when there is no terminal, or always when
+// SSH_ASKPASS_REQUIRE is "force" or "prefer".
+func askPassphrase(prompt string) ([]byte, error) {
+	program := askpass()
+	require := os.Getenv("SSH_ASKPASS_REQUIRE")
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err == nil {
+		defer func() { _ = tty.Close() }()
+	}
+
+	if program != "" && require != "never" && (tty == nil || require == "force" || require == "prefer") {
+		return runAskpass(program, prompt)
+	}
+
+	if tty == nil {
+		return nil, errors.New("no terminal or askpass program available to ask for a passphrase")
+	}
+
+	if _, err := fmt.Fprint(tty, prompt); err != nil {
+		return nil, err
+	}
+
+	pass, err := term.ReadPassword(int(tty.Fd()))
+	_, _ = fmt.Fprintln(tty)
+
+	return pass, err
+}
+
+func runAskpass(program, prompt string) ([]byte, error) {
+	var cmd *exec.Cmd
+	switch askpassStyle(program) {
+	case "pinentry":
+		return pinentry(program, prompt, "GETPIN")
+	case "zenity":
+		cmd = exec.Command(program, "--password", "--title="+prompt)
+	default:
+		cmd = exec.Command(program, prompt)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", program, err)
+	}
+
+	return bytes.TrimRight(out, "\r\n"), nil
+}
+
+// Tells how to talk to an askpass program by its name.
+func askpassStyle(program string) string {
+	name := filepath.Base(program)
+	switch {
+	case strings.HasPrefix(name, "pinentry"):
+		return "pinentry"
+	case name == "zenity":
+		return "zenity"
+	default:
+		return "askpass"
+	}
+}
+
+// Builds the prompt confirming a request from --confirm-prompt.
+func confirmText(op string, client peerCred, key string) string {
+	var b strings.Builder
+	if confirmTemplate == nil || confirmTemplate.Execute(&b, confirmRequest{Op: op, Client: client.String(), Key: key}) != nil {
+		return fmt.Sprintf("Allow %s by %s?", op, client)
+	}
+
+	return b.String()
+}
+
+// Asks the user to confirm an action with the askpass program (ssh-askpass
+// by default), the way ssh-agent confirms the use of keys added with
+// ssh-add -c. A desktop applet registered over D-Bus is asked first, and
+// the terminal when the program can't be run.
+func askConfirm(prompt string) error {
+	if asked, err := dbusConfirm(prompt); asked {
+		return err
+	}
+
+	program := askpass()
+	if program == "" {
+		program = "ssh-askpass"
+	}
+
+	var err error
+	switch askpassStyle(program) {
+	case "pinentry":
+		_, err = pinentry(program, prompt, "CONFIRM")
+	case "zenity":
+		err = exec.Command(program, "--question", "--text="+prompt).Run()
+	default:
+		cmd := exec.Command(program, prompt)
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+		err = cmd.Run()
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		if tty, terr := os.OpenFile("/dev/tty", os.O_RDWR, 0); terr == nil {
+			defer func() { _ = tty.Close() }()
+			return ttyConfirm(tty, prompt)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", program, err)
+	}
+
+	return nil
+}
+
+// Asks for a yes on the terminal.
+func ttyConfirm(tty io.ReadWriter, prompt string) error {
+	if _, err := fmt.Fprintf(tty, "%s [y/N] ", prompt); err != nil {
+		return err
+	}
+
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return errors.New("not confirmed on the terminal")
+	}
+
+	return nil
+}
+
+// Runs a pinentry program and sends it the command, GETPIN or CONFIRM,
+// after the prompt, returning the PIN it gets.
+func pinentry(program, prompt, command string) ([]byte, error) {
+	cmd := exec.Command(program)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: %w", program, err)
+	}
+	defer func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	}()
+
+	r := bufio.NewReader(stdout)
+
+	// Reads up to the OK or ERR ending the reply, returning the data lines
+	reply := func() ([]byte, error) {
+		var data []byte
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", program, err)
+			}
+			line = strings.TrimRight(line, "\n")
+
+			switch {
+			case line == "OK" || strings.HasPrefix(line, "OK "):
+				return data, nil
+			case strings.HasPrefix(line, "ERR "):
+				return nil, fmt.Errorf("%s: %s", program, line[4:])
+			case strings.HasPrefix(line, "D "):
+				d, err := url.PathUnescape(line[2:])
+				if err != nil {
+					return nil, err
+				}
+				data = append(data, d...)
+			}
+		}
+	}
+
+	if _, err := reply(); err != nil {
+		return nil, err
+	}
+
+	escape := strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D")
+	for _, line := range []string{"SETDESC " + escape.Replace(prompt), "SETTITLE ssh-agent-proxy", command} {
+		if _, err := fmt.Fprintln(stdin, line); err != nil {
+			return nil, err
+		}
+
+		data, err := reply()
+		if err != nil {
+			return nil, err
+		}
+		if line == command {
+			return data, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	lockAfter = flag.Duration("lock-after", 0, "engage the proxy lock after this long without client requests, 0 to never lock")
+
+	// When a client last sent a request, in Unix nanoseconds
+	lastActivity atomic.Int64
+)
+
+// A client connection noting the time of every request it reads.
+type activityReader struct {
+	io.ReadWriter
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.ReadWriter.Read(p)
+	if n > 0 {
+		lastActivity.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// Engages the proxy lock whenever no client has sent a request for the
+// given time, until ctx is done.
+func (r *proxyKeyring) autoLock(ctx context.Context, after time.Duration) {
+	lastActivity.Store(time.Now().UnixNano())
+
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, lastActivity.Load()))
+		if idle >= after {
+			if !r.locked.Load() {
+				slog.Info("locking after inactivity", "idle", idle.Round(time.Second))
+				r.SetLocked(true)
+				fireEvent(hookEvent{Event: "lock"})
+			}
+			idle = 0
+		}
+
+		timer.Reset(after - idle)
+	}
+}
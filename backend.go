@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Deadline for requests to the remote key services.
+const remoteTimeout = 30 * time.Second
+
+var errBackendLoop = errors.New("backend is the proxy's own socket")
+
+// A backend connection that is closed once its context is done, aborting
+// requests blocked on it.
+type ctxConn struct {
+	net.Conn
+	stop func() bool
+}
+
+// Opens a connection to the agent described by spec, which is either a plain
+// unix socket path or a URI naming one of the other transports. The
+// connection is bound to ctx and takes over its deadline.
+func dialBackend(ctx context.Context, spec string) (net.Conn, error) {
+	conn, err := dialSpec(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	return &ctxConn{Conn: conn, stop: context.AfterFunc(ctx, func() { _ = conn.Close() })}, nil
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+func dialSpec(ctx context.Context, spec string) (net.Conn, error) {
+	// A command line isn't a URL
+	if command, ok := strings.CutPrefix(spec, "exec:"); ok {
+		return dialExec(ctx, command)
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" {
+		return dialUnix(ctx, spec)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		return dialUnix(ctx, u.Path)
+	case "tcp":
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", u.Host)
+	case "tls":
+		return dialTLS(ctx, u)
+	case "vsock":
+		return dialVsock(ctx, u)
+	case "ws", "wss":
+		return dialWebSocket(ctx, u)
+	case "gpg":
+		return dialGPG(ctx)
+	case "wsl":
+		return dialWSL(u)
+	case "cygwin":
+		return dialCygwin(ctx, u.Opaque+u.Path)
+	case "pkcs11":
+		return dialPKCS11(u)
+	case "tpm":
+		return dialTPM(u)
+	case "awskms":
+		return dialAWSKMS(u)
+	case "gcpkms":
+		return dialGCPKMS(u)
+	case "azurekv":
+		return dialAzureKV(u)
+	case "vault":
+		return dialVault(u)
+	case "keychain":
+		return dialKeychain(u)
+	case "enclave":
+		return dialEnclave(u)
+	case "ssh":
+		return dialSSH(u)
+	case "forwarded":
+		return dialForwarded(ctx, u)
+	default:
+		return nil, fmt.Errorf("unsupported backend scheme %q", u.Scheme)
+	}
+}
+
+// The pid of the proxy, which backends mustn't have. Tests serving fake
+// backends from the proxy's own process clear it.
+var ownPid = os.Getpid()
+
+// Dials a unix socket backend, refusing the proxy's own socket, which would
+// make requests recurse until file descriptors run out.
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if peer, err := getPeerCred(conn); err == nil && peer.pid == ownPid {
+		_ = conn.Close()
+		return nil, errBackendLoop
+	}
+
+	return conn, nil
+}
+
+// Returns the socket path of a unix socket backend with symlinks resolved,
+// so that two specs for the same socket compare equal. Other specs are
+// returned as is.
+func canonicalBackend(spec string) string {
+	path := spec
+
+	if strings.HasPrefix(spec, "exec:") {
+		return spec
+	}
+
+	if u, err := url.Parse(spec); err == nil && u.Scheme != "" {
+		if u.Scheme != "unix" {
+			return spec
+		}
+		path = u.Path
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+
+	return path
+}
+
+// Returns a short label for a backend, for places where the full spec is
+// too long: the file name of socket paths, the scheme (and host) of URIs,
+// the program of commands.
+func backendLabel(spec string) string {
+	if command, ok := strings.CutPrefix(spec, "exec:"); ok {
+		// Skipping variable assignments before the program
+		for _, f := range strings.Fields(command) {
+			if !strings.Contains(f, "=") {
+				return "exec:" + filepath.Base(f)
+			}
+		}
+		return "exec"
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" {
+		return filepath.Base(spec)
+	}
+
+	switch {
+	case u.Scheme == "unix":
+		return filepath.Base(u.Path)
+	case u.Host != "":
+		return u.Scheme + ":" + u.Hostname()
+	default:
+		return u.Scheme
+	}
+}
+
+// Expands a leading ~/ to the user's home directory.
+func expandPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+
+	return path
+}
+
+// Performs a JSON request against a remote key service, decoding the reply
+// into out. Headers may be nil.
+func httpJSON(client *http.Client, method, target string, header http.Header, in, out any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
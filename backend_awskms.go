@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long the list of KMS keys is used before it is fetched again, so
+// that keys created, disabled or deleted show up
+const awsKMSKeysTTL = 5 * time.Minute
+
+// Asymmetric signing keys in AWS KMS, listed again every awsKMSKeysTTL.
+type awsKMS struct {
+	client *kms.Client
+	keyIDs []string
+
+	mu      sync.Mutex
+	keys    []agentSigner
+	fetched time.Time
+}
+
+var (
+	awsKMSMu     sync.Mutex
+	awsKMSAgents = map[string]*signerAgent{}
+)
+
+// Dials awskms:?key=alias/name&key=arn:...&region=...&profile=..., serving
+// the given KMS keys. Without key parameters every enabled SIGN_VERIFY key
+// of the account is used. Credentials come from the usual AWS sources:
+// environment, shared config, web identity or instance roles.
+func dialAWSKMS(u *url.URL) (net.Conn, error) {
+	awsKMSMu.Lock()
+	defer awsKMSMu.Unlock()
+
+	key := u.String()
+
+	a, ok := awsKMSAgents[key]
+	if !ok {
+		q := u.Query()
+
+		var opts []func(*config.LoadOptions) error
+		if region := q.Get("region"); region != "" {
+			opts = append(opts, config.WithRegion(region))
+		}
+		if profile := q.Get("profile"); profile != "" {
+			opts = append(opts, config.WithSharedConfigProfile(profile))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+		defer cancel()
+
+		cfg, err := config.LoadDefaultConfig(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("loading aws config: %w", err)
+		}
+
+		k := &awsKMS{client: kms.NewFromConfig(cfg), keyIDs: q["key"]}
+		a = &signerAgent{name: "awskms", load: k.signers}
+		awsKMSAgents[key] = a
+	}
+
+	return servePipe(a), nil
+}
+
+func (k *awsKMS) signers() ([]agentSigner, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.fetched.IsZero() && time.Since(k.fetched) < awsKMSKeysTTL {
+		return k.keys, nil
+	}
+
+	keys, err := k.fetch()
+	if err != nil {
+		// Better the keys last listed than none while KMS can't be reached
+		if !k.fetched.IsZero() {
+			slog.Warn("kms keys not refreshed", "error", err)
+			return k.keys, nil
+		}
+		return nil, err
+	}
+
+	k.keys, k.fetched = keys, time.Now()
+
+	return keys, nil
+}
+
+// Lists the KMS keys, with their public keys.
+func (k *awsKMS) fetch() ([]agentSigner, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	ids := k.keyIDs
+	if len(ids) == 0 {
+		pages := kms.NewListKeysPaginator(k.client, &kms.ListKeysInput{})
+		for pages.HasMorePages() {
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range page.Keys {
+				ids = append(ids, aws.ToString(entry.KeyId))
+			}
+		}
+	}
+
+	var keys []agentSigner
+
+	for _, id := range ids {
+		out, err := k.client.GetPublicKey(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(id)})
+		if err != nil {
+			if len(k.keyIDs) > 0 {
+				return nil, fmt.Errorf("%s: %w", id, err)
+			}
+			slog.Debug("skipping kms key", "key", id, "error", err)
+			continue
+		}
+
+		if out.KeyUsage != types.KeyUsageTypeSignVerify {
+			continue
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+
+		signer, err := ssh.NewSignerFromSigner(&remoteSigner{pub: pub, sign: k.signFunc(id, pub)})
+		if err != nil {
+			slog.Debug("skipping kms key", "key", id, "error", err)
+			continue
+		}
+
+		keys = append(keys, agentSigner{signer: signer, comment: "awskms:" + id})
+	}
+
+	return keys, nil
+}
+
+func (k *awsKMS) signFunc(id string, pub crypto.PublicKey) func([]byte, crypto.Hash) ([]byte, error) {
+	return func(digest []byte, hash crypto.Hash) ([]byte, error) {
+		alg, err := awsSigningAlgorithm(pub, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+		defer cancel()
+
+		out, err := k.client.Sign(ctx, &kms.SignInput{
+			KeyId:            aws.String(id),
+			Message:          digest,
+			MessageType:      types.MessageTypeDigest,
+			SigningAlgorithm: alg,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// ECDSA signatures already come ASN.1 encoded, as crypto.Signer wants
+		return out.Signature, nil
+	}
+}
+
+func awsSigningAlgorithm(pub crypto.PublicKey, hash crypto.Hash) (types.SigningAlgorithmSpec, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return types.SigningAlgorithmSpecEcdsaSha256, nil
+		case elliptic.P384():
+			return types.SigningAlgorithmSpecEcdsaSha384, nil
+		case elliptic.P521():
+			return types.SigningAlgorithmSpecEcdsaSha512, nil
+		}
+	case *rsa.PublicKey:
+		switch hash {
+		case crypto.SHA256:
+			return types.SigningAlgorithmSpecRsassaPkcs1V15Sha256, nil
+		case crypto.SHA512:
+			return types.SigningAlgorithmSpecRsassaPkcs1V15Sha512, nil
+		}
+	}
+
+	return "", fmt.Errorf("no kms signing algorithm for %T with %v", pub, hash)
+}
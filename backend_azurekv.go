@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Keys in an Azure Key Vault, accessed through its REST API. The public
+// keys never change, so they are only fetched once.
+type azureKV struct {
+	client *http.Client
+	vault  string
+	names  []string
+
+	mu   sync.Mutex
+	keys []agentSigner
+}
+
+// Fetches access tokens from the managed identity endpoint: the App Service
+// one when IDENTITY_ENDPOINT is set, IMDS otherwise.
+type azureManagedIdentity struct {
+	clientID string
+}
+
+const (
+	azureKVScope      = "https://vault.azure.net"
+	azureKVAPIVersion = "7.4"
+)
+
+var (
+	azureKVMu     sync.Mutex
+	azureKVAgents = map[string]*signerAgent{}
+)
+
+// Dials azurekv://myvault.vault.azure.net?key=name[/version], serving the
+// given keys (key may be repeated). Credentials are a client secret from
+// AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET when set, and
+// the managed identity otherwise; client-id selects a user-assigned one.
+func dialAzureKV(u *url.URL) (net.Conn, error) {
+	azureKVMu.Lock()
+	defer azureKVMu.Unlock()
+
+	key := u.String()
+
+	a, ok := azureKVAgents[key]
+	if !ok {
+		q := u.Query()
+
+		if len(q["key"]) == 0 {
+			return nil, fmt.Errorf("azurekv backends need at least one key parameter")
+		}
+
+		k := &azureKV{
+			client: oauth2.NewClient(context.Background(), azureTokenSource(q.Get("client-id"))),
+			vault:  "https://" + u.Host,
+			names:  q["key"],
+		}
+
+		a = &signerAgent{name: "azurekv " + u.Host, load: k.signers}
+		azureKVAgents[key] = a
+	}
+
+	return servePipe(a), nil
+}
+
+func azureTokenSource(clientID string) oauth2.TokenSource {
+	tenant, secret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+
+	if tenant != "" && secret != "" {
+		cfg := clientcredentials.Config{
+			ClientID:     os.Getenv("AZURE_CLIENT_ID"),
+			ClientSecret: secret,
+			TokenURL:     "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/token",
+			Scopes:       []string{azureKVScope + "/.default"},
+		}
+		return cfg.TokenSource(context.Background())
+	}
+
+	return oauth2.ReuseTokenSource(nil, &azureManagedIdentity{clientID: clientID})
+}
+
+func (m *azureManagedIdentity) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	q := url.Values{"resource": {azureKVScope}}
+	if m.clientID != "" {
+		q.Set("client_id", m.clientID)
+	}
+
+	var req *http.Request
+	var err error
+
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		q.Set("api-version", "2019-08-01")
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+q.Encode(), nil); err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		q.Set("api-version", "2018-02-01")
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("managed identity: %w", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("managed identity: %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+
+	expires, _ := strconv.ParseInt(tok.ExpiresOn, 10, 64)
+
+	return &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      time.Unix(expires, 0),
+	}, nil
+}
+
+// Calls a Key Vault REST method, decoding the JSON reply into out.
+func (k *azureKV) call(method, target string, in, out any) error {
+	return httpJSON(k.client, method, target+"?api-version="+azureKVAPIVersion, nil, in, out)
+}
+
+func (k *azureKV) signers() ([]agentSigner, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys != nil {
+		return k.keys, nil
+	}
+
+	var keys []agentSigner
+
+	for _, name := range k.names {
+		var res struct {
+			Key azureJWK `json:"key"`
+		}
+
+		if err := k.call(http.MethodGet, k.vault+"/keys/"+name, nil, &res); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		pub, err := res.Key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		signer, err := ssh.NewSignerFromSigner(&remoteSigner{pub: pub, sign: k.signFunc(res.Key.Kid, pub)})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		keys = append(keys, agentSigner{signer: signer, comment: "azurekv:" + name})
+	}
+
+	k.keys = keys
+
+	return keys, nil
+}
+
+func (k *azureKV) signFunc(kid string, pub crypto.PublicKey) func([]byte, crypto.Hash) ([]byte, error) {
+	return func(digest []byte, hash crypto.Hash) ([]byte, error) {
+		alg, err := azureSigningAlgorithm(pub, hash)
+		if err != nil {
+			return nil, err
+		}
+
+		var res struct {
+			Value string `json:"value"`
+		}
+
+		req := map[string]string{"alg": alg, "value": base64.RawURLEncoding.EncodeToString(digest)}
+		if err := k.call(http.MethodPost, kid+"/sign", req, &res); err != nil {
+			return nil, err
+		}
+
+		sig, err := base64.RawURLEncoding.DecodeString(res.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := pub.(*ecdsa.PublicKey); ok {
+			// Key Vault returns r || s, crypto.Signer callers expect ASN.1
+			half := len(sig) / 2
+			return asn1.Marshal(struct{ R, S *big.Int }{
+				new(big.Int).SetBytes(sig[:half]),
+				new(big.Int).SetBytes(sig[half:]),
+			})
+		}
+
+		return sig, nil
+	}
+}
+
+func azureSigningAlgorithm(pub crypto.PublicKey, hash crypto.Hash) (string, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		case elliptic.P521():
+			return "ES512", nil
+		}
+	case *rsa.PublicKey:
+		switch hash {
+		case crypto.SHA256:
+			return "RS256", nil
+		case crypto.SHA512:
+			return "RS512", nil
+		}
+	}
+
+	return "", fmt.Errorf("no key vault signing algorithm for %T with %v", pub, hash)
+}
+
+// The subset of a JSON web key needed to rebuild the public key.
+type azureJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (j *azureJWK) publicKey() (crypto.PublicKey, error) {
+	b64 := func(s string) *big.Int {
+		buf, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(buf)
+	}
+
+	switch strings.TrimSuffix(j.Kty, "-HSM") {
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: b64(j.X), Y: b64(j.Y)}, nil
+	case "RSA":
+		return &rsa.PublicKey{N: b64(j.N), E: int(b64(j.E).Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+	}
+}
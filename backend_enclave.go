@@ -0,0 +1,463 @@
+//go:build darwin && cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -framework Security -framework CoreFoundation
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+#define ENCLAVE_PUB_LEN 65
+#define ENCLAVE_LABEL_LEN 256
+
+typedef struct {
+	SecKeyRef ref;
+	unsigned char pub[ENCLAVE_PUB_LEN];
+	char label[ENCLAVE_LABEL_LEN];
+} enclave_key;
+
+static char *enclave_error(CFErrorRef err, const char *fallback) {
+	if (err == NULL) {
+		return strdup(fallback);
+	}
+
+	CFStringRef desc = CFErrorCopyDescription(err);
+	CFIndex len = CFStringGetMaximumSizeForEncoding(CFStringGetLength(desc), kCFStringEncodingUTF8) + 1;
+	char *buf = malloc(len);
+	if (!CFStringGetCString(desc, buf, len, kCFStringEncodingUTF8)) {
+		strcpy(buf, fallback);
+	}
+
+	CFRelease(desc);
+	CFRelease(err);
+
+	return buf;
+}
+
+static CFDataRef enclave_tag(const char *tag) {
+	return CFDataCreate(NULL, (const UInt8 *)tag, strlen(tag));
+}
+
+// Fills out with the public half and label of a private key reference,
+// taking ownership of ref.
+static int enclave_fill(SecKeyRef ref, CFStringRef label, enclave_key *out, char **err) {
+	SecKeyRef pub = SecKeyCopyPublicKey(ref);
+	if (pub == NULL) {
+		CFRelease(ref);
+		*err = strdup("no public key");
+		return -1;
+	}
+
+	CFErrorRef cferr = NULL;
+	CFDataRef data = SecKeyCopyExternalRepresentation(pub, &cferr);
+	CFRelease(pub);
+	if (data == NULL) {
+		CFRelease(ref);
+		*err = enclave_error(cferr, "exporting public key failed");
+		return -1;
+	}
+
+	if (CFDataGetLength(data) != ENCLAVE_PUB_LEN) {
+		CFRelease(data);
+		CFRelease(ref);
+		*err = strdup("unexpected public key length");
+		return -1;
+	}
+
+	memcpy(out->pub, CFDataGetBytePtr(data), ENCLAVE_PUB_LEN);
+	CFRelease(data);
+
+	out->label[0] = 0;
+	if (label != NULL) {
+		CFStringGetCString(label, out->label, ENCLAVE_LABEL_LEN, kCFStringEncodingUTF8);
+	}
+
+	out->ref = ref;
+
+	return 0;
+}
+
+static int enclave_generate(const char *tag, const char *label, int biometry, enclave_key *out, char **err) {
+	CFErrorRef cferr = NULL;
+
+	SecAccessControlCreateFlags flags = kSecAccessControlPrivateKeyUsage;
+	if (biometry) {
+		flags |= kSecAccessControlBiometryCurrentSet;
+	}
+
+	SecAccessControlRef access = SecAccessControlCreateWithFlags(NULL,
+		kSecAttrAccessibleWhenUnlockedThisDeviceOnly, flags, &cferr);
+	if (access == NULL) {
+		*err = enclave_error(cferr, "creating access control failed");
+		return -1;
+	}
+
+	CFDataRef tagData = enclave_tag(tag);
+	CFStringRef labelStr = CFStringCreateWithCString(NULL, label, kCFStringEncodingUTF8);
+
+	CFMutableDictionaryRef priv = CFDictionaryCreateMutable(NULL, 0,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFDictionarySetValue(priv, kSecAttrIsPermanent, kCFBooleanTrue);
+	CFDictionarySetValue(priv, kSecAttrApplicationTag, tagData);
+	CFDictionarySetValue(priv, kSecAttrLabel, labelStr);
+	CFDictionarySetValue(priv, kSecAttrAccessControl, access);
+
+	int bits = 256;
+	CFNumberRef size = CFNumberCreate(NULL, kCFNumberIntType, &bits);
+
+	CFMutableDictionaryRef attrs = CFDictionaryCreateMutable(NULL, 0,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFDictionarySetValue(attrs, kSecAttrKeyType, kSecAttrKeyTypeECSECPrimeRandom);
+	CFDictionarySetValue(attrs, kSecAttrKeySizeInBits, size);
+	CFDictionarySetValue(attrs, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	CFDictionarySetValue(attrs, kSecPrivateKeyAttrs, priv);
+
+	SecKeyRef ref = SecKeyCreateRandomKey(attrs, &cferr);
+
+	CFRelease(attrs);
+	CFRelease(size);
+	CFRelease(priv);
+	CFRelease(access);
+	CFRelease(tagData);
+
+	if (ref == NULL) {
+		CFRelease(labelStr);
+		*err = enclave_error(cferr, "generating key failed");
+		return -1;
+	}
+
+	int res = enclave_fill(ref, labelStr, out, err);
+	CFRelease(labelStr);
+
+	return res;
+}
+
+// Returns the number of keys with the given tag, writing at most max of
+// them to keys, or -1 on error.
+static int enclave_list(const char *tag, enclave_key *keys, int max, char **err) {
+	CFDataRef tagData = enclave_tag(tag);
+
+	CFMutableDictionaryRef query = CFDictionaryCreateMutable(NULL, 0,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFDictionarySetValue(query, kSecClass, kSecClassKey);
+	CFDictionarySetValue(query, kSecAttrTokenID, kSecAttrTokenIDSecureEnclave);
+	CFDictionarySetValue(query, kSecAttrApplicationTag, tagData);
+	CFDictionarySetValue(query, kSecReturnRef, kCFBooleanTrue);
+	CFDictionarySetValue(query, kSecReturnAttributes, kCFBooleanTrue);
+	CFDictionarySetValue(query, kSecMatchLimit, kSecMatchLimitAll);
+
+	CFTypeRef result = NULL;
+	OSStatus status = SecItemCopyMatching(query, &result);
+
+	CFRelease(query);
+	CFRelease(tagData);
+
+	if (status == errSecItemNotFound) {
+		return 0;
+	}
+	if (status != errSecSuccess) {
+		CFStringRef msg = SecCopyErrorMessageString(status, NULL);
+		*err = malloc(ENCLAVE_LABEL_LEN);
+		if (msg == NULL || !CFStringGetCString(msg, *err, ENCLAVE_LABEL_LEN, kCFStringEncodingUTF8)) {
+			snprintf(*err, ENCLAVE_LABEL_LEN, "keychain error %d", (int)status);
+		}
+		if (msg != NULL) {
+			CFRelease(msg);
+		}
+		return -1;
+	}
+
+	CFIndex count = CFArrayGetCount((CFArrayRef)result);
+	int n = 0;
+
+	for (CFIndex i = 0; i < count && n < max; i++) {
+		CFDictionaryRef item = CFArrayGetValueAtIndex((CFArrayRef)result, i);
+		SecKeyRef ref = (SecKeyRef)CFDictionaryGetValue(item, kSecValueRef);
+		if (ref == NULL) {
+			continue;
+		}
+
+		char *skip = NULL;
+		CFRetain(ref);
+		if (enclave_fill(ref, CFDictionaryGetValue(item, kSecAttrLabel), &keys[n], &skip) != 0) {
+			free(skip);
+			continue;
+		}
+		n++;
+	}
+
+	CFRelease(result);
+
+	return n;
+}
+
+// Signs a SHA-256 digest, returning an ASN.1 signature. Keys requiring
+// biometry show the Touch ID prompt here.
+static CFDataRef enclave_sign(SecKeyRef ref, const unsigned char *digest, int len, char **err) {
+	CFErrorRef cferr = NULL;
+
+	CFDataRef in = CFDataCreate(NULL, digest, len);
+	CFDataRef sig = SecKeyCreateSignature(ref, kSecKeyAlgorithmECDSASignatureDigestX962SHA256, in, &cferr);
+	CFRelease(in);
+
+	if (sig == NULL) {
+		*err = enclave_error(cferr, "signing failed");
+	}
+
+	return sig;
+}
+
+static int enclave_delete(SecKeyRef ref, char **err) {
+	CFMutableDictionaryRef query = CFDictionaryCreateMutable(NULL, 0,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFDictionarySetValue(query, kSecValueRef, ref);
+
+	OSStatus status = SecItemDelete(query);
+	CFRelease(query);
+
+	if (status != errSecSuccess) {
+		*err = malloc(64);
+		snprintf(*err, 64, "keychain error %d", (int)status);
+		return -1;
+	}
+
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Tags the keychain items of the keys generated by the proxy, so other
+// Secure Enclave keys are left alone.
+const enclaveTag = "com.github.noj.ssh-agent-proxy"
+
+// A P-256 key inside the Secure Enclave, implementing crypto.Signer. The key
+// can't be exported, it is used through its keychain reference.
+type enclaveKey struct {
+	ref   C.SecKeyRef
+	label string
+	pub   *ecdsa.PublicKey
+}
+
+var (
+	enclaveMu    sync.Mutex
+	enclaveAgent *signerAgent
+)
+
+func init() {
+	subcommands["enclave"] = cmdEnclave
+}
+
+// Dials enclave:, serving the keys previously created with the enclave
+// generate subcommand. Keys generated with -biometry ask for Touch ID on
+// every signature.
+func dialEnclave(u *url.URL) (net.Conn, error) {
+	enclaveMu.Lock()
+	defer enclaveMu.Unlock()
+
+	if enclaveAgent == nil {
+		enclaveAgent = &signerAgent{name: "secure enclave", load: enclaveSigners}
+	}
+
+	return servePipe(enclaveAgent), nil
+}
+
+func enclaveErr(err *C.char) error {
+	defer C.free(unsafe.Pointer(err))
+	return errors.New(C.GoString(err))
+}
+
+func newEnclaveKey(k *C.enclave_key) (*enclaveKey, error) {
+	x, y := elliptic.Unmarshal(elliptic.P256(), C.GoBytes(unsafe.Pointer(&k.pub[0]), C.ENCLAVE_PUB_LEN))
+	if x == nil {
+		C.CFRelease(C.CFTypeRef(k.ref))
+		return nil, errors.New("bad public key")
+	}
+
+	key := &enclaveKey{
+		ref:   k.ref,
+		label: C.GoString(&k.label[0]),
+		pub:   &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+	}
+
+	runtime.SetFinalizer(key, func(key *enclaveKey) {
+		C.CFRelease(C.CFTypeRef(key.ref))
+	})
+
+	return key, nil
+}
+
+func listEnclaveKeys() ([]*enclaveKey, error) {
+	tag := C.CString(enclaveTag)
+	defer C.free(unsafe.Pointer(tag))
+
+	var raw [64]C.enclave_key
+	var cerr *C.char
+
+	n := C.enclave_list(tag, &raw[0], C.int(len(raw)), &cerr)
+	if n < 0 {
+		return nil, enclaveErr(cerr)
+	}
+
+	var keys []*enclaveKey
+	for i := range int(n) {
+		key, err := newEnclaveKey(&raw[i])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func enclaveSigners() ([]agentSigner, error) {
+	keys, err := listEnclaveKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []agentSigner
+	for _, key := range keys {
+		signer, err := ssh.NewSignerFromSigner(key)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, agentSigner{signer: signer, comment: "enclave:" + key.label})
+	}
+
+	return res, nil
+}
+
+func (k *enclaveKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *enclaveKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+
+	var cerr *C.char
+
+	sig := C.enclave_sign(k.ref, (*C.uchar)(unsafe.Pointer(&digest[0])), C.int(len(digest)), &cerr)
+	runtime.KeepAlive(k)
+	if sig == 0 {
+		return nil, enclaveErr(cerr)
+	}
+	defer C.CFRelease(C.CFTypeRef(sig))
+
+	return C.GoBytes(unsafe.Pointer(C.CFDataGetBytePtr(sig)), C.int(C.CFDataGetLength(sig))), nil
+}
+
+// Manages the Secure Enclave keys served by enclave: backends.
+func cmdEnclave(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: enclave generate|list|delete")
+	}
+
+	switch args[0] {
+	case "generate":
+		fs := flag.NewFlagSet("enclave generate", flag.ExitOnError)
+		biometry := fs.Bool("biometry", false, "require Touch ID for every signature")
+		_ = fs.Parse(args[1:])
+
+		if fs.NArg() != 1 {
+			return errors.New("usage: enclave generate [-biometry] label")
+		}
+
+		tag := C.CString(enclaveTag)
+		defer C.free(unsafe.Pointer(tag))
+		label := C.CString(fs.Arg(0))
+		defer C.free(unsafe.Pointer(label))
+
+		var raw C.enclave_key
+		var cerr *C.char
+		var bio C.int
+		if *biometry {
+			bio = 1
+		}
+
+		if C.enclave_generate(tag, label, bio, &raw, &cerr) != 0 {
+			return enclaveErr(cerr)
+		}
+
+		key, err := newEnclaveKey(&raw)
+		if err != nil {
+			return err
+		}
+
+		return printEnclaveKey(key)
+	case "list":
+		keys, err := listEnclaveKeys()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := printEnclaveKey(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case "delete":
+		if len(args) != 2 {
+			return errors.New("usage: enclave delete label")
+		}
+
+		keys, err := listEnclaveKeys()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if key.label != args[1] {
+				continue
+			}
+
+			var cerr *C.char
+			if C.enclave_delete(key.ref, &cerr) != 0 {
+				return enclaveErr(cerr)
+			}
+
+			return nil
+		}
+
+		return fmt.Errorf("no key labelled %q", args[1])
+	default:
+		return fmt.Errorf("unknown enclave command %q", args[0])
+	}
+}
+
+func printEnclaveKey(key *enclaveKey) error {
+	pub, err := ssh.NewPublicKey(key.pub)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pub)), "\n"), key.label)
+
+	return nil
+}
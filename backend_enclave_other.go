@@ -0,0 +1,13 @@
+//go:build !darwin || !cgo
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+)
+
+func dialEnclave(u *url.URL) (net.Conn, error) {
+	return nil, errors.New("enclave backends require a cgo build on macOS")
+}
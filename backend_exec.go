@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// An exec backend that died this soon after starting isn't started again
+// before this long has passed, so a broken command doesn't fork in a loop
+const execRestartDelay = time.Second
+
+type (
+	// A program speaking the agent protocol on its stdin and stdout, as in
+	// exec:ssh bastion 'exec nc -U $SSH_AUTH_SOCK'. It keeps running
+	// between requests, which take turns on it, and is started again once
+	// it exits.
+	execBackend struct {
+		command string
+
+		// Held by the connection using the program
+		turn chan struct{}
+
+		mu      sync.Mutex
+		cmd     *exec.Cmd
+		stdin   *os.File
+		stdout  *os.File
+		exited  chan struct{}
+		started time.Time
+	}
+
+	// One turn on an exec backend's program. A turn given up with a reply
+	// still due stops the program, as the next one would read that reply.
+	execConn struct {
+		b       *execBackend
+		stdin   *os.File
+		stdout  *os.File
+		closed  sync.Once
+		pending int
+
+		// Of the reply being read, the length read so far and what remains
+		header []byte
+		left   uint32
+	}
+
+	execAddr string
+)
+
+var (
+	execBackendsMu sync.Mutex
+	execBackends   = map[string]*execBackend{}
+
+	errExecRestarting = errors.New("exec backend exited, starting it again shortly")
+)
+
+// Dials exec:<command>, run by the shell.
+func dialExec(ctx context.Context, command string) (net.Conn, error) {
+	execBackendsMu.Lock()
+	b, ok := execBackends[command]
+	if !ok {
+		b = &execBackend{command: command, turn: make(chan struct{}, 1)}
+		execBackends[command] = b
+	}
+	execBackendsMu.Unlock()
+
+	select {
+	case b.turn <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	stdin, stdout, err := b.running()
+	if err != nil {
+		<-b.turn
+		return nil, err
+	}
+
+	return &execConn{b: b, stdin: stdin, stdout: stdout}, nil
+}
+
+// Returns the pipes to the program, starting it if it isn't running.
+func (b *execBackend) running() (*os.File, *os.File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.cmd != nil {
+		select {
+		case <-b.exited:
+			b.cmd = nil
+		default:
+			return b.stdin, b.stdout, nil
+		}
+
+		if time.Since(b.started) < execRestartDelay {
+			return nil, nil, errExecRestarting
+		}
+	}
+
+	return b.start()
+}
+
+// Starts the program. The caller holds b.mu.
+func (b *execBackend) start() (*os.File, *os.File, error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		_, _ = inR.Close(), inW.Close()
+		return nil, nil, err
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", b.command)
+	cmd.Stdin, cmd.Stdout = inR, outW
+	// Stopped along with whatever it runs, and not by ^C before the proxy
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stderr, err := cmd.StderrPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	_, _ = inR.Close(), outW.Close()
+	if err != nil {
+		_, _ = inW.Close(), outR.Close()
+		return nil, nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			slog.Debug("exec backend", "command", b.command, "stderr", sc.Text())
+		}
+
+		err := cmd.Wait()
+		_, _ = inW.Close(), outR.Close()
+
+		// Stopping the program clears b.cmd first
+		b.mu.Lock()
+		stopped := b.cmd != cmd
+		b.mu.Unlock()
+		close(exited)
+
+		if !stopped {
+			slog.Warn("exec backend exited", "command", b.command, "pid", cmd.Process.Pid, "error", err)
+		}
+	}()
+
+	b.cmd, b.stdin, b.stdout, b.exited, b.started = cmd, inW, outR, exited, time.Now()
+	slog.Info("exec backend started", "command", b.command, "pid", cmd.Process.Pid)
+
+	return inW, outR, nil
+}
+
+// Stops the program, if it runs.
+func (b *execBackend) stop() {
+	b.mu.Lock()
+	cmd, exited := b.cmd, b.exited
+	b.cmd = nil
+	b.mu.Unlock()
+
+	if cmd == nil {
+		return
+	}
+
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// Stops the exec backends' programs as the proxy exits.
+func stopExecBackends() {
+	execBackendsMu.Lock()
+	defer execBackendsMu.Unlock()
+
+	for _, b := range execBackends {
+		b.stop()
+	}
+}
+
+// Writes a request, which the agent client always does in one go.
+func (c *execConn) Write(p []byte) (int, error) {
+	n, err := c.stdin.Write(p)
+	if n > 0 {
+		c.pending++
+	}
+
+	return n, err
+}
+
+// Reads replies, following their framing to tell when one is complete.
+func (c *execConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+
+	for rest := p[:n]; len(rest) > 0; {
+		if c.left == 0 {
+			take := min(4-len(c.header), len(rest))
+			c.header, rest = append(c.header, rest[:take]...), rest[take:]
+			if len(c.header) == 4 {
+				c.left, c.header = binary.BigEndian.Uint32(c.header), nil
+			}
+			continue
+		}
+
+		take := min(c.left, uint32(len(rest)))
+		c.left -= take
+		rest = rest[take:]
+		if c.left == 0 {
+			c.pending--
+		}
+	}
+
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// Ends the turn, stopping the program if a reply is still due.
+func (c *execConn) Close() error {
+	c.closed.Do(func() {
+		_ = c.stdin.SetDeadline(time.Time{})
+		_ = c.stdout.SetDeadline(time.Time{})
+
+		if c.pending != 0 || c.left != 0 || len(c.header) != 0 {
+			slog.Debug("exec backend given up on mid-request, stopping it", "command", c.b.command)
+			c.b.stop()
+		}
+
+		<-c.b.turn
+	})
+
+	return nil
+}
+
+func (c *execConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.stdin.SetDeadline(t), c.stdout.SetDeadline(t))
+}
+
+func (c *execConn) SetReadDeadline(t time.Time) error  { return c.stdout.SetDeadline(t) }
+func (c *execConn) SetWriteDeadline(t time.Time) error { return c.stdin.SetDeadline(t) }
+
+func (c *execConn) LocalAddr() net.Addr  { return execAddr(c.b.command) }
+func (c *execConn) RemoteAddr() net.Addr { return execAddr(c.b.command) }
+
+func (a execAddr) Network() string { return "exec" }
+func (a execAddr) String() string  { return strings.TrimSpace(string(a)) }
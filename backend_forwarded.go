@@ -0,0 +1,84 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Where sshd puts the sockets of agents forwarded to this host
+const defaultForwardedGlob = "/tmp/ssh-*/agent.*"
+
+var (
+	forwardedMu   sync.Mutex
+	lastForwarded = map[string]string{}
+)
+
+// Dials forwarded:[glob], the newest agent socket matching glob that still
+// answers, so that long-lived sessions such as tmux keep reaching the agent
+// of the latest SSH login instead of that of the one they were started
+// from. Only sockets of the proxy's own user are considered.
+func dialForwarded(ctx context.Context, u *url.URL) (net.Conn, error) {
+	pattern := u.Opaque + u.Path
+	if pattern == "" {
+		pattern = defaultForwardedGlob
+	}
+	pattern = expandPath(pattern)
+
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad forwarded socket pattern: %w", err)
+	}
+
+	type candidate struct {
+		path    string
+		modTime time.Time
+	}
+
+	var candidates []candidate
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil || fi.Mode().Type() != os.ModeSocket {
+			continue
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+			continue
+		}
+
+		candidates = append(candidates, candidate{path, fi.ModTime()})
+	}
+
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.modTime.UnixNano(), a.modTime.UnixNano())
+	})
+
+	// Sockets of logins that ended are left behind, and refuse connections
+	for _, c := range candidates {
+		conn, err := dialUnix(ctx, c.path)
+		if err != nil {
+			slog.Debug("forwarded socket dead", "path", c.path, "error", err)
+			continue
+		}
+
+		forwardedMu.Lock()
+		if lastForwarded[pattern] != c.path {
+			slog.Info("forwarded agent socket", "pattern", pattern, "path", c.path)
+			lastForwarded[pattern] = c.path
+		}
+		forwardedMu.Unlock()
+
+		return conn, nil
+	}
+
+	return nil, errors.New("no live forwarded agent socket")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2/google"
+)
+
+// Asymmetric signing key versions in Google Cloud KMS, accessed through its
+// REST API. The public keys never change, so they are only fetched once.
+type gcpKMS struct {
+	client   *http.Client
+	endpoint string
+	names    []string
+
+	mu   sync.Mutex
+	keys []agentSigner
+}
+
+var (
+	gcpKMSMu     sync.Mutex
+	gcpKMSAgents = map[string]*signerAgent{}
+
+	gcpDigestNames = map[crypto.Hash]string{
+		crypto.SHA256: "sha256",
+		crypto.SHA384: "sha384",
+		crypto.SHA512: "sha512",
+	}
+)
+
+// Dials gcpkms:?key=projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1,
+// serving the given key versions (key may be repeated) with application
+// default credentials. The endpoint parameter overrides the API endpoint,
+// e.g. for Private Service Connect.
+func dialGCPKMS(u *url.URL) (net.Conn, error) {
+	gcpKMSMu.Lock()
+	defer gcpKMSMu.Unlock()
+
+	key := u.String()
+
+	a, ok := gcpKMSAgents[key]
+	if !ok {
+		q := u.Query()
+
+		if len(q["key"]) == 0 {
+			return nil, errors.New("gcpkms backends need at least one key parameter")
+		}
+
+		client, err := google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/cloudkms")
+		if err != nil {
+			return nil, fmt.Errorf("loading google credentials: %w", err)
+		}
+
+		k := &gcpKMS{client: client, endpoint: q.Get("endpoint"), names: q["key"]}
+		if k.endpoint == "" {
+			k.endpoint = "https://cloudkms.googleapis.com"
+		}
+
+		a = &signerAgent{name: "gcpkms", load: k.signers}
+		gcpKMSAgents[key] = a
+	}
+
+	return servePipe(a), nil
+}
+
+// Calls a KMS REST method on a key version, decoding the JSON reply into out.
+func (k *gcpKMS) call(method, name, verb string, in, out any) error {
+	if err := httpJSON(k.client, method, strings.TrimSuffix(k.endpoint, "/")+"/v1/"+name+verb, nil, in, out); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (k *gcpKMS) signers() ([]agentSigner, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys != nil {
+		return k.keys, nil
+	}
+
+	var keys []agentSigner
+
+	for _, name := range k.names {
+		var res struct {
+			Pem       string `json:"pem"`
+			Algorithm string `json:"algorithm"`
+		}
+
+		if err := k.call(http.MethodGet, name, "/publicKey", nil, &res); err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode([]byte(res.Pem))
+		if block == nil {
+			return nil, fmt.Errorf("%s: no public key in reply", name)
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		signer, err := ssh.NewSignerFromSigner(&remoteSigner{pub: pub, sign: k.signFunc(name, res.Algorithm)})
+		if err != nil {
+			slog.Debug("skipping kms key", "key", name, "error", err)
+			continue
+		}
+
+		keys = append(keys, agentSigner{signer: signer, comment: "gcpkms:" + name})
+	}
+
+	k.keys = keys
+
+	return keys, nil
+}
+
+// Cloud KMS keys are bound to a single digest algorithm, which is part of
+// their algorithm name, e.g. RSA_SIGN_PKCS1_2048_SHA256.
+func (k *gcpKMS) signFunc(name, algorithm string) func([]byte, crypto.Hash) ([]byte, error) {
+	return func(digest []byte, hash crypto.Hash) ([]byte, error) {
+		digestName, ok := gcpDigestNames[hash]
+		if !ok || !strings.HasSuffix(algorithm, "_"+strings.ToUpper(digestName)) {
+			return nil, fmt.Errorf("key %s (%s) can't sign %v digests", name, algorithm, hash)
+		}
+
+		var res struct {
+			Signature []byte `json:"signature"`
+		}
+
+		req := map[string]any{"digest": map[string][]byte{digestName: digest}}
+		if err := k.call(http.MethodPost, name, ":asymmetricSign", req, &res); err != nil {
+			return nil, err
+		}
+
+		return res.Signature, nil
+	}
+}
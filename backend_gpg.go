@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var (
+	gpgSocketMu sync.Mutex
+	gpgSocket   string
+)
+
+// Dials gpg-agent's SSH socket, as reported by gpgconf. gpg-agent is started
+// on demand, so a missing or stale socket (left behind by an agent that was
+// killed or restarted) is handled by launching it and asking gpgconf again.
+func dialGPG(ctx context.Context) (net.Conn, error) {
+	gpgSocketMu.Lock()
+	defer gpgSocketMu.Unlock()
+
+	var d net.Dialer
+
+	if gpgSocket != "" {
+		if conn, err := d.DialContext(ctx, "unix", gpgSocket); err == nil {
+			return conn, nil
+		}
+	}
+
+	if err := exec.CommandContext(ctx, "gpgconf", "--launch", "gpg-agent").Run(); err != nil {
+		return nil, fmt.Errorf("launching gpg-agent: %w", err)
+	}
+
+	out, err := exec.CommandContext(ctx, "gpgconf", "--list-dirs", "agent-ssh-socket").Output()
+	if err != nil {
+		return nil, fmt.Errorf("locating gpg-agent ssh socket: %w", err)
+	}
+
+	sock := string(bytes.TrimSpace(out))
+	if sock != gpgSocket {
+		slog.Info("gpg-agent ssh socket", "socket", sock)
+		gpgSocket = sock
+	}
+
+	return d.DialContext(ctx, "unix", gpgSocket)
+}
+
+// Returns the directories gpg-agent writes its keys and sockets to, having
+// launched it so that they exist. Reports none if gpgconf can't tell.
+func gpgDirs(ctx context.Context) []string {
+	if err := exec.CommandContext(ctx, "gpgconf", "--launch", "gpg-agent").Run(); err != nil {
+		slog.Warn("gpg-agent not launched", "error", err)
+	}
+
+	out, err := exec.CommandContext(ctx, "gpgconf", "--list-dirs").Output()
+	if err != nil {
+		slog.Warn("gpg directories unknown", "error", err)
+		return nil
+	}
+
+	var dirs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		name, value, _ := strings.Cut(line, ":")
+		if name != "homedir" && name != "socketdir" {
+			continue
+		}
+
+		// Colons and percent signs are percent-escaped
+		if dir, err := url.PathUnescape(value); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
@@ -0,0 +1,324 @@
+//go:build darwin
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An agent whose keys are stored as generic passwords in the login
+// Keychain, so they survive restarts without plaintext key files. The keys
+// are loaded into an in-memory keyring on first use; keys added with a
+// lifetime only live in memory.
+type keychainAgent struct {
+	service string
+
+	mu      sync.Mutex
+	keyring agent.ExtendedAgent
+	loaded  bool
+}
+
+// The password data of a Keychain item.
+type keychainItem struct {
+	Key         string `json:"key"`
+	Comment     string `json:"comment,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+var (
+	keychainMu     sync.Mutex
+	keychainAgents = map[string]*keychainAgent{}
+)
+
+// Dials keychain:[?service=name], serving the keys stored under the given
+// Keychain service, ssh-agent-proxy by default. Keys added through the proxy
+// are stored there and removing them deletes them from the Keychain.
+func dialKeychain(u *url.URL) (net.Conn, error) {
+	keychainMu.Lock()
+	defer keychainMu.Unlock()
+
+	service := u.Query().Get("service")
+	if service == "" {
+		service = "ssh-agent-proxy"
+	}
+
+	a, ok := keychainAgents[service]
+	if !ok {
+		a = &keychainAgent{service: service, keyring: agent.NewKeyring().(agent.ExtendedAgent)}
+		keychainAgents[service] = a
+	}
+
+	return servePipe(a), nil
+}
+
+func runSecurity(stdin string, args ...string) ([]byte, error) {
+	cmd := exec.Command("security", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("security %s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return out, nil
+}
+
+// Returns the accounts of the generic passwords stored under the service.
+func (a *keychainAgent) accounts() ([]string, error) {
+	out, err := runSecurity("", "dump-keychain")
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	var account, service string
+
+	flush := func() {
+		if service == a.service && account != "" {
+			res = append(res, account)
+		}
+		account, service = "", ""
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "keychain:") {
+			flush()
+		} else if value, ok := strings.CutPrefix(line, `"acct"<blob>=`); ok {
+			account = strings.Trim(value, `"`)
+		} else if value, ok := strings.CutPrefix(line, `"svce"<blob>=`); ok {
+			service = strings.Trim(value, `"`)
+		}
+	}
+	flush()
+
+	return res, scanner.Err()
+}
+
+// Fills the keyring from the Keychain, once.
+func (a *keychainAgent) load() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.loaded {
+		return nil
+	}
+
+	accounts, err := a.accounts()
+	if err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		if err := a.loadItem(account); err != nil {
+			slog.Warn("skipping keychain item", "account", account, "error", err)
+		}
+	}
+
+	a.loaded = true
+
+	return nil
+}
+
+func (a *keychainAgent) loadItem(account string) error {
+	out, err := runSecurity("", "find-generic-password", "-s", a.service, "-a", account, "-w")
+	if err != nil {
+		return err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return err
+	}
+
+	var item keychainItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return err
+	}
+
+	key, err := ssh.ParseRawPrivateKey([]byte(item.Key))
+	if err != nil {
+		return err
+	}
+
+	added := agent.AddedKey{PrivateKey: key, Comment: item.Comment}
+
+	if item.Certificate != "" {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(item.Certificate))
+		if err != nil {
+			return err
+		}
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			added.Certificate = cert
+		}
+	}
+
+	return a.keyring.Add(added)
+}
+
+// Writes a key to the Keychain, replacing any item for the same key. The
+// data goes through security's interactive mode to keep it off the command
+// line.
+func (a *keychainAgent) store(key agent.AddedKey, pub ssh.PublicKey) error {
+	block, err := ssh.MarshalPrivateKey(key.PrivateKey, "")
+	if err != nil {
+		return err
+	}
+
+	item := keychainItem{Key: string(pem.EncodeToMemory(block)), Comment: key.Comment}
+	if key.Certificate != nil {
+		item.Certificate = string(ssh.MarshalAuthorizedKey(key.Certificate))
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+		a.service, ssh.FingerprintSHA256(pub), base64.StdEncoding.EncodeToString(data))
+
+	_, err = runSecurity(cmd, "-i")
+
+	return err
+}
+
+func (a *keychainAgent) delete(key ssh.PublicKey) error {
+	_, err := runSecurity("", "delete-generic-password", "-s", a.service, "-a", ssh.FingerprintSHA256(key))
+	return err
+}
+
+func (a *keychainAgent) List() ([]*agent.Key, error) {
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	return a.keyring.List()
+}
+
+func (a *keychainAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *keychainAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	return a.keyring.SignWithFlags(key, data, flags)
+}
+
+func (a *keychainAgent) Signers() ([]ssh.Signer, error) {
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+
+	return a.keyring.Signers()
+}
+
+func (a *keychainAgent) Add(key agent.AddedKey) error {
+	if err := a.load(); err != nil {
+		return err
+	}
+
+	if k, ok := key.PrivateKey.(*ed25519.PrivateKey); ok {
+		// ssh.ServeAgent hands out ed25519 keys by pointer
+		key.PrivateKey = *k
+	}
+
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	if err := a.keyring.Add(key); err != nil {
+		return err
+	}
+
+	if key.LifetimeSecs > 0 {
+		return nil
+	}
+
+	if err := a.store(key, signer.PublicKey()); err != nil {
+		_ = a.keyring.Remove(signer.PublicKey())
+		return fmt.Errorf("storing key in keychain: %w", err)
+	}
+
+	return nil
+}
+
+func (a *keychainAgent) Remove(key ssh.PublicKey) error {
+	if err := a.load(); err != nil {
+		return err
+	}
+
+	if err := a.keyring.Remove(key); err != nil {
+		return err
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	if err := a.delete(key); err != nil {
+		slog.Warn("deleting keychain item", "error", err)
+	}
+
+	return nil
+}
+
+func (a *keychainAgent) RemoveAll() error {
+	if err := a.load(); err != nil {
+		return err
+	}
+
+	keys, err := a.keyring.List()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, a.Remove(pub))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (a *keychainAgent) Lock(passphrase []byte) error {
+	return a.keyring.Lock(passphrase)
+}
+
+func (a *keychainAgent) Unlock(passphrase []byte) error {
+	return a.keyring.Unlock(passphrase)
+}
+
+func (a *keychainAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
@@ -0,0 +1,13 @@
+//go:build !darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+)
+
+func dialKeychain(u *url.URL) (net.Conn, error) {
+	return nil, errors.New("keychain backends are only available on macOS")
+}
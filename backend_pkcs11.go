@@ -0,0 +1,483 @@
+//go:build cgo
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ssh"
+)
+
+// A token accessed through a PKCS#11 module, kept open for the lifetime of
+// the process since modules can only be initialized once. The session is
+// opened once the token is plugged in, and again when it comes back after
+// being unplugged.
+type pkcs11Token struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	module  string
+	session pkcs11.SessionHandle
+	open    bool
+	label   string
+
+	// How long a login stays valid: 0 keeps it for the lifetime of the
+	// process, a negative value logs out after every signature.
+	pinTTL   time.Duration
+	loggedIn bool
+	loginAt  time.Time
+}
+
+// A private key object on a token, implementing crypto.Signer.
+type pkcs11Key struct {
+	token *pkcs11Token
+	id    []byte
+	pub   crypto.PublicKey
+}
+
+var (
+	pkcs11Mu     sync.Mutex
+	pkcs11Agents = map[string]*signerAgent{}
+)
+
+// DigestInfo prefixes for RSA PKCS#1 v1.5 signatures, as in crypto/rsa.
+var pkcs11HashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Dials pkcs11:/path/to/module.so?token=label&pin=policy. The first token
+// present is used unless a token label is given. The pin policy decides how
+// long a PIN login is kept: "once" (the default) keeps it until the proxy
+// exits, "always" asks for the PIN on every signature, and a duration such
+// as "15m" asks again once it has elapsed.
+func dialPKCS11(u *url.URL) (net.Conn, error) {
+	pkcs11Mu.Lock()
+	defer pkcs11Mu.Unlock()
+
+	key := u.String()
+
+	a, ok := pkcs11Agents[key]
+	if !ok {
+		token, err := openPKCS11(u.Path, u.Query().Get("token"), u.Query().Get("pin"))
+		if err != nil {
+			return nil, err
+		}
+
+		a = &signerAgent{name: "pkcs11 " + token.label, load: token.signers}
+		pkcs11Agents[key] = a
+	}
+
+	return servePipe(a), nil
+}
+
+func openPKCS11(module, label, pinPolicy string) (*pkcs11Token, error) {
+	t := &pkcs11Token{module: module, label: label}
+
+	switch pinPolicy {
+	case "", "once":
+	case "always":
+		t.pinTTL = -1
+	default:
+		ttl, err := time.ParseDuration(pinPolicy)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("bad pin policy %q", pinPolicy)
+		}
+		t.pinTTL = ttl
+	}
+
+	t.ctx = pkcs11.New(module)
+	if t.ctx == nil {
+		return nil, fmt.Errorf("loading pkcs11 module %s failed", module)
+	}
+
+	if err := t.ctx.Initialize(); err != nil {
+		t.ctx.Destroy()
+		return nil, fmt.Errorf("initializing %s: %w", module, err)
+	}
+
+	// A token not plugged in yet is looked for again by every listing
+	if err := t.openSession(label); err != nil {
+		slog.Warn("pkcs11 token not found, waiting for it", "module", module, "token", label, "error", err)
+	}
+
+	return t, nil
+}
+
+// Opens a session on the token with the given label, or the first one
+// present when label is empty.
+func (t *pkcs11Token) openSession(label string) error {
+	slots, err := t.ctx.GetSlotList(true)
+	if err != nil {
+		return err
+	}
+
+	for _, slot := range slots {
+		info, err := t.ctx.GetTokenInfo(slot)
+		if err != nil || (label != "" && info.Label != label) {
+			continue
+		}
+
+		if t.session, err = t.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION); err != nil {
+			return err
+		}
+
+		t.open = true
+		t.loggedIn = false
+		t.label = info.Label
+		slog.Info("pkcs11 token opened", "module", t.module, "token", t.label)
+
+		return nil
+	}
+
+	return fmt.Errorf("no pkcs11 token %q found in %s", label, t.module)
+}
+
+// Reports whether an error means the token was unplugged, which leaves the
+// session unusable.
+func pkcs11TokenGone(err error) bool {
+	var code pkcs11.Error
+	if !errors.As(err, &code) {
+		return false
+	}
+
+	switch code {
+	case pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_TOKEN_NOT_PRESENT, pkcs11.CKR_SESSION_HANDLE_INVALID,
+		pkcs11.CKR_SESSION_CLOSED, pkcs11.CKR_DEVICE_ERROR:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drops the session after the token went away, so the next listing looks
+// for it again. Must be called with mu held.
+func (t *pkcs11Token) lost(err error) {
+	if !t.open || !pkcs11TokenGone(err) {
+		return
+	}
+
+	slog.Warn("pkcs11 token removed", "module", t.module, "token", t.label, "error", err)
+
+	_ = t.ctx.CloseSession(t.session)
+	t.open = false
+	t.loggedIn = false
+}
+
+func (t *pkcs11Token) findObjects(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := t.ctx.FindObjectsInit(t.session, template); err != nil {
+		return nil, err
+	}
+	defer func() { _ = t.ctx.FindObjectsFinal(t.session) }()
+
+	var res []pkcs11.ObjectHandle
+
+	for {
+		objs, _, err := t.ctx.FindObjects(t.session, 32)
+		if err != nil {
+			return nil, err
+		}
+		if len(objs) == 0 {
+			return res, nil
+		}
+		res = append(res, objs...)
+	}
+}
+
+// Lists the token's public keys, falling back to certificates for tokens
+// (like many PIV cards) that don't expose public key objects. A token that
+// was unplugged is looked for again, and fails the listing until it is back.
+func (t *pkcs11Token) signers() ([]agentSigner, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.open {
+		if err := t.openSession(t.label); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := t.scan()
+	if err != nil {
+		t.lost(err)
+	}
+
+	return res, err
+}
+
+// Must be called with mu held.
+func (t *pkcs11Token) scan() ([]agentSigner, error) {
+	var res []agentSigner
+	seen := map[string]bool{}
+
+	for _, class := range []uint{pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_CERTIFICATE} {
+		objs, err := t.findObjects([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range objs {
+			id, label, pub, err := t.publicKey(obj, class)
+			if err != nil {
+				slog.Debug("skipping pkcs11 object", "token", t.label, "error", err)
+				continue
+			}
+
+			if seen[string(id)] {
+				continue
+			}
+			seen[string(id)] = true
+
+			signer, err := ssh.NewSignerFromSigner(&pkcs11Key{token: t, id: id, pub: pub})
+			if err != nil {
+				slog.Debug("skipping pkcs11 key", "token", t.label, "label", label, "error", err)
+				continue
+			}
+
+			res = append(res, agentSigner{signer: signer, comment: label})
+		}
+	}
+
+	return res, nil
+}
+
+func (t *pkcs11Token) publicKey(obj pkcs11.ObjectHandle, class uint) ([]byte, string, crypto.PublicKey, error) {
+	attrs, err := t.ctx.GetAttributeValue(t.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	id, label := attrs[0].Value, string(attrs[1].Value)
+
+	if class == pkcs11.CKO_CERTIFICATE {
+		attrs, err := t.ctx.GetAttributeValue(t.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		cert, err := x509.ParseCertificate(attrs[0].Value)
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		return id, label, cert.PublicKey, nil
+	}
+
+	attrs, err = t.ctx.GetAttributeValue(t.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	switch keyType := bytesToUint(attrs[0].Value); keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err := t.ctx.GetAttributeValue(t.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		return id, label, &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+
+	case pkcs11.CKK_EC:
+		attrs, err := t.ctx.GetAttributeValue(t.session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		pub, err := ecPublicKey(attrs[0].Value, attrs[1].Value)
+		return id, label, pub, err
+
+	default:
+		return nil, "", nil, fmt.Errorf("unsupported key type %d", keyType)
+	}
+}
+
+func ecPublicKey(params, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, err
+	}
+
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}):
+		curve = elliptic.P256()
+	case oid.Equal(asn1.ObjectIdentifier{1, 3, 132, 0, 34}):
+		curve = elliptic.P384()
+	case oid.Equal(asn1.ObjectIdentifier{1, 3, 132, 0, 35}):
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %v", oid)
+	}
+
+	// The point is normally wrapped in a DER octet string
+	var raw []byte
+	if _, err := asn1.Unmarshal(point, &raw); err != nil {
+		raw = point
+	}
+
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errors.New("invalid ec point")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// Decodes a CK_ULONG attribute value, which is in host byte order and as
+// long as the module's unsigned long.
+func bytesToUint(b []byte) uint {
+	switch len(b) {
+	case 8:
+		return uint(binary.NativeEndian.Uint64(b))
+	case 4:
+		return uint(binary.NativeEndian.Uint32(b))
+	default:
+		return 0
+	}
+}
+
+// Logs in to the token if the pin policy requires it, asking for the PIN.
+func (t *pkcs11Token) login() error {
+	if t.loggedIn {
+		if t.pinTTL == 0 || (t.pinTTL > 0 && time.Since(t.loginAt) < t.pinTTL) {
+			return nil
+		}
+		t.logout()
+	}
+
+	pin, err := askPassphrase(fmt.Sprintf("Enter PIN for %s: ", t.label))
+	if err != nil {
+		return err
+	}
+
+	err = t.ctx.Login(t.session, pkcs11.CKU_USER, string(pin))
+	clear(pin)
+
+	if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return fmt.Errorf("pkcs11 login: %w", err)
+	}
+
+	t.loggedIn = true
+	t.loginAt = time.Now()
+
+	return nil
+}
+
+func (t *pkcs11Token) logout() {
+	_ = t.ctx.Logout(t.session)
+	t.loggedIn = false
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *pkcs11Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	t := k.token
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.open {
+		return nil, errors.New("pkcs11 token not present")
+	}
+
+	sig, err := k.sign(digest, opts)
+	if err != nil {
+		t.lost(err)
+	}
+
+	return sig, err
+}
+
+// Must be called with the token's mu held.
+func (k *pkcs11Key) sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	t := k.token
+
+	if err := t.login(); err != nil {
+		return nil, err
+	}
+
+	if t.pinTTL < 0 {
+		defer t.logout()
+	}
+
+	objs, err := t.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, k.id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(objs) == 0 {
+		return nil, errors.New("private key not found on token")
+	}
+
+	var mech *pkcs11.Mechanism
+
+	switch k.pub.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := pkcs11HashPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+		}
+		mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		digest = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", k.pub)
+	}
+
+	if err := t.ctx.SignInit(t.session, []*pkcs11.Mechanism{mech}, objs[0]); err != nil {
+		return nil, err
+	}
+
+	sig, err := t.ctx.Sign(t.session, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := k.pub.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns r || s, crypto.Signer callers expect ASN.1
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+
+	return sig, nil
+}
@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+)
+
+func dialPKCS11(u *url.URL) (net.Conn, error) {
+	return nil, errors.New("pkcs11 backends require a cgo build")
+}
@@ -0,0 +1,75 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Builds the fake PKCS#11 module in testdata against the headers of the
+// pkcs11 package.
+func buildFakePKCS11(t *testing.T) string {
+	t.Helper()
+
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+
+	dir, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "github.com/miekg/pkcs11").Output()
+	if err != nil {
+		t.Skipf("pkcs11 headers not found: %v", err)
+	}
+
+	module := filepath.Join(t.TempDir(), "fakepkcs11.so")
+	out, err := exec.Command(cc, "-shared", "-fPIC", "-I", strings.TrimSpace(string(dir)), "-o", module, "testdata/fakepkcs11.c").CombinedOutput()
+	if err != nil {
+		t.Fatalf("building the fake module: %v\n%s", err, out)
+	}
+
+	return module
+}
+
+func TestPKCS11TokenPluggedInLater(t *testing.T) {
+	module := buildFakePKCS11(t)
+
+	present := filepath.Join(t.TempDir(), "present")
+	t.Setenv("FAKE_PKCS11_PRESENT", present)
+
+	u := &url.URL{Scheme: "pkcs11", Path: module, RawQuery: "token=fake"}
+	t.Cleanup(func() {
+		pkcs11Mu.Lock()
+		delete(pkcs11Agents, u.String())
+		pkcs11Mu.Unlock()
+	})
+
+	list := func() error {
+		conn, err := dialPKCS11(u)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+
+		_, err = agent.NewClient(conn).List()
+		return err
+	}
+
+	if err := list(); err == nil {
+		t.Fatal("listed a token that isn't there")
+	}
+
+	if err := os.WriteFile(present, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := list(); err != nil {
+		t.Fatalf("token not found once plugged in: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A host whose agent is used as a backend. The connection is kept open
+// between requests since the handshake is expensive. Each host is dialed
+// under its own lock, so that a slow one doesn't hold up the others.
+type sshRemote struct {
+	mu     sync.Mutex
+	client *ssh.Client
+	sock   string
+}
+
+var (
+	sshRemotesMu sync.Mutex
+	sshRemotes   = map[string]*sshRemote{}
+)
+
+// Dials the agent behind ssh://[user@]host[:port][/path/to/agent.sock]. When
+// no path is given, the remote login's SSH_AUTH_SOCK is used. The identity
+// query parameter selects a key file to authenticate with, otherwise the
+// agent in the proxy's own environment is used.
+func dialSSH(u *url.URL) (net.Conn, error) {
+	key := u.String()
+
+	sshRemotesMu.Lock()
+	remote, ok := sshRemotes[key]
+	if !ok {
+		remote = &sshRemote{}
+		sshRemotes[key] = remote
+	}
+	sshRemotesMu.Unlock()
+
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+
+	if remote.client != nil {
+		if conn, err := remote.client.Dial("unix", remote.sock); err == nil {
+			return conn, nil
+		}
+
+		// Most likely the connection dropped, start over
+		slog.Debug("ssh backend reconnecting", "host", u.Host)
+		_ = remote.client.Close()
+		remote.client = nil
+	}
+
+	client, sock, err := connectSSH(u)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial("unix", sock)
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("opening remote agent %s: %w", sock, err)
+	}
+
+	remote.client, remote.sock = client, sock
+
+	return conn, nil
+}
+
+// Logs in to the host and finds the agent socket to use there.
+func connectSSH(u *url.URL) (*ssh.Client, string, error) {
+	client, err := sshClient(u)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sock := u.Path
+	if sock == "" {
+		if sock, err = remoteAuthSock(client); err != nil {
+			_ = client.Close()
+			return nil, "", err
+		}
+	}
+
+	slog.Info("ssh backend connected", "host", sshAddr(u), "user", client.User(), "socket", sock)
+
+	return client, sock, nil
+}
+
+// Logs in to the host of ssh://[user@]host[:port], checking its key against
+// known_hosts. The identity query parameter selects a key file to
+// authenticate with, otherwise the agent in the proxy's own environment is
+// used.
+func sshClient(u *url.URL) (*ssh.Client, error) {
+	username := u.User.Username()
+	if username == "" {
+		if cur, err := user.Current(); err == nil {
+			username = cur.Username
+		}
+	}
+
+	auth, done, err := sshAuth(u.Query().Get("identity"))
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	home, _ := os.UserHomeDir()
+
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("loading known hosts: %w", err)
+	}
+
+	return ssh.Dial("tcp", sshAddr(u), &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         remoteTimeout,
+	})
+}
+
+func sshAddr(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	return u.Host
+}
+
+// Returns the authentication methods for connecting to a remote, and a
+// function releasing their resources once the handshake is over.
+func sshAuth(identity string) ([]ssh.AuthMethod, func(), error) {
+	if identity != "" {
+		key, err := loadKeyFile(expandPath(identity))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, func() {}, nil
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, errors.New("no identity given and SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, func() { _ = conn.Close() }, nil
+}
+
+// Asks the remote login shell where its agent lives.
+func remoteAuthSock(client *ssh.Client) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = session.Close() }()
+
+	out, err := session.Output(`echo "$SSH_AUTH_SOCK"`)
+	if err != nil {
+		return "", fmt.Errorf("querying remote SSH_AUTH_SOCK: %w", err)
+	}
+
+	sock := strings.TrimSpace(string(out))
+	if sock == "" {
+		return "", errors.New("remote SSH_AUTH_SOCK is not set")
+	}
+
+	return sock, nil
+}
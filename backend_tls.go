@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+)
+
+// Dials tls://host:port?cert=client.crt&key=client.key&ca=ca.crt, an agent
+// behind a TLS terminator requiring client certificates. The server must
+// present a certificate issued by the given CA; the system roots are not
+// consulted. The server-name parameter overrides the name verified against
+// the server certificate.
+func dialTLS(ctx context.Context, u *url.URL) (net.Conn, error) {
+	cfg, err := backendTLSConfig(u.Query())
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+
+	d := tls.Dialer{Config: cfg}
+
+	return d.DialContext(ctx, "tcp", u.Host)
+}
+
+func backendTLSConfig(q url.Values) (*tls.Config, error) {
+	certFile, keyFile, caFile := q.Get("cert"), q.Get("key"), q.Get("ca")
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("tls backends need cert, key and ca parameters")
+	}
+
+	cert, err := tls.LoadX509KeyPair(expandPath(certFile), expandPath(keyFile))
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+
+	pem, err := os.ReadFile(expandPath(caFile))
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   q.Get("server-name"),
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
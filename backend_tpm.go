@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/linuxtpm"
+	"golang.org/x/crypto/ssh"
+)
+
+// A TPM whose persistent signing keys are served as a backend. The device is
+// opened once and shared by all requests.
+type tpmDevice struct {
+	mu     sync.Mutex
+	tpm    transport.TPM
+	path   string
+	prompt bool
+}
+
+// A persistent key inside the TPM, implementing crypto.Signer. The private
+// key never leaves the TPM.
+type tpmKey struct {
+	dev    *tpmDevice
+	handle tpm2.TPMHandle
+	name   tpm2.TPM2BName
+	pub    crypto.PublicKey
+}
+
+var (
+	tpmMu     sync.Mutex
+	tpmAgents = map[string]*signerAgent{}
+
+	tpmHashAlgs = map[crypto.Hash]tpm2.TPMIAlgHash{
+		crypto.SHA1:   tpm2.TPMAlgSHA1,
+		crypto.SHA256: tpm2.TPMAlgSHA256,
+		crypto.SHA384: tpm2.TPMAlgSHA384,
+		crypto.SHA512: tpm2.TPMAlgSHA512,
+	}
+)
+
+// Dials tpm:[/dev/tpmrm0][?auth=prompt], serving every unrestricted signing
+// key persisted in the TPM. With auth=prompt the key's authorization value
+// is asked for on each signature, otherwise keys must have an empty one.
+func dialTPM(u *url.URL) (net.Conn, error) {
+	tpmMu.Lock()
+	defer tpmMu.Unlock()
+
+	key := u.String()
+
+	a, ok := tpmAgents[key]
+	if !ok {
+		path := u.Path
+		if path == "" {
+			path = "/dev/tpmrm0"
+		}
+
+		tpm, err := linuxtpm.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening tpm: %w", err)
+		}
+
+		slog.Info("tpm opened", "path", path)
+
+		dev := &tpmDevice{tpm: tpm, path: path, prompt: u.Query().Get("auth") == "prompt"}
+		a = &signerAgent{name: "tpm " + path, load: dev.signers}
+		tpmAgents[key] = a
+	}
+
+	return servePipe(a), nil
+}
+
+func (d *tpmDevice) signers() ([]agentSigner, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	caps, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapHandles,
+		Property:      uint32(tpm2.TPMHTPersistent) << 24,
+		PropertyCount: 64,
+	}.Execute(d.tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	handles, err := caps.CapabilityData.Data.Handles()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []agentSigner
+
+	for _, handle := range handles.Handle {
+		key, err := d.readKey(handle)
+		if err != nil {
+			slog.Debug("skipping tpm handle", "handle", fmt.Sprintf("%#x", uint32(handle)), "error", err)
+			continue
+		}
+
+		signer, err := ssh.NewSignerFromSigner(key)
+		if err != nil {
+			slog.Debug("skipping tpm key", "handle", fmt.Sprintf("%#x", uint32(handle)), "error", err)
+			continue
+		}
+
+		res = append(res, agentSigner{signer: signer, comment: fmt.Sprintf("tpm:%#x", uint32(handle))})
+	}
+
+	return res, nil
+}
+
+func (d *tpmDevice) readKey(handle tpm2.TPMHandle) (*tpmKey, error) {
+	rsp, err := tpm2.ReadPublic{ObjectHandle: handle}.Execute(d.tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := rsp.OutPublic.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	if !public.ObjectAttributes.SignEncrypt || public.ObjectAttributes.Restricted {
+		return nil, fmt.Errorf("not an unrestricted signing key")
+	}
+
+	pub, err := tpm2.Pub(*public)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tpmKey{dev: d, handle: handle, name: rsp.Name, pub: pub}, nil
+}
+
+func (k *tpmKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *tpmKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hashAlg, ok := tpmHashAlgs[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash %v", opts.HashFunc())
+	}
+
+	var scheme tpm2.TPMTSigScheme
+
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		scheme = tpm2.TPMTSigScheme{
+			Scheme:  tpm2.TPMAlgECDSA,
+			Details: tpm2.NewTPMUSigScheme(tpm2.TPMAlgECDSA, &tpm2.TPMSSchemeHash{HashAlg: hashAlg}),
+		}
+	case *rsa.PublicKey:
+		scheme = tpm2.TPMTSigScheme{
+			Scheme:  tpm2.TPMAlgRSASSA,
+			Details: tpm2.NewTPMUSigScheme(tpm2.TPMAlgRSASSA, &tpm2.TPMSSchemeHash{HashAlg: hashAlg}),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", k.pub)
+	}
+
+	var auth []byte
+	if k.dev.prompt {
+		var err error
+		if auth, err = askPassphrase(fmt.Sprintf("Enter authorization for tpm key %#x: ", uint32(k.handle))); err != nil {
+			return nil, err
+		}
+		defer clear(auth)
+	}
+
+	k.dev.mu.Lock()
+	defer k.dev.mu.Unlock()
+
+	rsp, err := tpm2.Sign{
+		KeyHandle: tpm2.AuthHandle{
+			Handle: k.handle,
+			Name:   k.name,
+			Auth:   tpm2.PasswordAuth(auth),
+		},
+		Digest:   tpm2.TPM2BDigest{Buffer: digest},
+		InScheme: scheme,
+		Validation: tpm2.TPMTTKHashCheck{
+			Tag:       tpm2.TPMSTHashCheck,
+			Hierarchy: tpm2.TPMRHNull,
+		},
+	}.Execute(k.dev.tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		sig, err := rsp.Signature.Signature.ECDSA()
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig.SignatureR.Buffer),
+			new(big.Int).SetBytes(sig.SignatureS.Buffer),
+		})
+	default:
+		sig, err := rsp.Signature.Signature.RSASSA()
+		if err != nil {
+			return nil, err
+		}
+		return sig.Sig.Buffer, nil
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A HashiCorp Vault server providing keys from the transit engine, which
+// signs on the server, and private keys stored in a KV version 2 secret,
+// which are fetched into memory and dropped again when the agent is locked.
+type vault struct {
+	client    *http.Client
+	addr      string
+	namespace string
+
+	transitMount string
+	transit      []string
+	kvMount      string
+	kv           []string
+
+	mu          sync.Mutex
+	token       string
+	transitKeys []agentSigner
+	kvKeys      []agentSigner
+	locked      bool
+	lockHash    [sha256.Size]byte
+}
+
+var (
+	vaultMu     sync.Mutex
+	vaultAgents = map[string]*signerAgent{}
+
+	vaultHashNames = map[crypto.Hash]string{
+		crypto.SHA1:   "sha1",
+		crypto.SHA256: "sha2-256",
+		crypto.SHA384: "sha2-384",
+		crypto.SHA512: "sha2-512",
+	}
+)
+
+// Dials vault:?transit=name&kv=path, serving the named transit keys and the
+// private keys found in the given KV secrets (both may be repeated). The
+// server comes from the addr parameter or VAULT_ADDR, the token from
+// VAULT_TOKEN or ~/.vault-token; mount and kv-mount override the engine
+// mount points. The token is renewed in the background while it allows it.
+func dialVault(u *url.URL) (net.Conn, error) {
+	vaultMu.Lock()
+	defer vaultMu.Unlock()
+
+	key := u.String()
+
+	a, ok := vaultAgents[key]
+	if !ok {
+		q := u.Query()
+
+		if len(q["transit"]) == 0 && len(q["kv"]) == 0 {
+			return nil, errors.New("vault backends need at least one transit or kv parameter")
+		}
+
+		token, err := vaultToken()
+		if err != nil {
+			return nil, err
+		}
+
+		v := &vault{
+			client:       http.DefaultClient,
+			addr:         q.Get("addr"),
+			namespace:    os.Getenv("VAULT_NAMESPACE"),
+			transitMount: q.Get("mount"),
+			transit:      q["transit"],
+			kvMount:      q.Get("kv-mount"),
+			kv:           q["kv"],
+			token:        token,
+		}
+		if v.addr == "" {
+			v.addr = os.Getenv("VAULT_ADDR")
+		}
+		if v.addr == "" {
+			v.addr = "https://127.0.0.1:8200"
+		}
+		if v.transitMount == "" {
+			v.transitMount = "transit"
+		}
+		if v.kvMount == "" {
+			v.kvMount = "secret"
+		}
+
+		go v.renewToken()
+
+		a = &signerAgent{name: "vault", load: v.signers, lock: v.lock, unlock: v.unlock}
+		vaultAgents[key] = a
+	}
+
+	return servePipe(a), nil
+}
+
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	buf, err := os.ReadFile(expandPath("~/.vault-token"))
+	if err != nil {
+		return "", fmt.Errorf("no vault token: %w", err)
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// Calls a Vault API path, decoding the JSON reply into out.
+func (v *vault) call(method, path string, in, out any) error {
+	v.mu.Lock()
+	header := http.Header{"X-Vault-Token": {v.token}}
+	v.mu.Unlock()
+
+	if v.namespace != "" {
+		header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	if err := httpJSON(v.client, method, strings.TrimSuffix(v.addr, "/")+"/v1/"+path, header, in, out); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Renews the token at half its remaining lifetime, for as long as Vault
+// allows. Tokens without a TTL never need renewing.
+func (v *vault) renewToken() {
+	var self struct {
+		Data struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		} `json:"data"`
+	}
+
+	if err := v.call(http.MethodGet, "auth/token/lookup-self", nil, &self); err != nil {
+		slog.Warn("vault token lookup failed", "error", err)
+		return
+	}
+
+	if !self.Data.Renewable || self.Data.TTL <= 0 {
+		return
+	}
+
+	ttl := time.Duration(self.Data.TTL) * time.Second
+
+	for {
+		time.Sleep(ttl / 2)
+
+		var res struct {
+			Auth struct {
+				LeaseDuration int64 `json:"lease_duration"`
+			} `json:"auth"`
+		}
+
+		if err := v.call(http.MethodPost, "auth/token/renew-self", map[string]any{}, &res); err != nil {
+			slog.Warn("vault token renewal failed", "error", err)
+			ttl = 2 * time.Minute
+			continue
+		}
+
+		slog.Debug("vault token renewed", "ttl", res.Auth.LeaseDuration)
+
+		if res.Auth.LeaseDuration <= 0 {
+			return
+		}
+		ttl = time.Duration(res.Auth.LeaseDuration) * time.Second
+	}
+}
+
+func (v *vault) signers() ([]agentSigner, error) {
+	v.mu.Lock()
+	transit, kv, locked := v.transitKeys, v.kvKeys, v.locked
+	v.mu.Unlock()
+
+	if locked {
+		return nil, nil
+	}
+
+	var err error
+
+	if transit == nil && len(v.transit) > 0 {
+		if transit, err = v.loadTransit(); err != nil {
+			return nil, err
+		}
+	}
+
+	if kv == nil && len(v.kv) > 0 {
+		if kv, err = v.loadKV(); err != nil {
+			return nil, err
+		}
+	}
+
+	v.mu.Lock()
+	v.transitKeys = transit
+	if !v.locked {
+		v.kvKeys = kv
+	}
+	v.mu.Unlock()
+
+	return append(transit[:len(transit):len(transit)], kv...), nil
+}
+
+func (v *vault) loadTransit() ([]agentSigner, error) {
+	var keys []agentSigner
+
+	for _, name := range v.transit {
+		var res struct {
+			Data struct {
+				Type          string `json:"type"`
+				LatestVersion int    `json:"latest_version"`
+				Keys          map[string]struct {
+					PublicKey string `json:"public_key"`
+				} `json:"keys"`
+			} `json:"data"`
+		}
+
+		if err := v.call(http.MethodGet, v.transitMount+"/keys/"+url.PathEscape(name), nil, &res); err != nil {
+			return nil, err
+		}
+
+		latest, ok := res.Data.Keys[strconv.Itoa(res.Data.LatestVersion)]
+		if !ok {
+			return nil, fmt.Errorf("%s: no public key for version %d", name, res.Data.LatestVersion)
+		}
+
+		pub, err := vaultPublicKey(res.Data.Type, latest.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		signer, err := ssh.NewSignerFromSigner(&remoteSigner{pub: pub, sign: v.signFunc(name, pub)})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		keys = append(keys, agentSigner{signer: signer, comment: "vault:" + name})
+	}
+
+	return keys, nil
+}
+
+func vaultPublicKey(typ, encoded string) (crypto.PublicKey, error) {
+	if typ == "ed25519" {
+		// Transit hands out raw ed25519 keys, base64 encoded
+		buf, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(buf) != ed25519.PublicKeySize {
+			return nil, errors.New("bad ed25519 public key")
+		}
+		return ed25519.PublicKey(buf), nil
+	}
+
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, fmt.Errorf("no public key for %s key", typ)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func (v *vault) signFunc(name string, pub crypto.PublicKey) func([]byte, crypto.Hash) ([]byte, error) {
+	return func(digest []byte, hash crypto.Hash) ([]byte, error) {
+		req := map[string]any{"input": base64.StdEncoding.EncodeToString(digest)}
+
+		if _, ok := pub.(ed25519.PublicKey); !ok {
+			hashName, ok := vaultHashNames[hash]
+			if !ok {
+				return nil, fmt.Errorf("unsupported hash %v", hash)
+			}
+
+			req["prehashed"] = true
+			req["hash_algorithm"] = hashName
+			req["signature_algorithm"] = "pkcs1v15"
+			req["marshaling_algorithm"] = "asn1"
+		}
+
+		var res struct {
+			Data struct {
+				Signature string `json:"signature"`
+			} `json:"data"`
+		}
+
+		if err := v.call(http.MethodPost, v.transitMount+"/sign/"+url.PathEscape(name), req, &res); err != nil {
+			return nil, err
+		}
+
+		// Signatures look like vault:v1:base64
+		encoded := res.Data.Signature
+		if i := strings.LastIndexByte(encoded, ':'); i >= 0 {
+			encoded = encoded[i+1:]
+		}
+
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+}
+
+func (v *vault) loadKV() ([]agentSigner, error) {
+	keys := []agentSigner{}
+
+	for _, path := range v.kv {
+		var res struct {
+			Data struct {
+				Data map[string]any `json:"data"`
+			} `json:"data"`
+		}
+
+		if err := v.call(http.MethodGet, v.kvMount+"/data/"+strings.TrimPrefix(path, "/"), nil, &res); err != nil {
+			return nil, err
+		}
+
+		for field, value := range res.Data.Data {
+			text, ok := value.(string)
+			if !ok {
+				continue
+			}
+
+			raw, err := ssh.ParseRawPrivateKey([]byte(text))
+			if err != nil {
+				continue
+			}
+
+			signer, err := ssh.NewSignerFromKey(raw)
+			if err != nil {
+				slog.Debug("skipping vault kv field", "path", path, "field", field, "error", err)
+				continue
+			}
+
+			keys = append(keys, agentSigner{signer: signer, comment: "vault:" + path + "#" + field})
+		}
+	}
+
+	return keys, nil
+}
+
+// Drops the KV keys and hides everything until unlocked with the same
+// passphrase.
+func (v *vault) lock(passphrase []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.locked {
+		return errors.New("already locked")
+	}
+
+	v.locked = true
+	v.lockHash = sha256.Sum256(passphrase)
+	v.kvKeys = nil
+
+	return nil
+}
+
+// Unlocks the backend and fetches the KV keys again straight away.
+func (v *vault) unlock(passphrase []byte) error {
+	v.mu.Lock()
+
+	if !v.locked {
+		v.mu.Unlock()
+		return errors.New("not locked")
+	}
+
+	hash := sha256.Sum256(passphrase)
+	if subtle.ConstantTimeCompare(hash[:], v.lockHash[:]) != 1 {
+		v.mu.Unlock()
+		return errors.New("incorrect passphrase")
+	}
+
+	v.locked = false
+	v.mu.Unlock()
+
+	if len(v.kv) == 0 {
+		return nil
+	}
+
+	keys, err := v.loadKV()
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.kvKeys = keys
+	v.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Well-known context IDs, by name
+var vsockCIDs = map[string]uint32{
+	"hypervisor": unix.VMADDR_CID_HYPERVISOR,
+	"local":      unix.VMADDR_CID_LOCAL,
+	"host":       unix.VMADDR_CID_HOST,
+	"any":        unix.VMADDR_CID_ANY,
+}
+
+// The address of a VM socket, e.g. 2:1234.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+func (a vsockAddr) String() string  { return fmt.Sprintf("%d:%d", a.cid, a.port) }
+
+// Parses the cid:port of a vsock:// URI. The context ID can also be one of
+// hypervisor, local, host and, to listen, any.
+func parseVsockAddr(u *url.URL) (vsockAddr, error) {
+	cid, ok := vsockCIDs[u.Hostname()]
+	if !ok {
+		n, err := strconv.ParseUint(u.Hostname(), 10, 32)
+		if err != nil {
+			return vsockAddr{}, fmt.Errorf("bad vsock context ID %q", u.Hostname())
+		}
+		cid = uint32(n)
+	}
+
+	port, err := strconv.ParseUint(u.Port(), 10, 32)
+	if err != nil {
+		return vsockAddr{}, fmt.Errorf("bad vsock port %q", u.Port())
+	}
+
+	return vsockAddr{cid: cid, port: uint32(port)}, nil
+}
+
+// A connected VM socket. The net package doesn't know AF_VSOCK, but an
+// os.File of a non-blocking socket is served by the runtime poller all the
+// same, deadlines included.
+type vsockConn struct {
+	*os.File
+	local, remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+func (c *vsockConn) peerCID() uint32      { return c.remote.cid }
+
+// Wraps a connected VM socket.
+func newVsockConn(f *os.File, fd int) *vsockConn {
+	c := &vsockConn{File: f}
+
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			c.local = vsockAddr{cid: vm.CID, port: vm.Port}
+		}
+	}
+	if sa, err := unix.Getpeername(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			c.remote = vsockAddr{cid: vm.CID, port: vm.Port}
+		}
+	}
+
+	return c
+}
+
+// Dials vsock://cid:port, an agent exposed over a VM socket by the host to
+// its guests or the other way round.
+func dialVsock(ctx context.Context, u *url.URL) (net.Conn, error) {
+	addr, err := parseVsockAddr(u)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vsock: %w", err)
+	}
+
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: addr.cid, Port: addr.port})
+	if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("vsock %s: %w", addr, err)
+	}
+
+	f := os.NewFile(uintptr(fd), "vsock")
+
+	// Wait for the connection, or give up with ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = f.SetWriteDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = f.SetWriteDeadline(time.Unix(1, 0)) })
+
+	raw, err := f.SyscallConn()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	var connectErr error
+	if err := raw.Write(func(fd uintptr) bool {
+		if _, err := unix.Getpeername(int(fd)); err == nil {
+			return true
+		}
+
+		errno, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		switch {
+		case err != nil:
+			connectErr = err
+		case errno != 0:
+			connectErr = unix.Errno(errno)
+		default:
+			return false
+		}
+
+		return true
+	}); err != nil {
+		connectErr = err
+	}
+
+	if !stop() && connectErr == nil {
+		connectErr = ctx.Err()
+	}
+
+	if connectErr != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("vsock %s: %w", addr, connectErr)
+	}
+
+	// Deadlines are up to the caller from here
+	_ = f.SetWriteDeadline(time.Time{})
+
+	return newVsockConn(f, fd), nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+)
+
+func dialVsock(ctx context.Context, u *url.URL) (net.Conn, error) {
+	return nil, errors.New("vsock backends are only available on Linux")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Copies between stdio and a named pipe, so that WSL, which can run Windows
+// programs but not open their pipes, can talk to the Windows OpenSSH agent.
+// It exits once stdin is closed, i.e. with the proxy.
+const wslRelayScript = `
+$pipe = New-Object System.IO.Pipes.NamedPipeClientStream('.', '%s', [System.IO.Pipes.PipeDirection]::InOut)
+$pipe.Connect(10000)
+$in = [Console]::OpenStandardInput()
+$out = [Console]::OpenStandardOutput()
+$null = $pipe.CopyToAsync($out)
+$in.CopyTo($pipe)
+`
+
+// Where Windows keeps PowerShell, for when the Windows PATH isn't appended to
+// WSL's
+const wslPowerShell = "/mnt/c/Windows/System32/WindowsPowerShell/v1.0/powershell.exe"
+
+// A PowerShell process relaying to an agent's named pipe, started once as
+// that takes a while and shared by all connections to the backend.
+type wslRelay struct {
+	agent agent.ExtendedAgent
+	done  chan struct{}
+}
+
+var (
+	wslMu     sync.Mutex
+	wslRelays = map[string]*wslRelay{}
+)
+
+// Dials wsl:[?pipe=name], the Windows OpenSSH agent seen from inside WSL,
+// through a relay to its named pipe, \\.\pipe\openssh-ssh-agent by default.
+// The relay is started again when it exits.
+func dialWSL(u *url.URL) (net.Conn, error) {
+	wslMu.Lock()
+	defer wslMu.Unlock()
+
+	pipe := u.Query().Get("pipe")
+	if pipe == "" {
+		pipe = "openssh-ssh-agent"
+	}
+
+	r, ok := wslRelays[pipe]
+	if ok {
+		select {
+		case <-r.done:
+			slog.Debug("wsl relay exited, restarting", "pipe", pipe)
+			ok = false
+		default:
+		}
+	}
+
+	if !ok {
+		var err error
+		if r, err = startWSLRelay(pipe); err != nil {
+			return nil, err
+		}
+		wslRelays[pipe] = r
+	}
+
+	return servePipe(r.agent), nil
+}
+
+func startWSLRelay(pipe string) (*wslRelay, error) {
+	if _, err := os.Stat("/proc/sys/fs/binfmt_misc/WSLInterop"); err != nil {
+		return nil, errors.New("wsl backends only work inside WSL with Windows interop enabled")
+	}
+
+	if strings.ContainsAny(pipe, `'\`) {
+		return nil, fmt.Errorf("bad pipe name %q", pipe)
+	}
+
+	exe, err := exec.LookPath("powershell.exe")
+	if err != nil {
+		exe = wslPowerShell
+	}
+
+	cmd := exec.Command(exe, "-NoProfile", "-NonInteractive", "-Command", fmt.Sprintf(wslRelayScript, pipe))
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting wsl relay: %w", err)
+	}
+
+	r := &wslRelay{
+		agent: agent.NewClient(struct {
+			io.Reader
+			io.Writer
+		}{stdout, stdin}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		err := cmd.Wait()
+		slog.Warn("wsl relay exited", "pipe", pipe, "error", err, "output", strings.TrimSpace(stderr.String()))
+		close(r.done)
+	}()
+
+	slog.Info("wsl relay started", "pipe", pipe, "pid", cmd.Process.Pid)
+
+	return r, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+)
+
+func dialWSL(u *url.URL) (net.Conn, error) {
+	return nil, errors.New("wsl backends are only available inside WSL")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// How long after a backend's passphrase was asked for it isn't asked again
+const unlockPromptInterval = time.Minute
+
+var (
+	unlockPrompt = flag.Bool("unlock-prompt", false, "ask for the passphrase of backends found locked, with the askpass program or on the terminal, and unlock them")
+
+	// One passphrase prompt at a time
+	unlockPromptMu sync.Mutex
+)
+
+// Set on the context of background probes, which mustn't prompt.
+type probeKey struct{}
+
+// Reports whether err is the backend refusing a request, as locked agents
+// refuse every one, rather than failing to answer.
+func isRefusal(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "agent: fail")
+}
+
+// Notes what a backend listed. Agents lock without telling and list
+// nothing until unlocked, so one listing no keys though it listed some
+// before may be locked, which a refused request then confirms. A backend
+// listing keys again is unlocked.
+func (h *backendHealth) noteListing(name string, keys int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if keys > 0 {
+		h.listed, h.emptied = true, false
+		h.setLocked(name, false, false)
+	} else if h.listed {
+		h.emptied = true
+	}
+}
+
+// Notes a sign or remove request the backend refused, taking it as locked
+// when it emptied since it last listed keys. Reports whether it is found
+// locked by this.
+func (h *backendHealth) noteRefusal(name string, err error) bool {
+	if !isRefusal(err) {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.emptied || h.locked {
+		return false
+	}
+
+	h.setLocked(name, true, false)
+
+	return true
+}
+
+// Forgets that the backend listed keys, once they are removed through the
+// proxy, so that it listing none afterwards isn't taken for a lock.
+func (h *backendHealth) noteRemoved() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.listed, h.emptied = false, false
+}
+
+// Records whether a backend is locked, and whether by the proxy, logging
+// and firing an event when it changes. Called with h.mu held.
+func (h *backendHealth) setLocked(name string, locked, byProxy bool) {
+	h.lockedByProxy = locked && byProxy
+
+	if locked == h.locked {
+		return
+	}
+	h.locked = locked
+
+	if locked {
+		slog.Warn("backend locked, its keys are hidden until it is unlocked", "backend", name, "by_proxy", byProxy)
+		fireEvent(hookEvent{Event: "backend-locked", Backend: name})
+	} else {
+		h.emptied = false
+		slog.Info("backend unlocked", "backend", name)
+		fireEvent(hookEvent{Event: "backend-unlocked", Backend: name})
+	}
+}
+
+// Records the lock state the proxy itself put the backend in.
+func (h *backendHealth) lockedByUs(name string, locked bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.setLocked(name, locked, true)
+}
+
+// Reports whether the user may be asked for the backend's passphrase now,
+// noting that they are: with --unlock-prompt, outside background probes,
+// for a backend locked other than through the proxy, once a minute.
+func (a checkedAgent) promptDue() bool {
+	if !*unlockPrompt || a.ctx.Value(probeKey{}) != nil {
+		return false
+	}
+
+	h := a.b.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.locked || h.lockedByProxy || time.Since(h.prompted) < unlockPromptInterval {
+		return false
+	}
+	h.prompted = time.Now()
+
+	return true
+}
+
+// Asks the user for the passphrase of a backend found locked and unlocks
+// it with it, reporting whether it was.
+func (a checkedAgent) promptUnlock() bool {
+	if !a.promptDue() || !unlockPromptMu.TryLock() {
+		return false
+	}
+	defer unlockPromptMu.Unlock()
+
+	pass, err := askPassphrase(fmt.Sprintf("Passphrase to unlock backend %s: ", a.b.name))
+	if err != nil {
+		slog.WarnContext(a.ctx, "backend passphrase not given", "backend", a.b.name, "error", err)
+		return false
+	}
+	defer clear(pass)
+
+	if err := a.ExtendedAgent.Unlock(pass); err != nil {
+		slog.WarnContext(a.ctx, "backend not unlocked", "backend", a.b.name, "error", err)
+		return false
+	}
+
+	a.b.health.lockedByUs(a.b.name, false)
+
+	return true
+}
+
+// Notes what the backend listed, listing again once the user unlocked it
+// if it is found locked.
+func (a checkedAgent) whenLocked(keys []*agent.Key) ([]*agent.Key, error) {
+	a.b.health.noteListing(a.b.name, len(keys))
+
+	if len(keys) > 0 || !a.promptUnlock() {
+		return keys, nil
+	}
+
+	return a.ExtendedAgent.List()
+}
+
+// Marks the context of a background probe.
+func probeContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, probeKey{}, true)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The latencies of one kind of request to one backend, over a benchmark.
+type benchResult struct {
+	Op       string  `json:"op"`
+	Backend  string  `json:"backend"`
+	Requests int     `json:"requests"`
+	Errors   int     `json:"errors"`
+	P50      float64 `json:"p50_ms"`
+	P90      float64 `json:"p90_ms"`
+	P99      float64 `json:"p99_ms"`
+	Max      float64 `json:"max_ms"`
+}
+
+type benchKey struct{ op, backend string }
+
+// The latencies a benchmark client measured.
+type benchSamples struct {
+	latencies map[benchKey][]time.Duration
+	errors    map[benchKey]int
+}
+
+func init() {
+	subcommands["bench"] = cmdBench
+}
+
+// Drives List and Sign requests against a proxy for a while, from several
+// clients at once, and prints the latency percentiles of each backend.
+func cmdBench(args []string) error {
+	fs, cf := newClientFlags("bench")
+	socket := fs.String("socket", os.Getenv("SSH_AUTH_SOCK"), "agent socket of the proxy to drive")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run for")
+	clients := fs.Int("clients", 4, "number of clients making requests at once")
+	ops := fs.String("ops", "list,sign", "comma-separated requests to make: list, sign")
+	inProcess := fs.Bool("in-process", false, "start a proxy in this process over the backends given as arguments and in --config, instead of driving a running one")
+	fs.StringVar(configFile, "config", *configFile, "path of the JSON config file, with --in-process")
+	_ = fs.Parse(args)
+
+	if *clients < 1 {
+		return errors.New("--clients must be positive")
+	}
+
+	var opList []string
+	for _, op := range strings.Split(*ops, ",") {
+		if op != "list" && op != "sign" {
+			return fmt.Errorf("unknown op %q", op)
+		}
+		opList = append(opList, op)
+	}
+
+	if !*inProcess && fs.NArg() != 0 {
+		return errors.New("usage: bench [flags], or bench --in-process [flags] [backend...]")
+	}
+
+	var owners map[string]string
+
+	if *inProcess {
+		stop, err := startBenchProxy(fs.Args(), socket)
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		owners = keyOwners(pkr.Keys())
+	} else {
+		var keys []keyInfo
+		err := adminCall(cf.adminSocket, "list-keys", nil, &keys)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "backends of the keys unknown: %v\n", err)
+		}
+		owners = keyOwners(keys, err)
+	}
+
+	if *socket == "" {
+		return errors.New("no agent socket, set SSH_AUTH_SOCK or --socket")
+	}
+
+	keys, err := benchKeys(*socket)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(opList, "sign") && len(keys) == 0 {
+		return errors.New("no keys to sign with")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	samples := make([]benchSamples, *clients)
+	errs := make([]error, *clients)
+
+	var wg sync.WaitGroup
+	for i := range *clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			samples[i], errs[i] = benchClient(ctx, *socket, opList, keys, i, owners)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	results := benchResults(samples)
+
+	if cf.json {
+		return printJSON(results)
+	}
+
+	total := 0
+	for _, r := range results {
+		total += r.Requests
+	}
+	fmt.Printf("%d requests from %d clients in %v, %.0f/s\n\n", total, *clients, *duration, float64(total)/duration.Seconds())
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "OP\tBACKEND\tREQUESTS\tERRORS\tP50\tP90\tP99\tMAX")
+	for _, r := range results {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.2fms\t%.2fms\t%.2fms\t%.2fms\n", r.Op, r.Backend, r.Requests, r.Errors, r.P50, r.P90, r.P99, r.Max)
+	}
+	return tw.Flush()
+}
+
+// Starts a proxy over the backends in the config file and those given,
+// serving on a temporary socket it sets socket to. The returned function
+// stops it.
+func startBenchProxy(specs []string, socket *string) (func(), error) {
+	// The proxy's logs would drown the results
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := cfg.Backends
+	for _, spec := range specs {
+		backends = append(backends, parseBackendArg(spec))
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("no backends specified")
+	}
+
+	pkr, err = NewProxyKeyring(backends)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "ssh-agent-proxy-bench")
+	if err != nil {
+		return nil, err
+	}
+
+	*socket = filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, l, frontend{})
+	}()
+
+	return func() {
+		_ = l.Close()
+		cancel()
+		<-done
+		_ = os.RemoveAll(dir)
+	}, nil
+}
+
+// Maps the fingerprints of the keys to their backends.
+func keyOwners(keys []keyInfo, err error) map[string]string {
+	owners := map[string]string{}
+	if err == nil {
+		for _, k := range keys {
+			owners[k.Fingerprint] = k.Backend
+		}
+	}
+
+	return owners
+}
+
+// Lists the keys to sign with. Security keys are left out, since each
+// signature would wait for a touch.
+func benchKeys(socket string) ([]*agent.Key, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to agent: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool { return isSecurityKey(k) }), nil
+}
+
+// Makes the requests in turn on a connection of its own until ctx is done,
+// signing with the keys in turn from the nth.
+func benchClient(ctx context.Context, socket string, ops []string, keys []*agent.Key, n int, owners map[string]string) (benchSamples, error) {
+	s := benchSamples{latencies: map[benchKey][]time.Duration{}, errors: map[benchKey]int{}}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return s, fmt.Errorf("connecting to agent: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	a := agent.NewClient(conn)
+
+	data := make([]byte, 32)
+	_, _ = rand.Read(data)
+
+	for i := 0; ctx.Err() == nil; i++ {
+		var k benchKey
+		start := time.Now()
+
+		switch ops[i%len(ops)] {
+		case "list":
+			k = benchKey{"list", "all"}
+			_, err = a.List()
+		case "sign":
+			key := keys[(n+i/len(ops))%len(keys)]
+			k = benchKey{"sign", owners[ssh.FingerprintSHA256(key)]}
+			if k.backend == "" {
+				k.backend = "?"
+			}
+			_, err = a.Sign(key, data)
+		}
+
+		s.latencies[k] = append(s.latencies[k], time.Since(start))
+		if err != nil {
+			s.errors[k]++
+		}
+	}
+
+	return s, nil
+}
+
+// Merges the clients' samples into percentiles, sorted by op and backend.
+func benchResults(samples []benchSamples) []benchResult {
+	latencies := map[benchKey][]time.Duration{}
+	errs := map[benchKey]int{}
+	for _, s := range samples {
+		for k, l := range s.latencies {
+			latencies[k] = append(latencies[k], l...)
+		}
+		for k, n := range s.errors {
+			errs[k] += n
+		}
+	}
+
+	keys := slices.SortedFunc(maps.Keys(latencies), func(a, b benchKey) int {
+		return strings.Compare(a.op+"\x00"+a.backend, b.op+"\x00"+b.backend)
+	})
+
+	results := []benchResult{}
+	for _, k := range keys {
+		l := latencies[k]
+		slices.Sort(l)
+
+		results = append(results, benchResult{
+			Op:       k.op,
+			Backend:  k.backend,
+			Requests: len(l),
+			Errors:   errs[k],
+			P50:      percentile(l, 0.50),
+			P90:      percentile(l, 0.90),
+			P99:      percentile(l, 0.99),
+			Max:      percentile(l, 1),
+		})
+	}
+
+	return results
+}
+
+// Returns the pth percentile of the sorted latencies, in milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	i := max(int(math.Ceil(p*float64(len(sorted))))-1, 0)
+
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
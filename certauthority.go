@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type (
+	// A certificate authority issuing certificates for some backend keys.
+	// The public key is sent to the Vault SSH secrets engine sign endpoint
+	// given by Vault, posted to URL, or passed to Command.
+	certConfig struct {
+		// Fingerprints of the keys to certify
+		Keys       []string `json:"keys"`
+		Principals []string `json:"principals,omitempty"`
+
+		Vault   string   `json:"vault,omitempty"`
+		URL     string   `json:"url,omitempty"`
+		Command []string `json:"command,omitempty"`
+	}
+
+	// The certificates issued so far, by public key blob.
+	certCache struct {
+		mu     sync.Mutex
+		certs  map[string]issuedCert
+		failed map[string]time.Time
+	}
+
+	issuedCert struct {
+		cert *ssh.Certificate
+		ca   *certConfig
+		key  ssh.PublicKey
+	}
+)
+
+const (
+	// Certificates are fetched again this long before they expire
+	certRenewMargin = time.Minute
+
+	// How long to wait before asking again after a failure
+	certRetryDelay = time.Minute
+)
+
+var (
+	certConfigs []certConfig
+	issuedCerts certCache
+)
+
+func (c certConfig) validate() error {
+	if len(c.Keys) == 0 {
+		return errors.New("no keys")
+	}
+
+	n := 0
+	for _, set := range []bool{c.Vault != "", c.URL != "", len(c.Command) > 0} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("needs exactly one of vault, url or command")
+	}
+
+	return nil
+}
+
+// Returns the certificate authority for a key, nil if it has none.
+func certConfigFor(key ssh.PublicKey) *certConfig {
+	fp := ssh.FingerprintSHA256(key)
+
+	for i, c := range certConfigs {
+		if slices.Contains(c.Keys, fp) {
+			return &certConfigs[i]
+		}
+	}
+
+	return nil
+}
+
+// Appends the certificates issued for the listed keys, fetching those that
+// are missing or about to expire.
+func appendIssuedCerts(keys []*agent.Key) []*agent.Key {
+	if len(certConfigs) == 0 {
+		return keys
+	}
+
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+
+		c := certConfigFor(pub)
+		if c == nil {
+			continue
+		}
+
+		if cert := issuedCerts.get(c, pub); cert != nil {
+			keys = append(keys, &agent.Key{Format: cert.Type(), Blob: cert.Marshal(), Comment: k.Comment})
+		}
+	}
+
+	return keys
+}
+
+// Returns a valid certificate for the key, fetching a new one when needed.
+// Returns nil if none could be had.
+func (cc *certCache) get(c *certConfig, key ssh.PublicKey) *ssh.Certificate {
+	blob := string(key.Marshal())
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if ic, ok := cc.certs[blob]; ok && certValid(ic.cert, certRenewMargin) {
+		return ic.cert
+	}
+
+	if time.Since(cc.failed[blob]) < certRetryDelay {
+		return nil
+	}
+
+	cert, err := c.fetch(key)
+	if err != nil {
+		slog.Warn("certificate not issued", "fingerprint", ssh.FingerprintSHA256(key), "error", err)
+
+		if cc.failed == nil {
+			cc.failed = map[string]time.Time{}
+		}
+		cc.failed[blob] = time.Now()
+
+		return nil
+	}
+
+	if cc.certs == nil {
+		cc.certs = map[string]issuedCert{}
+	}
+	cc.certs[blob] = issuedCert{cert: cert, ca: c, key: key}
+	delete(cc.failed, blob)
+
+	slog.Info("certificate issued", "fingerprint", ssh.FingerprintSHA256(key), "serial", cert.Serial, "valid_before", certExpiry(cert))
+
+	return cert
+}
+
+// Reports whether a certificate is still valid for at least margin.
+func certValid(cert *ssh.Certificate, margin time.Duration) bool {
+	return cert.ValidBefore == ssh.CertTimeInfinity || time.Now().Add(margin).Before(certExpiry(cert))
+}
+
+func certExpiry(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(cert.ValidBefore), 0)
+}
+
+// Asks the certificate authority for a certificate of the key.
+func (c *certConfig) fetch(key ssh.PublicKey) (*ssh.Certificate, error) {
+	pubLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+
+	var signed string
+
+	switch {
+	case c.Vault != "":
+		token, err := vaultToken()
+		if err != nil {
+			return nil, err
+		}
+
+		header := http.Header{"X-Vault-Token": {token}}
+		if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+			header.Set("X-Vault-Namespace", ns)
+		}
+
+		req := map[string]string{"public_key": pubLine, "cert_type": "user"}
+		if len(c.Principals) > 0 {
+			req["valid_principals"] = strings.Join(c.Principals, ",")
+		}
+
+		var res struct {
+			Data struct {
+				SignedKey string `json:"signed_key"`
+			} `json:"data"`
+		}
+		if err := httpJSON(http.DefaultClient, http.MethodPost, c.Vault, header, req, &res); err != nil {
+			return nil, err
+		}
+		signed = res.Data.SignedKey
+
+	case c.URL != "":
+		req := map[string]any{"public_key": pubLine, "principals": c.Principals}
+
+		var res struct {
+			Certificate string `json:"certificate"`
+		}
+		if err := httpJSON(http.DefaultClient, http.MethodPost, c.URL, nil, req, &res); err != nil {
+			return nil, err
+		}
+		signed = res.Certificate
+
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+		cmd.Env = append(os.Environ(), "SSH_CERT_PRINCIPALS="+strings.Join(c.Principals, ","))
+		cmd.Stdin = strings.NewReader(pubLine + "\n")
+
+		out, err := cmd.Output()
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%s: %w: %s", c.Command[0], err, bytes.TrimSpace(ee.Stderr))
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Command[0], err)
+		}
+		signed = string(out)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed))
+	if err != nil {
+		return nil, fmt.Errorf("bad certificate: %w", err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || !bytes.Equal(cert.Key.Marshal(), key.Marshal()) {
+		return nil, errors.New("not a certificate of the key")
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var certExpiryWarning = flag.Duration("cert-expiry-warning", 7*24*time.Hour, "warn about listed certificates expiring within this long, 0 to never")
+
+// How often the listed certificates are checked for expiry. Listing dials
+// every backend, so this is much rarer than renewal checks.
+const certExpiryCheckInterval = 5 * time.Minute
+
+// A listed certificate, as last checked.
+type certExpiryInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Backend     string    `json:"backend"`
+	KeyID       string    `json:"key_id"`
+	ValidBefore time.Time `json:"valid_before"`
+}
+
+var certExpiries struct {
+	mu    sync.Mutex
+	certs []certExpiryInfo
+
+	// What was last warned about each certificate, by fingerprint:
+	// "expiring" or "expired"
+	warned map[string]string
+}
+
+// Checks the listed certificates for expiry until ctx is done, warning once
+// about each that comes within --cert-expiry-warning of expiring and again
+// once it has expired. Expired certificates make servers refuse the key
+// with no hint as to why.
+func (r *proxyKeyring) watchCertExpiry(ctx context.Context) {
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		r.checkCertExpiry()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *proxyKeyring) checkCertExpiry() {
+	keys, err := r.Keys()
+	if err != nil {
+		// Locked, nothing can be listed
+		return
+	}
+
+	var certs []certExpiryInfo
+	for _, k := range keys {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey))
+		if err != nil {
+			continue
+		}
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok || cert.ValidBefore == ssh.CertTimeInfinity {
+			continue
+		}
+
+		certs = append(certs, certExpiryInfo{Fingerprint: k.Fingerprint, Backend: k.Backend, KeyID: cert.KeyId, ValidBefore: certExpiry(cert)})
+	}
+
+	certExpiries.mu.Lock()
+	defer certExpiries.mu.Unlock()
+
+	certExpiries.certs = certs
+	if certExpiries.warned == nil {
+		certExpiries.warned = map[string]string{}
+	}
+
+	for _, c := range certs {
+		left := time.Until(c.ValidBefore)
+
+		state := ""
+		switch {
+		case left <= 0:
+			state = "expired"
+		case left < *certExpiryWarning:
+			state = "expiring"
+		}
+
+		if state == "" || certExpiries.warned[c.Fingerprint] == state {
+			continue
+		}
+		certExpiries.warned[c.Fingerprint] = state
+
+		if state == "expired" {
+			slog.Warn("certificate expired", "fingerprint", c.Fingerprint, "backend", c.Backend, "key_id", c.KeyID, "valid_before", c.ValidBefore)
+			desktopNotify("SSH certificate expired", fmt.Sprintf("%s (%s) expired at %s", c.KeyID, c.Backend, c.ValidBefore.Local().Format(time.DateTime)))
+		} else {
+			slog.Warn("certificate expiring soon", "fingerprint", c.Fingerprint, "backend", c.Backend, "key_id", c.KeyID, "valid_before", c.ValidBefore, "left", left.Round(time.Minute))
+			desktopNotify("SSH certificate expiring", fmt.Sprintf("%s (%s) expires at %s", c.KeyID, c.Backend, c.ValidBefore.Local().Format(time.DateTime)))
+		}
+	}
+
+	// Certificates gone or renewed may be warned about again
+	for fp := range certExpiries.warned {
+		if !slices.ContainsFunc(certs, func(c certExpiryInfo) bool {
+			return c.Fingerprint == fp && time.Until(c.ValidBefore) < *certExpiryWarning
+		}) {
+			delete(certExpiries.warned, fp)
+		}
+	}
+}
+
+// Returns the listed certificates as last checked, soonest to expire first.
+func listedCertExpiries() []certExpiryInfo {
+	certExpiries.mu.Lock()
+	defer certExpiries.mu.Unlock()
+
+	certs := slices.Clone(certExpiries.certs)
+	slices.SortFunc(certs, func(a, b certExpiryInfo) int {
+		return cmp.Or(a.ValidBefore.Compare(b.ValidBefore), strings.Compare(a.Fingerprint, b.Fingerprint))
+	})
+
+	return certs
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// How often certificates are checked for renewal
+const certCheckInterval = 30 * time.Second
+
+// A key file loaded with a certificate, whose -cert.pub file is read again
+// when the certificate nears its expiry.
+type keyFileCert struct {
+	path string
+	key  agent.AddedKey
+}
+
+var (
+	keyFileCertsMu sync.Mutex
+	keyFileCerts   []*keyFileCert
+)
+
+// Reports whether a certificate is in the last fifth of its validity, or
+// closer than certRenewMargin to its expiry.
+func renewDue(cert *ssh.Certificate) bool {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return false
+	}
+
+	lifetime := time.Duration(cert.ValidBefore-min(cert.ValidAfter, cert.ValidBefore)) * time.Second
+
+	return time.Until(certExpiry(cert)) < max(lifetime/5, certRenewMargin)
+}
+
+// Notes a key file whose certificate is to be renewed.
+func watchKeyFileCert(path string, key agent.AddedKey) {
+	keyFileCertsMu.Lock()
+	defer keyFileCertsMu.Unlock()
+
+	keyFileCerts = append(keyFileCerts, &keyFileCert{path: path, key: key})
+}
+
+// Renews certificates before they expire, until ctx is done: those issued
+// by a CA are fetched anew, those of key files are read again from their
+// -cert.pub files once something else replaced them. Listings carry on
+// with the old certificate until the new one is in place.
+func (r *proxyKeyring) renewCerts(ctx context.Context) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if issuedCerts.renew() || r.reloadKeyFileCerts() {
+			r.cache.invalidate()
+		}
+	}
+}
+
+// Fetches new certificates for those due for renewal, reporting whether any
+// was replaced.
+func (cc *certCache) renew() bool {
+	var due []issuedCert
+
+	cc.mu.Lock()
+	for _, ic := range cc.certs {
+		if renewDue(ic.cert) {
+			due = append(due, ic)
+		}
+	}
+	cc.mu.Unlock()
+
+	renewed := false
+
+	for _, ic := range due {
+		cert, err := ic.ca.fetch(ic.key)
+		if err != nil {
+			slog.Warn("certificate not renewed", "fingerprint", ssh.FingerprintSHA256(ic.key), "valid_before", certExpiry(ic.cert), "error", err)
+			continue
+		}
+
+		cc.mu.Lock()
+		cc.certs[string(ic.key.Marshal())] = issuedCert{cert: cert, ca: ic.ca, key: ic.key}
+		cc.mu.Unlock()
+
+		slog.Info("certificate renewed", "fingerprint", ssh.FingerprintSHA256(ic.key), "serial", cert.Serial, "valid_before", certExpiry(cert))
+		renewed = true
+	}
+
+	return renewed
+}
+
+// Loads the certificates of key files that were replaced on disk since
+// they were loaded, once the loaded ones are due for renewal. Reports
+// whether any was replaced.
+func (r *proxyKeyring) reloadKeyFileCerts() bool {
+	keyFileCertsMu.Lock()
+	defer keyFileCertsMu.Unlock()
+
+	reloaded := false
+
+	for _, kf := range keyFileCerts {
+		old := kf.key.Certificate
+		if !renewDue(old) {
+			continue
+		}
+
+		raw, err := os.ReadFile(kf.path + "-cert.pub")
+		if err != nil {
+			slog.Warn("certificate not renewed", "file", kf.path, "error", err)
+			continue
+		}
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(raw)
+		cert, ok := pub.(*ssh.Certificate)
+		if err != nil || !ok || string(cert.Marshal()) == string(old.Marshal()) {
+			slog.Debug("certificate file not renewed yet", "file", kf.path, "valid_before", certExpiry(old))
+			continue
+		}
+
+		key := kf.key
+		key.Certificate = cert
+
+		if err := r.replaceInternal(old, key); err != nil {
+			slog.Warn("certificate not renewed", "file", kf.path, "error", err)
+			continue
+		}
+
+		kf.key = key
+		slog.Info("certificate renewed", "file", kf.path, "serial", cert.Serial, "valid_before", certExpiry(cert))
+		reloaded = true
+	}
+
+	return reloaded
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var listCerts = flag.String("list-certs", "all", "how to list keys that have a certificate: all (key and certificate), first (certificates ahead of plain keys) or only (the certificate alone)")
+
+// Checks --list-certs.
+func setupListCerts() error {
+	switch *listCerts {
+	case "all", "first", "only":
+		return nil
+	default:
+		return fmt.Errorf("bad --list-certs %q, must be all, first or only", *listCerts)
+	}
+}
+
+// Returns the key a listed certificate certifies, nil for plain keys.
+func certifiedKey(k *agent.Key) []byte {
+	pub, err := ssh.ParsePublicKey(k.Blob)
+	if err != nil {
+		return nil
+	}
+
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		return cert.Key.Marshal()
+	}
+
+	return nil
+}
+
+// Pairs certificates with the plain keys they certify, whichever backends
+// they come from, and orders or hides them according to --list-certs.
+func arrangeCerts(keys []*agent.Key) []*agent.Key {
+	switch *listCerts {
+	case "first":
+		slices.SortStableFunc(keys, func(a, b *agent.Key) int {
+			switch {
+			case certifiedKey(a) != nil && certifiedKey(b) == nil:
+				return -1
+			case certifiedKey(a) == nil && certifiedKey(b) != nil:
+				return 1
+			default:
+				return 0
+			}
+		})
+
+	case "only":
+		var certified [][]byte
+		for _, k := range keys {
+			if key := certifiedKey(k); key != nil {
+				certified = append(certified, key)
+			}
+		}
+
+		keys = slices.DeleteFunc(keys, func(k *agent.Key) bool {
+			return slices.ContainsFunc(certified, func(key []byte) bool { return bytes.Equal(key, k.Blob) })
+		})
+	}
+
+	return keys
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type subcommand func(args []string) error
+
+// Client subcommands, dispatched on the first command line argument.
+var subcommands = map[string]subcommand{
+	"backends":    cmdBackends,
+	"status":      cmdStatus,
+	"install":     cmdInstall,
+	"keys":        cmdKeys,
+	"lock":        cmdPlain("lock"),
+	"unlock":      cmdPlain("unlock"),
+	"flush-cache": cmdPlain("flush-cache"),
+	"shutdown":    cmdPlain("shutdown"),
+}
+
+// Flags shared by every subcommand talking to a running proxy.
+type clientFlags struct {
+	adminSocket string
+	json        bool
+}
+
+func newClientFlags(name string) (*flag.FlagSet, *clientFlags) {
+	cf := &clientFlags{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&cf.adminSocket, "admin-socket", defaultAdminSocket(), "path of the admin control socket")
+	fs.BoolVar(&cf.json, "json", false, "print raw JSON instead of a table")
+	return fs, cf
+}
+
+// Sends a single request to the admin socket and decodes the reply data into out.
+func adminCall(socket, command string, args []string, out any) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("connecting to proxy: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if err := json.NewEncoder(conn).Encode(adminRequest{Command: command, Args: args}); err != nil {
+		return err
+	}
+
+	var res adminResponse
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return err
+	}
+
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+
+	if out != nil && res.Data != nil {
+		return json.Unmarshal(res.Data, out)
+	}
+
+	return nil
+}
+
+// Formats how long ago t was, for status tables.
+func sinceString(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return time.Since(t).Round(time.Second).String()
+}
+
+// Sums up the backend's status in a word, for status tables.
+func (b backendStatus) state() string {
+	switch {
+	case b.Disabled:
+		return "disabled"
+	case b.Quarantined != "":
+		return "quarantined"
+	case b.Locked:
+		return "locked"
+	case b.Up:
+		return "up"
+	default:
+		return "down"
+	}
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func cmdBackends(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: backends list|add|remove|enable|disable [flags] [backend]")
+	}
+
+	fs, cf := newClientFlags("backends " + args[0])
+	_ = fs.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		var backends []backendStatus
+		if err := adminCall(cf.adminSocket, "list-backends", nil, &backends); err != nil {
+			return err
+		}
+
+		if cf.json {
+			return printJSON(backends)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "NAME\tSOCKET\tSTATUS\tSINCE\tKEYS\tERROR")
+		for _, b := range backends {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", b.Name, b.Socket, b.state(), sinceString(b.Since), b.Keys, b.Error)
+		}
+		return tw.Flush()
+
+	case "add", "remove", "enable", "disable":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: backends %s [flags] <backend>", args[0])
+		}
+		return adminCall(cf.adminSocket, args[0]+"-backend", fs.Args(), nil)
+
+	default:
+		return fmt.Errorf("unknown backends command %q", args[0])
+	}
+}
+
+func cmdKeys(args []string) error {
+	fs, cf := newClientFlags("keys")
+	_ = fs.Parse(args)
+
+	var keys []keyInfo
+	if err := adminCall(cf.adminSocket, "list-keys", nil, &keys); err != nil {
+		return err
+	}
+
+	if cf.json {
+		return printJSON(keys)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TYPE\tFINGERPRINT\tCOMMENT\tBACKEND\tSIGNATURES\tLAST USED")
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", k.Type, k.Fingerprint, k.Comment, k.Backend, k.Signatures, sinceString(k.LastUsed))
+	}
+	return tw.Flush()
+}
+
+func cmdStatus(args []string) error {
+	fs, cf := newClientFlags("status")
+	_ = fs.Parse(args)
+
+	var st proxyStatus
+	if err := adminCall(cf.adminSocket, "status", nil, &st); err != nil {
+		return err
+	}
+
+	if cf.json {
+		return printJSON(st)
+	}
+
+	fmt.Printf("socket:   %s\n", st.Socket)
+	fmt.Printf("locked:   %t\n", st.Locked)
+	fmt.Printf("backends: %d/%d up\n", st.BackendsUp, st.Backends)
+	fmt.Printf("clients:  %d (peak %d)\n", st.Clients, st.PeakClients)
+
+	if len(st.Latencies) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "BACKEND\tOP\tREQUESTS\tMEAN\tP50\tP90\tP99")
+	for _, l := range st.Latencies {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%.1fms\t%.1fms\t%.1fms\t%.1fms\n", l.Backend, l.Op, l.Count, l.Mean, l.P50, l.P90, l.P99)
+	}
+	return tw.Flush()
+}
+
+// Returns the subcommand sending an admin command that takes no arguments
+// and returns nothing, such as lock.
+func cmdPlain(command string) subcommand {
+	return func(args []string) error {
+		fs, cf := newClientFlags(command)
+		_ = fs.Parse(args)
+
+		return adminCall(cf.adminSocket, command, nil, nil)
+	}
+}
+
+// Runs the subcommand named by the first argument, if there is one.
+func runSubcommand(args []string) bool {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		return false
+	}
+
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return false
+	}
+
+	if err := cmd(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+
+	return true
+}
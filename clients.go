@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxClients     = flag.Int("max-clients", 0, "maximum number of concurrent client connections, 0 for no limit")
+	maxClientsWait = flag.Duration("max-clients-wait", 0, "how long a connection beyond --max-clients waits for a free slot before being closed, 0 to close it at once")
+
+	clientIdleTimeout = flag.Duration("client-idle-timeout", 0, "close client connections idle for this long, 0 to keep them open")
+
+	clientSlots chan struct{}
+
+	clientCount atomic.Int64
+	clientPeak  atomic.Int64
+)
+
+// Sets up the client connection cap according to the flags.
+func setupClientLimit() {
+	if *maxClients > 0 {
+		clientSlots = make(chan struct{}, *maxClients)
+	}
+}
+
+// Claims a connection slot, waiting up to --max-clients-wait for one to free
+// up. Returns false if none did; otherwise releaseClient must be called when
+// the connection is done.
+func acquireClient() bool {
+	if clientSlots != nil {
+		select {
+		case clientSlots <- struct{}{}:
+		default:
+			if *maxClientsWait <= 0 {
+				return false
+			}
+
+			timer := time.NewTimer(*maxClientsWait)
+			defer timer.Stop()
+
+			select {
+			case clientSlots <- struct{}{}:
+			case <-timer.C:
+				return false
+			}
+		}
+	}
+
+	n := clientCount.Add(1)
+	for {
+		peak := clientPeak.Load()
+		if n <= peak || clientPeak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+
+	return true
+}
+
+func releaseClient() {
+	clientCount.Add(-1)
+
+	if clientSlots != nil {
+		<-clientSlots
+	}
+}
+
+// A client connection that times out when no request arrives within
+// timeout. The deadline is only armed between a reply and the next request,
+// so slow signatures don't count as idle time even though the connection is
+// read ahead.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+	return &idleConn{Conn: conn, timeout: timeout}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(p)
+}
+
+// A client connection read ahead by a goroutine, so that a client hanging up
+// is noticed while its request is still being handled.
+type watchedConn struct {
+	*io.PipeReader
+	io.Writer
+}
+
+// Starts reading ahead on conn, calling cancel as soon as the connection is
+// closed or fails. The returned connection must be closed to stop the
+// goroutine.
+func watchConn(conn io.ReadWriter, cancel context.CancelFunc) *watchedConn {
+	pr, pw := io.Pipe()
+
+	go func() {
+		_, err := io.Copy(pw, conn)
+		cancel()
+		_ = pw.CloseWithError(err)
+	}()
+
+	return &watchedConn{PipeReader: pr, Writer: conn}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// What the arguments of a subcommand complete to
+const (
+	argFiles    = "files"
+	argBackends = "backends"
+)
+
+// How the words after a subcommand complete: one of its actions first, if
+// it has any, then its flags and arguments, the latter by action ("" when
+// it has none). Subcommands taking the proxy's flags set proxyFlags.
+type completionSpec struct {
+	actions    []string
+	flags      []string
+	proxyFlags bool
+	args       map[string]string
+}
+
+func (spec completionSpec) flagNames() []string {
+	if spec.proxyFlags {
+		return append(proxyFlagNames(), spec.flags...)
+	}
+
+	return spec.flags
+}
+
+var completionSpecs = map[string]completionSpec{
+	"backends": {
+		actions: []string{"list", "add", "remove", "enable", "disable"},
+		flags:   clientFlagNames(),
+		args:    map[string]string{"add": argFiles, "remove": argBackends, "enable": argBackends, "disable": argBackends},
+	},
+	"status":          {flags: clientFlagNames()},
+	"keys":            {flags: clientFlagNames()},
+	"lock":            {flags: clientFlagNames()},
+	"unlock":          {flags: clientFlagNames()},
+	"flush-cache":     {flags: clientFlagNames()},
+	"shutdown":        {flags: clientFlagNames()},
+	"install":         {flags: []string{"systemd", "launchd", "write"}},
+	"completion":      {actions: []string{"bash", "zsh", "fish"}},
+	"enclave":         {actions: []string{"generate", "list", "delete"}, flags: []string{"biometry"}},
+	"doctor":          {proxyFlags: true, args: map[string]string{"": argFiles}},
+	"conformance":     {flags: []string{"json", "read-only", "timeout"}, args: map[string]string{"": argFiles}},
+	"publish":         {flags: append(clientFlagNames(), "uid", "gid", "mode", "read-only", "backends", "target")},
+	"unpublish":       {flags: clientFlagNames()},
+	"tui":             {flags: append(clientFlagNames(), "interval")},
+	"dashboard":       {flags: clientFlagNames()},
+	"removals":        {actions: []string{"list", "approve", "reject"}, flags: clientFlagNames()},
+	"ssh-config":      {flags: append(clientFlagNames(), "socket", "config", "write")},
+	"verify-upstream": {flags: append(clientFlagNames(), "github", "gitlab", "github-url", "gitlab-url", "backend")},
+}
+
+func init() {
+	subcommands["completion"] = cmdCompletion
+}
+
+func proxyFlagNames() []string {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+
+	return names
+}
+
+func clientFlagNames() []string {
+	fs, _ := newClientFlags("")
+
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+
+	return names
+}
+
+// Flags whose value completes to a file name
+var pathFlags = []string{"admin-socket", "config", "dashboard-token-file", "grpc-socket", "key", "keyring-file", "keyring-identity", "log-file", "publish-dir", "read-only-socket", "socket", "symlink", "usage-file"}
+
+// A flag of the proxy or its subcommands, as far as completion cares.
+type completionFlag struct {
+	name  string
+	usage string
+	value bool
+	path  bool
+}
+
+// Returns the proxy's flags followed by those of the client subcommands.
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+
+	add := func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		value := !ok || !b.IsBoolFlag()
+
+		flags = append(flags, completionFlag{
+			name:  f.Name,
+			usage: f.Usage,
+			value: value,
+			path:  value && slices.Contains(pathFlags, f.Name),
+		})
+	}
+
+	flag.VisitAll(add)
+
+	fs, _ := newClientFlags("")
+	fs.VisitAll(func(f *flag.Flag) {
+		if flag.Lookup(f.Name) == nil {
+			add(f)
+		}
+	})
+
+	return flags
+}
+
+// Prints a completion script for the shell named by the argument.
+func cmdCompletion(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: completion bash|zsh|fish")
+	}
+
+	var commands []string
+	for _, name := range slices.Sorted(maps.Keys(subcommands)) {
+		commands = append(commands, name)
+	}
+
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion(commands))
+	case "zsh":
+		fmt.Print(zshCompletion(commands))
+	case "fish":
+		fmt.Print(fishCompletion(commands))
+	default:
+		return fmt.Errorf("unknown shell %q", args[0])
+	}
+
+	return nil
+}
+
+// Lists the running proxy's backends, one name per line
+const backendNamesCommand = `ssh-agent-proxy backends list 2>/dev/null | awk 'NR > 1 { print $1 }'`
+
+// Returns the flags that take a path and those that take some other value,
+// as shell case patterns.
+func flagPatterns() (paths, values string) {
+	var p, v []string
+
+	for _, f := range completionFlags() {
+		switch {
+		case f.path:
+			p = append(p, "-"+f.name, "--"+f.name)
+		case f.value:
+			v = append(v, "-"+f.name, "--"+f.name)
+		}
+	}
+
+	return strings.Join(p, "|"), strings.Join(v, "|")
+}
+
+func dashed(names []string) string {
+	var words []string
+	for _, name := range names {
+		words = append(words, "--"+name)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Returns the actions of a subcommand that complete to args, as a case
+// pattern.
+func actionsFor(spec completionSpec, args string) string {
+	var actions []string
+	for _, action := range spec.actions {
+		if spec.args[action] == args {
+			actions = append(actions, action)
+		}
+	}
+
+	return strings.Join(actions, "|")
+}
+
+func bashCompletion(commands []string) string {
+	paths, values := flagPatterns()
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `# bash completion for ssh-agent-proxy, from "ssh-agent-proxy completion bash"
+
+_ssh_agent_proxy_backends() {
+	%s
+}
+
+_ssh_agent_proxy() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	COMPREPLY=()
+
+	case $prev in
+	%s)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+		;;
+	%s)
+		return
+		;;
+	esac
+
+	case ${COMP_WORDS[1]} in
+`, backendNamesCommand, paths, values)
+
+	for _, name := range commands {
+		spec := completionSpecs[name]
+
+		var branches []string
+		if len(spec.actions) > 0 {
+			branches = append(branches, "[[ $COMP_CWORD -eq 2 ]]", fmt.Sprintf("COMPREPLY=($(compgen -W %q -- \"$cur\"))", strings.Join(spec.actions, " ")))
+		}
+		if flags := spec.flagNames(); len(flags) > 0 {
+			branches = append(branches, "[[ $cur == -* ]]", fmt.Sprintf("COMPREPLY=($(compgen -W %q -- \"$cur\"))", dashed(flags)))
+		}
+		if files := actionsFor(spec, argFiles); files != "" {
+			branches = append(branches, fmt.Sprintf("[[ ${COMP_WORDS[2]} == @(%s) ]]", files), `COMPREPLY=($(compgen -f -- "$cur"))`)
+		}
+		if backends := actionsFor(spec, argBackends); backends != "" {
+			branches = append(branches, fmt.Sprintf("[[ ${COMP_WORDS[2]} == @(%s) ]]", backends), `COMPREPLY=($(compgen -W "$(_ssh_agent_proxy_backends)" -- "$cur"))`)
+		}
+		if spec.args[""] == argFiles {
+			branches = append(branches, "", `COMPREPLY=($(compgen -f -- "$cur"))`)
+		}
+
+		fmt.Fprintf(&b, "\t%s)\n%s\t\treturn\n\t\t;;\n", name, ifChain(branches))
+	}
+
+	fmt.Fprintf(&b, `	esac
+
+	# The proxy itself, taking backends after its flags
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	elif [[ $COMP_CWORD -eq 1 ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur") $(compgen -f -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+
+complete -o filenames -F _ssh_agent_proxy ssh-agent-proxy
+`, dashed(proxyFlagNames()), strings.Join(commands, " "))
+
+	return b.String()
+}
+
+func zshCompletion(commands []string) string {
+	paths, values := flagPatterns()
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `#compdef ssh-agent-proxy
+# zsh completion for ssh-agent-proxy, from "ssh-agent-proxy completion zsh"
+
+_ssh_agent_proxy_backends() {
+	local -a names
+	names=(${(f)"$(%s)"})
+	compadd -a names
+}
+
+_ssh_agent_proxy() {
+	local cur=${words[CURRENT]} prev=${words[CURRENT-1]}
+
+	case $prev in
+	(%s)
+		_files
+		return
+		;;
+	(%s)
+		return
+		;;
+	esac
+
+	case ${words[2]} in
+`, backendNamesCommand, paths, values)
+
+	for _, name := range commands {
+		spec := completionSpecs[name]
+
+		var branches []string
+		if len(spec.actions) > 0 {
+			branches = append(branches, "(( CURRENT == 3 ))", "compadd -- "+strings.Join(spec.actions, " "))
+		}
+		if flags := spec.flagNames(); len(flags) > 0 {
+			branches = append(branches, "[[ $cur == -* ]]", "compadd -- "+dashed(flags))
+		}
+		if files := actionsFor(spec, argFiles); files != "" {
+			branches = append(branches, fmt.Sprintf("[[ ${words[3]} == (%s) ]]", files), "_files")
+		}
+		if backends := actionsFor(spec, argBackends); backends != "" {
+			branches = append(branches, fmt.Sprintf("[[ ${words[3]} == (%s) ]]", backends), "_ssh_agent_proxy_backends")
+		}
+		if spec.args[""] == argFiles {
+			branches = append(branches, "", "_files")
+		}
+
+		fmt.Fprintf(&b, "\t(%s)\n%s\t\t;;\n", name, ifChain(branches))
+	}
+
+	fmt.Fprintf(&b, `	(*)
+		# The proxy itself, taking backends after its flags
+		if [[ $cur == -* ]]; then
+			compadd -- %s
+		elif (( CURRENT == 2 )); then
+			compadd -- %s
+			_files
+		else
+			_files
+		fi
+		;;
+	esac
+}
+
+if [[ $funcstack[1] == _ssh_agent_proxy ]]; then
+	_ssh_agent_proxy "$@"
+else
+	compdef _ssh_agent_proxy ssh-agent-proxy
+fi
+`, dashed(proxyFlagNames()), strings.Join(commands, " "))
+
+	return b.String()
+}
+
+func fishCompletion(commands []string) string {
+	var b strings.Builder
+
+	b.WriteString(`# fish completion for ssh-agent-proxy, from "ssh-agent-proxy completion fish"
+
+function __ssh_agent_proxy_backends
+	` + backendNamesCommand + `
+end
+
+`)
+
+	all := strings.Join(commands, " ")
+	noCommand := fmt.Sprintf("not __fish_seen_subcommand_from %s", all)
+
+	fmt.Fprintf(&b, "complete -c ssh-agent-proxy -n %s -f -a %s\n", fishQuote("__fish_use_subcommand"), fishQuote(all))
+
+	for _, f := range completionFlags() {
+		if flag.Lookup(f.name) == nil {
+			continue
+		}
+
+		fmt.Fprintf(&b, "complete -c ssh-agent-proxy -n %s %s%s -d %s\n", fishQuote(noCommand), fishFlag(f.name), fishValue(f), fishQuote(f.usage))
+	}
+
+	byName := map[string]completionFlag{}
+	for _, f := range completionFlags() {
+		byName[f.name] = f
+	}
+
+	for _, name := range commands {
+		spec := completionSpecs[name]
+		seen := "__fish_seen_subcommand_from " + name
+
+		// Files only complete where asked for
+		b.WriteString("\n")
+		if spec.args[""] != argFiles {
+			noFiles := seen
+			if files := actionsFor(spec, argFiles); files != "" {
+				noFiles += "; and not __fish_seen_subcommand_from " + strings.ReplaceAll(files, "|", " ")
+			}
+			fmt.Fprintf(&b, "complete -c ssh-agent-proxy -n %s -f\n", fishQuote(noFiles))
+		}
+
+		if len(spec.actions) > 0 {
+			actions := strings.Join(spec.actions, " ")
+			fmt.Fprintf(&b, "complete -c ssh-agent-proxy -n %s -a %s\n", fishQuote(seen+"; and not __fish_seen_subcommand_from "+actions), fishQuote(actions))
+		}
+
+		for _, flagName := range spec.flagNames() {
+			f, ok := byName[flagName]
+			if !ok {
+				f = completionFlag{name: flagName}
+			}
+			fmt.Fprintf(&b, "complete -c ssh-agent-proxy -n %s %s%s", fishQuote(seen), fishFlag(f.name), fishValue(f))
+			if f.usage != "" {
+				fmt.Fprintf(&b, " -d %s", fishQuote(f.usage))
+			}
+			b.WriteString("\n")
+		}
+
+		if backends := actionsFor(spec, argBackends); backends != "" {
+			fmt.Fprintf(&b, "complete -c ssh-agent-proxy -n %s -a '(__ssh_agent_proxy_backends)'\n", fishQuote(seen+"; and __fish_seen_subcommand_from "+strings.ReplaceAll(backends, "|", " ")))
+		}
+	}
+
+	return b.String()
+}
+
+// Returns an if statement taking the first branch whose condition holds,
+// given as pairs of conditions and commands, an empty condition making the
+// last an else. Bash and zsh share the syntax.
+func ifChain(branches []string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(branches); i += 2 {
+		switch {
+		case branches[i] == "" && i == 0:
+			fmt.Fprintf(&b, "\t\t%s\n", branches[i+1])
+			return b.String()
+		case branches[i] == "":
+			fmt.Fprintf(&b, "\t\telse\n\t\t\t%s\n", branches[i+1])
+		case i == 0:
+			fmt.Fprintf(&b, "\t\tif %s; then\n\t\t\t%s\n", branches[i], branches[i+1])
+		default:
+			fmt.Fprintf(&b, "\t\telif %s; then\n\t\t\t%s\n", branches[i], branches[i+1])
+		}
+	}
+	if b.Len() > 0 {
+		b.WriteString("\t\tfi\n")
+	}
+
+	return b.String()
+}
+
+// Returns the option naming a flag: single letter ones are completed with
+// one dash, like -c, the others with two.
+func fishFlag(name string) string {
+	if len(name) == 1 {
+		return "-s " + name
+	}
+
+	return "-l " + name
+}
+
+// Returns the options completing a flag's value.
+func fishValue(f completionFlag) string {
+	switch {
+	case f.path:
+		return " -r -F"
+	case f.value:
+		return " -x"
+	default:
+		return ""
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type (
+	// The JSON config file. Backends given on the command line are added
+	// after the ones listed here.
+	proxyConfig struct {
+		Backends     []backendConfig   `json:"backends"`
+		Destinations []destinationRule `json:"destinations,omitempty"`
+		Policy       []policyRule      `json:"policy,omitempty"`
+		Quotas       []signQuota       `json:"quotas,omitempty"`
+		Recording    *recordingConfig  `json:"recording,omitempty"`
+		Hooks        []hookConfig      `json:"hooks,omitempty"`
+		Certificates []certConfig      `json:"certificates,omitempty"`
+		Users        []userView        `json:"users,omitempty"`
+		Listeners    []listenerConfig  `json:"listeners,omitempty"`
+		Programs     []programPin      `json:"programs,omitempty"`
+		WeakKeys     *weakKeyPolicy    `json:"weak_keys,omitempty"`
+
+		// The profile active at startup, if any
+		Profiles []profile `json:"profiles,omitempty"`
+		Profile  string    `json:"profile,omitempty"`
+	}
+
+	backendConfig struct {
+		Name   string `json:"name,omitempty"`
+		Socket string `json:"socket"`
+
+		// Backends with a higher priority are asked first, and their keys
+		// listed first
+		Priority int `json:"priority,omitempty"`
+
+		// Only keys whose comments match this regular expression are used
+		Expose string `json:"expose,omitempty"`
+
+		// Backends sharing a group stand in for each other: the later ones
+		// are only asked when the earlier ones are down or lack the key
+		Group string `json:"group,omitempty"`
+
+		// The agent to run on Socket, restarted when it dies and given
+		// the key files in Keys and the keys added to it again
+		Command []string `json:"command,omitempty"`
+		Keys    []string `json:"keys,omitempty"`
+	}
+)
+
+var (
+	configFile = flag.String("config", defaultConfigFile(), "path of the JSON config file")
+
+	backendNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// Returns the config file used when none is given on the command line.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "ssh-agent-proxy", "config.json")
+}
+
+// Reads the config file. A missing file is only an error when it was asked
+// for explicitly.
+func loadConfig(path string) (*proxyConfig, error) {
+	cfg := &proxyConfig{}
+
+	if path == "" {
+		return cfg, nil
+	}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !flagGiven("config") {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(buf)))
+	dec.DisallowUnknownFields()
+
+	// An empty file is as good as none
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, b := range cfg.Backends {
+		if b.Socket == "" {
+			return nil, fmt.Errorf("%s: backend %d has no socket", path, i+1)
+		}
+		if b.Name != "" && !backendNameRe.MatchString(b.Name) {
+			return nil, fmt.Errorf("%s: bad backend name %q", path, b.Name)
+		}
+		if _, err := regexp.Compile(b.Expose); err != nil {
+			return nil, fmt.Errorf("%s: backend %d: bad expose pattern: %w", path, i+1, err)
+		}
+		if len(b.Command) > 0 && (b.Name == "" || !filepath.IsAbs(expandPath(b.Socket))) {
+			return nil, fmt.Errorf("%s: backend %d: a backend with a command needs a name and a socket path", path, i+1)
+		}
+		if len(b.Keys) > 0 && len(b.Command) == 0 {
+			return nil, fmt.Errorf("%s: backend %d: keys are only given to backends with a command", path, i+1)
+		}
+	}
+
+	for i, d := range cfg.Destinations {
+		if len(d.Hosts) == 0 && len(d.HostKeys) == 0 {
+			return nil, fmt.Errorf("%s: destination %d matches no hosts", path, i+1)
+		}
+	}
+
+	for i, rule := range cfg.Policy {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("%s: policy rule %d: %w", path, i+1, err)
+		}
+	}
+
+	for i := range cfg.Quotas {
+		if err := cfg.Quotas[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: quota %d: %w", path, i+1, err)
+		}
+	}
+
+	if cfg.Recording != nil {
+		if err := cfg.Recording.validate(); err != nil {
+			return nil, fmt.Errorf("%s: recording: %w", path, err)
+		}
+	}
+
+	for i, h := range cfg.Hooks {
+		if err := h.validate(); err != nil {
+			return nil, fmt.Errorf("%s: hook %d: %w", path, i+1, err)
+		}
+	}
+
+	for i, c := range cfg.Certificates {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("%s: certificate authority %d: %w", path, i+1, err)
+		}
+	}
+
+	for i, v := range cfg.Users {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("%s: user view %d: %w", path, i+1, err)
+		}
+	}
+
+	for i, p := range cfg.Profiles {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("%s: profile %d: %w", path, i+1, err)
+		}
+	}
+
+	for i, l := range cfg.Listeners {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("%s: listener %d: %w", path, i+1, err)
+		}
+	}
+
+	if cfg.WeakKeys != nil {
+		if err := cfg.WeakKeys.validate(); err != nil {
+			return nil, fmt.Errorf("%s: weak keys: %w", path, err)
+		}
+	}
+
+	for i, p := range cfg.Programs {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("%s: program %d: %w", path, i+1, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Parses a backend given on the command line or through the admin socket,
+// either a plain spec or name=spec.
+func parseBackendArg(arg string) backendConfig {
+	if name, spec, ok := strings.Cut(arg, "="); ok && backendNameRe.MatchString(name) {
+		return backendConfig{Name: name, Socket: spec}
+	}
+
+	return backendConfig{Socket: arg}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The comment of the throwaway keys conformance adds
+const conformanceComment = "ssh-agent-proxy conformance"
+
+// The outcome of one conformance check.
+type conformanceResult struct {
+	Check  string `json:"check"`
+	Result string `json:"result"` // ok, unsupported, failed or skipped
+	Detail string `json:"detail,omitempty"`
+}
+
+// Runs the conformance checks against one backend.
+type conformance struct {
+	spec     string
+	timeout  time.Duration
+	results  []conformanceResult
+	failures int
+
+	// The throwaway keys added, removed again at the end
+	added []ssh.PublicKey
+}
+
+func init() {
+	subcommands["conformance"] = cmdConformance
+}
+
+// Runs a battery of agent protocol requests against a backend and reports
+// which it supports, to tell why a backend misbehaves behind the proxy.
+// Unless --read-only, it adds, removes and locks with throwaway keys and
+// passphrases, undoing what it did.
+func cmdConformance(args []string) error {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print raw JSON instead of a table")
+	readOnly := fs.Bool("read-only", false, "only list and sign, leaving the backend's keys and lock alone")
+	timeout := fs.Duration("timeout", doctorTimeout, "how long each request may take; signing with a key that asks for confirmation counts")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: conformance [--json] [--read-only] [--timeout d] <backend>")
+	}
+
+	// Backends such as gpg: log as they are dialed
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	c := &conformance{spec: parseBackendArg(fs.Arg(0)).Socket, timeout: *timeout}
+	c.run(*readOnly)
+
+	if *asJSON {
+		if err := printJSON(c.results); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range c.results {
+			label := r.Result
+			if r.Result == "failed" {
+				label = "FAIL"
+			}
+			fmt.Printf("%-12s %-14s %s\n", label, r.Check, r.Detail)
+		}
+	}
+
+	if c.failures > 0 {
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+func (c *conformance) report(check, result, format string, args ...any) {
+	if result == "failed" {
+		c.failures++
+	}
+
+	c.results = append(c.results, conformanceResult{Check: check, Result: result, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Dials the backend for one check and hands a client to fn, reporting the
+// error if the backend can't be reached.
+func (c *conformance) with(check string, fn func(agent.ExtendedAgent)) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	conn, err := dialBackend(ctx, c.spec)
+	if err != nil {
+		c.report(check, "failed", "can't connect: %v", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	fn(agent.NewClient(conn))
+}
+
+func (c *conformance) run(readOnly bool) {
+	var keys []*agent.Key
+
+	c.with("list", func(a agent.ExtendedAgent) {
+		var err error
+		if keys, err = a.List(); err != nil {
+			c.report("list", "failed", "%v", err)
+			return
+		}
+
+		if len(keys) == 1 {
+			c.report("list", "ok", "1 key")
+		} else {
+			c.report("list", "ok", "%d keys", len(keys))
+		}
+	})
+	if len(c.results) > 0 && c.results[0].Result == "failed" {
+		// Nothing else can work
+		return
+	}
+
+	c.checkSign(keys)
+	c.checkUnknownExtension()
+	c.checkQueryExtension()
+
+	if readOnly {
+		for _, check := range []string{"add", "sign-added", "add-rsa", "rsa-sha2-256", "rsa-sha2-512", "lifetime", "confirm", "remove", "lock"} {
+			c.report(check, "skipped", "--read-only")
+		}
+		return
+	}
+
+	defer c.cleanUp()
+
+	c.checkAdd()
+	c.checkRSAFlags()
+	c.checkConstraint("lifetime", agent.AddedKey{LifetimeSecs: 600})
+	c.checkConstraint("confirm", agent.AddedKey{ConfirmBeforeUse: true})
+	c.checkRemove()
+	c.checkLock()
+}
+
+// Signs with the first key that needn't be touched, as ssh does.
+func (c *conformance) checkSign(keys []*agent.Key) {
+	var key *agent.Key
+	for _, k := range keys {
+		if !strings.HasPrefix(k.Type(), "sk-") {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		c.report("sign", "skipped", "no key to sign with without a touch")
+		return
+	}
+
+	// Certificates sign in the format of their key
+	pub, err := ssh.ParsePublicKey(key.Marshal())
+	if err != nil {
+		c.report("sign", "failed", "listed key unreadable: %v", err)
+		return
+	}
+
+	c.with("sign", func(a agent.ExtendedAgent) {
+		c.sign(a, "sign", pub, 0)
+	})
+}
+
+// Signs with key, checking the signature is good and in the format the
+// flags ask for.
+func (c *conformance) sign(a agent.ExtendedAgent, check string, key ssh.PublicKey, flags agent.SignatureFlags) bool {
+	data := make([]byte, 32)
+	_, _ = rand.Read(data)
+
+	sig, err := a.SignWithFlags(key, data, flags)
+	if err != nil {
+		c.report(check, "failed", "%s: %v", ssh.FingerprintSHA256(key), err)
+		return false
+	}
+
+	if err := key.Verify(data, sig); err != nil {
+		c.report(check, "failed", "%s: bad %s signature: %v", ssh.FingerprintSHA256(key), sig.Format, err)
+		return false
+	}
+
+	want := key.Type()
+	switch {
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		want = ssh.KeyAlgoRSASHA256
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		want = ssh.KeyAlgoRSASHA512
+	}
+	if cert, ok := key.(*ssh.Certificate); ok && flags == 0 {
+		want = cert.Key.Type()
+	}
+	if sig.Format != want {
+		c.report(check, "unsupported", "%s: asked for %s, got %s", ssh.FingerprintSHA256(key), want, sig.Format)
+		return false
+	}
+
+	c.report(check, "ok", "%s, %s", ssh.FingerprintSHA256(key), sig.Format)
+
+	return true
+}
+
+// Sends an extension nobody knows: agents must refuse it and keep the
+// connection open, rather than hang up as some older ones do.
+func (c *conformance) checkUnknownExtension() {
+	c.with("extension", func(a agent.ExtendedAgent) {
+		_, err := a.Extension("conformance-probe@ssh-agent-proxy", nil)
+		if err == nil {
+			c.report("extension", "failed", "an unknown extension was answered with success")
+			return
+		}
+		if !errors.Is(err, agent.ErrExtensionUnsupported) {
+			c.report("extension", "failed", "unknown extension: %v", err)
+			return
+		}
+
+		if _, err := a.List(); err != nil {
+			c.report("extension", "failed", "connection unusable after an unknown extension: %v", err)
+			return
+		}
+
+		c.report("extension", "ok", "unknown extensions refused")
+	})
+}
+
+// Asks for the extensions the agent supports with the query extension of
+// draft-miller-ssh-agent.
+func (c *conformance) checkQueryExtension() {
+	c.with("query", func(a agent.ExtendedAgent) {
+		reply, err := a.Extension("query", nil)
+		if errors.Is(err, agent.ErrExtensionUnsupported) {
+			c.report("query", "unsupported", "the agent doesn't tell its extensions")
+			return
+		}
+		if err != nil {
+			c.report("query", "failed", "%v", err)
+			return
+		}
+
+		// SSH_AGENT_SUCCESS, then the names as strings
+		var names []string
+		rest := reply[min(1, len(reply)):]
+		for len(rest) > 0 {
+			var s struct {
+				Name string
+				Rest []byte `ssh:"rest"`
+			}
+			if err := ssh.Unmarshal(rest, &s); err != nil {
+				break
+			}
+			names = append(names, s.Name)
+			rest = s.Rest
+		}
+
+		c.report("query", "ok", "%s", strings.Join(names, ", "))
+	})
+}
+
+// Adds a throwaway key, which must be listed and sign.
+func (c *conformance) checkAdd() {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		c.report("add", "failed", "%v", err)
+		return
+	}
+
+	pub, ok := c.add("add", agent.AddedKey{PrivateKey: priv, Comment: conformanceComment})
+	if !ok {
+		c.report("sign-added", "skipped", "no key added")
+		return
+	}
+
+	c.with("sign-added", func(a agent.ExtendedAgent) {
+		c.sign(a, "sign-added", pub, 0)
+	})
+}
+
+// Adds a key, checking that it is listed afterwards, and reports the
+// outcome.
+func (c *conformance) add(check string, key agent.AddedKey) (ssh.PublicKey, bool) {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		c.report(check, "failed", "%v", err)
+		return nil, false
+	}
+	pub := signer.PublicKey()
+
+	var added bool
+	c.with(check, func(a agent.ExtendedAgent) {
+		if err := a.Add(key); err != nil {
+			c.report(check, "unsupported", "refused: %v", err)
+			return
+		}
+		c.added = append(c.added, pub)
+
+		if !c.listed(a, pub) {
+			c.report(check, "failed", "accepted, but not listed")
+			return
+		}
+
+		added = true
+		c.report(check, "ok", "%s", ssh.FingerprintSHA256(pub))
+	})
+
+	return pub, added
+}
+
+func (c *conformance) listed(a agent.ExtendedAgent, pub ssh.PublicKey) bool {
+	keys, err := a.List()
+	if err != nil {
+		return false
+	}
+
+	for _, k := range keys {
+		if string(k.Marshal()) == string(pub.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Signs with a throwaway RSA key asking for SHA-2 signatures, which ssh
+// needs for servers that refuse SHA-1.
+func (c *conformance) checkRSAFlags() {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		c.report("add-rsa", "failed", "%v", err)
+		return
+	}
+
+	pub, ok := c.add("add-rsa", agent.AddedKey{PrivateKey: priv, Comment: conformanceComment})
+	if !ok {
+		c.report("rsa-sha2-256", "skipped", "no RSA key added")
+		return
+	}
+
+	c.with("rsa-sha2-256", func(a agent.ExtendedAgent) {
+		if c.sign(a, "rsa-sha2-256", pub, agent.SignatureFlagRsaSha256) {
+			c.sign(a, "rsa-sha2-512", pub, agent.SignatureFlagRsaSha512)
+		}
+	})
+}
+
+// Adds a throwaway key with a constraint; the agent must either honor it
+// or refuse the key, never drop the constraint silently, which the client
+// can't tell.
+func (c *conformance) checkConstraint(check string, key agent.AddedKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		c.report(check, "failed", "%v", err)
+		return
+	}
+	key.PrivateKey, key.Comment = priv, conformanceComment
+
+	c.add(check, key)
+}
+
+// Removes a throwaway key, which must no longer be listed.
+func (c *conformance) checkRemove() {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		c.report("remove", "failed", "%v", err)
+		return
+	}
+	signer, _ := ssh.NewSignerFromKey(priv)
+	pub := signer.PublicKey()
+
+	c.with("remove", func(a agent.ExtendedAgent) {
+		if err := a.Add(agent.AddedKey{PrivateKey: priv, Comment: conformanceComment}); err != nil {
+			c.report("remove", "skipped", "no key added: %v", err)
+			return
+		}
+		c.added = append(c.added, pub)
+
+		if err := a.Remove(pub); err != nil {
+			c.report("remove", "failed", "%v", err)
+			return
+		}
+		if c.listed(a, pub) {
+			c.report("remove", "failed", "removed, but still listed")
+			return
+		}
+
+		c.report("remove", "ok", "%s", ssh.FingerprintSHA256(pub))
+	})
+}
+
+// Locks the agent with a random passphrase, checks it hides its keys, and
+// unlocks it again.
+func (c *conformance) checkLock() {
+	pass := make([]byte, 16)
+	_, _ = rand.Read(pass)
+	pass = []byte(fmt.Sprintf("%x", pass))
+
+	c.with("lock", func(a agent.ExtendedAgent) {
+		if err := a.Lock(pass); err != nil {
+			c.report("lock", "unsupported", "refused: %v", err)
+			return
+		}
+
+		// Whatever else happens, it mustn't be left locked
+		defer func() {
+			if err := a.Unlock(pass); err != nil {
+				c.report("unlock", "failed", "the agent is still locked, unlock it with ssh-add -X and this passphrase: %s (%v)", pass, err)
+				return
+			}
+			c.report("unlock", "ok", "unlocked")
+		}()
+
+		if keys, err := a.List(); err == nil && len(keys) > 0 {
+			c.report("lock", "failed", "locked, but still lists %d keys", len(keys))
+			return
+		}
+
+		c.report("lock", "ok", "keys hidden while locked")
+	})
+}
+
+// Removes the throwaway keys left behind, e.g. when a check failed.
+func (c *conformance) cleanUp() {
+	if len(c.added) == 0 {
+		return
+	}
+
+	c.with("clean-up", func(a agent.ExtendedAgent) {
+		for _, pub := range c.added {
+			if c.listed(a, pub) {
+				if err := a.Remove(pub); err != nil {
+					c.report("clean-up", "failed", "%s left in the agent: %v", ssh.FingerprintSHA256(pub), err)
+				}
+			}
+		}
+	})
+}
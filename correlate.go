@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// The IDs tying together the log lines and events of one client
+// connection, and of the request it is making: numbered from 1 since the
+// proxy started, and within the connection.
+type correlation struct {
+	conn    uint64
+	request atomic.Uint64
+}
+
+type correlationKey struct{}
+
+var lastConnID atomic.Uint64
+
+// Returns ctx carrying the IDs of a new client connection.
+func withCorrelation(ctx context.Context) (context.Context, *correlation) {
+	c := &correlation{conn: lastConnID.Add(1)}
+
+	return context.WithValue(ctx, correlationKey{}, c), c
+}
+
+// Returns the IDs ctx carries, nil outside client connections.
+func correlationOf(ctx context.Context) *correlation {
+	if ctx == nil {
+		return nil
+	}
+
+	c, _ := ctx.Value(correlationKey{}).(*correlation)
+
+	return c
+}
+
+// Moves on to the connection's next request, as the client sends it.
+func (c *correlation) next() {
+	if c == nil {
+		return
+	}
+
+	c.request.Add(1)
+}
+
+// Returns the connection and request IDs, 0 for a request before the
+// first.
+func (c *correlation) ids() (conn, request uint64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	return c.conn, c.request.Load()
+}
+
+// A slog.Handler adding the IDs the context carries to the records logged
+// with one, as conn and request.
+type correlatingHandler struct {
+	slog.Handler
+}
+
+func (h correlatingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if conn, request := correlationOf(ctx).ids(); conn != 0 {
+		rec = rec.Clone()
+		rec.AddAttrs(slog.Uint64("conn", conn))
+		if request != 0 {
+			rec.AddAttrs(slog.Uint64("request", request))
+		}
+	}
+
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h correlatingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return correlatingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h correlatingHandler) WithGroup(name string) slog.Handler {
+	return correlatingHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cygwin, and MSYS with it, emulates unix sockets with a file naming a TCP
+// port on localhost and a secret that clients prove they could read the
+// file with. Git for Windows' ssh and ssh-agent use them. Under WSL the
+// proxy can reach their agents and let them reach it.
+
+const cygwinCookie = "!<socket >"
+
+// The contents of an emulated socket file.
+type cygwinSocket struct {
+	port   int
+	secret [16]byte
+}
+
+func isCygwin(socket string) bool {
+	return strings.HasPrefix(socket, "cygwin:")
+}
+
+// Returns the path of the socket file of a cygwin:/path spec.
+func cygwinPath(socket string) string {
+	return expandPath(strings.TrimPrefix(strings.TrimPrefix(socket, "cygwin:"), "//"))
+}
+
+// Parses a socket file, e.g. "!<socket >49923 s 1A2B3C4D-5E6F7081-92A3B4C5-D6E7F809".
+func readCygwinSocket(path string) (cygwinSocket, error) {
+	var s cygwinSocket
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	rest, ok := bytes.CutPrefix(bytes.TrimRight(b, "\x00"), []byte(cygwinCookie))
+	if !ok {
+		return s, fmt.Errorf("%s is not a cygwin socket", path)
+	}
+
+	var kind byte
+	var words [4]uint32
+	if _, err := fmt.Sscanf(string(rest), "%d %c %08x-%08x-%08x-%08x", &s.port, &kind, &words[0], &words[1], &words[2], &words[3]); err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if kind != 's' {
+		return s, fmt.Errorf("%s is not a stream socket", path)
+	}
+
+	// Sent as the four ints in the sender's byte order, little-endian
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(s.secret[4*i:], w)
+	}
+
+	return s, nil
+}
+
+func (s cygwinSocket) String() string {
+	return fmt.Sprintf("%s%d s %08x-%08x-%08x-%08x", cygwinCookie, s.port,
+		binary.LittleEndian.Uint32(s.secret[0:]), binary.LittleEndian.Uint32(s.secret[4:]),
+		binary.LittleEndian.Uint32(s.secret[8:]), binary.LittleEndian.Uint32(s.secret[12:]))
+}
+
+// The credentials exchanged after the secret, a struct ucred of pid, uid and
+// gid. Cygwin's ids mean nothing here; the proxy's own are sent.
+func cygwinCred() []byte {
+	cred := make([]byte, 0, 12)
+	cred = binary.LittleEndian.AppendUint32(cred, uint32(os.Getpid()))
+	cred = binary.LittleEndian.AppendUint32(cred, uint32(os.Getuid()))
+	cred = binary.LittleEndian.AppendUint32(cred, uint32(os.Getgid()))
+
+	return cred
+}
+
+// Exchanges the secret and credentials on a new connection, the client
+// sending first.
+func cygwinHandshake(conn net.Conn, secret [16]byte, client bool) error {
+	send := func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	}
+
+	recvSecret := func() error {
+		var got [16]byte
+		if _, err := io.ReadFull(conn, got[:]); err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(got[:], secret[:]) != 1 {
+			return errors.New("cygwin socket: wrong secret")
+		}
+		return nil
+	}
+
+	recvCred := func() error {
+		_, err := io.ReadFull(conn, make([]byte, 12))
+		return err
+	}
+
+	steps := []func() error{
+		recvSecret,
+		func() error { return send(secret[:]) },
+		recvCred,
+		func() error { return send(cygwinCred()) },
+	}
+	if client {
+		steps = []func() error{steps[1], steps[0], steps[3], steps[2]}
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Dials cygwin:/path/to/agent.sock, e.g. the socket of Git for Windows'
+// ssh-agent under /mnt/c.
+func dialCygwin(ctx context.Context, path string) (net.Conn, error) {
+	s, err := readCygwinSocket(expandPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(s.port)))
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if err := cygwinHandshake(conn, s.secret, true); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// An emulated unix socket for Cygwin and MSYS clients: a TCP port on
+// localhost, and a file telling them the port and the secret.
+type cygwinListener struct {
+	tcp    net.Listener
+	path   string
+	secret [16]byte
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listens on cygwin:/path/to/agent.sock, keeping the port when it was handed
+// over by the proxy upgraded.
+func listenCygwin(socket string) (net.Listener, error) {
+	l, err := listenCygwinTCP(socket)
+	if err != nil {
+		return nil, err
+	}
+	l.path = cygwinPath(socket)
+
+	file := cygwinSocket{port: l.port(), secret: l.secret}
+
+	// Only the owner may learn the secret; Cygwin writes a terminating NUL
+	_ = os.Remove(l.path)
+	if err := os.WriteFile(l.path, append([]byte(file.String()), 0), 0o600); err != nil {
+		_ = l.tcp.Close()
+		return nil, err
+	}
+
+	markCygwinSocket(l.path)
+
+	go l.run()
+
+	return l, nil
+}
+
+// Listens on a port on localhost for clients doing the Cygwin handshake
+// with a new secret, without a socket file yet.
+func listenCygwinTCP(socket string) (*cygwinListener, error) {
+	l := &cygwinListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+
+	if _, err := rand.Read(l.secret[:]); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if l.tcp, err = listenTCP(socket, "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *cygwinListener) port() int {
+	return l.tcp.Addr().(*net.TCPAddr).Port
+}
+
+// Gives the file the system attribute, by which Cygwin tells socket files
+// apart from regular ones. Only possible from WSL, elsewhere the file is
+// left as is.
+func markCygwinSocket(path string) {
+	win, err := exec.Command("wslpath", "-w", path).Output()
+	if err != nil {
+		return
+	}
+
+	if out, err := exec.Command("attrib.exe", "+s", strings.TrimSpace(string(win))).CombinedOutput(); err != nil {
+		slog.Warn("cygwin socket not marked as system file", "path", path, "error", err, "output", strings.TrimSpace(string(out)))
+	}
+}
+
+func (l *cygwinListener) run() {
+	for {
+		conn, err := l.tcp.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("cygwin accept", "error", err)
+			continue
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+func (l *cygwinListener) handshake(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	if err := cygwinHandshake(conn, l.secret, false); err != nil {
+		slog.Warn("cygwin client not permitted, connection rejected", "error", err)
+		_ = conn.Close()
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+func (l *cygwinListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops listening and removes the socket file, unless the socket was handed
+// over to the upgraded proxy, which has written its own.
+func (l *cygwinListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.tcp.Close()
+
+		if l.path != "" && !handedOff.Load() {
+			_ = os.Remove(l.path)
+		}
+	})
+
+	return err
+}
+
+func (l *cygwinListener) Addr() net.Addr {
+	return l.tcp.Addr()
+}
+
+// Returns a copy of the TCP socket, to hand it over on upgrades.
+func (l *cygwinListener) File() (*os.File, error) {
+	return tcpFile(l.tcp)
+}
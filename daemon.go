@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var (
+	shellSh  = flag.Bool("s", false, "run in the background and print sh commands setting SSH_AUTH_SOCK, like ssh-agent -s")
+	shellCsh = flag.Bool("c", false, "run in the background and print csh commands setting SSH_AUTH_SOCK, like ssh-agent -c")
+)
+
+// Set in the environment of the background process started by daemonize.
+const daemonEnv = "SSH_AGENT_PROXY_DAEMON"
+
+// Whether the proxy runs in the background for eval $(ssh-agent-proxy -s).
+func evalMode() bool {
+	return *shellSh || *shellCsh
+}
+
+// Starts the proxy again as a background process and relays the shell
+// commands it prints once it listens, then exits. Only returns in the
+// background process.
+func daemonize() error {
+	if os.Getenv(daemonEnv) != "" {
+		return os.Unsetenv(daemonEnv)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	_ = w.Close()
+
+	if n, _ := io.Copy(os.Stdout, r); n == 0 {
+		// Nothing printed, so the proxy failed to start and said why
+		_ = cmd.Wait()
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+
+	return nil
+}
+
+// Prints the commands setting up a shell to use the proxy, in the same
+// form as ssh-agent.
+func printShellEnv(w io.Writer) {
+	pid := os.Getpid()
+
+	if *shellCsh {
+		_, _ = fmt.Fprintf(w, "setenv SSH_AUTH_SOCK %s;\nsetenv SSH_AGENT_PID %d;\necho Agent pid %d;\n", authSock, pid, pid)
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\nSSH_AGENT_PID=%d; export SSH_AGENT_PID;\necho Agent pid %d;\n", authSock, pid, pid)
+}
+
+// Points the standard streams at /dev/null once the shell commands have been
+// printed, letting the starting process exit and dropping any further
+// output meant for the terminal.
+func detach() error {
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = null.Close() }()
+
+	for fd := range 3 {
+		if err := dupFd(int(null.Fd()), fd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	dashboardAddr      = flag.String("dashboard", "", "serve a status page on this localhost address, e.g. 127.0.0.1:7070")
+	dashboardTokenFile = flag.String("dashboard-token-file", "", "file holding the dashboard's access token, a new one on every start by default")
+)
+
+// A status page for proxies running as a service, with the same information
+// as the TUI. It only listens on localhost, and only answers requests
+// carrying its token, which the admin socket tells.
+type dashboard struct {
+	url   string
+	token string
+}
+
+// What the dashboard shows, also served as JSON.
+type dashboardState struct {
+	Status     proxyStatus     `json:"status"`
+	Backends   []backendStatus `json:"backends"`
+	Keys       []keyInfo       `json:"keys"`
+	Signatures []hookEvent     `json:"signatures"`
+	Events     []hookEvent     `json:"events"`
+}
+
+const dashboardCookie = "ssh-agent-proxy-token"
+
+var dashboardPage = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"since": sinceString,
+	"state": backendStatus.state,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>ssh-agent-proxy</title>
+<style>
+body { font: 14px sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+td { font-family: monospace; }
+.up { color: green; } .down, .denied { color: firebrick; } .disabled, .locked { color: gray; }
+</style>
+</head>
+<body>
+<h1>ssh-agent-proxy</h1>
+<p>{{.Status.Socket}} &middot; {{if .Status.Locked}}<b class="locked">locked</b>{{else}}unlocked{{end}}
+&middot; {{.Status.BackendsUp}}/{{.Status.Backends}} backends up &middot; {{.Status.Clients}} clients (peak {{.Status.PeakClients}})</p>
+
+<h2>Backends</h2>
+<table>
+<tr><th>Name</th><th>Socket</th><th>Status</th><th>Since</th><th>Keys</th><th>Signatures</th><th>Last used</th><th>Error</th></tr>
+{{range .Backends}}<tr><td>{{.Name}}</td><td>{{.Socket}}</td><td class="{{state .}}">{{state .}}</td><td>{{since .Since}}</td><td>{{.Keys}}</td><td>{{.Signatures}}</td><td>{{since .LastUsed}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+
+<h2>Keys</h2>
+<table>
+<tr><th>Type</th><th>Fingerprint</th><th>Comment</th><th>Backend</th><th>Signatures</th><th>Last used</th></tr>
+{{range .Keys}}<tr><td>{{.Type}}</td><td>{{.Fingerprint}}</td><td>{{.Comment}}</td><td>{{.Backend}}</td><td>{{.Signatures}}</td><td>{{since .LastUsed}}</td></tr>
+{{end}}</table>
+
+<h2>Signatures</h2>
+<table>
+<tr><th>Time</th><th>Result</th><th>Key</th><th>Backend</th><th>Purpose</th><th>User</th><th>Client</th><th>Error</th></tr>
+{{range .Signatures}}<tr><td>{{.Time.Local.Format "2006-01-02 15:04:05"}}</td><td{{if eq .Event "sign-denied"}} class="denied"{{end}}>{{.Event}}</td><td>{{.Fingerprint}}</td><td>{{.Backend}}</td><td>{{.Purpose}}{{with .Namespace}} ({{.}}){{end}}</td><td>{{.User}}</td><td>{{with .Client}}{{.Exe}} [{{.PID}}]{{end}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+
+<h2>Events</h2>
+<table>
+<tr><th>Time</th><th>Event</th><th>Backend</th><th>Error</th></tr>
+{{range .Events}}<tr><td>{{.Time.Local.Format "2006-01-02 15:04:05"}}</td><td>{{.Event}}</td><td>{{.Backend}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+var dash *dashboard
+
+func init() {
+	subcommands["dashboard"] = cmdDashboard
+
+	adminCommands["dashboard"] = func(args []string) (any, error) {
+		if dash == nil {
+			return nil, errors.New("no dashboard, see --dashboard")
+		}
+		return dash.url + "/?token=" + dash.token, nil
+	}
+}
+
+// Checks that the dashboard listens on localhost only.
+func validateDashboardAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("dashboard: %w", err)
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("dashboard: %s is not a localhost address", addr)
+	}
+
+	return nil
+}
+
+// Serves the dashboard on addr, unless it was handed over by the proxy
+// upgraded.
+func listenDashboard(addr string) (net.Listener, error) {
+	if err := validateDashboardAddr(addr); err != nil {
+		return nil, err
+	}
+
+	d := &dashboard{}
+
+	if *dashboardTokenFile != "" {
+		b, err := os.ReadFile(expandPath(*dashboardTokenFile))
+		if err != nil {
+			return nil, err
+		}
+		if d.token = strings.TrimSpace(string(b)); d.token == "" {
+			return nil, fmt.Errorf("%s is empty", *dashboardTokenFile)
+		}
+	} else {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		d.token = hex.EncodeToString(b)
+	}
+
+	l, err := listenTCP("http://"+addr, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d.url = "http://" + l.Addr().String()
+	dash = d
+
+	srv := &http.Server{
+		Handler:           d,
+		ReadHeaderTimeout: handshakeTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+
+	go func() {
+		if err := srv.Serve(l); !errors.Is(err, net.ErrClosed) {
+			slog.Error("dashboard", "error", err)
+		}
+	}()
+
+	return l, nil
+}
+
+// Tells whether the request carries the token, in the query, a cookie or
+// an Authorization header.
+func (d *dashboard) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if c, err := r.Cookie(dashboardCookie); token == "" && err == nil {
+		token = c.Value
+	}
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); token == "" && ok {
+		token = auth
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) == 1
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !d.authorized(r) {
+		http.Error(w, "token required, see ssh-agent-proxy dashboard", http.StatusUnauthorized)
+		return
+	}
+
+	// Moves the token from the link to a cookie, out of the address bar
+	if r.URL.Query().Has("token") {
+		http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Value: d.token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardPage.Execute(w, currentDashboardState()); err != nil {
+			slog.Debug("dashboard", "error", err)
+		}
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	case "/state.json":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(currentDashboardState())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Gathers the dashboard's contents, the latest events first.
+func currentDashboardState() dashboardState {
+	st := dashboardState{
+		Status:   currentStatus(),
+		Backends: pkr.Status(),
+	}
+
+	// A locked proxy lists no keys
+	st.Keys, _ = pkr.Keys()
+
+	events := latestEvents()
+	slices.Reverse(events)
+
+	for _, ev := range events {
+		if strings.HasPrefix(ev.Event, "sign-") {
+			st.Signatures = append(st.Signatures, ev)
+		} else {
+			st.Events = append(st.Events, ev)
+		}
+	}
+
+	return st
+}
+
+func cmdDashboard(args []string) error {
+	fs, cf := newClientFlags("dashboard")
+	_ = fs.Parse(args)
+
+	var url string
+	if err := adminCall(cf.adminSocket, "dashboard", nil, &url); err != nil {
+		return err
+	}
+
+	fmt.Println(url)
+
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import "flag"
+
+var dbusService = flag.Bool("dbus", false, "offer the proxy's state, events and confirmations on the session D-Bus (Linux only)")
+
+// The proxy's D-Bus service, for desktop applets to show its activity and
+// confirm requests natively.
+const (
+	dbusName      = "io.github.noj.SshAgentProxy"
+	dbusPath      = "/io/github/noj/SshAgentProxy"
+	dbusInterface = "io.github.noj.SshAgentProxy1"
+
+	// Implemented by an applet that registered to confirm requests, on its
+	// own connection
+	dbusConfirmerPath      = "/io/github/noj/SshAgentProxy/Confirmer"
+	dbusConfirmerInterface = "io.github.noj.SshAgentProxy1.Confirmer"
+)
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+// How long a confirmation applet gets to answer before SSH_ASKPASS is asked
+// instead
+const dbusConfirmTimeout = 2 * time.Minute
+
+// The object exported on the session bus. Its exported methods are the
+// service's methods.
+type dbusObject struct {
+	conn *dbus.Conn
+
+	mu        sync.Mutex
+	confirmer string
+}
+
+type (
+	dbusBackend struct {
+		Name     string
+		Socket   string
+		Up       bool
+		Disabled bool
+		Locked   bool
+		Keys     int32
+		Error    string
+	}
+
+	dbusKey struct {
+		Type        string
+		Fingerprint string
+		Comment     string
+		Backend     string
+	}
+)
+
+var dbusObj *dbusObject
+
+// Connects to the session bus and takes the service's name over, from the
+// proxy being upgraded too.
+func startDBus() error {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return fmt.Errorf("d-bus: %w", err)
+	}
+
+	obj := &dbusObject{conn: conn}
+
+	node := &introspect.Node{
+		Name: dbusPath,
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{
+				Name:    dbusInterface,
+				Methods: introspect.Methods(obj),
+				Signals: []introspect.Signal{
+					{Name: "LockChanged", Args: []introspect.Arg{{Name: "locked", Type: "b"}}},
+					{Name: "BackendChanged", Args: []introspect.Arg{{Name: "name", Type: "s"}, {Name: "up", Type: "b"}, {Name: "error", Type: "s"}}},
+					{Name: "SignEvent", Args: []introspect.Arg{
+						{Name: "event", Type: "s"}, {Name: "fingerprint", Type: "s"}, {Name: "backend", Type: "s"},
+						{Name: "purpose", Type: "s"}, {Name: "exe", Type: "s"}, {Name: "pid", Type: "i"}, {Name: "error", Type: "s"},
+					}},
+				},
+			},
+		},
+	}
+
+	if err := conn.Export(obj, dbusPath, dbusInterface); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if err := conn.Export(introspect.NewIntrospectable(node), dbusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	// Watches for the confirmer leaving the bus
+	if err := conn.AddMatchSignal(dbus.WithMatchInterface("org.freedesktop.DBus"), dbus.WithMatchMember("NameOwnerChanged")); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagAllowReplacement|dbus.NameFlagReplaceExisting|dbus.NameFlagDoNotQueue)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		_ = conn.Close()
+		return fmt.Errorf("d-bus: %s is taken", dbusName)
+	}
+
+	dbusObj = obj
+
+	go obj.emitEvents()
+	go obj.watchConfirmer()
+
+	return nil
+}
+
+// Turns the proxy's events into signals.
+func (o *dbusObject) emitEvents() {
+	_, events, _ := subscribeEvents(false)
+
+	for ev := range events {
+		var err error
+
+		switch ev.Event {
+		case "lock", "unlock":
+			err = o.conn.Emit(dbusPath, dbusInterface+".LockChanged", ev.Event == "lock")
+		case "backend-up", "backend-down":
+			err = o.conn.Emit(dbusPath, dbusInterface+".BackendChanged", ev.Backend, ev.Event == "backend-up", ev.Error)
+		case "sign-success", "sign-denied":
+			var exe string
+			var pid int32
+			if ev.Client != nil {
+				exe, pid = ev.Client.Exe, int32(ev.Client.PID)
+			}
+			err = o.conn.Emit(dbusPath, dbusInterface+".SignEvent", ev.Event, ev.Fingerprint, ev.Backend, ev.Purpose, exe, pid, ev.Error)
+		}
+
+		if err != nil {
+			slog.Debug("d-bus signal", "event", ev.Event, "error", err)
+		}
+	}
+}
+
+// Forgets the confirmer once it leaves the bus.
+func (o *dbusObject) watchConfirmer() {
+	signals := make(chan *dbus.Signal, 16)
+	o.conn.Signal(signals)
+
+	for sig := range signals {
+		if sig.Name != "org.freedesktop.DBus.NameOwnerChanged" || len(sig.Body) != 3 {
+			continue
+		}
+
+		name, _ := sig.Body[0].(string)
+		owner, _ := sig.Body[2].(string)
+		if owner != "" {
+			continue
+		}
+
+		o.mu.Lock()
+		if o.confirmer == name {
+			o.confirmer = ""
+			slog.Info("d-bus confirmer left", "name", name)
+		}
+		o.mu.Unlock()
+	}
+}
+
+// Asks the applet that registered to confirm requests, if any. Returns
+// false when there is none or it didn't answer, for SSH_ASKPASS to be asked
+// instead.
+func dbusConfirm(prompt string) (bool, error) {
+	if dbusObj == nil {
+		return false, nil
+	}
+
+	dbusObj.mu.Lock()
+	confirmer := dbusObj.confirmer
+	dbusObj.mu.Unlock()
+
+	if confirmer == "" {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbusConfirmTimeout)
+	defer cancel()
+
+	var allowed bool
+	err := dbusObj.conn.Object(confirmer, dbusConfirmerPath).CallWithContext(ctx, dbusConfirmerInterface+".Confirm", 0, prompt).Store(&allowed)
+	if err != nil {
+		slog.Warn("d-bus confirmer failed", "name", confirmer, "error", err)
+		return false, nil
+	}
+
+	if !allowed {
+		return true, errors.New("refused over d-bus")
+	}
+
+	return true, nil
+}
+
+func dbusErr(err error) *dbus.Error {
+	if err == nil {
+		return nil
+	}
+
+	return dbus.NewError(dbusInterface+".Error", []any{err.Error()})
+}
+
+func (o *dbusObject) GetStatus() (locked bool, backends, backendsUp int32, clients int64, _ *dbus.Error) {
+	st := currentStatus()
+
+	return st.Locked, int32(st.Backends), int32(st.BackendsUp), st.Clients, nil
+}
+
+func (o *dbusObject) ListBackends() ([]dbusBackend, *dbus.Error) {
+	var backends []dbusBackend
+	for _, b := range pkr.Status() {
+		backends = append(backends, dbusBackend{b.Name, b.Socket, b.Up, b.Disabled, b.Locked, int32(b.Keys), b.Error})
+	}
+
+	return backends, nil
+}
+
+func (o *dbusObject) ListKeys() ([]dbusKey, *dbus.Error) {
+	keys, err := pkr.Keys()
+	if err != nil {
+		return nil, dbusErr(err)
+	}
+
+	var list []dbusKey
+	for _, k := range keys {
+		list = append(list, dbusKey{k.Type, k.Fingerprint, k.Comment, k.Backend})
+	}
+
+	return list, nil
+}
+
+func (o *dbusObject) Lock() *dbus.Error {
+	_, err := adminCommands["lock"](nil)
+	return dbusErr(err)
+}
+
+func (o *dbusObject) Unlock() *dbus.Error {
+	_, err := adminCommands["unlock"](nil)
+	return dbusErr(err)
+}
+
+func (o *dbusObject) SetBackendEnabled(backend string, enabled bool) *dbus.Error {
+	return dbusErr(pkr.SetEnabled(backend, enabled))
+}
+
+// Makes the caller the one asked to confirm requests, replacing any other.
+func (o *dbusObject) RegisterConfirmer(sender dbus.Sender) *dbus.Error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.confirmer = string(sender)
+	slog.Info("d-bus confirmer registered", "name", o.confirmer)
+
+	return nil
+}
+
+// Stops asking the caller, if it is the one asked.
+func (o *dbusObject) UnregisterConfirmer(sender dbus.Sender) *dbus.Error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.confirmer == string(sender) {
+		o.confirmer = ""
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func startDBus() error {
+	return errors.New("D-Bus is only supported on Linux")
+}
+
+func dbusConfirm(prompt string) (bool, error) {
+	return false, nil
+}
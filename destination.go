@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Limits the keys listed to clients connecting to certain hosts. A host
+// matches when its key is among HostKeys, or is recorded in known_hosts
+// under a name matching one of the Hosts patterns.
+type destinationRule struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	HostKeys []string `json:"host_keys,omitempty"`
+	Keys     []string `json:"keys"`
+}
+
+var destinationRules []destinationRule
+
+// One client connection. ssh binds the connection to the host it is
+// authenticating to with the session-bind@openssh.com extension before
+// asking for keys, which lets the listing be narrowed down to that host.
+type clientAgent struct {
+	agent.ExtendedAgent
+	ctx context.Context
+
+	// Fingerprints of the keys to list, nil for all of them
+	allowed []string
+
+	// The host the connection was last bound to, if any
+	hostKey    ssh.PublicKey
+	forwarding bool
+}
+
+// The payload of session-bind@openssh.com, see PROTOCOL.agent in OpenSSH.
+type sessionBindMsg struct {
+	HostKey    []byte
+	SessionID  []byte
+	Signature  []byte
+	Forwarding bool
+}
+
+func (a *clientAgent) List() ([]*agent.Key, error) {
+	keys, err := a.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.allowed != nil {
+		keys = slices.DeleteFunc(keys, func(k *agent.Key) bool {
+			pub, err := ssh.ParsePublicKey(k.Blob)
+			return err != nil || !slices.Contains(a.allowed, ssh.FingerprintSHA256(pub))
+		})
+	}
+
+	return keys, nil
+}
+
+func (a *clientAgent) removeAllExcept(protected []string) error {
+	r, ok := a.ExtendedAgent.(partialRemover)
+	if !ok {
+		return errPolicyDenied
+	}
+
+	return r.removeAllExcept(protected)
+}
+
+func (a *clientAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != "session-bind@openssh.com" {
+		return a.ExtendedAgent.Extension(extensionType, contents)
+	}
+
+	var msg sessionBindMsg
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return nil, err
+	}
+
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(msg.Signature, &sig); err != nil {
+		return nil, err
+	}
+
+	if err := hostKey.Verify(msg.SessionID, &sig); err != nil {
+		return nil, errors.New("session-bind: bad host key signature")
+	}
+
+	// Every hop binds when forwarding, the last one is the destination
+	a.hostKey, a.forwarding = hostKey, msg.Forwarding
+	a.allowed = nil
+	for _, rule := range destinationRules {
+		if rule.matches(hostKey) {
+			a.allowed = rule.Keys
+			break
+		}
+	}
+
+	slog.DebugContext(a.ctx, "session bound", "host_key", ssh.FingerprintSHA256(hostKey), "forwarding", msg.Forwarding, "keys", a.allowed)
+
+	return nil, nil
+}
+
+// Describes the host the connection is bound to for policy commands, nil
+// when ssh didn't bind it.
+func (a *clientAgent) destination() *policyDestination {
+	if a.hostKey == nil {
+		return nil
+	}
+
+	names, _ := knownHostNames(a.hostKey)
+
+	return &policyDestination{HostKey: ssh.FingerprintSHA256(a.hostKey), Hosts: names, Forwarding: a.forwarding}
+}
+
+func (rule destinationRule) matches(hostKey ssh.PublicKey) bool {
+	if slices.Contains(rule.HostKeys, ssh.FingerprintSHA256(hostKey)) {
+		return true
+	}
+
+	if len(rule.Hosts) == 0 {
+		return false
+	}
+
+	names, hashed := knownHostNames(hostKey)
+
+	for _, pattern := range rule.Hosts {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok || name == pattern {
+				return true
+			}
+		}
+
+		// Hashed names can only be compared against plain host names
+		if !strings.ContainsAny(pattern, "*?") && slices.ContainsFunc(hashed, func(h string) bool {
+			return hashedHostMatches(h, pattern)
+		}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the names ~/.ssh/known_hosts records for a host key, split into
+// plain and hashed ones.
+func knownHostNames(hostKey ssh.PublicKey) (names, hashed []string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil
+	}
+
+	f, err := os.Open(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, nil
+	}
+	defer func() { _ = f.Close() }()
+
+	want := string(hostKey.Marshal())
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts(scanner.Bytes())
+		if err != nil || marker != "" || string(key.Marshal()) != want {
+			continue
+		}
+
+		for _, host := range hosts {
+			if strings.HasPrefix(host, "|1|") {
+				hashed = append(hashed, host)
+				continue
+			}
+
+			names = append(names, host)
+
+			// Non-standard ports are recorded as [host]:port
+			if strings.HasPrefix(host, "[") {
+				if i := strings.Index(host, "]"); i > 0 {
+					names = append(names, host[1:i])
+				}
+			}
+		}
+	}
+
+	return names, hashed
+}
+
+// Checks a known_hosts "|1|salt|hash" entry against a host name.
+func hashedHostMatches(entry, host string) bool {
+	parts := strings.Split(entry, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
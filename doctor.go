@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/unix"
+)
+
+// How long doctor waits for each backend to list its keys
+const doctorTimeout = 10 * time.Second
+
+func init() {
+	subcommands["doctor"] = cmdDoctor
+}
+
+// Collects the findings of doctor, printing them as they come.
+type diagnosis struct {
+	failed bool
+}
+
+func (d *diagnosis) ok(subject, format string, args ...any) {
+	fmt.Printf("ok    %s: %s\n", subject, fmt.Sprintf(format, args...))
+}
+
+// Reports a problem the proxy works around or that may be intended, with
+// what to do about it.
+func (d *diagnosis) warn(subject, hint, format string, args ...any) {
+	fmt.Printf("warn  %s: %s\n", subject, fmt.Sprintf(format, args...))
+	if hint != "" {
+		fmt.Printf("      %s\n", hint)
+	}
+}
+
+// Reports a problem keeping the proxy, or a backend, from working.
+func (d *diagnosis) fail(subject, hint, format string, args ...any) {
+	d.failed = true
+
+	fmt.Printf("FAIL  %s: %s\n", subject, fmt.Sprintf(format, args...))
+	if hint != "" {
+		fmt.Printf("      %s\n", hint)
+	}
+}
+
+// Checks the setup the proxy would run with, given the same flags and
+// backends, and prints what is wrong with it and how to fix it.
+func cmdDoctor(args []string) error {
+	_ = flag.CommandLine.Parse(args)
+
+	// Backends such as gpg: log as they are dialed
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	d := &diagnosis{}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		d.fail("config", "fix the file or point --config elsewhere", "%v", err)
+		cfg = &proxyConfig{}
+	} else if *configFile != "" {
+		if _, err := os.Stat(*configFile); err == nil {
+			d.ok("config", "%s loaded", *configFile)
+		}
+	}
+
+	backends := cfg.Backends
+	for _, arg := range flag.Args() {
+		backends = append(backends, parseBackendArg(arg))
+	}
+
+	if len(backends) == 0 && !*internalKeyring && len(keyFiles) == 0 {
+		d.fail("backends", "give backends as arguments or in the config file", "none configured")
+	}
+
+	own := ownSockets()
+
+	for _, b := range backends {
+		d.checkBackend(b, own)
+	}
+
+	d.checkSockets(cfg)
+
+	if d.failed {
+		return errors.New("problems found")
+	}
+
+	return nil
+}
+
+// Checks the sockets the proxy listens on.
+func (d *diagnosis) checkSockets(cfg *proxyConfig) {
+	if *socketPath == "" {
+		d.ok("agent socket", "a new temporary directory is made on start")
+	} else {
+		d.checkSocket("agent socket", expandPath(*socketPath))
+	}
+
+	if *readOnlySocket != "" {
+		d.checkSocket("read-only socket", expandPath(*readOnlySocket))
+	}
+
+	for i, l := range cfg.Listeners {
+		if isSocketPath(l.Socket) {
+			d.checkSocket(fmt.Sprintf("listener %d", i+1), expandPath(l.Socket))
+		}
+	}
+
+	if *adminSocket != "" {
+		d.checkSocket("admin socket", *adminSocket)
+	}
+}
+
+// Returns the paths a proxy started with these flags is reached through,
+// symlinks resolved.
+func ownSockets() map[string]bool {
+	own := map[string]bool{}
+
+	for _, path := range []string{*socketPath, *symlinkPath, *readOnlySocket} {
+		if path != "" {
+			own[canonicalBackend(expandPath(path))] = true
+		}
+	}
+
+	return own
+}
+
+// Checks that a backend can be reached and lists its keys, and that it
+// doesn't lead back to the proxy.
+func (d *diagnosis) checkBackend(b backendConfig, own map[string]bool) {
+	name := b.Name
+	if name == "" {
+		name = backendLabel(b.Socket)
+	}
+	subject := "backend " + name
+
+	path := b.Socket
+	if u, err := url.Parse(b.Socket); err == nil && u.Scheme != "" {
+		path = ""
+		if u.Scheme == "unix" {
+			path = u.Path
+		}
+	}
+
+	if path != "" {
+		path = expandPath(path)
+
+		if own[canonicalBackend(path)] {
+			d.fail(subject, "remove it; the proxy would skip it anyway", "%s is the proxy's own socket", path)
+			return
+		}
+
+		fi, err := os.Stat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			d.fail(subject, "check the path, or start the agent that creates it", "%s does not exist", path)
+			return
+		case errors.Is(err, fs.ErrPermission):
+			d.fail(subject, "the proxy must run as a user that can reach the socket", "%s: permission denied", path)
+			return
+		case err != nil:
+			d.fail(subject, "", "%v", err)
+			return
+		case fi.Mode().Type() != fs.ModeSocket:
+			d.fail(subject, "point it at the agent's socket, e.g. the value of its SSH_AUTH_SOCK", "%s is not a socket", path)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+
+	conn, err := dialBackend(ctx, b.Socket)
+	if path != "" && errors.Is(err, syscall.ECONNREFUSED) {
+		d.fail(subject, "the agent that made the socket is gone; restart it", "nobody is listening on %s", path)
+		return
+	}
+	if err != nil {
+		d.fail(subject, "", "can't connect: %v", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	if c, ok := conn.(*ctxConn); ok {
+		if peer, ok := proxyPeer(c.Conn); ok {
+			d.warn(subject, "make sure that proxy doesn't use this one as a backend, or requests go round in circles", "served by another proxy, %s", peer)
+		}
+	}
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		d.fail(subject, "", "connected, but listing keys failed: %v", err)
+		return
+	}
+
+	if len(keys) == 1 {
+		d.ok(subject, "1 key")
+	} else {
+		d.ok(subject, "%d keys", len(keys))
+	}
+}
+
+// Returns the peer of a unix socket connection if it is an ssh-agent-proxy.
+func proxyPeer(conn net.Conn) (peerCred, bool) {
+	peer, err := getPeerCred(conn)
+	if err != nil || peer.exe == "" {
+		return peer, false
+	}
+
+	self, _ := os.Executable()
+
+	return peer, peer.exe == self || filepath.Base(peer.exe) == "ssh-agent-proxy"
+}
+
+// Checks that the proxy can listen on path and that nobody else can swap
+// the socket for their own.
+func (d *diagnosis) checkSocket(subject, path string) {
+	dir := filepath.Dir(path)
+
+	fi, err := os.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		parent := filepath.Dir(dir)
+		if err := unix.Access(parent, unix.W_OK); err != nil {
+			d.fail(subject, "create it, or choose a path in a directory you own", "%s doesn't exist and can't be created in %s", dir, parent)
+		} else {
+			d.ok(subject, "%s is created on start", dir)
+		}
+		return
+	}
+	if err != nil {
+		d.fail(subject, "", "%v", err)
+		return
+	}
+
+	if err := unix.Access(dir, unix.W_OK); err != nil {
+		d.fail(subject, "choose a directory the proxy's user can write to", "can't create sockets in %s", dir)
+		return
+	}
+
+	// A sticky directory such as /tmp only lets owners remove their files
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if ok && int(st.Uid) != os.Getuid() && fi.Mode()&os.ModeSticky == 0 {
+		d.warn(subject, "use a directory of your own", "%s belongs to uid %d, who can replace the socket", dir, st.Uid)
+	} else if fi.Mode().Perm()&0o022 != 0 && fi.Mode()&os.ModeSticky == 0 {
+		d.warn(subject, fmt.Sprintf("chmod go-w %s", dir), "others can write to %s and replace the socket", dir)
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			d.warn(subject, "a proxy already running keeps it; stop it or give this one another path", "%s is in use", path)
+			return
+		}
+
+		d.ok(subject, "%s is stale and gets replaced", path)
+		return
+	}
+
+	d.ok(subject, "%s", path)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	shutdownGrace = flag.Duration("shutdown-grace", 5*time.Second, "on shutdown, wait this long for requests in flight to be answered before closing their connections")
+
+	// Starts shutting down, as SIGTERM does
+	requestShutdown context.CancelFunc = func() {}
+)
+
+// Tracks whether a client connection is in the middle of a request, so that
+// shutting down closes idle connections at once and busy ones as soon as
+// their reply is sent.
+type drainer struct {
+	mu       sync.Mutex
+	busy     bool
+	draining bool
+	close    func()
+}
+
+// Notes that a request was read.
+func (d *drainer) begin() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.busy = true
+}
+
+// Notes that the last request was answered, closing the connection if the
+// proxy is shutting down.
+func (d *drainer) end() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.busy = false
+	if d.draining {
+		d.close()
+	}
+}
+
+// Closes the connection now if it is idle, or else once the request in
+// flight is answered.
+func (d *drainer) drain() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.draining = true
+	if !d.busy {
+		d.close()
+	}
+}
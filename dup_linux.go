@@ -0,0 +1,7 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+func dupFd(oldfd, newfd int) error {
+	return unix.Dup3(oldfd, newfd, 0)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+func dupFd(oldfd, newfd int) error {
+	return unix.Dup2(oldfd, newfd)
+}
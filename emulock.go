@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// The backends the proxy keeps locked on their behalf because they don't
+// implement locking themselves, such as gpg-agent's SSH socket, by name, with
+// a hash of the passphrase kept as a secret. Their keys are neither listed nor used until
+// they are unlocked through the proxy.
+type emulatedLocks struct {
+	mu sync.Mutex
+	by map[string]*secret
+}
+
+var errBadPassphrase = errors.New("wrong passphrase")
+
+func (l *emulatedLocks) lock(backend string, passphrase []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.by == nil {
+		l.by = map[string]*secret{}
+	}
+
+	sum := sha256.Sum256(passphrase)
+	defer clear(sum[:])
+
+	l.by[backend].destroy()
+	l.by[backend] = newSecret(sum[:])
+}
+
+func (l *emulatedLocks) locked(backend string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.by[backend]
+
+	return ok
+}
+
+// Reports whether the proxy keeps any of the backends named in only locked,
+// or any at all when only is nil.
+func (l *emulatedLocks) anyLocked(only []string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for backend := range l.by {
+		if only == nil || slices.Contains(only, backend) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Unlocks the backends locked by the proxy among those named in only, or all
+// of them when only is nil. Returns the names of the backends unlocked.
+func (l *emulatedLocks) unlock(only []string, passphrase []byte) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sum := sha256.Sum256(passphrase)
+	defer clear(sum[:])
+
+	var unlocked []string
+
+	for backend, want := range l.by {
+		if only != nil && !slices.Contains(only, backend) {
+			continue
+		}
+
+		if !want.equal(sum[:]) {
+			return nil, errBadPassphrase
+		}
+
+		unlocked = append(unlocked, backend)
+	}
+
+	for _, backend := range unlocked {
+		l.by[backend].destroy()
+		delete(l.by, backend)
+	}
+
+	return unlocked, nil
+}
+
+// Forgets every lock, zeroing the passphrase hashes.
+func (l *emulatedLocks) wipe() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for backend, s := range l.by {
+		s.destroy()
+		delete(l.by, backend)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+)
+
+var eventsSocket = flag.String("events-socket", "", "path of a socket streaming agent events as JSON lines, empty to disable")
+
+// Listens on the events socket, replacing a stale one, and streams the
+// events to every client connecting.
+func listenEvents(path string) (net.Listener, error) {
+	l, err := listenAdmin(path)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				slog.Error("events accept", "error", err)
+				continue
+			}
+
+			go streamEvents(conn)
+		}
+	}()
+
+	return l, nil
+}
+
+// Writes the events to come to the client, one JSON object per line like
+// hooks get them, until it hangs up.
+func streamEvents(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	_, events, unsubscribe := subscribeEvents(false)
+	defer unsubscribe()
+
+	// Clients only listen, anything they send is ignored until they hang up
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case <-gone:
+			return
+		case ev := <-events:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+func init() {
+	subcommands["export"] = cmdExport
+}
+
+// Prints the public keys in authorized_keys format, or writes a file of
+// them for every backend. Certificates are left out, as authorized_keys
+// takes their keys rather than them.
+func cmdExport(args []string) error {
+	fs, cf := newClientFlags("export")
+	backends := fs.String("backend", "", "comma-separated names of the backends to export the keys of, all by default")
+	dir := fs.String("dir", "", "write the keys of each backend to <dir>/<backend>.pub instead")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return errors.New("usage: export [flags]")
+	}
+
+	var keys []keyInfo
+	if err := adminCall(cf.adminSocket, "list-keys", nil, &keys); err != nil {
+		return err
+	}
+
+	var only []string
+	if *backends != "" {
+		only = strings.Split(*backends, ",")
+	}
+
+	keys = slices.DeleteFunc(keys, func(k keyInfo) bool {
+		return k.PublicKey == "" || strings.Contains(k.Type, "-cert-v") || (only != nil && !slices.Contains(only, k.Backend))
+	})
+
+	if cf.json {
+		return printJSON(keys)
+	}
+
+	line := func(k keyInfo) string {
+		if k.Comment == "" {
+			return k.PublicKey + "\n"
+		}
+		return k.PublicKey + " " + k.Comment + "\n"
+	}
+
+	if *dir == "" {
+		for _, k := range keys {
+			fmt.Print(line(k))
+		}
+		return nil
+	}
+
+	files := map[string]string{}
+	for _, k := range keys {
+		files[k.Backend] += line(k)
+	}
+
+	if err := os.MkdirAll(expandPath(*dir), 0o755); err != nil {
+		return err
+	}
+
+	for _, backend := range slices.Sorted(maps.Keys(files)) {
+		path := filepath.Join(expandPath(*dir), backend+".pub")
+		if err := os.WriteFile(path, []byte(files[backend]), 0o644); err != nil {
+			return err
+		}
+		fmt.Println(path)
+	}
+
+	return nil
+}
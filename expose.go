@@ -0,0 +1,58 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// A backend agent exposing only the keys whose comments match a pattern.
+// The other keys are neither listed nor used for signing.
+type exposedAgent struct {
+	agent.ExtendedAgent
+	expose *regexp.Regexp
+}
+
+func (a *exposedAgent) List() ([]*agent.Key, error) {
+	keys, err := a.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool {
+		return !a.expose.MatchString(k.Comment)
+	}), nil
+}
+
+func (a *exposedAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *exposedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if ok, err := hasKey(a, key); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errKeyNotFound
+	}
+
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (a *exposedAgent) Signers() ([]ssh.Signer, error) {
+	signers, err := a.ExtendedAgent.Signers()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(signers, func(s ssh.Signer) bool {
+		blob := string(s.PublicKey().Marshal())
+		return !slices.ContainsFunc(keys, func(k *agent.Key) bool { return string(k.Blob) == blob })
+	}), nil
+}
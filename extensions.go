@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSH_AGENT_SUCCESS, which extension replies start with
+const agentSuccess = 6
+
+// Answers the proxy's own extensions. Their replies carry JSON, in the same
+// format as the admin socket's.
+func (r *boundKeyring) Extension(extensionType string, contents []byte) ([]byte, error) {
+	switch extensionType {
+	case "list-backends@ssh-agent-proxy":
+		status := r.Status()
+		if r.offered != nil {
+			status = slices.DeleteFunc(status, func(b backendStatus) bool {
+				return !slices.Contains(r.offered, b.Name)
+			})
+		}
+
+		return extensionReply(status)
+
+	case "locked-backends@ssh-agent-proxy":
+		locked := []string{}
+		for _, b := range r.Status() {
+			if b.Locked && (r.offered == nil || slices.Contains(r.offered, b.Name)) {
+				locked = append(locked, b.Name)
+			}
+		}
+
+		return extensionReply(locked)
+
+	case "pin-backend@ssh-agent-proxy":
+		var req struct{ Name string }
+		if err := ssh.Unmarshal(contents, &req); err != nil {
+			return nil, err
+		}
+
+		return nil, r.pin(req.Name)
+	default:
+		return nil, agent.ErrExtensionUnsupported
+	}
+}
+
+// Restricts the connection to the named backend, or lifts the restriction
+// when name is empty.
+func (r *boundKeyring) pin(name string) error {
+	if name != "" && (!r.hasBackend(name) || r.offered != nil && !slices.Contains(r.offered, name)) {
+		return fmt.Errorf("backend %s not registered", name)
+	}
+
+	r.pinned = name
+	slog.DebugContext(r.ctx, "connection pinned", "backend", name)
+
+	return nil
+}
+
+// Encodes an extension reply as SSH_AGENT_SUCCESS followed by a string of
+// JSON.
+func extensionReply(v any) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{agentSuccess}, ssh.Marshal(struct{ JSON []byte }{buf})...), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var fallbackAgent = flag.String("fallback-agent", "", "start this ssh-agent as a backend whenever no other backend is reachable, e.g. \"ssh-agent\"")
+
+const (
+	// The backend the fallback agent is added as
+	fallbackName = "fallback-agent"
+
+	// How often the other backends are checked while there is no fallback
+	// agent
+	fallbackCheckInterval = 10 * time.Second
+
+	// How long the agent gets to make its socket
+	fallbackStartTimeout = 5 * time.Second
+)
+
+// The ssh-agent the proxy started, or took over from the proxy it upgraded.
+// It is asked last, and kept running once other backends return, since keys
+// may have been added to it.
+var fallback struct {
+	mu      sync.Mutex
+	running bool
+	pid     int
+	exited  chan struct{}
+}
+
+// Returns where the fallback agent listens, with its pid kept beside it.
+func fallbackSocket() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ssh-agent-proxy-%d.fallback", os.Getuid()))
+}
+
+// Takes over the fallback agent left by the proxy this one upgraded, then
+// starts one whenever no other backend answers, and again should it die.
+func watchFallback(ctx context.Context) {
+	if adoptFallback() {
+		slog.Info("fallback agent taken over", "socket", fallbackSocket())
+	}
+
+	t := time.NewTicker(fallbackCheckInterval)
+	defer t.Stop()
+
+	for {
+		fallback.mu.Lock()
+		running, exited := fallback.running, fallback.exited
+		fallback.mu.Unlock()
+
+		// Taken over, so there is no waiting for it to exit
+		if running && exited == nil && !fallbackAnswers() {
+			slog.Warn("fallback agent gone")
+			_ = pkr.RemoveBackend(fallbackName)
+
+			fallback.mu.Lock()
+			fallback.running, fallback.pid = false, 0
+			fallback.mu.Unlock()
+
+			running = false
+		}
+
+		if !running && !backendsReachable() {
+			if err := startFallback(); err != nil {
+				slog.Error("fallback agent not started", "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-exited:
+		case <-t.C:
+		}
+	}
+}
+
+// Reports whether any enabled backend, besides the fallback agent and the
+// internal keyring, answers.
+func backendsReachable() bool {
+	for _, b := range pkr.Status() {
+		if b.Name != fallbackName && b.Name != "internal" && !b.Disabled && b.Up {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reports whether the fallback agent listens.
+func fallbackAnswers() bool {
+	conn, err := net.Dial("unix", fallbackSocket())
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+
+	return true
+}
+
+// Uses the fallback agent already running, if it answers.
+func adoptFallback() bool {
+	socket := fallbackSocket()
+
+	b, err := os.ReadFile(socket + ".pid")
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || !fallbackAnswers() {
+		return false
+	}
+
+	if err := pkr.AddBackend(backendConfig{Name: fallbackName, Socket: socket, Priority: -1}); err != nil {
+		slog.Error("fallback agent not added", "error", err)
+		return false
+	}
+
+	fallback.mu.Lock()
+	fallback.running, fallback.pid, fallback.exited = true, pid, nil
+	fallback.mu.Unlock()
+
+	return true
+}
+
+func startFallback() error {
+	socket := fallbackSocket()
+	if err := removeStaleSocket(socket); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(*fallbackAgent, "-D", "-a", socket)
+	cmd.Stderr = os.Stderr
+	// Outlives an upgrade, and isn't stopped by ^C before the proxy is
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		close(exited)
+
+		fallback.mu.Lock()
+		defer fallback.mu.Unlock()
+
+		if fallback.pid == cmd.Process.Pid {
+			fallback.running = false
+			slog.Warn("fallback agent exited", "error", err)
+			_ = pkr.RemoveBackend(fallbackName)
+		}
+	}()
+
+	if err := waitForSocket(socket, exited); err != nil {
+		_ = cmd.Process.Kill()
+		return err
+	}
+
+	_ = os.WriteFile(socket+".pid", []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o600)
+
+	fallback.mu.Lock()
+	fallback.running, fallback.pid, fallback.exited = true, cmd.Process.Pid, exited
+	fallback.mu.Unlock()
+
+	if err := pkr.AddBackend(backendConfig{Name: fallbackName, Socket: socket, Priority: -1}); err != nil {
+		return err
+	}
+
+	slog.Warn("no backend reachable, fallback agent started", "socket", socket, "pid", cmd.Process.Pid)
+
+	return nil
+}
+
+// Waits for an agent to listen on socket, giving up once it exits.
+func waitForSocket(socket string, exited <-chan struct{}) error {
+	deadline := time.Now().Add(fallbackStartTimeout)
+
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			_ = conn.Close()
+			return nil
+		}
+
+		select {
+		case <-exited:
+			return errors.New("agent exited")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	return fmt.Errorf("agent didn't listen on %s", socket)
+}
+
+// Stops the fallback agent as the proxy exits, unless it handed over to an
+// upgraded one, which takes it over.
+func stopFallback() {
+	if handedOff.Load() {
+		return
+	}
+
+	fallback.mu.Lock()
+	pid := fallback.pid
+	fallback.pid = 0
+	fallback.mu.Unlock()
+
+	if pid == 0 {
+		return
+	}
+
+	if p, err := os.FindProcess(pid); err == nil {
+		_ = p.Signal(syscall.SIGTERM)
+	}
+
+	socket := fallbackSocket()
+	_ = os.Remove(socket)
+	_ = os.Remove(socket + ".pid")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How long the proxy may take to answer a fuzzed stream before it counts as
+// hung
+const fuzzTimeout = 5 * time.Second
+
+// Frames an agent request of the type with the body.
+func frame(typ byte, body ...[]byte) []byte {
+	msg := []byte{typ}
+	for _, b := range body {
+		msg = append(msg, b...)
+	}
+
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...)
+}
+
+// Encodes an SSH string.
+func sshString(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+// Adds well-formed and malformed requests of every kind as seeds.
+func addAgentSeeds(f *testing.F, key ssh.PublicKey) {
+	blob := key.Marshal()
+
+	list := frame(11)
+	sign := frame(13, sshString(blob), sshString([]byte("data")), []byte{0, 0, 0, 0})
+
+	seeds := [][]byte{
+		list,
+		sign,
+		append(list, sign...),
+		frame(13, sshString(blob), sshString([]byte("SSHSIG")), []byte{0, 0, 0, 2}),
+		frame(13, sshString(blob[:len(blob)/2])),
+		frame(18, sshString(blob)),
+		frame(17, sshString([]byte("ssh-ed25519")), sshString(bytes.Repeat([]byte{1}, 32))),
+		frame(25, sshString([]byte("ssh-ed25519")), []byte{1, 0, 0, 0}),
+		frame(27, sshString([]byte("query"))),
+		frame(27, sshString([]byte("list-backends@ssh-agent-proxy"))),
+		frame(27, sshString([]byte("pin-backend@ssh-agent-proxy")), sshString([]byte("nope"))),
+		frame(22, sshString([]byte("pass"))),
+		frame(23, sshString([]byte("pass"))),
+		frame(200),
+		{0, 0, 0, 0},
+		{0, 0, 0, 1},
+		{0, 0, 0},
+		{0xff, 0xff, 0xff, 0xff, 11},
+		sign[:len(sign)-3],
+	}
+
+	for _, s := range seeds {
+		f.Add(s)
+	}
+}
+
+// Feeds a client connection arbitrary bytes and hangs up, checking that the
+// proxy neither crashes nor hangs, that every reply is well framed, and that
+// it still answers other clients afterwards.
+func FuzzServeConn(f *testing.F) {
+	a := newFakeAgent(f, "a", 2)
+	key := a.addKey(f)
+	p := startProxy(f, a)
+
+	addAgentSeeds(f, key)
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		conn, err := net.Dial("unix", p.socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+
+		_ = conn.SetDeadline(time.Now().Add(fuzzTimeout))
+
+		// Replies may only come once the request is read
+		go func() {
+			_, _ = conn.Write(stream)
+			_ = conn.(*net.UnixConn).CloseWrite()
+		}()
+
+		replies, err := io.ReadAll(conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("no hang-up within %v", fuzzTimeout)
+		}
+
+		for len(replies) > 0 {
+			if len(replies) < 4 {
+				t.Fatalf("truncated reply length %x", replies)
+			}
+			l := binary.BigEndian.Uint32(replies)
+			if l == 0 || uint32(len(replies)-4) < l {
+				t.Fatalf("bad reply frame of %d bytes with %d left", l, len(replies)-4)
+			}
+			replies = replies[4+l:]
+		}
+
+		// Fuzzed requests may lock the proxy or remove keys, but not break it
+		c := p.client(t)
+		if _, err := c.List(); err != nil {
+			t.Fatalf("list after the fuzzed stream: %v", err)
+		}
+	})
+}
+
+// Checks that the message guard only passes on whole requests within the
+// size limit, however the stream is cut.
+func FuzzMessageGuard(f *testing.F) {
+	f.Add(frame(11), 64)
+	f.Add(append(frame(11), frame(13, sshString([]byte("key")))...), 8)
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 1, 11}, 16)
+	f.Add([]byte{0, 1, 0, 0, 11}, 16)
+	f.Add([]byte{0, 0, 0, 5, 11}, 16)
+
+	f.Fuzz(func(t *testing.T, stream []byte, limit int) {
+		if limit < 1 || limit > 1<<20 {
+			t.Skip()
+		}
+
+		var replies bytes.Buffer
+		g := &messageGuard{ReadWriter: struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(stream), &replies}, max: limit}
+
+		passed, err := io.ReadAll(g)
+		if err != nil && !errors.Is(err, errMessageTooLarge) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(passed) > len(stream) {
+			t.Fatalf("passed on %d bytes of %d", len(passed), len(stream))
+		}
+
+		for len(passed) >= 4 {
+			l := binary.BigEndian.Uint32(passed)
+			if l == 0 || l > uint32(limit) {
+				t.Fatalf("passed on a request of %d bytes, max %d", l, limit)
+			}
+			passed = passed[min(len(passed), 4+int(l)):]
+		}
+
+		if replies.Len()%len(failureReply) != 0 || !bytes.Equal(replies.Bytes(), bytes.Repeat(failureReply, replies.Len()/len(failureReply))) {
+			t.Fatalf("replies %x aren't all failures", replies.Bytes())
+		}
+	})
+}
+
+// Checks that telling what is being signed never panics on arbitrary data.
+func FuzzParseSignData(f *testing.F) {
+	f.Add([]byte("SSHSIG"))
+	f.Add(append([]byte("SSHSIG"), sshString([]byte("git"))...))
+	f.Add(append(sshString(make([]byte, 32)), 50))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = parseSignData(data)
+	})
+}
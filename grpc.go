@@ -0,0 +1,217 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/admin/v1/admin.proto
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	adminv1 "github.com/noj/ssh-agent-proxy/proto/admin/v1"
+)
+
+var grpcSocket = flag.String("grpc-socket", "", "path of a socket serving the admin API over gRPC, empty to disable")
+
+// The admin API as a versioned gRPC service, defined in
+// proto/admin/v1/admin.proto.
+type grpcAdmin struct {
+	adminv1.UnimplementedAdminServer
+}
+
+// Serves the gRPC admin API on a unix socket, replacing a stale one.
+func listenGRPC(path string) (net.Listener, error) {
+	l, err := listenAdmin(path)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		slog.Info("admin command", "method", info.FullMethod)
+		return handler(ctx, req)
+	}))
+	adminv1.RegisterAdminServer(srv, grpcAdmin{})
+
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("grpc", "error", err)
+		}
+	}()
+
+	return l, nil
+}
+
+// Maps the proxy's errors to status codes.
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errLocked):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errDuplicateBackend):
+		return status.Error(codes.AlreadyExists, err.Error())
+	default:
+		return status.Error(codes.Unknown, err.Error())
+	}
+}
+
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	return timestamppb.New(t)
+}
+
+func (grpcAdmin) GetStatus(context.Context, *adminv1.GetStatusRequest) (*adminv1.GetStatusResponse, error) {
+	st := currentStatus()
+
+	return &adminv1.GetStatusResponse{
+		Socket:      st.Socket,
+		Locked:      st.Locked,
+		Backends:    int32(st.Backends),
+		BackendsUp:  int32(st.BackendsUp),
+		Clients:     st.Clients,
+		PeakClients: st.PeakClients,
+	}, nil
+}
+
+func (grpcAdmin) ListBackends(context.Context, *adminv1.ListBackendsRequest) (*adminv1.ListBackendsResponse, error) {
+	res := &adminv1.ListBackendsResponse{}
+
+	for _, b := range pkr.Status() {
+		res.Backends = append(res.Backends, &adminv1.Backend{
+			Name:      b.Name,
+			Socket:    b.Socket,
+			Disabled:  b.Disabled,
+			Locked:    b.Locked,
+			Up:        b.Up,
+			Keys:      int32(b.Keys),
+			Error:     b.Error,
+			Since:     timestamp(b.Since),
+			LastCheck: timestamp(b.LastCheck),
+		})
+	}
+
+	return res, nil
+}
+
+func (grpcAdmin) AddBackend(_ context.Context, req *adminv1.AddBackendRequest) (*adminv1.AddBackendResponse, error) {
+	if req.Socket == "" {
+		return nil, status.Error(codes.InvalidArgument, "no socket")
+	}
+
+	arg := req.Socket
+	if req.Name != "" {
+		if !backendNameRe.MatchString(req.Name) {
+			return nil, status.Errorf(codes.InvalidArgument, "bad name %q", req.Name)
+		}
+		arg = req.Name + "=" + req.Socket
+	}
+
+	return &adminv1.AddBackendResponse{}, grpcError(pkr.AddBackend(parseBackendArg(arg)))
+}
+
+func (grpcAdmin) RemoveBackend(_ context.Context, req *adminv1.RemoveBackendRequest) (*adminv1.RemoveBackendResponse, error) {
+	return &adminv1.RemoveBackendResponse{}, grpcError(pkr.RemoveBackend(req.Backend))
+}
+
+func (grpcAdmin) SetBackendEnabled(_ context.Context, req *adminv1.SetBackendEnabledRequest) (*adminv1.SetBackendEnabledResponse, error) {
+	return &adminv1.SetBackendEnabledResponse{}, grpcError(pkr.SetEnabled(req.Backend, req.Enabled))
+}
+
+func (grpcAdmin) ListKeys(context.Context, *adminv1.ListKeysRequest) (*adminv1.ListKeysResponse, error) {
+	keys, err := pkr.Keys()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	res := &adminv1.ListKeysResponse{}
+	for _, k := range keys {
+		res.Keys = append(res.Keys, &adminv1.Key{Type: k.Type, Fingerprint: k.Fingerprint, Comment: k.Comment, Backend: k.Backend})
+	}
+
+	return res, nil
+}
+
+func (grpcAdmin) ListPolicyRules(context.Context, *adminv1.ListPolicyRulesRequest) (*adminv1.ListPolicyRulesResponse, error) {
+	res := &adminv1.ListPolicyRulesResponse{}
+
+	for _, r := range policyRules {
+		res.Rules = append(res.Rules, &adminv1.PolicyRule{
+			Operations: r.Operations,
+			Keys:       r.Keys,
+			Backends:   r.Backends,
+			Users:      r.Users,
+			Cids:       r.CIDs,
+			Purposes:   r.Purposes,
+			Days:       r.Days,
+			Hours:      r.Hours,
+			Timezone:   r.Timezone,
+			Action:     r.Action,
+		})
+	}
+
+	return res, nil
+}
+
+func (grpcAdmin) SetLocked(_ context.Context, req *adminv1.SetLockedRequest) (*adminv1.SetLockedResponse, error) {
+	command := "unlock"
+	if req.Locked {
+		command = "lock"
+	}
+
+	_, err := adminCommands[command](nil)
+
+	return &adminv1.SetLockedResponse{}, grpcError(err)
+}
+
+func (grpcAdmin) StreamEvents(req *adminv1.StreamEventsRequest, stream grpc.ServerStreamingServer[adminv1.Event]) error {
+	recent, events, unsubscribe := subscribeEvents(req.IncludeRecent)
+	defer unsubscribe()
+
+	slog.Info("admin command", "method", "StreamEvents")
+
+	for _, ev := range recent {
+		if err := stream.Send(grpcEvent(ev)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			if err := stream.Send(grpcEvent(ev)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func grpcEvent(ev hookEvent) *adminv1.Event {
+	e := &adminv1.Event{
+		Event:       ev.Event,
+		Time:        timestamp(ev.Time),
+		Backend:     ev.Backend,
+		Fingerprint: ev.Fingerprint,
+		Purpose:     ev.Purpose,
+		Namespace:   ev.Namespace,
+		User:        ev.User,
+		Error:       ev.Error,
+	}
+
+	if ev.Client != nil {
+		e.Client = &adminv1.Client{Uid: int32(ev.Client.UID), Pid: int32(ev.Client.PID), Exe: ev.Client.Exe}
+	}
+
+	return e
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Set in the environment of a proxy started by upgrade: the paths of the
+// sockets it takes over, one per line as vsock addresses contain colons,
+// the agent socket first, which it gets as file
+// descriptors 4 and up. File descriptor 3 is written to once it is ready.
+// The proxy lock is carried over as well, and engaged in the new proxy
+// when backends were locked in the proxy.
+const (
+	handoffEnv       = "SSH_AGENT_PROXY_SOCKETS"
+	handoffLockedEnv = "SSH_AGENT_PROXY_LOCKED"
+)
+
+// How long the new proxy may take to start
+const upgradeTimeout = 30 * time.Second
+
+var (
+	inherited     = map[string]net.Listener{}
+	inheritedPath string
+	readyFile     *os.File
+
+	// Set once the sockets were handed over, so they are left in place
+	handedOff atomic.Bool
+)
+
+// Takes over the sockets of the proxy that started this one, if any.
+func inheritSockets() error {
+	list := os.Getenv(handoffEnv)
+	if list == "" {
+		return nil
+	}
+	_ = os.Unsetenv(handoffEnv)
+
+	// The old proxy's shell commands are still in effect
+	*shellSh, *shellCsh = false, false
+
+	readyFile = os.NewFile(3, "ready")
+
+	for i, path := range strings.Split(list, "\n") {
+		var l net.Listener
+		var err error
+
+		if isVsock(path) {
+			l, err = inheritVsock(4+i, path)
+		} else {
+			f := os.NewFile(uintptr(4+i), path)
+			l, err = net.FileListener(f)
+			_ = f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("inherited socket %s: %w", path, err)
+		}
+
+		// Removed on exit like the sockets made by this proxy
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+
+		if i == 0 {
+			inheritedPath = path
+		}
+		inherited[path] = l
+	}
+
+	return nil
+}
+
+// Returns the inherited socket at path, nil if there is none.
+func takeInherited(path string) net.Listener {
+	l := inherited[path]
+	delete(inherited, path)
+
+	return l
+}
+
+// Reports whether the proxy lock was engaged when the proxy was upgraded.
+func inheritedLock() bool {
+	defer func() { _ = os.Unsetenv(handoffLockedEnv) }()
+
+	return os.Getenv(handoffLockedEnv) != ""
+}
+
+// Tells the proxy that started this one that it may go.
+func signalReady() {
+	if readyFile == nil {
+		return
+	}
+
+	_, _ = readyFile.Write([]byte{1})
+	_ = readyFile.Close()
+	readyFile = nil
+
+	// Sockets the new config no longer listens on
+	for path, l := range inherited {
+		_ = l.Close()
+		slog.Info("inherited socket closed", "path", path)
+	}
+}
+
+// Starts the proxy binary again whenever SIGUSR2 arrives, handing it the
+// sockets, and shuts down once it is up. Clients keep connecting to the same
+// sockets throughout.
+func upgradeOnSignal(sockets map[string]net.Listener, agentPath string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+
+	for range ch {
+		slog.Info("upgrading")
+
+		// The new proxy picks up where this one left off
+		if err := saveUsage(); err != nil {
+			slog.Warn("usage statistics not saved", "error", err)
+		}
+
+		// Published sockets come and go while the proxy runs
+		all := maps.Clone(sockets)
+		maps.Copy(all, publishedSockets())
+
+		if err := upgrade(all, agentPath); err != nil {
+			slog.Error("upgrade failed", "error", err)
+			continue
+		}
+
+		slog.Info("upgraded, handing over to the new proxy")
+
+		// The new proxy listens on them now
+		for _, l := range all {
+			if ul, ok := l.(interface{ SetUnlinkOnClose(bool) }); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+		handedOff.Store(true)
+		requestShutdown()
+
+		return
+	}
+}
+
+func upgrade(sockets map[string]net.Listener, agentPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	// The agent socket goes first
+	paths := []string{agentPath}
+	for path := range sockets {
+		if path != agentPath {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths[1:])
+
+	// The new proxy gets copies, closing these leaves the sockets open
+	files := []*os.File{w}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	for _, path := range paths {
+		fl, ok := sockets[path].(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("socket %s can't be handed over", path)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), handoffEnv+"="+strings.Join(paths, "\n"))
+	// Locks the proxy keeps for backends die with it, the new one keeps
+	// their keys hidden behind its own lock instead
+	if pkr.locked.Load() || pkr.emulated.anyLocked(nil) {
+		cmd.Env = append(cmd.Env, handoffLockedEnv+"=1")
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Only the new proxy may write, so its exit is noticed
+	_ = w.Close()
+
+	_ = r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		_ = cmd.Process.Kill()
+		go func() { _ = cmd.Wait() }()
+
+		return errors.New("new proxy didn't start, see its log")
+	}
+
+	// Not waited for by this process, which is about to exit
+	return cmd.Process.Release()
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// A backend agent for tests, serving an in-memory keyring on a socket in a
+// temporary directory. Its latency and failures can be changed while the
+// proxy uses it.
+type fakeAgent struct {
+	agent.ExtendedAgent
+
+	name   string
+	socket string
+
+	delay atomic.Int64
+	fail  atomic.Pointer[error]
+
+	// Requests served, by any client
+	requests atomic.Int64
+}
+
+var errFake = errors.New("fake agent failure")
+
+// Starts a fake backend agent holding keys fresh ed25519 keys commented with
+// its name.
+func newFakeAgent(t testing.TB, name string, keys int) *fakeAgent {
+	t.Helper()
+
+	f := &fakeAgent{
+		ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent),
+		name:          name,
+		socket:        filepath.Join(shortTempDir(t), name+".sock"),
+	}
+
+	for range keys {
+		f.addKey(t)
+	}
+
+	l, err := net.Listen("unix", f.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_ = agent.ServeAgent(f, conn)
+			}()
+		}
+	}()
+
+	return f
+}
+
+// Unix socket paths are short, too short for the test's own temporary
+// directory on some systems.
+func shortTempDir(t testing.TB) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "sap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	return dir
+}
+
+// Adds a fresh key to the agent, returning its public half.
+func (f *fakeAgent) addKey(t testing.TB) ssh.PublicKey {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.ExtendedAgent.Add(agent.AddedKey{PrivateKey: priv, Comment: f.name}); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// Makes every request take d longer.
+func (f *fakeAgent) setDelay(d time.Duration) {
+	f.delay.Store(int64(d))
+}
+
+// Makes every request fail with err, or succeed again when err is nil.
+func (f *fakeAgent) setFailure(err error) {
+	if err == nil {
+		f.fail.Store(nil)
+		return
+	}
+	f.fail.Store(&err)
+}
+
+func (f *fakeAgent) config() backendConfig {
+	return backendConfig{Name: f.name, Socket: f.socket}
+}
+
+// Counts the request, waits the delay and returns the failure set, if any.
+func (f *fakeAgent) serve() error {
+	f.requests.Add(1)
+	time.Sleep(time.Duration(f.delay.Load()))
+
+	if err := f.fail.Load(); err != nil {
+		return *err
+	}
+
+	return nil
+}
+
+func (f *fakeAgent) List() ([]*agent.Key, error) {
+	if err := f.serve(); err != nil {
+		return nil, err
+	}
+	return f.ExtendedAgent.List()
+}
+
+func (f *fakeAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return f.SignWithFlags(key, data, 0)
+}
+
+func (f *fakeAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := f.serve(); err != nil {
+		return nil, err
+	}
+	return f.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (f *fakeAgent) Add(key agent.AddedKey) error {
+	if err := f.serve(); err != nil {
+		return err
+	}
+	return f.ExtendedAgent.Add(key)
+}
+
+func (f *fakeAgent) Remove(key ssh.PublicKey) error {
+	if err := f.serve(); err != nil {
+		return err
+	}
+	return f.ExtendedAgent.Remove(key)
+}
+
+func (f *fakeAgent) RemoveAll() error {
+	if err := f.serve(); err != nil {
+		return err
+	}
+	return f.ExtendedAgent.RemoveAll()
+}
+
+func (f *fakeAgent) Lock(passphrase []byte) error {
+	if err := f.serve(); err != nil {
+		return err
+	}
+	return f.ExtendedAgent.Lock(passphrase)
+}
+
+func (f *fakeAgent) Unlock(passphrase []byte) error {
+	if err := f.serve(); err != nil {
+		return err
+	}
+	return f.ExtendedAgent.Unlock(passphrase)
+}
+
+// A proxy serving on a socket in a temporary directory, for tests.
+type testProxy struct {
+	keyring *proxyKeyring
+	socket  string
+}
+
+// Starts the proxy over the backends, replacing the global keyring for the
+// duration of the test. Tests using it mustn't run in parallel.
+func startProxy(t testing.TB, backends ...*fakeAgent) *testProxy {
+	t.Helper()
+
+	configs := make([]backendConfig, len(backends))
+	for i, b := range backends {
+		configs[i] = b.config()
+	}
+
+	return startProxyConfigs(t, configs...)
+}
+
+// Starts the proxy like startProxy, over backends of any kind.
+func startProxyConfigs(t testing.TB, configs ...backendConfig) *testProxy {
+	t.Helper()
+
+	kr, err := NewProxyKeyring(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The backends are served by the test's process
+	savedKeyring, savedPid := pkr, ownPid
+	pkr, ownPid = kr, 0
+	t.Cleanup(func() { pkr, ownPid = savedKeyring, savedPid })
+
+	p := &testProxy{keyring: kr, socket: filepath.Join(shortTempDir(t), "proxy.sock")}
+
+	l, err := net.Listen("unix", p.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, l, frontend{})
+	}()
+
+	t.Cleanup(func() {
+		_ = l.Close()
+		cancel()
+		<-done
+	})
+
+	return p
+}
+
+// Registers an in-process backend over the keys, like a KMS holding them,
+// returning its config.
+func newSignerBackend(t testing.TB, name string, keys int) backendConfig {
+	t.Helper()
+
+	var signers []agentSigner
+	for i := range keys {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signers = append(signers, agentSigner{signer: signer, comment: fmt.Sprintf("%s-%d", name, i)})
+	}
+
+	// Dialed from the cache of KMS agents, without reaching AWS
+	spec := "awskms:?key=" + name
+
+	awsKMSMu.Lock()
+	awsKMSAgents[spec] = &signerAgent{name: name, load: func() ([]agentSigner, error) { return signers, nil }}
+	awsKMSMu.Unlock()
+
+	t.Cleanup(func() {
+		awsKMSMu.Lock()
+		delete(awsKMSAgents, spec)
+		awsKMSMu.Unlock()
+	})
+
+	return backendConfig{Name: name, Socket: spec}
+}
+
+// Serves the proxy on a TCP port of localhost as well, as the remote
+// listeners do, returning its address.
+func (p *testProxy) serveTCP(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, l, frontend{})
+	}()
+
+	t.Cleanup(func() {
+		_ = l.Close()
+		cancel()
+		<-done
+	})
+
+	return l.Addr().String()
+}
+
+// Connects a client to the proxy, closed at the end of the test.
+func (p *testProxy) client(t *testing.T) agent.ExtendedAgent {
+	t.Helper()
+
+	conn, err := net.Dial("unix", p.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return agent.NewClient(conn)
+}
+
+// Lists the keys through the proxy, failing the test on error.
+func listKeys(t *testing.T, a agent.ExtendedAgent) []*agent.Key {
+	t.Helper()
+
+	keys, err := a.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	return keys
+}
+
+// Sets a command line flag for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = flag.Set(name, old) })
+}
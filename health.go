@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var healthInterval = flag.Duration("health-interval", 30*time.Second, "how often to probe the backends, 0 to only probe them when asked for their status")
+
+// The last known state of a backend, shared by every copy of it.
+type backendHealth struct {
+	mu      sync.Mutex
+	checked time.Time
+	up      bool
+	keys    int
+	err     string
+	since   time.Time
+
+	// Malformed replies in a row, and the last one once there were too
+	// many
+	protocolErrors int
+	quarantined    string
+
+	// Whether the backend listed keys, lists none since, and refused a
+	// request since, so is taken as locked, possibly by the proxy itself
+	listed        bool
+	emptied       bool
+	locked        bool
+	lockedByProxy bool
+	prompted      time.Time
+}
+
+// Records the outcome of talking to a backend. Changes between up and down
+// are logged once, repeated failures only at debug level.
+func (h *backendHealth) record(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	up := err == nil
+
+	if h.checked.IsZero() || up != h.up {
+		h.since = now
+
+		if !up {
+			slog.Warn("backend down", "backend", name, "error", err)
+			fireEvent(hookEvent{Event: "backend-down", Backend: name, Error: err.Error()})
+		} else if !h.checked.IsZero() {
+			slog.Info("backend up", "backend", name)
+			fireEvent(hookEvent{Event: "backend-up", Backend: name})
+		}
+	} else if !up {
+		slog.Debug("backend still down", "backend", name, "error", err)
+	}
+
+	h.checked = now
+	h.up = up
+	h.err = ""
+	if err != nil {
+		h.err = err.Error()
+	}
+}
+
+// Reports whether the backend has been talked to yet.
+func (h *backendHealth) known() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return !h.checked.IsZero()
+}
+
+// Copies the recorded state into st.
+func (h *backendHealth) fill(st *backendStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st.Up = h.up
+	st.Keys = h.keys
+	st.Error = h.err
+	st.Quarantined = h.quarantined
+	st.Locked = st.Locked || h.locked
+
+	// Shown wherever the error is, as the reason it stays out of use
+	if h.quarantined != "" {
+		st.Error = h.quarantined
+	}
+	st.Since = h.since
+	st.LastCheck = h.checked
+}
+
+// Checks whether a backend answers a List request.
+func probeBackend(ctx context.Context, b backend) {
+	ctx, cancel := backendContext(withOpTimeout(probeContext(ctx), *listTimeout))
+	defer cancel()
+
+	conn, err := dialBackend(ctx, b.spec)
+	if err != nil {
+		b.health.record(b.name, err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	keys, err := checkedAgent{agent.NewClient(conn), ctx, b}.List()
+	if err == nil {
+		b.health.mu.Lock()
+		b.health.keys = len(keys)
+		b.health.mu.Unlock()
+	}
+
+	b.health.record(b.name, err)
+}
+
+// Probes every enabled backend now and then every interval, until ctx is
+// done.
+func (r *proxyKeyring) monitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range r.Backends() {
+			if !b.disabled && b.health.quarantine() == "" {
+				probeBackend(ctx, b)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
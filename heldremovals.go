@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type (
+	// The removals the policy holds for an admin to approve. Their keys are
+	// hidden from clients as if removed, but stay in the backends until the
+	// removal is approved; rejecting it, or restarting the proxy, brings
+	// them back.
+	heldRemovals struct {
+		mu      sync.Mutex
+		lastID  int
+		pending []*heldRemoval
+	}
+
+	heldRemoval struct {
+		ID     int       `json:"id"`
+		Op     string    `json:"op"`
+		Keys   []heldKey `json:"keys"`
+		Client string    `json:"client"`
+		Time   time.Time `json:"time"`
+	}
+
+	heldKey struct {
+		Fingerprint string `json:"fingerprint"`
+		Backend     string `json:"backend"`
+
+		key ssh.PublicKey
+	}
+)
+
+var errRemovalHeld = errors.New("removal held for approval")
+
+func init() {
+	subcommands["removals"] = cmdRemovals
+
+	adminCommands["held-removals"] = func(args []string) (any, error) {
+		return pkr.held.list(), nil
+	}
+	adminCommands["approve-removal"] = func(args []string) (any, error) {
+		id, err := removalID(args)
+		if err != nil {
+			return nil, err
+		}
+		return nil, pkr.approveRemoval(id)
+	}
+	adminCommands["reject-removal"] = func(args []string) (any, error) {
+		id, err := removalID(args)
+		if err != nil {
+			return nil, err
+		}
+		return nil, pkr.rejectRemoval(id)
+	}
+}
+
+func removalID(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, errors.New("usage: approve-removal|reject-removal <id>")
+	}
+
+	return strconv.Atoi(args[0])
+}
+
+// Hides the keys a client asked to remove until an admin decides, and
+// reports it.
+func (r *proxyKeyring) holdRemoval(ctx context.Context, op string, keys []ssh.PublicKey, peer peerCred) {
+	defer r.cache.invalidate()
+
+	hr := &heldRemoval{Op: op, Client: peer.String(), Time: time.Now()}
+	for _, key := range keys {
+		hr.Keys = append(hr.Keys, heldKey{Fingerprint: ssh.FingerprintSHA256(key), Backend: r.owner(key), key: key})
+	}
+
+	h := &r.held
+	h.mu.Lock()
+	h.lastID++
+	hr.ID = h.lastID
+	h.pending = append(h.pending, hr)
+	h.mu.Unlock()
+
+	slog.WarnContext(ctx, "removal held for approval", "id", hr.ID, "op", op, "keys", len(keys), "uid", peer.uid, "pid", peer.pid, "exe", peer.exe)
+
+	ev := hookEvent{Event: "removal-held", Client: &hookClient{UID: peer.uid, PID: peer.pid, Exe: peer.exe}, Removal: hr.ID}
+	if len(keys) == 1 {
+		ev.Fingerprint, ev.Backend = hr.Keys[0].Fingerprint, hr.Keys[0].Backend
+	}
+	ev.Conn, ev.Request = correlationOf(ctx).ids()
+	fireEvent(ev)
+}
+
+// Reports whether the key is hidden by a held removal.
+func (h *heldRemovals) hidden(blob []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, hr := range h.pending {
+		for _, k := range hr.Keys {
+			if string(k.key.Marshal()) == string(blob) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Drops the keys of held removals from a listing.
+func (h *heldRemovals) filter(keys []*agent.Key) []*agent.Key {
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool {
+		return h.hidden(k.Blob)
+	})
+}
+
+// Returns the held removals, oldest first.
+func (h *heldRemovals) list() []heldRemoval {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := make([]heldRemoval, 0, len(h.pending))
+	for _, hr := range h.pending {
+		list = append(list, *hr)
+	}
+
+	return list
+}
+
+// Takes the held removal with the id off the list.
+func (h *heldRemovals) take(id int) (*heldRemoval, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := slices.IndexFunc(h.pending, func(hr *heldRemoval) bool { return hr.ID == id })
+	if i < 0 {
+		return nil, fmt.Errorf("no held removal %d", id)
+	}
+
+	hr := h.pending[i]
+	h.pending = slices.Delete(h.pending, i, i+1)
+
+	return hr, nil
+}
+
+// Removes the keys of a held removal from their backends.
+func (r *proxyKeyring) approveRemoval(id int) error {
+	defer r.cache.invalidate()
+
+	hr, err := r.held.take(id)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, k := range hr.Keys {
+		for backend, a := range r.agents(context.Background(), []string{k.Backend}) {
+			if err := a.Remove(k.key); err != nil {
+				errs = append(errs, fmt.Errorf("%s from %s: %w", k.Fingerprint, backend, err))
+				continue
+			}
+
+			r.expiries.forget(k.key)
+			if s := supervisorOf(backend); s != nil {
+				s.forget(k.key)
+			}
+		}
+	}
+
+	slog.Info("held removal approved", "id", id, "op", hr.Op, "keys", len(hr.Keys), "errors", len(errs))
+
+	return errors.Join(errs...)
+}
+
+// Drops a held removal, listing its keys again.
+func (r *proxyKeyring) rejectRemoval(id int) error {
+	defer r.cache.invalidate()
+
+	hr, err := r.held.take(id)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("held removal rejected", "id", id, "op", hr.Op, "keys", len(hr.Keys))
+
+	return nil
+}
+
+// Lists the held removals, or approves or rejects one.
+func cmdRemovals(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: removals list|approve|reject [flags] [id]")
+	}
+
+	fs, cf := newClientFlags("removals " + args[0])
+	_ = fs.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		var held []heldRemoval
+		if err := adminCall(cf.adminSocket, "held-removals", nil, &held); err != nil {
+			return err
+		}
+
+		if cf.json {
+			return printJSON(held)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "ID\tOP\tCLIENT\tSINCE\tKEYS")
+		for _, hr := range held {
+			var keys []string
+			for _, k := range hr.Keys {
+				keys = append(keys, k.Fingerprint+" ("+k.Backend+")")
+			}
+			_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", hr.ID, hr.Op, hr.Client, sinceString(hr.Time), strings.Join(keys, ", "))
+		}
+		return tw.Flush()
+
+	case "approve", "reject":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: removals %s [flags] <id>", args[0])
+		}
+		return adminCall(cf.adminSocket, args[0]+"-removal", fs.Args(), nil)
+
+	default:
+		return fmt.Errorf("unknown removals command %q", args[0])
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type (
+	// A hook run on agent events. Command is run with the event as JSON on
+	// stdin and its name in SSH_AGENT_PROXY_EVENT; URL is sent the event in
+	// a POST request.
+	hookConfig struct {
+		Events  []string `json:"events"`
+		Command []string `json:"command,omitempty"`
+		URL     string   `json:"url,omitempty"`
+	}
+
+	hookEvent struct {
+		Event       string      `json:"event"`
+		Time        time.Time   `json:"time"`
+		Backend     string      `json:"backend,omitempty"`
+		Fingerprint string      `json:"fingerprint,omitempty"`
+		Purpose     string      `json:"purpose,omitempty"`
+		Namespace   string      `json:"namespace,omitempty"`
+		User        string      `json:"user,omitempty"`
+		Client      *hookClient `json:"client,omitempty"`
+		Error       string      `json:"error,omitempty"`
+
+		// For sign-failures, how many signatures failed in a row, for
+		// backend-quarantined how many malformed replies
+		Failures int `json:"failures,omitempty"`
+
+		// For removal-held, the ID to approve or reject it by
+		Removal int `json:"removal,omitempty"`
+
+		// The client connection and its request the event comes from
+		Conn    uint64 `json:"conn,omitempty"`
+		Request uint64 `json:"request,omitempty"`
+	}
+
+	hookClient struct {
+		UID int    `json:"uid"`
+		PID int    `json:"pid"`
+		Exe string `json:"exe,omitempty"`
+	}
+
+	// An agent reporting the requests of one client connection to the hooks
+	// and notifications.
+	eventAgent struct {
+		agent.ExtendedAgent
+		ctx  context.Context
+		peer peerCred
+	}
+)
+
+const (
+	hookTimeout = 10 * time.Second
+
+	// How many of the latest events the admin socket can tell
+	recentEventsMax = 100
+)
+
+var (
+	hooks []hookConfig
+
+	recentMu     sync.Mutex
+	recentEvents []hookEvent
+	eventSubs    = map[chan hookEvent]bool{}
+
+	hookEvents = []string{"connect", "add", "sign-success", "sign-denied", "sign-failures", "removal-held", "lock", "unlock", "backend-down", "backend-up", "backend-quarantined", "backend-locked", "backend-unlocked"}
+)
+
+func (h hookConfig) validate() error {
+	if len(h.Events) == 0 {
+		return errors.New("no events")
+	}
+
+	for _, ev := range h.Events {
+		if !slices.Contains(hookEvents, ev) {
+			return fmt.Errorf("unknown event %q", ev)
+		}
+	}
+
+	if (len(h.Command) > 0) == (h.URL != "") {
+		return errors.New("needs either a command or a url")
+	}
+
+	return nil
+}
+
+// Runs the hooks subscribed to the event in the background, and keeps it
+// among the recent events.
+func fireEvent(ev hookEvent) {
+	ev.Time = time.Now()
+
+	recentMu.Lock()
+	// Connections are too many to keep, they would crowd out the rest
+	if ev.Event != "connect" {
+		if len(recentEvents) == recentEventsMax {
+			recentEvents = slices.Delete(recentEvents, 0, 1)
+		}
+		recentEvents = append(recentEvents, ev)
+	}
+
+	// Subscribers too slow to keep up miss events rather than hold up others
+	for ch := range eventSubs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	recentMu.Unlock()
+
+	for _, h := range hooks {
+		if slices.Contains(h.Events, ev.Event) {
+			go h.run(ev)
+		}
+	}
+}
+
+// Returns the recent events, oldest first.
+func latestEvents() []hookEvent {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+
+	return slices.Clone(recentEvents)
+}
+
+// Returns the recent events if asked for them and a channel receiving the
+// events to come, until unsubscribe is called.
+func subscribeEvents(recent bool) (events []hookEvent, ch <-chan hookEvent, unsubscribe func()) {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+
+	if recent {
+		events = slices.Clone(recentEvents)
+	}
+
+	sub := make(chan hookEvent, recentEventsMax)
+	eventSubs[sub] = true
+
+	return events, sub, func() {
+		recentMu.Lock()
+		defer recentMu.Unlock()
+
+		delete(eventSubs, sub)
+	}
+}
+
+func (h hookConfig) run(ev hookEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	if len(h.Command) > 0 {
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Env = append(os.Environ(), "SSH_AGENT_PROXY_EVENT="+ev.Event)
+		cmd.Stdin = bytes.NewReader(payload)
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			slog.Warn("hook failed", "event", ev.Event, "command", h.Command[0], "error", err, "output", string(out))
+		}
+
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(payload))
+	if err != nil {
+		slog.Warn("hook failed", "event", ev.Event, "url", h.URL, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Warn("hook failed", "event", ev.Event, "url", h.URL, "error", err)
+		return
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		slog.Warn("hook failed", "event", ev.Event, "url", h.URL, "status", res.Status)
+	}
+}
+
+// Returns the event for a request of the client, concerning key if it is
+// not nil.
+func (a *eventAgent) event(name string, key ssh.PublicKey, err error) hookEvent {
+	ev := hookEvent{Event: name, Client: &hookClient{UID: a.peer.uid, PID: a.peer.pid, Exe: a.peer.exe}}
+	ev.Conn, ev.Request = correlationOf(a.ctx).ids()
+
+	if key != nil {
+		ev.Fingerprint = ssh.FingerprintSHA256(key)
+		ev.Backend = pkr.owner(key)
+	}
+
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	return ev
+}
+
+// Returns the event for a signing request of the client.
+func (a *eventAgent) signEvent(name string, key ssh.PublicKey, d signData, err error) hookEvent {
+	ev := a.event(name, key, err)
+	ev.Purpose, ev.Namespace, ev.User = d.purpose, d.namespace, d.user
+
+	return ev
+}
+
+func (a *eventAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *eventAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	sig, err := a.ExtendedAgent.SignWithFlags(key, data, flags)
+
+	d := parseSignData(data)
+
+	switch {
+	case err == nil:
+		ev := a.signEvent("sign-success", key, d, nil)
+		recordUsage(ev.Fingerprint, ev.Backend)
+		fireEvent(ev)
+
+		if *notifySign {
+			notifySignature(key, a.peer, d)
+		}
+	case errors.Is(err, errPolicyDenied), errors.Is(err, errRateLimited), errors.Is(err, errQuotaExceeded), errors.Is(err, errLocked), errors.Is(err, errKeyNotVisible), errors.Is(err, errPrincipalNotEntitled), errors.Is(err, errWeakKey):
+		fireEvent(a.signEvent("sign-denied", key, d, err))
+	}
+
+	a.checkSignFailures(key, d, err)
+
+	return sig, err
+}
+
+func (a *eventAgent) Add(key agent.AddedKey) error {
+	err := a.ExtendedAgent.Add(key)
+	if err == nil {
+		pub, _ := publicKeyOf(key)
+		fireEvent(a.event("add", pub, nil))
+	}
+
+	return err
+}
+
+func (a *eventAgent) Lock(passphrase []byte) error {
+	err := a.ExtendedAgent.Lock(passphrase)
+	if err == nil {
+		fireEvent(a.event("lock", nil, nil))
+	}
+
+	return err
+}
+
+func (a *eventAgent) Unlock(passphrase []byte) error {
+	err := a.ExtendedAgent.Unlock(passphrase)
+	if err == nil {
+		fireEvent(a.event("unlock", nil, nil))
+	}
+
+	return err
+}
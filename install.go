@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	systemdUnitName = "ssh-agent-proxy.service"
+	launchdLabel    = "com.github.noj.ssh-agent-proxy"
+)
+
+// Generates a user service running the proxy with the arguments after --,
+// printing it or, with --write, installing it.
+func cmdInstall(args []string) error {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	systemd := fs.Bool("systemd", false, "generate a systemd user service")
+	launchd := fs.Bool("launchd", false, "generate a launchd LaunchAgent")
+	write := fs.Bool("write", false, "install the file instead of printing it")
+	_ = fs.Parse(args)
+
+	if *systemd == *launchd {
+		return errors.New("usage: install --systemd|--launchd [--write] [-- proxy flags and backends]")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	command := append([]string{exe}, fs.Args()...)
+
+	var unit, path, enable string
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	if *systemd {
+		unit = systemdUnit(command)
+		path = filepath.Join(home, ".config", "systemd", "user", systemdUnitName)
+		enable = "systemctl --user daemon-reload && systemctl --user enable --now " + systemdUnitName
+	} else {
+		unit = launchdPlist(command)
+		path = filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist")
+		enable = "launchctl load -w " + path
+	}
+
+	if !*write {
+		fmt.Print(unit)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, []byte(unit), 0o644); err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %s, start it with:\n  %s\n", path, enable)
+
+	return nil
+}
+
+func systemdUnit(command []string) string {
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = systemdQuote(arg)
+	}
+
+	return fmt.Sprintf(`[Unit]
+Description=SSH agent proxy
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`, strings.Join(quoted, " "))
+}
+
+// Quotes an argument for ExecStart, escaping systemd's specifiers and
+// variable expansion.
+func systemdQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+	return `"` + r.Replace(arg) + `"`
+}
+
+func launchdPlist(command []string) string {
+	var b strings.Builder
+
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + launchdLabel + `</string>
+	<key>ProgramArguments</key>
+	<array>
+`)
+
+	for _, arg := range command {
+		b.WriteString("\t\t<string>")
+		_ = xml.EscapeText(&b, []byte(arg))
+		b.WriteString("</string>\n")
+	}
+
+	b.WriteString(`	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`)
+
+	return b.String()
+}
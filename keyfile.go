@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Reads a private key file the way ssh-add does: the comment is taken from
+// the matching .pub file when there is one, and a -cert.pub next to the key
+// is loaded as its certificate.
+func loadKeyFile(path string) (agent.AddedKey, error) {
+	var added agent.AddedKey
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return added, err
+	}
+	defer clear(pem)
+
+	key, err := ssh.ParseRawPrivateKey(pem)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		key, err = decryptKey(path, pem)
+	}
+
+	if err != nil {
+		return added, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	added.PrivateKey = key
+	added.Comment = path
+
+	if pub, err := os.ReadFile(path + ".pub"); err == nil {
+		if _, comment, _, _, err := ssh.ParseAuthorizedKey(pub); err == nil && comment != "" {
+			added.Comment = comment
+		}
+	}
+
+	if raw, err := os.ReadFile(path + "-cert.pub"); err == nil {
+		if pub, _, _, _, err := ssh.ParseAuthorizedKey(raw); err == nil {
+			if cert, ok := pub.(*ssh.Certificate); ok {
+				added.Certificate = cert
+			}
+		}
+	}
+
+	return added, nil
+}
+
+// Decrypts a key with the passphrase in the keychain, or else prompts for
+// it, giving the user three tries.
+func decryptKey(path string, pem []byte) (any, error) {
+	if pass, err := keychainPassphrase(keychainAccount(path)); err == nil {
+		key, err := ssh.ParseRawPrivateKeyWithPassphrase(pem, pass)
+		clear(pass)
+
+		if err == nil {
+			return key, nil
+		}
+		slog.Warn("key file not decrypted with the keychain passphrase", "file", path, "error", err)
+	} else if !errors.Is(err, errNoKeychainEntry) {
+		slog.Warn("key file passphrase not looked up", "file", path, "error", err)
+	}
+
+	for range 3 {
+		pass, err := askPassphrase(fmt.Sprintf("Enter passphrase for %s: ", path))
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ssh.ParseRawPrivateKeyWithPassphrase(pem, pass)
+		clear(pass)
+
+		if !errors.Is(err, x509.IncorrectPasswordError) {
+			return key, err
+		}
+
+		fmt.Fprintln(os.Stderr, "Bad passphrase, try again.")
+	}
+
+	return nil, x509.IncorrectPasswordError
+}
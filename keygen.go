@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// A key generated by the proxy, whose private half never left it.
+type generatedKey struct {
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+	Backend     string `json:"backend,omitempty"`
+}
+
+func init() {
+	subcommands["keygen"] = cmdKeygen
+
+	adminCommands["generate-key"] = func(args []string) (any, error) {
+		if len(args) != 6 {
+			return nil, errors.New("usage: generate-key <type> <bits> <comment> <backend> <lifetime> <confirm>")
+		}
+
+		bits, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("bits: %w", err)
+		}
+		lifetime, err := strconv.ParseUint(args[4], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("lifetime: %w", err)
+		}
+		confirm, err := strconv.ParseBool(args[5])
+		if err != nil {
+			return nil, fmt.Errorf("confirm: %w", err)
+		}
+
+		return generateKey(args[0], bits, args[2], args[3], uint32(lifetime), confirm)
+	}
+}
+
+// Makes a new private key of the type, bits being the RSA modulus or ECDSA
+// curve size, 0 for the default.
+func newPrivateKey(typ string, bits int) (crypto.Signer, error) {
+	switch typ {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ecdsa":
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("ecdsa keys have 256, 384 or 521 bits, not %d", bits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case "rsa":
+		if bits == 0 {
+			bits = 3072
+		}
+		if bits < 2048 {
+			return nil, fmt.Errorf("rsa keys have at least 2048 bits, not %d", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	default:
+		return nil, fmt.Errorf("unknown key type %q, want ed25519, ecdsa or rsa", typ)
+	}
+}
+
+// Generates a key and adds it to the backend, or to the first that takes
+// it when backend is empty, as ssh-add would through the proxy.
+func generateKey(typ string, bits int, comment, backend string, lifetime uint32, confirm bool) (*generatedKey, error) {
+	if *readOnly {
+		return nil, errReadOnlyProxy
+	}
+
+	if backend != "" && !pkr.hasBackend(backend) {
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+
+	key, err := newPrivateKey(typ, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var only []string
+	if backend != "" {
+		only = []string{backend}
+	}
+
+	added := agent.AddedKey{PrivateKey: key, Comment: comment, LifetimeSecs: lifetime, ConfirmBeforeUse: confirm}
+	if err := pkr.WithContext(context.Background(), only).Add(added); err != nil {
+		return nil, err
+	}
+
+	fingerprint := ssh.FingerprintSHA256(pub)
+
+	// Which backend took it, when any might have
+	if backend == "" {
+		keys, _ := pkr.Keys()
+		for _, k := range keys {
+			if k.Fingerprint == fingerprint {
+				backend = k.Backend
+			}
+		}
+	}
+
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		line += " " + comment
+	}
+
+	return &generatedKey{PublicKey: line, Fingerprint: fingerprint, Backend: backend}, nil
+}
+
+func cmdKeygen(args []string) error {
+	fs, cf := newClientFlags("keygen")
+	typ := fs.String("type", "ed25519", "key type: ed25519, ecdsa or rsa")
+	bits := fs.Int("bits", 0, "RSA modulus or ECDSA curve size, 0 for the default")
+	comment := fs.String("comment", "", "comment of the key")
+	backend := fs.String("backend", "", "backend to add the key to, or \"internal\"; the first that takes it by default")
+	lifetime := fs.Duration("lifetime", 0, "remove the key after this long, 0 to keep it")
+	confirm := fs.Bool("confirm", false, "confirm each use of the key")
+	output := fs.String("output", "", "also write the public key to this file")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return errors.New("usage: keygen [flags]")
+	}
+
+	callArgs := []string{*typ, strconv.Itoa(*bits), *comment, *backend, strconv.Itoa(int(lifetime.Seconds())), strconv.FormatBool(*confirm)}
+
+	var key generatedKey
+	if err := adminCall(cf.adminSocket, "generate-key", callArgs, &key); err != nil {
+		return err
+	}
+
+	if *output != "" {
+		if err := os.WriteFile(expandPath(*output), []byte(key.PublicKey+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+
+	if cf.json {
+		return printJSON(key)
+	}
+
+	fmt.Println(key.PublicKey)
+
+	return nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	keyringFile     = flag.String("keyring-file", "", "keep the keys added to the internal keyring in this file, encrypted with age, across restarts")
+	keyringIdentity = flag.String("keyring-identity", "", "age identity file the keyring file is encrypted for, instead of a passphrase given with ssh-add -X")
+)
+
+// A key as kept in the keyring file.
+type storedKey struct {
+	PrivateKey  string `json:"private_key"`
+	Certificate string `json:"certificate,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+	Confirm     bool   `json:"confirm,omitempty"`
+}
+
+// The internal keyring, writing the keys clients add to an encrypted file
+// and reading them back on the next start. Keys added with a lifetime are
+// meant to go away and aren't written.
+//
+// With a passphrase rather than an age identity, the file can only be read
+// once the user gives it: until then the keyring is closed and the proxy
+// locked, and ssh-add -X opens it.
+type persistentKeyring struct {
+	*guardedKeyring
+	path string
+
+	// The keys written to the file, by public key
+	mu        sync.Mutex
+	saved     map[string]bool
+	recipient age.Recipient
+	identity  age.Identity
+	pass      *secret
+
+	saveMu sync.Mutex
+	saving sync.WaitGroup
+}
+
+func newPersistentKeyring(path string) (*persistentKeyring, error) {
+	k := &persistentKeyring{
+		guardedKeyring: newGuardedKeyring(),
+		path:           expandPath(path),
+		saved:          map[string]bool{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o700); err != nil {
+		return nil, err
+	}
+
+	if *keyringIdentity == "" {
+		return k, nil
+	}
+
+	b, err := os.ReadFile(expandPath(*keyringIdentity))
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := age.ParseIdentities(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", *keyringIdentity, err)
+	}
+
+	x, ok := ids[0].(*age.X25519Identity)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an X25519 identity", *keyringIdentity)
+	}
+
+	k.identity, k.recipient = x, x.Recipient()
+
+	return k, k.load()
+}
+
+// Reports whether the keyring waits for its passphrase.
+func (k *persistentKeyring) closed() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.recipient == nil
+}
+
+// Opens the keyring with its passphrase, which encrypts the file from now
+// on when there is none yet.
+func (k *persistentKeyring) open(passphrase []byte) error {
+	id, err := age.NewScryptIdentity(string(passphrase))
+	if err != nil {
+		return err
+	}
+
+	r, err := age.NewScryptRecipient(string(passphrase))
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.identity = id
+	k.mu.Unlock()
+
+	if err := k.load(); err != nil {
+		k.mu.Lock()
+		k.identity = nil
+		k.mu.Unlock()
+
+		return err
+	}
+
+	k.mu.Lock()
+	k.recipient, k.pass = r, newSecret(passphrase)
+	k.mu.Unlock()
+
+	return nil
+}
+
+// Reads the keys from the file, if there is one yet.
+func (k *persistentKeyring) load() error {
+	f, err := os.Open(k.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	k.mu.Lock()
+	id := k.identity
+	k.mu.Unlock()
+
+	r, err := age.Decrypt(f, id)
+	if err != nil {
+		return fmt.Errorf("decrypting %s: %w", k.path, err)
+	}
+
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	defer clear(plain)
+
+	var stored []storedKey
+	if err := json.Unmarshal(plain, &stored); err != nil {
+		return fmt.Errorf("%s: %w", k.path, err)
+	}
+
+	for _, s := range stored {
+		key, err := s.added()
+		if err != nil {
+			slog.Warn("key in keyring file skipped", "file", k.path, "error", err)
+			continue
+		}
+
+		if err := k.keep(key); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("keyring file loaded", "file", k.path, "keys", len(stored))
+
+	return nil
+}
+
+func (s storedKey) added() (agent.AddedKey, error) {
+	key, err := ssh.ParseRawPrivateKey([]byte(s.PrivateKey))
+	if err != nil {
+		return agent.AddedKey{}, err
+	}
+
+	added := agent.AddedKey{PrivateKey: key, Comment: s.Comment, ConfirmBeforeUse: s.Confirm}
+
+	if s.Certificate != "" {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.Certificate))
+		if err != nil {
+			return agent.AddedKey{}, err
+		}
+
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			return agent.AddedKey{}, errors.New("not a certificate")
+		}
+		added.Certificate = cert
+	}
+
+	return added, nil
+}
+
+func (k *persistentKeyring) Add(key agent.AddedKey) error {
+	if err := k.keep(key); err != nil {
+		return err
+	}
+
+	k.saveLater()
+
+	return nil
+}
+
+// Adds a key, remembering it for the file unless it has a lifetime.
+func (k *persistentKeyring) keep(key agent.AddedKey) error {
+	if err := k.guardedKeyring.Add(key); err != nil {
+		return err
+	}
+
+	if key.LifetimeSecs > 0 {
+		return nil
+	}
+
+	pub, err := publicKeyOf(key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.saved[string(pub.Marshal())] = true
+	k.mu.Unlock()
+
+	return nil
+}
+
+// Unlock unlocks the keyring. While it has no file yet, this is where it
+// learns the passphrase to encrypt one with.
+func (k *persistentKeyring) Unlock(passphrase []byte) error {
+	if err := k.guardedKeyring.Unlock(passphrase); err != nil {
+		return err
+	}
+
+	if !k.closed() {
+		return nil
+	}
+
+	if err := k.open(passphrase); err != nil {
+		return err
+	}
+
+	k.saveLater()
+
+	return nil
+}
+
+func (k *persistentKeyring) Remove(key ssh.PublicKey) error {
+	if err := k.guardedKeyring.Remove(key); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	delete(k.saved, string(key.Marshal()))
+	k.mu.Unlock()
+
+	k.saveLater()
+
+	return nil
+}
+
+func (k *persistentKeyring) RemoveAll() error {
+	if err := k.guardedKeyring.RemoveAll(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	clear(k.saved)
+	k.mu.Unlock()
+
+	k.saveLater()
+
+	return nil
+}
+
+// Returns the public key of a key being added, its certificate if it has
+// one.
+func publicKeyOf(key agent.AddedKey) (ssh.PublicKey, error) {
+	if key.Certificate != nil {
+		return key.Certificate, nil
+	}
+
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.PublicKey(), nil
+}
+
+// Saves in the background, as encrypting with a passphrase takes a while.
+func (k *persistentKeyring) saveLater() {
+	k.saving.Add(1)
+	go func() {
+		defer k.saving.Done()
+		k.save()
+	}()
+}
+
+// Writes the keys out, replacing the file at once. Does nothing while the
+// keyring waits for its passphrase, since the file can't be encrypted yet.
+func (k *persistentKeyring) save() {
+	k.saveMu.Lock()
+	defer k.saveMu.Unlock()
+
+	k.mu.Lock()
+	recipient := k.recipient
+
+	var stored []storedKey
+	k.each(func(blob string, key agent.AddedKey) {
+		if !k.saved[blob] {
+			return
+		}
+
+		block, err := ssh.MarshalPrivateKey(key.PrivateKey, key.Comment)
+		if err != nil {
+			slog.Warn("key not written to keyring file", "comment", key.Comment, "error", err)
+			return
+		}
+
+		s := storedKey{PrivateKey: string(pem.EncodeToMemory(block)), Comment: key.Comment, Confirm: key.ConfirmBeforeUse}
+		if key.Certificate != nil {
+			s.Certificate = string(ssh.MarshalAuthorizedKey(key.Certificate))
+		}
+		stored = append(stored, s)
+	})
+	k.mu.Unlock()
+
+	if recipient == nil {
+		return
+	}
+
+	if err := k.write(recipient, stored); err != nil {
+		slog.Error("keyring file not written", "file", k.path, "error", err)
+	}
+}
+
+func (k *persistentKeyring) write(recipient age.Recipient, stored []storedKey) error {
+	plain, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	defer clear(plain)
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Reports whether the keyring waits for the passphrase of an existing file.
+func (k *persistentKeyring) pending() bool {
+	if !k.closed() {
+		return false
+	}
+
+	_, err := os.Stat(k.path)
+	return err == nil
+}
+
+// Zeroes the keys and the passphrase, once the file is written.
+func (k *persistentKeyring) wipe() {
+	k.saving.Wait()
+
+	k.guardedKeyring.wipe()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.pass.destroy()
+	k.pass = nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An in-memory keyring keeping its private keys in secrets rather than on
+// the Go heap, which they are only parsed onto while signing. The secrets
+// are zeroed once the key is removed or expires, and on shutdown.
+type guardedKeyring struct {
+	agent.ExtendedAgent
+
+	// Held for writing while secrets are destroyed, and for reading while
+	// the keyring may use them
+	mu   sync.RWMutex
+	keys map[string]guardedKey
+}
+
+// A key of the keyring, with the secret its private parts are kept in.
+type guardedKey struct {
+	added   agent.AddedKey
+	secret  *secret
+	expires time.Time
+}
+
+// A private key kept marshaled in a secret.
+type guardedPrivateKey struct {
+	pub    crypto.PublicKey
+	secret *secret
+}
+
+// Signs with a key of a guarded keyring, so that signers handed out don't
+// outlive its secret.
+type guardedSigner struct {
+	keyring *guardedKeyring
+	pub     ssh.PublicKey
+}
+
+func newGuardedKeyring() *guardedKeyring {
+	return &guardedKeyring{
+		ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent),
+		keys:          map[string]guardedKey{},
+	}
+}
+
+// Keeps a private key marshaled in a secret, returning a signer that parses
+// it onto the heap for each signature only. Keys that can't be marshaled,
+// such as DSA ones, and keys guarded already are returned as they are with
+// a nil secret.
+func guardKey(key any) (any, *secret) {
+	switch k := key.(type) {
+	case *guardedPrivateKey:
+		return k, nil
+	case *ed25519.PrivateKey:
+		key = *k
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return key, nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return key, nil
+	}
+	defer clear(der)
+
+	s := newSecret(der)
+
+	return &guardedPrivateKey{pub: signer.Public(), secret: s}, s
+}
+
+// Parses the key out of its secret. It stays on the heap until wiped.
+func (k *guardedPrivateKey) open() (any, error) {
+	return x509.ParsePKCS8PrivateKey(k.secret.bytes())
+}
+
+func (k *guardedPrivateKey) Public() crypto.PublicKey {
+	return k.pub
+}
+
+func (k *guardedPrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key, err := k.open()
+	if err != nil {
+		return nil, err
+	}
+	defer wipeKey(key)
+
+	return key.(crypto.Signer).Sign(rand, digest, opts)
+}
+
+// Zeroes the private parts of a parsed key.
+func wipeKey(key any) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		clear(k)
+	case *ecdsa.PrivateKey:
+		clear(k.D.Bits())
+	case *rsa.PrivateKey:
+		for _, n := range append([]*big.Int{k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv}, k.Primes...) {
+			if n != nil {
+				clear(n.Bits())
+			}
+		}
+	}
+}
+
+func (g *guardedKeyring) Add(key agent.AddedKey) error {
+	pub, err := publicKeyOf(key)
+	if err != nil {
+		return err
+	}
+
+	var s *secret
+	key.PrivateKey, s = guardKey(key.PrivateKey)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.ExtendedAgent.Add(key); err != nil {
+		s.destroy()
+		return err
+	}
+
+	// Expiring no earlier than the keyring lets go of it
+	k := guardedKey{added: key, secret: s}
+	if key.LifetimeSecs > 0 {
+		k.expires = time.Now().Add(time.Duration(key.LifetimeSecs) * time.Second)
+	}
+
+	// Replacing the key added before
+	g.keys[string(pub.Marshal())].secret.destroy()
+	g.keys[string(pub.Marshal())] = k
+
+	g.expire()
+
+	return nil
+}
+
+// Destroys the secrets of keys past their lifetime, which the keyring
+// drops before it next uses any key. Called with mu held for writing.
+func (g *guardedKeyring) expire() {
+	now := time.Now()
+
+	for blob, k := range g.keys {
+		if !k.expires.IsZero() && now.After(k.expires) {
+			k.secret.destroy()
+			delete(g.keys, blob)
+		}
+	}
+}
+
+func (g *guardedKeyring) List() ([]*agent.Key, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.expire()
+
+	return g.ExtendedAgent.List()
+}
+
+func (g *guardedKeyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return g.SignWithFlags(key, data, 0)
+}
+
+func (g *guardedKeyring) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (g *guardedKeyring) Signers() ([]ssh.Signer, error) {
+	signers, err := g.ExtendedAgent.Signers()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]ssh.Signer, len(signers))
+	for i, s := range signers {
+		res[i] = guardedSigner{g, s.PublicKey()}
+	}
+
+	return res, nil
+}
+
+func (g *guardedKeyring) Remove(key ssh.PublicKey) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.ExtendedAgent.Remove(key); err != nil {
+		return err
+	}
+
+	g.keys[string(key.Marshal())].secret.destroy()
+	delete(g.keys, string(key.Marshal()))
+
+	return nil
+}
+
+func (g *guardedKeyring) RemoveAll() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.ExtendedAgent.RemoveAll(); err != nil {
+		return err
+	}
+
+	g.destroy()
+
+	return nil
+}
+
+// Destroys the secrets of every key. Called with mu held for writing.
+func (g *guardedKeyring) destroy() {
+	for _, k := range g.keys {
+		k.secret.destroy()
+	}
+	clear(g.keys)
+}
+
+// Drops every key and zeroes its secret, on shutdown.
+func (g *guardedKeyring) wipe() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// A locked keyring refuses to remove its keys, which can't sign once
+	// their secrets are gone anyway
+	_ = g.ExtendedAgent.RemoveAll()
+
+	g.destroy()
+}
+
+// Calls fn with every key held, its private key parsed for the call only.
+func (g *guardedKeyring) each(fn func(blob string, key agent.AddedKey)) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for blob, k := range g.keys {
+		key := k.added
+
+		guarded, ok := key.PrivateKey.(*guardedPrivateKey)
+		if !ok {
+			fn(blob, key)
+			continue
+		}
+
+		priv, err := guarded.open()
+		if err != nil {
+			continue
+		}
+
+		key.PrivateKey = priv
+		fn(blob, key)
+		wipeKey(priv)
+	}
+}
+
+func (s guardedSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s guardedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.keyring.Sign(s.pub, data)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestGuardedKeyring(t *testing.T) {
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGuardedKeyring()
+
+	for _, key := range []any{&ed, ec, rs} {
+		if err := g.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatalf("add %T: %v", key, err)
+		}
+	}
+
+	keys, err := g.List()
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("got %d keys, %v", len(keys), err)
+	}
+
+	for _, k := range keys {
+		sig, err := g.Sign(k, []byte("data"))
+		if err != nil {
+			t.Fatalf("sign with %s: %v", k.Type(), err)
+		}
+		if err := k.Verify([]byte("data"), sig); err != nil {
+			t.Errorf("signature of %s: %v", k.Type(), err)
+		}
+	}
+
+	// The guarded keys can be written out to the keyring file
+	g.each(func(blob string, key agent.AddedKey) {
+		if _, err := ssh.MarshalPrivateKey(key.PrivateKey, ""); err != nil {
+			t.Errorf("marshal %T: %v", key.PrivateKey, err)
+		}
+	})
+
+	if err := g.Remove(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.keys) != 2 {
+		t.Errorf("%d secrets kept for 2 keys", len(g.keys))
+	}
+
+	g.wipe()
+
+	if len(g.keys) != 0 {
+		t.Errorf("%d secrets kept after wiping", len(g.keys))
+	}
+	if _, err := g.Sign(keys[1], []byte("data")); err == nil {
+		t.Error("signed after wiping")
+	}
+}
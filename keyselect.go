@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	maxKeys = flag.Int("max-keys", 0, "list at most this many keys to clients, 0 for no limit")
+	mruKeys = flag.Bool("mru-keys", false, "list the keys that signed most recently first")
+
+	keyUses = &keyUsage{used: map[string]time.Time{}}
+)
+
+// When each key last produced a signature, by public key blob.
+type keyUsage struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// Notes that key just signed something.
+func (u *keyUsage) record(key ssh.PublicKey) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.used[string(key.Marshal())] = time.Now()
+}
+
+// Sorts keys by when they last signed, most recent first. Unused keys keep
+// their order after the used ones.
+func (u *keyUsage) sort(keys []*agent.Key) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	slices.SortStableFunc(keys, func(a, b *agent.Key) int {
+		return u.used[string(b.Blob)].Compare(u.used[string(a.Blob)])
+	})
+}
+
+// An agent picking the keys offered to a client, once every other filter
+// left out those it mustn't see.
+type selectingAgent struct {
+	agent.ExtendedAgent
+}
+
+func (a selectingAgent) List() ([]*agent.Key, error) {
+	keys, err := a.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return selectKeys(keys), nil
+}
+
+// Picks the keys offered to a client out of the keys it may see. Servers
+// give up after MaxAuthTries (6 by default) keys, so only the first
+// --max-keys are kept, backends with a higher priority coming first unless
+// --mru-keys puts recently used keys in front.
+func selectKeys(keys []*agent.Key) []*agent.Key {
+	if *mruKeys {
+		keyUses.sort(keys)
+	}
+
+	if *maxKeys <= 0 || len(keys) <= *maxKeys {
+		return keys
+	}
+
+	slog.Debug("key list capped", "keys", len(keys), "max", *maxKeys)
+
+	return keys[:*maxKeys]
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Upper bounds of the latency histogram buckets, in seconds: from a local
+// agent's fraction of a millisecond to a token waiting for a touch.
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// How long one kind of request to one backend took, since the proxy
+// started.
+type latencyHistogram struct {
+	// By bucket, the last counting the requests over every bound
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type latencyKey struct{ backend, op string }
+
+// The latencies of a backend's requests of one kind, as the status command
+// shows them.
+type latencySummary struct {
+	Backend string  `json:"backend"`
+	Op      string  `json:"op"`
+	Count   uint64  `json:"count"`
+	Mean    float64 `json:"mean_ms"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+}
+
+var latencies struct {
+	mu sync.Mutex
+	by map[latencyKey]*latencyHistogram
+}
+
+func recordLatency(backend, op string, d time.Duration) {
+	latencies.mu.Lock()
+	defer latencies.mu.Unlock()
+
+	if latencies.by == nil {
+		latencies.by = map[latencyKey]*latencyHistogram{}
+	}
+
+	k := latencyKey{backend, op}
+	h := latencies.by[k]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		latencies.by[k] = h
+	}
+
+	s := d.Seconds()
+	i, _ := slices.BinarySearch(latencyBuckets, s)
+	h.counts[i]++
+	h.count++
+	h.sum += s
+}
+
+// Calls f with every histogram, by backend and request kind, holding the
+// lock.
+func eachLatency(f func(k latencyKey, h *latencyHistogram)) {
+	latencies.mu.Lock()
+	defer latencies.mu.Unlock()
+
+	keys := make([]latencyKey, 0, len(latencies.by))
+	for k := range latencies.by {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b latencyKey) int {
+		return cmp.Or(cmp.Compare(a.backend, b.backend), cmp.Compare(a.op, b.op))
+	})
+
+	for _, k := range keys {
+		f(k, latencies.by[k])
+	}
+}
+
+// Returns the mean time the backend took for requests of the kind, in
+// seconds, 0 when it answered none.
+func meanLatency(backend, op string) float64 {
+	latencies.mu.Lock()
+	defer latencies.mu.Unlock()
+
+	h := latencies.by[latencyKey{backend, op}]
+	if h == nil || h.count == 0 {
+		return 0
+	}
+
+	return h.sum / float64(h.count)
+}
+
+func latencySummaries() []latencySummary {
+	var res []latencySummary
+
+	eachLatency(func(k latencyKey, h *latencyHistogram) {
+		res = append(res, latencySummary{
+			Backend: k.backend,
+			Op:      k.op,
+			Count:   h.count,
+			Mean:    h.sum / float64(h.count) * 1000,
+			P50:     h.quantile(0.50) * 1000,
+			P90:     h.quantile(0.90) * 1000,
+			P99:     h.quantile(0.99) * 1000,
+		})
+	})
+
+	return res
+}
+
+// Estimates the qth quantile, in seconds, interpolating within its bucket
+// like Prometheus' histogram_quantile. Beyond the last bound, it is the
+// last bound.
+func (h *latencyHistogram) quantile(q float64) float64 {
+	rank := q * float64(h.count)
+
+	var seen uint64
+	for i, n := range h.counts {
+		if float64(seen+n) < rank || n == 0 {
+			seen += n
+			continue
+		}
+
+		if i == len(latencyBuckets) {
+			return latencyBuckets[i-1]
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+
+		return lower + (latencyBuckets[i]-lower)*(rank-float64(seen))/float64(n)
+	}
+
+	return 0
+}
+
+// A backend agent timing its requests, and logging their outcome with the
+// correlation IDs of the client request they serve.
+type timedAgent struct {
+	agent.ExtendedAgent
+	ctx     context.Context
+	backend string
+}
+
+func (a timedAgent) time(op string, start time.Time, err *error) {
+	d := time.Since(start)
+	recordLatency(a.backend, op, d)
+
+	slog.DebugContext(a.ctx, "backend answered", "backend", a.backend, "op", op, "duration", d, "error", *err)
+}
+
+func (a timedAgent) List() (_ []*agent.Key, err error) {
+	defer a.time("list", time.Now(), &err)
+	return a.ExtendedAgent.List()
+}
+
+func (a timedAgent) Sign(key ssh.PublicKey, data []byte) (_ *ssh.Signature, err error) {
+	defer a.time("sign", time.Now(), &err)
+	return a.ExtendedAgent.Sign(key, data)
+}
+
+func (a timedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (_ *ssh.Signature, err error) {
+	defer a.time("sign", time.Now(), &err)
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (a timedAgent) Add(key agent.AddedKey) (err error) {
+	defer a.time("add", time.Now(), &err)
+	return a.ExtendedAgent.Add(key)
+}
+
+func (a timedAgent) Remove(key ssh.PublicKey) (err error) {
+	defer a.time("remove", time.Now(), &err)
+	return a.ExtendedAgent.Remove(key)
+}
+
+func (a timedAgent) RemoveAll() (err error) {
+	defer a.time("remove-all", time.Now(), &err)
+	return a.ExtendedAgent.RemoveAll()
+}
+
+func (a timedAgent) Lock(passphrase []byte) (err error) {
+	defer a.time("lock", time.Now(), &err)
+	return a.ExtendedAgent.Lock(passphrase)
+}
+
+func (a timedAgent) Unlock(passphrase []byte) (err error) {
+	defer a.time("unlock", time.Now(), &err)
+	return a.ExtendedAgent.Unlock(passphrase)
+}
+
+func (a timedAgent) Extension(extensionType string, contents []byte) (_ []byte, err error) {
+	defer a.time("extension", time.Now(), &err)
+	return a.ExtendedAgent.Extension(extensionType, contents)
+}
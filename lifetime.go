@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// When the keys added through the proxy with a lifetime expire, by public
+// key blob. Backends are not trusted to honor the constraint: expired keys
+// are removed from them and hidden in case that fails.
+type keyExpiries struct {
+	mu sync.Mutex
+	at map[string]time.Time
+}
+
+var errKeyExpired = errors.New("key lifetime expired")
+
+// Returns the public key an added key is listed as.
+func addedPublicKey(key agent.AddedKey) (ssh.PublicKey, error) {
+	if key.Certificate != nil {
+		return key.Certificate, nil
+	}
+
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.PublicKey(), nil
+}
+
+// Starts tracking the lifetime of a key just added to a backend. A key added
+// again without a lifetime no longer expires.
+func (r *proxyKeyring) trackLifetime(backend string, key agent.AddedKey) {
+	pub, err := addedPublicKey(key)
+	if err != nil {
+		return
+	}
+
+	blob := string(pub.Marshal())
+	e := &r.expiries
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if key.LifetimeSecs == 0 {
+		delete(e.at, blob)
+		return
+	}
+
+	lifetime := time.Duration(key.LifetimeSecs) * time.Second
+	at := time.Now().Add(lifetime)
+
+	if e.at == nil {
+		e.at = map[string]time.Time{}
+	}
+	e.at[blob] = at
+
+	time.AfterFunc(lifetime, func() {
+		e.mu.Lock()
+		current := e.at[blob]
+		e.mu.Unlock()
+
+		// Added again in the meantime
+		if !current.Equal(at) {
+			return
+		}
+
+		r.expire(backend, pub)
+	})
+}
+
+// Removes an expired key from the backend it was added to.
+func (r *proxyKeyring) expire(name string, key ssh.PublicKey) {
+	defer r.cache.invalidate()
+
+	if r.paired.remove(key) {
+		r.expiries.forget(key)
+		slog.Info("paired certificate expired", "backend", name, "fingerprint", ssh.FingerprintSHA256(key))
+		return
+	}
+
+	for _, a := range r.agentsExcept(context.Background(), []string{name}, backend.readOnly) {
+		if err := a.Remove(key); err != nil {
+			slog.Warn("expired key not removed, hiding it", "backend", name, "fingerprint", ssh.FingerprintSHA256(key), "error", err)
+			return
+		}
+	}
+
+	r.expiries.forget(key)
+	slog.Info("key expired", "backend", name, "fingerprint", ssh.FingerprintSHA256(key))
+}
+
+// Reports whether the key was added with a lifetime that has run out.
+func (e *keyExpiries) expired(blob []byte) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	at, ok := e.at[string(blob)]
+
+	return ok && !time.Now().Before(at)
+}
+
+// Stops tracking the lifetime of a key removed through the proxy, or of
+// every key when key is nil.
+func (e *keyExpiries) forget(key ssh.PublicKey) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if key == nil {
+		clear(e.at)
+	} else {
+		delete(e.at, string(key.Marshal()))
+	}
+}
+
+// Drops the expired keys from a listing.
+func (e *keyExpiries) filter(keys []*agent.Key) []*agent.Key {
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool {
+		return e.expired(k.Blob)
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var listCacheTTL = flag.Duration("list-cache-ttl", 0, "serve key listings from a cache, refreshed in the background once older than this; 0 disables the cache")
+
+// The merged key listing of all backends, as last fetched.
+type listCache struct {
+	mu         sync.Mutex
+	keys       []*agent.Key
+	fetched    time.Time
+	refreshing bool
+	gen        uint64
+}
+
+// Returns the cached listing, fetching it first if there is none yet. A
+// listing older than the TTL is still served while a fresh one is fetched
+// in the background. Failed listings are not cached.
+func (r *proxyKeyring) cachedList(ctx context.Context) ([]*agent.Key, error) {
+	c := &r.cache
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fetched.IsZero() {
+		keys, err := r.list(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		c.keys, c.fetched = keys, time.Now()
+	} else if time.Since(c.fetched) > *listCacheTTL && !c.refreshing {
+		c.refreshing = true
+		gen := c.gen
+
+		// Not canceled along with the client that happened to trigger it
+		ctx := context.WithoutCancel(ctx)
+
+		go func() {
+			keys, err := r.list(ctx, nil)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			// Drop the listing if the keys changed while it was fetched
+			if err == nil && c.gen == gen {
+				c.keys, c.fetched = keys, time.Now()
+			}
+			c.refreshing = false
+		}()
+	}
+
+	return slices.Clone(c.keys), nil
+}
+
+// Discards the cached listing, so the next List fetches the keys again.
+// Called after every request that may change them.
+func (c *listCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keys, c.fetched = nil, time.Time{}
+	c.gen++
+}
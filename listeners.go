@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+type (
+	// An extra agent socket offering only some of the backends, e.g. one
+	// for personal tools that never sees the work keys. Its policy rules
+	// are checked before the global ones. A vsock://any:port socket serves
+	// the VMs whose context IDs are listed in CIDs; a ws://host:port/path or
+	// wss:// one serves WebSocket clients sending the token in TokenFile; a
+	// tls://host:port one serves clients presenting one of the certificates
+	// in ClientFingerprints; an ssh://host/path one is a socket on another
+	// host, forwarded over an SSH connection the proxy keeps up; a
+	// cygwin:/path one is a socket emulated the way Cygwin and MSYS do; an
+	// npipe:name one is a Windows named pipe, served from WSL; a
+	// tsnet://hostname:port one is a node of its own on the tailnet, serving
+	// the peers in TailnetPeers.
+	listenerConfig struct {
+		Socket    string       `json:"socket"`
+		Backends  []string     `json:"backends,omitempty"`
+		Policy    []policyRule `json:"policy,omitempty"`
+		ReadOnly  bool         `json:"read_only,omitempty"`
+		CIDs      []uint32     `json:"cids,omitempty"`
+		TokenFile string       `json:"token_file,omitempty"`
+		TLSCert   string       `json:"tls_cert,omitempty"`
+		TLSKey    string       `json:"tls_key,omitempty"`
+
+		// SHA-256 fingerprints of client certificates, in hex
+		ClientFingerprints []string `json:"client_fingerprints,omitempty"`
+
+		// Node names, user login names and tags of tailnet peers
+		TailnetPeers []string `json:"tailnet_peers,omitempty"`
+
+		// If set, the only principals the certificates offered may name
+		Principals []string `json:"principals,omitempty"`
+	}
+
+	// How the clients of one socket see the proxy.
+	frontend struct {
+		readOnly bool
+
+		// Names of the backends offered, nil for all of them
+		backends []string
+
+		policy []policyRule
+
+		// The principals certificates may name, nil for any
+		principals []string
+
+		// Context IDs of the VMs allowed to connect, nil for any client
+		cids []uint32
+	}
+)
+
+// How long network clients may take to set up their connection
+const handshakeTimeout = 10 * time.Second
+
+var listeners []listenerConfig
+
+func (l listenerConfig) validate() error {
+	if l.Socket == "" {
+		return errors.New("no socket")
+	}
+
+	if isVsock(l.Socket) != (len(l.CIDs) > 0) {
+		return errors.New("vsock sockets need cids, and only they take them")
+	}
+
+	if isWebSocket(l.Socket) != (l.TokenFile != "") {
+		return errors.New("websocket sockets need a token_file, and only they take one")
+	}
+
+	secure := strings.HasPrefix(l.Socket, "wss://") || isTLS(l.Socket)
+	if secure != (l.TLSCert != "" && l.TLSKey != "") || !secure && (l.TLSCert != "" || l.TLSKey != "") {
+		return errors.New("wss and tls sockets need tls_cert and tls_key, and only they take them")
+	}
+
+	if isTLS(l.Socket) != (len(l.ClientFingerprints) > 0) {
+		return errors.New("tls sockets need client_fingerprints, and only they take them")
+	}
+
+	if isTailnet(l.Socket) != (len(l.TailnetPeers) > 0) {
+		return errors.New("tsnet sockets need tailnet_peers, and only they take them")
+	}
+
+	if isSSH(l.Socket) && !strings.Contains(strings.TrimPrefix(l.Socket, "ssh://"), "/") {
+		return errors.New("ssh sockets need the path of the remote socket")
+	}
+
+	for _, fp := range l.ClientFingerprints {
+		if _, err := parseCertFingerprint(fp); err != nil {
+			return err
+		}
+	}
+
+	for i, rule := range l.Policy {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("policy rule %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Returns how the listener's clients see the proxy, after checking that its
+// backends exist.
+func (l listenerConfig) frontend() (frontend, error) {
+	for _, name := range l.Backends {
+		if !pkr.hasBackend(name) {
+			return frontend{}, fmt.Errorf("listener %s: backend %s not registered", l.Socket, name)
+		}
+	}
+
+	return frontend{
+		readOnly: l.ReadOnly,
+		backends: l.Backends,
+		policy:   append(slices.Clip(l.Policy), policyRules...),
+		cids:     l.CIDs,
+
+		principals: l.Principals,
+	}, nil
+}
+
+// Listens on the listener's socket, unless it was handed over by the proxy
+// upgraded.
+func (l listenerConfig) listen() (net.Listener, error) {
+	switch {
+	case isWebSocket(l.Socket):
+		return listenWebSocket(l)
+	case isTLS(l.Socket):
+		return listenTLS(l)
+	case isSSH(l.Socket):
+		return listenSSH(l.Socket)
+	case isCygwin(l.Socket):
+		return listenCygwin(l.Socket)
+	case isNamedPipe(l.Socket):
+		return listenNamedPipe(l.Socket)
+	case isTailnet(l.Socket):
+		return listenTailnet(l)
+	case !isVsock(l.Socket):
+		return listenShared(expandPath(l.Socket))
+	}
+
+	if inherited := takeInherited(l.Socket); inherited != nil {
+		return inherited, nil
+	}
+
+	return listenVsock(l.Socket)
+}
+
+func isVsock(socket string) bool {
+	return strings.HasPrefix(socket, "vsock://")
+}
+
+func isWebSocket(socket string) bool {
+	return strings.HasPrefix(socket, "ws://") || strings.HasPrefix(socket, "wss://")
+}
+
+func isTLS(socket string) bool {
+	return strings.HasPrefix(socket, "tls://")
+}
+
+func isSSH(socket string) bool {
+	return strings.HasPrefix(socket, "ssh://")
+}
+
+func isNamedPipe(socket string) bool {
+	return strings.HasPrefix(socket, "npipe:")
+}
+
+// Returns the name of the pipe of an npipe:name spec, also accepted as
+// npipe://./pipe/name.
+func namedPipeName(socket string) string {
+	name := strings.TrimPrefix(socket, "npipe:")
+
+	return strings.TrimPrefix(name, "//./pipe/")
+}
+
+// Reports whether the socket is a unix socket in the file system.
+func isSocketPath(socket string) bool {
+	return !strings.Contains(socket, "://") && !isCygwin(socket) && !isNamedPipe(socket)
+}
+
+// Reports whether the client connected over the network, and is only known
+// by its address.
+func isRemoteClient(conn net.Conn) bool {
+	switch conn.(type) {
+	case *wsConn, *tls.Conn, *sshConn, *tsnetConn, *net.TCPConn:
+		return true
+	}
+
+	return false
+}
+
+// Listens on a TCP address for the socket, unless it was handed over by the
+// proxy upgraded.
+func listenTCP(socket, addr string) (net.Listener, error) {
+	if inherited := takeInherited(socket); inherited != nil {
+		return inherited, nil
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// Returns a copy of a TCP socket, to hand it over on upgrades.
+func tcpFile(l net.Listener) (*os.File, error) {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("not a TCP socket")
+	}
+
+	return tl.File()
+}
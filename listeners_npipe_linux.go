@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Serves a Windows named pipe from WSL, which can run Windows programs but
+// not open pipes: PowerShell accepts the pipe's clients and connects each
+// to a port on localhost, doing the Cygwin handshake with the secret so
+// that other local users can't use the port. It exits once stdin is closed,
+// i.e. with the proxy.
+const npipeRelayScript = `
+$secret = [Convert]::FromBase64String('%s')
+function Read-Full($s, $n) {
+	$b = New-Object byte[] $n
+	$o = 0
+	while ($o -lt $n) {
+		$r = $s.Read($b, $o, $n - $o)
+		if ($r -le 0) { throw 'connection closed' }
+		$o += $r
+	}
+}
+$eof = [Console]::OpenStandardInput().ReadAsync((New-Object byte[] 1), 0, 1)
+while ($true) {
+	$pipe = New-Object System.IO.Pipes.NamedPipeServerStream('%s', [System.IO.Pipes.PipeDirection]::InOut, -1, [System.IO.Pipes.PipeTransmissionMode]::Byte, [System.IO.Pipes.PipeOptions]::Asynchronous)
+	if ([Threading.Tasks.Task]::WaitAny(@($pipe.WaitForConnectionAsync(), $eof)) -eq 1) { exit }
+	try {
+		$tcp = New-Object System.Net.Sockets.TcpClient('127.0.0.1', %d)
+		$s = $tcp.GetStream()
+		$s.Write($secret, 0, 16)
+		Read-Full $s 16
+		$s.Write((New-Object byte[] 12), 0, 12)
+		Read-Full $s 12
+		$null = $pipe.CopyToAsync($s)
+		$null = $s.CopyToAsync($pipe)
+	} catch {
+		$pipe.Dispose()
+	}
+}
+`
+
+// A named pipe served through a PowerShell relay.
+type npipeListener struct {
+	*cygwinListener
+	stdin io.Closer
+}
+
+// Listens on npipe:name, the Windows named pipe \\.\pipe\name, from inside
+// WSL.
+func listenNamedPipe(socket string) (net.Listener, error) {
+	if _, err := os.Stat("/proc/sys/fs/binfmt_misc/WSLInterop"); err != nil {
+		return nil, errors.New("npipe sockets only work inside WSL with Windows interop enabled")
+	}
+
+	pipe := namedPipeName(socket)
+	if pipe == "" || strings.ContainsAny(pipe, `'\`) {
+		return nil, fmt.Errorf("bad pipe name %q", pipe)
+	}
+
+	cl, err := listenCygwinTCP(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	exe, err := exec.LookPath("powershell.exe")
+	if err != nil {
+		exe = wslPowerShell
+	}
+
+	script := fmt.Sprintf(npipeRelayScript, base64.StdEncoding.EncodeToString(cl.secret[:]), pipe, cl.port())
+	cmd := exec.Command(exe, "-NoProfile", "-NonInteractive", "-Command", script)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		_ = cl.tcp.Close()
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		_ = cl.tcp.Close()
+		return nil, fmt.Errorf("starting npipe relay: %w", err)
+	}
+
+	go func() {
+		err := cmd.Wait()
+
+		select {
+		case <-cl.done:
+			return
+		default:
+		}
+		slog.Warn("npipe relay exited", "pipe", pipe, "error", err, "output", strings.TrimSpace(stderr.String()))
+	}()
+
+	slog.Info("npipe relay started", "pipe", pipe, "pid", cmd.Process.Pid)
+
+	go cl.run()
+
+	return &npipeListener{cygwinListener: cl, stdin: stdin}, nil
+}
+
+// Stops listening, and the relay with it.
+func (l *npipeListener) Close() error {
+	err := l.cygwinListener.Close()
+	_ = l.stdin.Close()
+
+	return err
+}
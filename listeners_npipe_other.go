@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func listenNamedPipe(socket string) (net.Listener, error) {
+	return nil, errors.New("npipe sockets are only available inside WSL")
+}
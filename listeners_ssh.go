@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// How often an idle SSH connection is checked on, so that a dead one is
+	// noticed and replaced
+	sshKeepalive = 30 * time.Second
+
+	// Longest wait between attempts at reconnecting
+	sshMaxBackoff = time.Minute
+)
+
+// A unix socket on a remote host, forwarded back to the proxy over an SSH
+// connection the proxy keeps up: agent forwarding that doesn't depend on
+// any login. When the connection drops it is made again, and the socket
+// with it.
+type sshListener struct {
+	u *url.URL
+
+	mu     sync.Mutex
+	client *ssh.Client
+	remote net.Listener
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// A client connection forwarded from a remote socket.
+type sshConn struct {
+	net.Conn
+	host net.Addr
+}
+
+// Tells the host the client connected on.
+func (c *sshConn) RemoteAddr() net.Addr {
+	return c.host
+}
+
+// Listens on ssh://[user@]host[:port]/path/to/agent.sock. A host that can't
+// be reached yet is retried in the background.
+func listenSSH(socket string) (net.Listener, error) {
+	u, err := url.Parse(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &sshListener{u: u, done: make(chan struct{})}
+
+	if err := l.connect(); err != nil {
+		slog.Warn("remote socket not forwarded, retrying", "host", u.Host, "error", err)
+	}
+
+	return l, nil
+}
+
+// Logs in to the host and listens on the socket there, replacing the one
+// left behind by the last connection, which sshd won't listen over.
+func (l *sshListener) connect() error {
+	client, err := sshClient(l.u)
+	if err != nil {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		_ = client.Close()
+		return err
+	}
+
+	err = session.Run("rm -f -- '" + strings.ReplaceAll(l.u.Path, "'", `'\''`) + "'")
+	_ = session.Close()
+	if err != nil {
+		_ = client.Close()
+		return fmt.Errorf("removing %s: %w", l.u.Path, err)
+	}
+
+	remote, err := client.ListenUnix(l.u.Path)
+	if err != nil {
+		_ = client.Close()
+		return fmt.Errorf("listening on %s: %w", l.u.Path, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		_ = client.Close()
+		return net.ErrClosed
+	default:
+	}
+
+	l.client, l.remote = client, remote
+
+	go l.keepalive(client)
+
+	slog.Info("remote socket forwarded", "host", l.u.Host, "path", l.u.Path)
+
+	return nil
+}
+
+// Closes the connection once the host stops answering, which makes Accept
+// reconnect.
+func (l *sshListener) keepalive(client *ssh.Client) {
+	t := time.NewTicker(sshKeepalive)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		var err error
+		select {
+		case err = <-reply:
+		case <-time.After(sshKeepalive):
+			err = errors.New("no reply to keepalive")
+		}
+
+		if err != nil {
+			slog.Debug("ssh keepalive", "host", l.u.Host, "error", err)
+			_ = client.Close()
+			return
+		}
+	}
+}
+
+func (l *sshListener) Accept() (net.Conn, error) {
+	backoff := time.Second
+
+	for {
+		l.mu.Lock()
+		client, remote := l.client, l.remote
+		l.mu.Unlock()
+
+		if remote != nil {
+			conn, err := remote.Accept()
+			if err == nil {
+				return &sshConn{Conn: conn, host: client.RemoteAddr()}, nil
+			}
+
+			select {
+			case <-l.done:
+				return nil, net.ErrClosed
+			default:
+			}
+
+			slog.Warn("ssh connection lost, reconnecting", "host", l.u.Host, "error", err)
+
+			_ = client.Close()
+			l.mu.Lock()
+			l.client, l.remote = nil, nil
+			l.mu.Unlock()
+		}
+
+		select {
+		case <-l.done:
+			return nil, net.ErrClosed
+		case <-time.After(backoff):
+		}
+
+		if err := l.connect(); err != nil {
+			slog.Debug("remote socket still not forwarded", "host", l.u.Host, "error", err)
+			backoff = min(2*backoff, sshMaxBackoff)
+		} else {
+			backoff = time.Second
+		}
+	}
+}
+
+// Stops forwarding. The remote socket is left behind, dead, until the next
+// connection replaces it.
+func (l *sshListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if l.client != nil {
+			_ = l.client.Close()
+		}
+	})
+
+	return nil
+}
+
+func (l *sshListener) Addr() net.Addr {
+	return sshListenerAddr(l.u.String())
+}
+
+type sshListenerAddr string
+
+func (a sshListenerAddr) Network() string { return "ssh" }
+func (a sshListenerAddr) String() string  { return string(a) }
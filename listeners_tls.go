@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Serves the agent protocol over TCP with mutual TLS, to clients presenting
+// one of the allowed certificates. Certificates are pinned by fingerprint;
+// no CA is involved, so self-signed ones do.
+type tlsListener struct {
+	tcp     net.Listener
+	cfg     *tls.Config
+	allowed map[[sha256.Size]byte]bool
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Parses a SHA-256 certificate fingerprint as printed by
+// `openssl x509 -noout -fingerprint -sha256`, colons and case optional.
+func parseCertFingerprint(s string) ([sha256.Size]byte, error) {
+	var fp [sha256.Size]byte
+
+	s = strings.TrimPrefix(s, "sha256 Fingerprint=")
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return fp, fmt.Errorf("bad certificate fingerprint %q", s)
+	}
+	copy(fp[:], b)
+
+	return fp, nil
+}
+
+// Listens on tls://host:port, unless it was handed over by the proxy
+// upgraded.
+func listenTLS(l listenerConfig) (net.Listener, error) {
+	u, err := url.Parse(l.Socket)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(expandPath(l.TLSCert), expandPath(l.TLSKey))
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+
+	tl := &tlsListener{
+		allowed: map[[sha256.Size]byte]bool{},
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+
+	for _, s := range l.ClientFingerprints {
+		fp, err := parseCertFingerprint(s)
+		if err != nil {
+			return nil, err
+		}
+		tl.allowed[fp] = true
+	}
+
+	tl.cfg = &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: tl.verify,
+		MinVersion:            tls.VersionTLS13,
+	}
+
+	if tl.tcp, err = listenTCP(l.Socket, u.Host); err != nil {
+		return nil, err
+	}
+
+	go tl.run()
+
+	return tl, nil
+}
+
+func (l *tlsListener) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 || !l.allowed[sha256.Sum256(rawCerts[0])] {
+		return errors.New("client certificate not allowed")
+	}
+
+	return nil
+}
+
+// Accepts TCP connections and hands those completing the handshake to
+// Accept, so that slow clients don't hold up the others.
+func (l *tlsListener) run() {
+	for {
+		conn, err := l.tcp.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("tls accept", "error", err)
+			continue
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+func (l *tlsListener) handshake(conn net.Conn) {
+	tc := tls.Server(conn, l.cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	if err := tc.HandshakeContext(ctx); err != nil {
+		slog.Warn("tls client not permitted, connection rejected", "remote", conn.RemoteAddr().String(), "error", err)
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- tc:
+	case <-l.done:
+		_ = tc.Close()
+	}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.tcp.Close()
+	})
+
+	return err
+}
+
+func (l *tlsListener) Addr() net.Addr {
+	return l.tcp.Addr()
+}
+
+// Returns a copy of the TCP socket, to hand it over on upgrades.
+func (l *tlsListener) File() (*os.File, error) {
+	return tcpFile(l.tcp)
+}
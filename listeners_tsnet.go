@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
+)
+
+// Serves the agent protocol on the tailnet as a node of its own, embedding
+// Tailscale, to the peers listed by node name, user login name or tag.
+// Tailscale has authenticated them by the time they connect.
+type tsnetListener struct {
+	server  *tsnet.Server
+	ln      net.Listener
+	lc      *tailscale.LocalClient
+	allowed []string
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// A tailnet client, known by its node.
+type tsnetConn struct {
+	net.Conn
+	node string
+}
+
+type tsnetAddr struct {
+	net.Addr
+	node string
+}
+
+func (a tsnetAddr) String() string {
+	return a.node + " (" + a.Addr.String() + ")"
+}
+
+func (c *tsnetConn) RemoteAddr() net.Addr {
+	return tsnetAddr{c.Conn.RemoteAddr(), c.node}
+}
+
+func isTailnet(socket string) bool {
+	return strings.HasPrefix(socket, "tsnet://")
+}
+
+// Returns the directory keeping the state of the tailnet node with the
+// host name.
+func tsnetStateDir(hostname string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "ssh-agent-proxy", "tsnet-"+hostname), nil
+}
+
+// Joins the tailnet as tsnet://hostname:port and listens on the port. The
+// node's state is kept in the user's config directory; the first time, it
+// is logged in with the auth key in TS_AUTHKEY, or the login URL logged.
+func listenTailnet(l listenerConfig) (net.Listener, error) {
+	u, err := url.Parse(l.Socket)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, errors.New("tsnet sockets need a host name and port")
+	}
+
+	dir, err := tsnetStateDir(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	server := &tsnet.Server{
+		Hostname: u.Hostname(),
+		Dir:      dir,
+		UserLogf: func(format string, args ...any) {
+			slog.Info("tailscale: "+fmt.Sprintf(format, args...), "node", u.Hostname())
+		},
+		Logf: func(format string, args ...any) {},
+	}
+
+	if err := os.MkdirAll(server.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	tl := &tsnetListener{
+		server:  server,
+		allowed: l.TailnetPeers,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+
+	if tl.ln, err = server.Listen("tcp", ":"+u.Port()); err != nil {
+		_ = server.Close()
+		return nil, err
+	}
+
+	if tl.lc, err = server.LocalClient(); err != nil {
+		_ = server.Close()
+		return nil, err
+	}
+
+	go tl.run()
+
+	return tl, nil
+}
+
+// Accepts connections and hands those of allowed peers to Accept, so that
+// looking them up doesn't hold up the others.
+func (l *tsnetListener) run() {
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			slog.Error("tsnet accept", "error", err)
+			continue
+		}
+
+		go l.identify(conn)
+	}
+}
+
+func (l *tsnetListener) identify(conn net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	who, err := l.lc.WhoIs(ctx, conn.RemoteAddr().String())
+	if err != nil {
+		slog.Warn("tailnet client unknown, connection rejected", "remote", conn.RemoteAddr().String(), "error", err)
+		_ = conn.Close()
+		return
+	}
+
+	node := strings.TrimSuffix(who.Node.Name, ".")
+
+	names := append([]string{node, who.Node.ComputedName}, who.Node.Tags...)
+	if who.UserProfile != nil {
+		names = append(names, who.UserProfile.LoginName)
+	}
+
+	if !slices.ContainsFunc(names, func(name string) bool { return name != "" && slices.Contains(l.allowed, name) }) {
+		slog.Warn("tailnet client not permitted, connection rejected", "node", node, "names", names)
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- &tsnetConn{Conn: conn, node: node}:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+func (l *tsnetListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Stops listening and leaves the tailnet.
+func (l *tsnetListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = errors.Join(l.ln.Close(), l.server.Close())
+	})
+
+	return err
+}
+
+func (l *tsnetListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
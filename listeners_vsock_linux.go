@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// A listening VM socket, accepting through the runtime poller like
+// vsockConn.
+type vsockListener struct {
+	f      *os.File
+	addr   vsockAddr
+	closed atomic.Bool
+}
+
+// Listens on vsock://cid:port, usually vsock://any:port.
+func listenVsock(socket string) (net.Listener, error) {
+	u, err := url.Parse(socket)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := parseVsockAddr(u)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vsock: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: addr.cid, Port: addr.port}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("vsock %s: %w", socket, err)
+	}
+
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("vsock %s: %w", socket, err)
+	}
+
+	return &vsockListener{f: os.NewFile(uintptr(fd), socket), addr: addr}, nil
+}
+
+// Takes over a listening VM socket inherited as file descriptor fd.
+func inheritVsock(fd int, socket string) (net.Listener, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, ok := sa.(*unix.SockaddrVM)
+	if !ok {
+		return nil, errors.New("not a vsock socket")
+	}
+
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return nil, err
+	}
+
+	return &vsockListener{f: os.NewFile(uintptr(fd), socket), addr: vsockAddr{cid: vm.CID, port: vm.Port}}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	raw, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var nfd int
+	var acceptErr error
+
+	if err := raw.Read(func(fd uintptr) bool {
+		nfd, _, acceptErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return !errors.Is(acceptErr, unix.EAGAIN)
+	}); err != nil {
+		if l.closed.Load() {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+
+	if acceptErr != nil {
+		return nil, acceptErr
+	}
+
+	return newVsockConn(os.NewFile(uintptr(nfd), "vsock"), nfd), nil
+}
+
+func (l *vsockListener) Close() error {
+	l.closed.Store(true)
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Returns a copy of the socket, to hand it over on upgrades.
+func (l *vsockListener) File() (*os.File, error) {
+	raw, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dup int
+	var dupErr error
+
+	if err := raw.Control(func(fd uintptr) {
+		dup, dupErr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	}); err != nil {
+		return nil, err
+	}
+
+	if dupErr != nil {
+		return nil, dupErr
+	}
+
+	return os.NewFile(uintptr(dup), l.f.Name()), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoVsock = errors.New("vsock sockets are only available on Linux")
+
+func listenVsock(socket string) (net.Listener, error) {
+	return nil, errNoVsock
+}
+
+func inheritVsock(fd int, socket string) (net.Listener, error) {
+	return nil, errNoVsock
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+var (
+	logFormat = flag.String("log-format", "text", "log output format, text or json")
+	logLevel  = flag.String("log-level", "debug", "minimum log level: debug, info, warn or error")
+	logFile   = flag.String("log-file", "stdout", "log destination: stdout, stderr, syslog or a file path")
+
+	logMaxSize = flag.Int64("log-max-size", 0, "rotate the log file once it exceeds this many megabytes, 0 to disable")
+	logMaxAge  = flag.Duration("log-max-age", 0, "rotate the log file after this long, 0 to disable")
+	logKeep    = flag.Int("log-keep", 5, "number of rotated log files to retain, 0 to keep all")
+)
+
+// Returns the writer logs should go to according to --log-file.
+func openLogOutput(dest string) (io.Writer, error) {
+	switch {
+	case logsToStdout(dest):
+		return os.Stdout, nil
+	case dest == "stderr":
+		return os.Stderr, nil
+	case dest == "syslog":
+		return openSyslog()
+	default:
+		if *logMaxSize > 0 || *logMaxAge > 0 {
+			return newRotatingFile(dest, *logMaxSize<<20, *logMaxAge, *logKeep)
+		}
+		return os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	}
+}
+
+// Whether logging to dest writes to standard output, including through its
+// device files.
+func logsToStdout(dest string) bool {
+	switch dest {
+	case "", "stdout", "-", "/dev/stdout", "/dev/fd/1", "/proc/self/fd/1":
+		return true
+	}
+	return false
+}
+
+// Installs the default logger according to the logging flags.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("bad log level: %w", err)
+	}
+
+	out, err := openLogOutput(*logFile)
+	if err != nil {
+		return fmt.Errorf("opening log output: %w", err)
+	}
+
+	opts := &slog.HandlerOptions{
+		Level: level,
+	}
+
+	var handler slog.Handler
+
+	switch *logFormat {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	}
+
+	handler = leveledSyslog(handler, out)
+	handler = correlatingHandler{handler}
+
+	if *logRedact {
+		handler = redactingHandler{handler}
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
@@ -0,0 +1,79 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"sync"
+)
+
+// The system log, written to at the level of the record being logged.
+type syslogOutput struct {
+	mu    sync.Mutex
+	w     *syslog.Writer
+	level slog.Level
+}
+
+// A handler logging each record to the system log at its own level.
+type syslogHandler struct {
+	slog.Handler
+	out *syslogOutput
+}
+
+func openSyslog() (io.Writer, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "ssh-agent-proxy")
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogOutput{w: w}, nil
+}
+
+// Makes records written to the system log keep their level.
+func leveledSyslog(h slog.Handler, out io.Writer) slog.Handler {
+	if s, ok := out.(*syslogOutput); ok {
+		return syslogHandler{h, s}
+	}
+
+	return h
+}
+
+func (o *syslogOutput) Write(p []byte) (int, error) {
+	var err error
+
+	switch msg := string(p); {
+	case o.level >= slog.LevelError:
+		err = o.w.Err(msg)
+	case o.level >= slog.LevelWarn:
+		err = o.w.Warning(msg)
+	case o.level >= slog.LevelInfo:
+		err = o.w.Info(msg)
+	default:
+		err = o.w.Debug(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (h syslogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+
+	h.out.level = rec.Level
+
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return syslogHandler{h.Handler.WithAttrs(attrs), h.out}
+}
+
+func (h syslogHandler) WithGroup(name string) slog.Handler {
+	return syslogHandler{h.Handler.WithGroup(name), h.out}
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+func openSyslog() (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func leveledSyslog(h slog.Handler, out io.Writer) slog.Handler {
+	return h
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The suffix of rotated files
+const rotatedSuffix = "20060102T150405.000"
+
+// A log file that rotates itself once it grows beyond maxSize bytes or
+// has been written to for longer than maxAge. Rotated files are renamed
+// with a timestamp suffix and only the newest keep of them are retained.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	fp     *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		keep:    keep,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	fp, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	info, err := fp.Stat()
+	if err != nil {
+		_ = fp.Close()
+		return err
+	}
+
+	rf.fp = fp
+	rf.size = info.Size()
+	rf.opened = time.Now()
+
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.needsRotation(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			// Keep logging to the current file rather than losing records
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+
+	n, err := rf.fp.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+func (rf *rotatingFile) needsRotation(n int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+
+	return rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+}
+
+// Renames the file and opens a new one in its place, writing on to the old
+// one if that fails.
+func (rf *rotatingFile) rotate() error {
+	rotated := rf.path + "." + time.Now().Format(rotatedSuffix)
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+
+	old := rf.fp
+	if err := rf.open(); err != nil {
+		_ = os.Rename(rotated, rf.path)
+		return err
+	}
+	_ = old.Close()
+
+	rf.prune()
+
+	return nil
+}
+
+// Removes all but the newest keep rotated files, leaving other files named
+// after the log alone.
+func (rf *rotatingFile) prune() {
+	if rf.keep <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(rf.path))
+	if err != nil {
+		return
+	}
+
+	var old []string
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), filepath.Base(rf.path)+".")
+		if _, err := time.Parse(rotatedSuffix, suffix); ok && err == nil {
+			old = append(old, filepath.Join(filepath.Dir(rf.path), e.Name()))
+		}
+	}
+
+	if len(old) <= rf.keep {
+		return
+	}
+
+	// The timestamp suffix sorts chronologically
+	slices.Sort(old)
+
+	for _, name := range old[:len(old)-rf.keep] {
+		if err := os.Remove(name); err != nil {
+			fmt.Fprintf(os.Stderr, "removing rotated log: %v\n", err)
+		}
+	}
+}
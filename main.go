@@ -1,19 +1,48 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh/agent"
 )
 
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 var (
-	pkr *proxyKeyring
+	pkr      *proxyKeyring
+	authSock string
+
+	internalKeyring = flag.Bool("internal-keyring", false, "keep keys no backend accepts in an in-memory keyring")
+	keyFiles        stringList
+	adminSocket     = flag.String("admin-socket", defaultAdminSocket(), "path of the admin control socket, empty to disable")
 )
 
+func init() {
+	flag.Var(&keyFiles, "key", "load a private key file into the internal keyring, may be repeated")
+}
+
 func check(err error) {
 	if err != nil {
 		slog.Error("fatal", "error", err)
@@ -21,54 +50,511 @@ func check(err error) {
 	}
 }
 
-func init() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	}))
+func handler(shutdown context.Context, conn net.Conn, fe frontend) {
+	defer func() { _ = conn.Close() }()
 
-	slog.SetDefault(logger)
-}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(shutdown))
+	defer cancel()
 
-func cleanup(fp *os.File) {
-	name := fp.Name()
-	_ = fp.Close()
-	_ = os.Remove(name)
-}
+	ctx, ids := withCorrelation(ctx)
+
+	// Unblocks the request loop once the client is gone or out of time
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	// On shutdown the request in flight gets --shutdown-grace to be answered
+	d := &drainer{close: func() { _ = conn.Close() }}
+	stopDrain := context.AfterFunc(shutdown, func() {
+		d.drain()
+		time.AfterFunc(*shutdownGrace, cancel)
+	})
+	defer stopDrain()
+
+	peer, err := getPeerCred(conn)
+	if err != nil {
+		slog.DebugContext(ctx, "peer credentials", "error", err)
+	}
+
+	if !acquireClient() {
+		slog.WarnContext(ctx, "too many clients, connection rejected", "uid", peer.uid, "pid", peer.pid, "exe", peer.exe, "max", *maxClients)
+		return
+	}
+	defer releaseClient()
+
+	if fe.cids != nil && (peer.cid < 0 || !slices.Contains(fe.cids, uint32(peer.cid))) {
+		slog.WarnContext(ctx, "vsock client not permitted, connection rejected", "cid", peer.cid)
+		return
+	}
+
+	// Views are of local users, VMs and remote clients have no uid to go by
+	var view *userView
+	if peer.cid < 0 && !isRemoteClient(conn) {
+		var permitted bool
+		if view, permitted = userViewFor(peer); !permitted {
+			slog.WarnContext(ctx, "client not permitted, connection rejected", "uid", peer.uid, "pid", peer.pid, "exe", peer.exe)
+			return
+		}
+	}
+
+	// Clients seeing only some keys mustn't change the others
+	readOnly := fe.readOnly || view != nil
+
+	switch {
+	case peer.cid >= 0:
+		slog.InfoContext(ctx, "client accepted", "cid", peer.cid, "read_only", readOnly)
+	case isRemoteClient(conn):
+		slog.InfoContext(ctx, "client accepted", "remote", conn.RemoteAddr().String(), "read_only", readOnly)
+	default:
+		slog.InfoContext(ctx, "client accepted", "uid", peer.uid, "pid", peer.pid, "exe", peer.exe, "read_only", readOnly)
+	}
+
+	offered, program := pinnedBackends(peer, fe.backends)
+	if program != "" {
+		slog.DebugContext(ctx, "client pinned to backends", "program", program, "backends", offered)
+	}
+
+	ca := &clientAgent{ExtendedAgent: pkr.WithContext(ctx, offered), ctx: ctx}
+	var a agent.ExtendedAgent = ca
+	if view != nil {
+		a = &userAgent{ExtendedAgent: a, ctx: ctx, view: view, peer: peer}
+	}
+	if view != nil && len(view.Principals) > 0 {
+		a = &principalAgent{ExtendedAgent: a, ctx: ctx, peer: peer, principals: view.Principals}
+	}
+	if len(fe.principals) > 0 {
+		a = &principalAgent{ExtendedAgent: a, ctx: ctx, peer: peer, principals: fe.principals}
+	}
+	if len(fe.policy) > 0 || len(profiles) > 0 {
+		a = &policyAgent{ExtendedAgent: a, ctx: ctx, peer: peer, rules: fe.policy, client: ca}
+	}
+	if signLimiter != nil {
+		a = &rateLimitedAgent{ExtendedAgent: a, ctx: ctx, peer: peer}
+	}
+	if len(signQuotas) > 0 {
+		a = &quotaAgent{ExtendedAgent: a, ctx: ctx, peer: peer}
+	}
+	if recording != nil {
+		a = &recordingAgent{ExtendedAgent: a, ctx: ctx, peer: peer}
+	}
+	// Always, the admin socket tells the recent events
+	ea := &eventAgent{ExtendedAgent: a, ctx: ctx, peer: peer}
+	fireEvent(ea.event("connect", nil, nil))
+	a = ea
+	if readOnly {
+		a = &readOnlyAgent{ExtendedAgent: a}
+	}
+	if *maxKeys > 0 || *mruKeys {
+		a = selectingAgent{a}
+	}
+
+	rw := io.ReadWriter(conn)
+	if *clientIdleTimeout > 0 {
+		rw = newIdleConn(conn, *clientIdleTimeout)
+	}
+	rw = traceClient(ctx, rw, peer)
+	if *lockAfter > 0 {
+		rw = activityReader{rw}
+	}
 
-func handler(conn net.Conn) {
-	slog.Info("client accepted")
+	wc := watchConn(rw, cancel)
+	defer func() { _ = wc.Close() }()
 
-	if err := agent.ServeAgent(pkr, conn); err != nil && !errors.Is(err, io.EOF) {
-		slog.Error("serve agent", "error", err)
+	guard := &messageGuard{ReadWriter: wc, max: *maxMessageSize, requests: d, ids: ids}
+	if *passthroughBackend != "" && !readOnly {
+		guard.passthrough = func(req []byte) ([]byte, error) {
+			reply, err := pkr.Passthrough(ctx, offered, req)
+			if err != nil {
+				slog.WarnContext(ctx, "passthrough", "type", req[0], "backend", *passthroughBackend, "uid", peer.uid, "pid", peer.pid, "error", err)
+			} else {
+				slog.InfoContext(ctx, "request passed through", "type", req[0], "backend", *passthroughBackend, "uid", peer.uid, "pid", peer.pid)
+			}
+
+			return reply, err
+		}
 	}
 
-	_ = conn.Close()
+	err = agent.ServeAgent(a, guard)
+
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		slog.InfoContext(ctx, "idle client closed", "uid", peer.uid, "pid", peer.pid)
+	case errors.Is(err, errMessageTooLarge):
+		slog.WarnContext(ctx, "client closed after an oversized request", "uid", peer.uid, "pid", peer.pid, "exe", peer.exe, "max", *maxMessageSize)
+	case err == nil || errors.Is(err, io.EOF):
+	case ctx.Err() != nil:
+		// Hung up in the middle of a request, or shutting down
+		slog.DebugContext(ctx, "client gone", "uid", peer.uid, "pid", peer.pid, "error", err)
+	default:
+		slog.ErrorContext(ctx, "serve agent", "error", err)
+	}
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		slog.Error("fatal", "error", "no auth sockets specified")
-		os.Exit(1)
+	if runSubcommand(os.Args[1:]) {
+		return
+	}
+
+	args, command := splitCommand(os.Args[1:])
+	_ = flag.CommandLine.Parse(args)
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if *checkOnly {
+		if err := validateSetup(); err != nil {
+			fmt.Fprintf(os.Stderr, "check: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	check(inheritSockets())
+
+	if len(command) > 0 {
+		if evalMode() {
+			check(errors.New("-s and -c can't be combined with a command"))
+		}
+
+		// The command owns the terminal
+		if !flagGiven("log-file") {
+			*logFile = os.DevNull
+		}
+	}
+
+	if *stdio && (evalMode() || len(command) > 0) {
+		check(errors.New("--stdio can't be combined with -s, -c or a command"))
+	}
+
+	if evalMode() || *stdio {
+		// Standard output is reserved for the shell commands or the client
+		if logsToStdout(*logFile) {
+			*logFile = "stderr"
+		}
+		if evalMode() {
+			check(daemonize())
+		}
 	}
 
-	pkr = NewProxyKeyring(os.Args[1:])
+	check(setupLogging())
+	check(setupRateLimit())
+	check(setupSignOrder())
+	check(setupAskpass())
+	check(setupListCerts())
+	check(setupMessageGuard())
+	setupClientLimit()
+
+	if len(keyFiles) > 0 || *keyringFile != "" {
+		*internalKeyring = true
+	}
 
-	fp, err := os.CreateTemp(os.TempDir(), "ssh-agent-proxy-*")
+	cfg, err := loadConfig(*configFile)
 	check(err)
 
-	name := fp.Name()
-	cleanup(fp)
+	destinationRules = cfg.Destinations
+	policyRules = cfg.Policy
+	signQuotas = cfg.Quotas
+	recording = cfg.Recording
+	hooks = cfg.Hooks
+	certConfigs = cfg.Certificates
+	listeners = cfg.Listeners
+	userViews = cfg.Users
+	programPins = cfg.Programs
+	weakKeys = cfg.WeakKeys
+	profiles = cfg.Profiles
 
-	slog.Info("starting", "SSH_AUTH_SOCK", name, "sockets", pkr.sockets)
+	backends := cfg.Backends
+	for _, arg := range flag.Args() {
+		backends = append(backends, parseBackendArg(arg))
+	}
 
-	socket, err := net.Listen("unix", name)
+	if len(backends) < 1 && !*internalKeyring && *fallbackAgent == "" {
+		slog.Error("fatal", "error", "no backends specified")
+		os.Exit(1)
+	}
+
+	pkr, err = NewProxyKeyring(backends)
 	check(err)
+	check(setupPassthrough())
+
+	if *internalKeyring {
+		check(pkr.EnableInternalKeyring())
+	}
+
+	check(setupProfiles(cfg.Profile))
+
+	if k := pkr.persistent(); k != nil && k.closed() {
+		k.openFromKeychain()
+	}
+
+	// The keyring file waits for its passphrase, given by unlocking
+	if k := pkr.persistent(); inheritedLock() || (k != nil && k.pending()) {
+		pkr.SetLocked(true)
+	}
+
+	for _, path := range keyFiles {
+		key, err := loadKeyFile(path)
+		check(err)
+		check(pkr.AddInternal(key))
+
+		// Kept guarded, for adding again with renewed certificates
+		if key.Certificate != nil {
+			guarded := key
+			guarded.PrivateKey, _ = guardKey(key.PrivateKey)
+			watchKeyFileCert(path, guarded)
+		}
+
+		slog.Info("key loaded", "file", path, "comment", key.Comment)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	requestShutdown = stop
+
+	if *healthInterval > 0 {
+		go pkr.monitor(ctx, *healthInterval)
+	}
+
+	if *lockAfter > 0 {
+		go pkr.autoLock(ctx, *lockAfter)
+	}
+
+	if len(certConfigs) > 0 || len(keyFileCerts) > 0 {
+		go pkr.renewCerts(ctx)
+	}
+
+	if *certExpiryWarning > 0 {
+		go pkr.watchCertExpiry(ctx)
+	}
+
+	if *stdio {
+		check(dropPrivileges())
+		superviseBackends(cfg.Backends)
+		err := awaitBackends(ctx)
+		if err == nil {
+			serveStdio(ctx)
+		}
+		stopFallback()
+		stopSupervised()
+		stopExecBackends()
+		pkr.WipeSecrets()
+		if errors.Is(err, errNoBackendAnswered) {
+			check(err)
+		}
+		return
+	}
+
+	socket, path := takeInherited(inheritedPath), inheritedPath
+	if socket == nil {
+		socket, path, err = listenAgent(*socketPath)
+		check(err)
+	}
+
+	// Handed over to the new proxy on upgrades
+	sockets := map[string]net.Listener{path: socket}
+
+	authSock = path
+	pkr.RemoveSelf(authSock)
+
+	slog.Info("starting", "version", version, "commit", commit, "SSH_AUTH_SOCK", authSock, "backends", backendNames(pkr.Backends()))
+
+	if *symlinkPath != "" {
+		link := expandPath(*symlinkPath)
+		check(linkSocket(link, authSock))
+
+		slog.Info("symlink updated", "path", link)
+	}
+
+	var admin, roSocket, dashSocket, grpcAdmin, events net.Listener
+
+	if *readOnlySocket != "" {
+		roSocket, err = listenShared(expandPath(*readOnlySocket))
+		check(err)
+		sockets[expandPath(*readOnlySocket)] = roSocket
+
+		slog.Info("read-only socket", "path", *readOnlySocket)
+	}
+
+	var extra []net.Listener
+	var frontends []frontend
+
+	for _, l := range listeners {
+		fe, err := l.frontend()
+		check(err)
+
+		socket, err := l.listen()
+		check(err)
+
+		// Forwarded and tailnet sockets are set up anew by the upgraded proxy
+		if !isSSH(l.Socket) && !isTailnet(l.Socket) {
+			sockets[expandPath(l.Socket)] = socket
+		}
+
+		extra = append(extra, socket)
+		frontends = append(frontends, fe)
+
+		slog.Info("listener", "path", l.Socket, "backends", l.Backends, "read_only", l.ReadOnly)
+	}
+
+	if *adminSocket != "" {
+		admin, err = listenAdmin(*adminSocket)
+		check(err)
+		sockets[*adminSocket] = admin
+
+		slog.Info("admin socket", "path", *adminSocket)
+		go serveAdmin(admin)
+	}
+
+	if *grpcSocket != "" {
+		grpcAdmin, err = listenGRPC(*grpcSocket)
+		check(err)
+		sockets[*grpcSocket] = grpcAdmin
+
+		slog.Info("grpc socket", "path", *grpcSocket)
+	}
+
+	if *eventsSocket != "" {
+		events, err = listenEvents(*eventsSocket)
+		check(err)
+		sockets[*eventsSocket] = events
+
+		slog.Info("events socket", "path", *eventsSocket)
+	}
+
+	if *dashboardAddr != "" {
+		dashSocket, err = listenDashboard(*dashboardAddr)
+		check(err)
+		sockets["http://"+*dashboardAddr] = dashSocket
+
+		slog.Info("dashboard", "url", dash.url)
+	}
+
+	// Clients of a command's proxy aren't canceled when it stops taking signals
+	publishCtx := ctx
+	if len(command) > 0 {
+		publishCtx = context.Background()
+	}
+	check(restorePublished(publishCtx))
+
+	check(dropPrivileges())
+	check(loadUsage())
+
+	if *dbusService {
+		check(startDBus())
+
+		slog.Info("d-bus service", "name", dbusName)
+	}
+
+	written := []string{authSock}
+	for path := range sockets {
+		if path != authSock {
+			written = append(written, path)
+		}
+	}
+	// Supervised agents' sockets and pid files are removed on exit
+	for _, b := range cfg.Backends {
+		if len(b.Command) > 0 {
+			written = append(written, expandPath(b.Socket))
+		}
+	}
+	check(sandbox(ctx, writtenPaths(written), backends))
+
+	if *fallbackAgent != "" {
+		go watchFallback(context.Background())
+	}
+
+	// What the proxy started is stopped again, however it exits
+	cleanUp := func() {
+		removeSockets(append(extra, socket, admin, roSocket, dashSocket, grpcAdmin, events)...)
+		saveUsageOnExit()
+		stopFallback()
+		stopSupervised()
+		stopExecBackends()
+		pkr.WipeSecrets()
+	}
+
+	superviseBackends(cfg.Backends)
+	// Interrupted by a signal, or without a backend and --fail-fast
+	if err := awaitBackends(ctx); err != nil {
+		slog.Info("shutting down")
+		cleanUp()
+		if errors.Is(err, errNoBackendAnswered) {
+			check(err)
+		}
+		return
+	}
+
+	signalReady()
+
+	if evalMode() {
+		printShellEnv(os.Stdout)
+		check(detach())
+	}
+
+	if len(command) > 0 {
+		// The command decides when to stop, signals are passed on to it
+		stop()
+		go serve(context.Background(), socket, frontend{policy: policyRules})
+		if roSocket != nil {
+			go serve(context.Background(), roSocket, frontend{readOnly: true, policy: policyRules})
+		}
+		for i, l := range extra {
+			go serve(context.Background(), l, frontends[i])
+		}
+
+		code := runCommand(command)
+		cleanUp()
+		os.Exit(code)
+	}
+
+	go upgradeOnSignal(sockets, authSock)
+	go persistUsage(ctx)
+
+	// Stops accepting clients once a signal arrives
+	context.AfterFunc(ctx, func() { _ = socket.Close() })
+
+	if roSocket != nil {
+		context.AfterFunc(ctx, func() { _ = roSocket.Close() })
+		go serve(ctx, roSocket, frontend{readOnly: true, policy: policyRules})
+	}
+
+	for i, l := range extra {
+		context.AfterFunc(ctx, func() { _ = l.Close() })
+		go serve(ctx, l, frontends[i])
+	}
+
+	serve(ctx, socket, frontend{policy: policyRules})
+
+	slog.Info("shutting down")
+	cleanUp()
+}
+
+// Accepts client connections until the listener is closed, then waits for
+// the clients being served, whose requests are canceled with ctx. The
+// frontend tells how the socket's clients see the proxy.
+func serve(ctx context.Context, socket net.Listener, fe frontend) {
+	// Whatever the socket, a read-only proxy never changes the backends
+	fe.readOnly = fe.readOnly || *readOnly
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
 
 	for {
-		if conn, err := socket.Accept(); err != nil {
+		conn, err := socket.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+
+		if err != nil {
 			slog.Error("accept", "error", err)
 		} else {
-			go handler(conn)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handler(ctx, conn, fe)
+			}()
 		}
 	}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes the proxy's metrics in the Prometheus text format, served by the
+// dashboard on /metrics.
+func writeMetrics(w io.Writer) {
+	metric := func(name, typ, help string) {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	sample := func(name string, value any, labels ...string) {
+		var ls []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			ls = append(ls, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		if len(ls) > 0 {
+			name += "{" + strings.Join(ls, ",") + "}"
+		}
+		_, _ = fmt.Fprintf(w, "%s %v\n", name, value)
+	}
+	seconds := func(t time.Time) float64 {
+		return float64(t.UnixMilli()) / 1000
+	}
+	boolean := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	st := currentStatus()
+
+	metric("ssh_agent_proxy_locked", "gauge", "Whether the proxy is locked.")
+	sample("ssh_agent_proxy_locked", boolean(st.Locked))
+
+	metric("ssh_agent_proxy_clients", "gauge", "Clients connected.")
+	sample("ssh_agent_proxy_clients", st.Clients)
+
+	backends := pkr.Status()
+
+	metric("ssh_agent_proxy_backend_up", "gauge", "Whether the backend answers.")
+	for _, b := range backends {
+		sample("ssh_agent_proxy_backend_up", boolean(b.Up), "backend", b.Name)
+	}
+
+	metric("ssh_agent_proxy_backend_request_duration_seconds", "histogram", "How long the backend took to answer requests, by kind.")
+	eachLatency(func(k latencyKey, h *latencyHistogram) {
+		var cumulative uint64
+		for i, n := range h.counts {
+			cumulative += n
+
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			sample("ssh_agent_proxy_backend_request_duration_seconds_bucket", cumulative, "backend", k.backend, "op", k.op, "le", le)
+		}
+		sample("ssh_agent_proxy_backend_request_duration_seconds_sum", h.sum, "backend", k.backend, "op", k.op)
+		sample("ssh_agent_proxy_backend_request_duration_seconds_count", h.count, "backend", k.backend, "op", k.op)
+	})
+
+	metric("ssh_agent_proxy_certificate_expiry_timestamp_seconds", "gauge", "When the listed certificate expires, as last checked.")
+	for _, c := range listedCertExpiries() {
+		sample("ssh_agent_proxy_certificate_expiry_timestamp_seconds", seconds(c.ValidBefore), "fingerprint", c.Fingerprint, "backend", c.Backend, "key_id", c.KeyID)
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	names := slices.Sorted(maps.Keys(usage.Backends))
+
+	metric("ssh_agent_proxy_backend_signatures_total", "counter", "Signatures made by the backend, across restarts.")
+	for _, name := range names {
+		sample("ssh_agent_proxy_backend_signatures_total", usage.Backends[name].Signatures, "backend", name)
+	}
+
+	metric("ssh_agent_proxy_backend_last_used_timestamp_seconds", "gauge", "When the backend last signed.")
+	for _, name := range names {
+		sample("ssh_agent_proxy_backend_last_used_timestamp_seconds", seconds(usage.Backends[name].LastUsed), "backend", name)
+	}
+
+	fingerprints := slices.Sorted(maps.Keys(usage.Keys))
+
+	metric("ssh_agent_proxy_key_signatures_total", "counter", "Signatures made with the key, across restarts.")
+	for _, fp := range fingerprints {
+		sample("ssh_agent_proxy_key_signatures_total", usage.Keys[fp].Signatures, "fingerprint", fp, "backend", usage.Keys[fp].Backend)
+	}
+
+	metric("ssh_agent_proxy_key_last_used_timestamp_seconds", "gauge", "When the key last signed.")
+	for _, fp := range fingerprints {
+		sample("ssh_agent_proxy_key_last_used_timestamp_seconds", seconds(usage.Keys[fp].LastUsed), "fingerprint", fp, "backend", usage.Keys[fp].Backend)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Like OpenSSH's AGENT_MAX_LEN
+const defaultMaxMessageSize = 256 << 10
+
+var (
+	maxMessageSize = flag.Int("max-message-size", defaultMaxMessageSize, "close client connections sending a request larger than this many bytes")
+
+	errMessageTooLarge = errors.New("request too large")
+)
+
+// A client connection checking the length of every request before the agent
+// server reads it. The server would allocate up to 16 MiB for a request and
+// drop the connection on an empty one without replying. Empty requests are
+// answered with SSH_AGENT_FAILURE here, and requests over the maximum also
+// end the connection, as their body is never read. Requests of types the
+// server doesn't know are answered here too when passthrough is set.
+type messageGuard struct {
+	io.ReadWriter
+	max int
+
+	// Told when requests are read and answered, if set
+	requests *drainer
+
+	// Numbers the requests, if set
+	ids *correlation
+
+	// Answers the requests the agent server doesn't implement, if set
+	passthrough func(req []byte) ([]byte, error)
+
+	// Bytes of the current request yet to be passed on
+	pending []byte
+	left    int
+}
+
+// Checks --max-message-size.
+func setupMessageGuard() error {
+	if *maxMessageSize < 1 {
+		return fmt.Errorf("bad --max-message-size %d, must be positive", *maxMessageSize)
+	}
+
+	return nil
+}
+
+// SSH_AGENT_FAILURE, framed
+var failureReply = []byte{0, 0, 0, 1, 5}
+
+func (g *messageGuard) Read(p []byte) (int, error) {
+	if len(g.pending) == 0 && g.left == 0 {
+		if err := g.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(g.pending) > 0 {
+		n := copy(p, g.pending)
+		g.pending = g.pending[n:]
+
+		return n, nil
+	}
+
+	n, err := g.ReadWriter.Read(p[:min(len(p), g.left)])
+	g.left -= n
+
+	return n, err
+}
+
+// Reads the length of the next request, answering empty ones and those
+// passed through. The server only asks for it once the previous request is
+// answered.
+func (g *messageGuard) next() error {
+	var length [4]byte
+
+	for {
+		g.requests.end()
+
+		if _, err := io.ReadFull(g.ReadWriter, length[:]); err != nil {
+			return err
+		}
+
+		l := binary.BigEndian.Uint32(length[:])
+		if l > uint32(g.max) {
+			_, _ = g.Write(failureReply)
+			return errMessageTooLarge
+		}
+
+		if l == 0 {
+			if _, err := g.Write(failureReply); err != nil {
+				return err
+			}
+			continue
+		}
+
+		g.requests.begin()
+		g.ids.next()
+
+		if g.passthrough == nil {
+			g.pending, g.left = length[:], int(l)
+			return nil
+		}
+
+		req := make([]byte, 1, l)
+		if _, err := io.ReadFull(g.ReadWriter, req); err != nil {
+			return err
+		}
+
+		if slices.Contains(servedRequests, req[0]) {
+			g.pending, g.left = append(length[:], req[0]), int(l)-1
+			return nil
+		}
+
+		req = req[:l]
+		if _, err := io.ReadFull(g.ReadWriter, req[1:]); err != nil {
+			return err
+		}
+
+		reply := failureReply
+		if body, err := g.passthrough(req); err == nil {
+			reply = append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+		}
+
+		if _, err := g.Write(reply); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var notifySign = flag.Bool("notify-sign", false, "show a desktop notification for every signature made")
+
+// Shows a desktop notification using notify-send, or osascript on macOS.
+// Failures are only logged, notifications are best effort.
+func desktopNotify(title, body string) {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		script := "display notification " + strconv.Quote(body) + " with title " + strconv.Quote(title)
+		cmd = exec.Command("osascript", "-e", script)
+	default:
+		cmd = exec.Command("notify-send", "--app-name=ssh-agent-proxy", title, body)
+	}
+
+	go func() {
+		if err := cmd.Run(); err != nil {
+			slog.Debug("desktop notification failed", "error", err)
+		}
+	}()
+}
+
+// Tells the user a key was used, what for and by which client.
+func notifySignature(key ssh.PublicKey, peer peerCred, d signData) {
+	name := pkr.keyComment(key)
+	if name == "" {
+		name = ssh.FingerprintSHA256(key)
+	}
+
+	desktopNotify("SSH key used", fmt.Sprintf("%s used for %s by %s", name, d, peer))
+}
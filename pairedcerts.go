@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type (
+	// Certificates added by clients for keys another backend already
+	// holds, such as a hardware token. The proxy lists them along with
+	// that backend's keys, which sign for them, rather than storing the
+	// certificate and a copy of its key somewhere else.
+	pairedCerts struct {
+		mu    sync.Mutex
+		certs []pairedCert
+	}
+
+	pairedCert struct {
+		cert    *ssh.Certificate
+		backend string
+	}
+)
+
+// Finds the backend already holding the key a certificate being added
+// certifies, "" if there is none or the certificate must go to a backend
+// to keep its constraints.
+func (r *boundKeyring) pairingBackend(key agent.AddedKey) string {
+	if key.Certificate == nil || key.ConfirmBeforeUse || len(key.ConstraintExtensions) > 0 {
+		return ""
+	}
+
+	for backend, a := range r.agents(withOpTimeout(r.ctx, *listTimeout), r.only()) {
+		if held, err := hasKey(a, key.Certificate.Key); err == nil && held {
+			return backend
+		}
+	}
+
+	return ""
+}
+
+// Pairs the certificate with the key the backend holds, replacing a
+// certificate added before for the same key.
+func (r *proxyKeyring) pairCert(backend string, key agent.AddedKey) {
+	defer r.cache.invalidate()
+
+	p := &r.paired
+	p.mu.Lock()
+	p.certs = slices.DeleteFunc(p.certs, func(pc pairedCert) bool {
+		return string(pc.cert.Key.Marshal()) == string(key.Certificate.Key.Marshal())
+	})
+	p.certs = append(p.certs, pairedCert{cert: key.Certificate, backend: backend})
+	p.mu.Unlock()
+
+	r.trackLifetime(backend, key)
+
+	slog.Info("certificate paired with a key of another backend", "backend", backend, "fingerprint", ssh.FingerprintSHA256(key.Certificate.Key), "key_id", key.Certificate.KeyId)
+}
+
+// Appends the valid certificates paired with the keys a backend listed.
+func (p *pairedCerts) appendTo(backend string, keys []*agent.Key) []*agent.Key {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pc := range p.certs {
+		if pc.backend != backend || !certValid(pc.cert, 0) {
+			continue
+		}
+
+		blob := pc.cert.Key.Marshal()
+		if i := slices.IndexFunc(keys, func(k *agent.Key) bool { return string(k.Blob) == string(blob) }); i >= 0 {
+			keys = append(keys, &agent.Key{Format: pc.cert.Type(), Blob: pc.cert.Marshal(), Comment: keys[i].Comment})
+		}
+	}
+
+	return keys
+}
+
+// Drops a paired certificate, reporting whether there was one.
+func (p *pairedCerts) remove(key ssh.PublicKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.certs)
+	p.certs = slices.DeleteFunc(p.certs, func(pc pairedCert) bool {
+		return string(pc.cert.Marshal()) == string(key.Marshal())
+	})
+
+	return len(p.certs) < n
+}
+
+// Drops the certificates paired with keys of the backends in only, or of
+// all of them when it is nil, but the protected ones.
+func (p *pairedCerts) removeAllExcept(only, protected []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.certs = slices.DeleteFunc(p.certs, func(pc pairedCert) bool {
+		return (only == nil || slices.Contains(only, pc.backend)) && !slices.Contains(protected, pc.backend)
+	})
+}
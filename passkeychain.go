@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+var passphraseKeychain = flag.Bool("passphrase-keychain", false, "look the keyring file, key file and proxy lock passphrases up in the system keychain (macOS Keychain, or the Secret Service with secret-tool) before asking for them")
+
+// The keychain service the passphrases are stored under
+const keychainService = "ssh-agent-proxy"
+
+// The keychain account of the proxy lock's passphrase
+const lockAccount = "lock"
+
+var errNoKeychainEntry = errors.New("not in the keychain")
+
+// Looks up the passphrase stored for account, the path of a key or keyring
+// file or "lock": a generic password of the ssh-agent-proxy service in the
+// macOS Keychain, or a Secret Service item with the service and account
+// attributes elsewhere.
+func keychainPassphrase(account string) ([]byte, error) {
+	if !*passphraseKeychain {
+		return nil, errNoKeychainEntry
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", keychainService, "-a", account, "-w")
+	default:
+		cmd = exec.Command("secret-tool", "lookup", "service", keychainService, "account", account)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return nil, errNoKeychainEntry
+		}
+		return nil, fmt.Errorf("%s: %w", cmd.Args[0], err)
+	}
+
+	pass := bytes.TrimSuffix(out, []byte("\n"))
+	if len(pass) == 0 {
+		return nil, errNoKeychainEntry
+	}
+
+	return pass, nil
+}
+
+// Returns the keychain account of a key or keyring file: its absolute path.
+func keychainAccount(path string) string {
+	if abs, err := filepath.Abs(expandPath(path)); err == nil {
+		return abs
+	}
+
+	return path
+}
+
+// Opens the keyring file with the passphrase in the keychain, if there is
+// one, so an unattended proxy needn't wait locked for ssh-add -X.
+func (k *persistentKeyring) openFromKeychain() {
+	pass, err := keychainPassphrase(keychainAccount(k.path))
+	if err != nil {
+		if !errors.Is(err, errNoKeychainEntry) {
+			slog.Warn("keyring file passphrase not looked up", "error", err)
+		}
+		return
+	}
+	defer clear(pass)
+
+	if err := k.open(pass); err != nil {
+		slog.Warn("keyring file not opened with the keychain passphrase", "file", k.path, "error", err)
+		return
+	}
+
+	slog.Info("keyring file opened with the keychain passphrase", "file", k.path)
+}
+
+// Checks the passphrase given to release the proxy lock against the one in
+// the keychain, reporting false when there is none and the user is to
+// confirm instead.
+func checkLockPassphrase(passphrase []byte) (checked bool, err error) {
+	pass, err := keychainPassphrase(lockAccount)
+	if err != nil {
+		if !errors.Is(err, errNoKeychainEntry) {
+			slog.Warn("proxy lock passphrase not looked up", "error", err)
+		}
+		return false, nil
+	}
+	defer clear(pass)
+
+	if subtle.ConstantTimeCompare(pass, passphrase) != 1 {
+		return true, errors.New("wrong passphrase")
+	}
+
+	return true, nil
+}
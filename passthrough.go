@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Like the agent client's limit on replies
+const maxPassthroughReply = 16 << 20
+
+var passthroughBackend = flag.String("passthrough", "", "forward requests the proxy doesn't implement, such as adding smartcard keys, verbatim to this backend")
+
+// The request types the agent server answers itself: identities (v1 and
+// v2), removing all v1 identities, signing, adding and removing keys,
+// locking and extensions. Any other request is passed through.
+var servedRequests = []byte{1, 9, 11, 13, 17, 18, 19, 22, 23, 25, 27}
+
+var errPassthroughDisabled = errors.New("passthrough backend is disabled or locked")
+
+// Checks that the --passthrough backend exists.
+func setupPassthrough() error {
+	if *passthroughBackend != "" && !pkr.hasBackend(*passthroughBackend) {
+		return fmt.Errorf("--passthrough: no backend %s", *passthroughBackend)
+	}
+
+	return nil
+}
+
+// Sends a request, without its length, to the --passthrough backend as is
+// and returns its reply the same way. Backends outside only, unless it is
+// nil, are off limits.
+func (r *proxyKeyring) Passthrough(ctx context.Context, only []string, req []byte) ([]byte, error) {
+	if r.locked.Load() {
+		return nil, errLocked
+	}
+
+	r.mu.Lock()
+	i := r.find(*passthroughBackend)
+	var b backend
+	if i >= 0 {
+		b = r.backends[i]
+	}
+	r.mu.Unlock()
+
+	if i < 0 || (only != nil && !slices.Contains(only, b.name)) {
+		return nil, fmt.Errorf("backend %s not registered", *passthroughBackend)
+	}
+
+	if b.disabled || r.emulated.locked(b.name) {
+		return nil, errPassthroughDisabled
+	}
+
+	bctx, cancel := backendContext(ctx)
+	defer cancel()
+
+	conn, err := dialBackend(bctx, b.spec)
+	if err != nil {
+		b.health.record(b.name, err)
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	rw := traceBackend(ctx, conn, b.name)
+
+	if _, err := rw.Write(binary.BigEndian.AppendUint32(nil, uint32(len(req)))); err != nil {
+		return nil, err
+	}
+	if _, err := rw.Write(req); err != nil {
+		return nil, err
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(rw, length[:]); err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(length[:])
+	if l > maxPassthroughReply {
+		return nil, fmt.Errorf("reply of %d bytes too large", l)
+	}
+
+	reply := make([]byte, l)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"syscall"
+)
+
+// The credentials of the process at the other end of a client connection.
+// Fields are -1, or empty, when the platform can't tell.
+type peerCred struct {
+	uid int
+	pid int
+	exe string
+
+	// The context ID of the VM a vsock client connects from
+	cid int
+}
+
+var unknownPeer = peerCred{uid: -1, pid: -1, cid: -1}
+
+// Implemented by vsock connections, which only tell the peer's VM.
+type vsockPeer interface {
+	peerCID() uint32
+}
+
+// Describes the process for prompts and notifications, e.g. "ssh (pid 42)".
+func (p peerCred) String() string {
+	if p.cid >= 0 {
+		return fmt.Sprintf("vsock cid %d", p.cid)
+	}
+
+	if p.exe == "" {
+		return fmt.Sprintf("pid %d", p.pid)
+	}
+
+	return fmt.Sprintf("%s (pid %d)", filepath.Base(p.exe), p.pid)
+}
+
+// Returns the credentials of the peer of a unix socket connection.
+func getPeerCred(conn net.Conn) (peerCred, error) {
+	if vc, ok := conn.(vsockPeer); ok {
+		cred := unknownPeer
+		cred.cid = int(vc.peerCID())
+
+		return cred, nil
+	}
+
+	if sc, ok := conn.(*stdioConn); ok {
+		return sc.parent(), nil
+	}
+
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return unknownPeer, syscall.ENOTSUP
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return unknownPeer, err
+	}
+
+	cred := unknownPeer
+	var credErr error
+
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = sockPeerCred(int(fd))
+	}); err != nil {
+		return unknownPeer, err
+	}
+
+	if cred.pid > 0 {
+		cred.exe = processExe(cred.pid)
+	}
+	cred.cid = -1
+
+	return cred, credErr
+}
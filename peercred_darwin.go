@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+func sockPeerCred(fd int) (peerCred, error) {
+	xucred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return unknownPeer, err
+	}
+
+	pid, err := unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	if err != nil {
+		pid = -1
+	}
+
+	return peerCred{uid: int(xucred.Uid), pid: pid}, nil
+}
+
+// Returns the executable of a process, "" if it can't be told. The
+// arguments sysctl starts with the argument count, followed by the path.
+func processExe(pid int) string {
+	buf, err := unix.SysctlRaw("kern.procargs2", pid)
+	if err != nil || len(buf) < 4 {
+		return ""
+	}
+
+	exe, _, _ := bytes.Cut(buf[4:], []byte{0})
+
+	return string(exe)
+}
+
+// Returns the parent of a process, -1 if it can't be told.
+func processParent(pid int) int {
+	kp, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return -1
+	}
+
+	return int(kp.Eproc.Ppid)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func sockPeerCred(fd int) (peerCred, error) {
+	ucred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return unknownPeer, err
+	}
+
+	return peerCred{uid: int(ucred.Uid), pid: int(ucred.Pid)}, nil
+}
+
+// Returns the executable of a process, "" if it can't be told.
+func processExe(pid int) string {
+	exe, _ := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	return exe
+}
+
+// Returns the parent of a process, -1 if it can't be told. The command
+// name in /proc/<pid>/stat is in parentheses and may hold anything, the
+// state and parent pid follow the last one.
+func processParent(pid int) int {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return -1
+	}
+
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 2 {
+		return -1
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return -1
+	}
+
+	return ppid
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package main
+
+import "syscall"
+
+func sockPeerCred(fd int) (peerCred, error) {
+	return unknownPeer, syscall.ENOTSUP
+}
+
+func processExe(pid int) string {
+	return ""
+}
+
+func processParent(pid int) int {
+	return -1
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/user"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// A policy rule, matching requests on every field that is set. The first
+// matching rule decides; requests matching none are allowed.
+type policyRule struct {
+	// list, sign, add, remove, remove-all, lock or unlock
+	Operations []string `json:"operations,omitempty"`
+
+	// Key fingerprints
+	Keys []string `json:"keys,omitempty"`
+
+	// Names of the backends holding the key
+	Backends []string `json:"backends,omitempty"`
+
+	// Client user names or uids
+	Users []string `json:"users,omitempty"`
+
+	// Context IDs of the VMs of vsock clients
+	CIDs []uint32 `json:"cids,omitempty"`
+
+	// What signatures are for: auth, sshsig or other
+	Purposes []string `json:"purposes,omitempty"`
+
+	// Days of the week (mon to sun) and a time of day range such as
+	// "09:00-18:00", "22:00-06:00" or "00:00-24:00", in the local time zone
+	// or Timezone
+	Days     []string `json:"days,omitempty"`
+	Hours    string   `json:"hours,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+
+	// allow, deny, confirm, hold, command or rego
+	Action string `json:"action"`
+
+	// With the command action, the command whose exit status decides
+	Command []string `json:"command,omitempty"`
+
+	// With the rego action, the Rego policy whose decision counts
+	Rego string `json:"rego,omitempty"`
+}
+
+// A request as seen by the policy. Key and backend are unset for requests
+// that don't concern a single key.
+type policyRequest struct {
+	op      string
+	key     ssh.PublicKey
+	backend string
+	peer    peerCred
+	time    time.Time
+
+	// What a signing request is for
+	sign signData
+
+	// The host the connection is bound to, if ssh told
+	dest *policyDestination
+}
+
+// An agent that can leave some backends out when removing all identities.
+type partialRemover interface {
+	removeAllExcept(protected []string) error
+}
+
+// An agent applying the policy to one client connection.
+type policyAgent struct {
+	agent.ExtendedAgent
+	ctx   context.Context
+	peer  peerCred
+	rules []policyRule
+
+	// The connection, which knows the host it is bound to
+	client *clientAgent
+}
+
+var (
+	policyRules []policyRule
+
+	policyOperations = []string{"list", "sign", "add", "remove", "remove-all", "lock", "unlock"}
+	policyDays       = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	policyPurposes   = []string{"auth", "sshsig", "other"}
+
+	errPolicyDenied = errors.New("denied by policy")
+)
+
+func (rule policyRule) validate() error {
+	for _, op := range rule.Operations {
+		if !slices.Contains(policyOperations, op) {
+			return fmt.Errorf("unknown operation %q", op)
+		}
+	}
+
+	for _, purpose := range rule.Purposes {
+		if !slices.Contains(policyPurposes, purpose) {
+			return fmt.Errorf("unknown purpose %q", purpose)
+		}
+	}
+
+	for _, day := range rule.Days {
+		if !slices.Contains(policyDays, day) {
+			return fmt.Errorf("unknown day %q", day)
+		}
+	}
+
+	if _, _, err := rule.hours(); err != nil {
+		return err
+	}
+
+	if _, err := rule.location(); err != nil {
+		return err
+	}
+
+	if (rule.Action == "command") != (len(rule.Command) > 0) {
+		return errors.New("command goes with the command action")
+	}
+	if (rule.Action == "rego") != (rule.Rego != "") {
+		return errors.New("rego goes with the rego action")
+	}
+
+	switch rule.Action {
+	case "allow", "deny", "command":
+	case "rego":
+		if _, err := regoPolicies.get(expandPath(rule.Rego)); err != nil {
+			return err
+		}
+	case "confirm":
+		if len(rule.Operations) == 0 || slices.Contains(rule.Operations, "list") {
+			return errors.New("confirm can't apply to list")
+		}
+	case "hold":
+		if len(rule.Operations) == 0 || slices.ContainsFunc(rule.Operations, func(op string) bool { return op != "remove" && op != "remove-all" }) {
+			return errors.New("hold only applies to remove and remove-all")
+		}
+	default:
+		return fmt.Errorf("bad action %q, must be allow, deny, confirm, hold, command or rego", rule.Action)
+	}
+
+	return nil
+}
+
+func (rule policyRule) matches(req policyRequest) bool {
+	if len(rule.Operations) > 0 && !slices.Contains(rule.Operations, req.op) {
+		return false
+	}
+
+	if len(rule.Keys) > 0 && (req.key == nil || !slices.Contains(rule.Keys, ssh.FingerprintSHA256(req.key))) {
+		return false
+	}
+
+	if len(rule.Backends) > 0 && !slices.Contains(rule.Backends, req.backend) {
+		return false
+	}
+
+	if len(rule.Users) > 0 && !slices.ContainsFunc(rule.Users, req.peer.isUser) {
+		return false
+	}
+
+	if len(rule.CIDs) > 0 && (req.peer.cid < 0 || !slices.Contains(rule.CIDs, uint32(req.peer.cid))) {
+		return false
+	}
+
+	if len(rule.Purposes) > 0 && !slices.Contains(rule.Purposes, req.sign.purpose) {
+		return false
+	}
+
+	return rule.inWindow(req.time)
+}
+
+// Parses the Hours range into minutes since midnight.
+func (rule policyRule) hours() (from, to int, err error) {
+	if rule.Hours == "" {
+		return 0, 0, nil
+	}
+
+	var fh, fm, th, tm int
+	if _, err := fmt.Sscanf(rule.Hours, "%d:%d-%d:%d", &fh, &fm, &th, &tm); err != nil ||
+		fh < 0 || fh > 23 || fm < 0 || fm > 59 || th < 0 || th > 24 || tm < 0 || tm > 59 || th == 24 && tm > 0 {
+		return 0, 0, fmt.Errorf("bad hours %q, must be like 09:00-18:00", rule.Hours)
+	}
+
+	from, to = fh*60+fm, th*60+tm
+	if from == to {
+		return 0, 0, fmt.Errorf("bad hours %q, the range is empty", rule.Hours)
+	}
+
+	return from, to, nil
+}
+
+// Returns the time zone the rule's hours are in, the local one unless
+// Timezone is set.
+func (rule policyRule) location() (*time.Location, error) {
+	if rule.Timezone == "" {
+		return time.Local, nil
+	}
+
+	return time.LoadLocation(rule.Timezone)
+}
+
+// Reports whether t falls within the rule's days and hours. Ranges ending
+// before they start span midnight, and count as part of the day they start
+// on.
+func (rule policyRule) inWindow(t time.Time) bool {
+	if loc, err := rule.location(); err == nil {
+		t = t.In(loc)
+	}
+
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+
+	if rule.Hours != "" {
+		from, to, _ := rule.hours()
+
+		switch {
+		case from <= to && (minute < from || minute >= to):
+			return false
+		case from > to && minute < to:
+			// The early morning part of yesterday's range
+			day = (day + 6) % 7
+		case from > to && minute < from:
+			return false
+		}
+	}
+
+	return len(rule.Days) == 0 || slices.Contains(rule.Days, policyDays[day])
+}
+
+// Reports whether the peer runs as the user given by name or uid.
+func (p peerCred) isUser(name string) bool {
+	if name == strconv.Itoa(p.uid) {
+		return true
+	}
+
+	u, err := user.Lookup(name)
+
+	return err == nil && u.Uid == strconv.Itoa(p.uid)
+}
+
+// Applies the policy rules to a request, asking for confirmation where the
+// matching rule says so.
+func authorize(ctx context.Context, rules []policyRule, req policyRequest) error {
+	action, matched := "allow", 0
+	for i, rule := range rules {
+		if rule.matches(req) {
+			action, matched = rule.Action, i+1
+			break
+		}
+	}
+
+	switch action {
+	case "command":
+		action = policyCommandAction(ctx, rules[matched-1].Command, req)
+	case "rego":
+		action = regoAction(ctx, expandPath(rules[matched-1].Rego), req)
+	}
+
+	// Listings aren't worth asking about, like confirm rules can't
+	if action == "confirm" && req.op == "list" {
+		action = "deny"
+	}
+
+	args := []any{"op", req.op, "backend", req.backend, "uid", req.peer.uid, "pid", req.peer.pid, "exe", req.peer.exe, "rule", matched}
+	if req.key != nil {
+		args = append(args, "fingerprint", ssh.FingerprintSHA256(req.key))
+	}
+	if req.sign.purpose != "" {
+		args = append(args, req.sign.logArgs()...)
+	}
+
+	switch action {
+	case "deny":
+		// Hidden keys are expected to stay hidden, that's not worth a warning
+		level := slog.LevelWarn
+		if req.op == "list" {
+			level = slog.LevelDebug
+		}
+
+		slog.Log(ctx, level, "request denied by policy", args...)
+		return errPolicyDenied
+
+	case "confirm":
+		op := req.op
+		if req.sign.purpose != "" {
+			op = req.sign.String()
+		}
+
+		var key string
+		if req.key != nil {
+			key = ssh.FingerprintSHA256(req.key)
+		}
+
+		if err := askConfirm(confirmText(op, req.peer, key)); err != nil {
+			slog.WarnContext(ctx, "request not confirmed", append(args, "error", err)...)
+			return errPolicyDenied
+		}
+
+	case "hold":
+		return errRemovalHeld
+	}
+
+	return nil
+}
+
+func (a *policyAgent) request(op string, key ssh.PublicKey) policyRequest {
+	req := policyRequest{op: op, key: key, peer: a.peer, time: time.Now()}
+	if key != nil {
+		req.backend = pkr.owner(key)
+	}
+	if a.client != nil {
+		req.dest = a.client.destination()
+	}
+
+	return req
+}
+
+// Returns the rules of the active profile followed by the connection's.
+func (a *policyAgent) policy() []policyRule {
+	if rules := profilePolicy(); len(rules) > 0 {
+		return append(slices.Clip(rules), a.rules...)
+	}
+
+	return a.rules
+}
+
+func (a *policyAgent) List() ([]*agent.Key, error) {
+	keys, err := a.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool {
+		return authorize(a.ctx, a.policy(), a.request("list", k)) != nil
+	}), nil
+}
+
+func (a *policyAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *policyAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	req := a.request("sign", key)
+	req.sign = parseSignData(data)
+
+	if err := authorize(a.ctx, a.policy(), req); err != nil {
+		return nil, err
+	}
+
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (a *policyAgent) Add(key agent.AddedKey) error {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	if err := authorize(a.ctx, a.policy(), a.request("add", signer.PublicKey())); err != nil {
+		return err
+	}
+
+	return a.ExtendedAgent.Add(key)
+}
+
+func (a *policyAgent) Remove(key ssh.PublicKey) error {
+	err := authorize(a.ctx, a.policy(), a.request("remove", key))
+	if errors.Is(err, errRemovalHeld) {
+		pkr.holdRemoval(a.ctx, "remove", []ssh.PublicKey{key}, a.peer)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return a.ExtendedAgent.Remove(key)
+}
+
+// Removes all identities, deciding per backend when rules name backends,
+// so that some can be protected from ssh-add -D or it can be limited to
+// the internal keyring. The request is only denied when every backend is.
+func (a *policyAgent) RemoveAll() error {
+	rules := a.policy()
+
+	if !slices.ContainsFunc(rules, policyRule.scopesRemoveAll) {
+		err := authorize(a.ctx, rules, a.request("remove-all", nil))
+		if errors.Is(err, errRemovalHeld) {
+			return a.holdRemoveAll(nil)
+		}
+		if err != nil {
+			return err
+		}
+
+		return a.ExtendedAgent.RemoveAll()
+	}
+
+	var names, protected, held []string
+	for _, b := range pkr.Status() {
+		names = append(names, b.Name)
+	}
+
+	for _, name := range names {
+		req := a.request("remove-all", nil)
+		req.backend = name
+
+		switch err := authorize(a.ctx, rules, req); {
+		case errors.Is(err, errRemovalHeld):
+			held = append(held, name)
+		case err != nil:
+			protected = append(protected, name)
+		}
+	}
+
+	if len(protected) == len(names) {
+		return errPolicyDenied
+	}
+
+	if len(held) > 0 {
+		if err := a.holdRemoveAll(held); err != nil {
+			return err
+		}
+		if len(protected)+len(held) == len(names) {
+			return nil
+		}
+		protected = append(protected, held...)
+	}
+
+	r, ok := a.ExtendedAgent.(partialRemover)
+	if !ok {
+		return errPolicyDenied
+	}
+
+	return r.removeAllExcept(protected)
+}
+
+// Holds the removal of the keys the client sees in the backends, or in all
+// of them when backends is nil.
+func (a *policyAgent) holdRemoveAll(backends []string) error {
+	keys, err := a.ExtendedAgent.List()
+	if err != nil {
+		return err
+	}
+
+	var held []ssh.PublicKey
+	for _, k := range keys {
+		if backends == nil || slices.Contains(backends, pkr.owner(k)) {
+			held = append(held, k)
+		}
+	}
+
+	if len(held) > 0 {
+		pkr.holdRemoval(a.ctx, "remove-all", held, a.peer)
+	}
+
+	return nil
+}
+
+// Reports whether the rule names backends for remove-all requests.
+func (rule policyRule) scopesRemoveAll() bool {
+	return len(rule.Backends) > 0 && (len(rule.Operations) == 0 || slices.Contains(rule.Operations, "remove-all"))
+}
+
+func (a *policyAgent) Lock(passphrase []byte) error {
+	if err := authorize(a.ctx, a.policy(), a.request("lock", nil)); err != nil {
+		return err
+	}
+
+	return a.ExtendedAgent.Lock(passphrase)
+}
+
+func (a *policyAgent) Unlock(passphrase []byte) error {
+	if err := authorize(a.ctx, a.policy(), a.request("unlock", nil)); err != nil {
+		return err
+	}
+
+	return a.ExtendedAgent.Unlock(passphrase)
+}
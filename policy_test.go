@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Returns a fresh ed25519 public key.
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestPolicyHours(t *testing.T) {
+	for _, hours := range []string{"09:00-18:00", "22:00-06:00", "00:00-24:00", "23:59-00:00"} {
+		if _, _, err := (policyRule{Hours: hours}).hours(); err != nil {
+			t.Errorf("%s: %v", hours, err)
+		}
+	}
+
+	for _, hours := range []string{"24:00-06:00", "09:00-24:30", "09:60-18:00", "-1:00-06:00", "09:00-09:00", "9-18"} {
+		if _, _, err := (policyRule{Hours: hours}).hours(); err == nil {
+			t.Errorf("%s: accepted", hours)
+		}
+	}
+}
+
+func TestPolicyInWindow(t *testing.T) {
+	// A Monday
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, time.January, 1, hour, minute, 0, 0, time.UTC)
+	}
+	weekdays := []string{"mon", "tue", "wed", "thu", "fri"}
+
+	tests := []struct {
+		name string
+		rule policyRule
+		time time.Time
+		want bool
+	}{
+		{"no window", policyRule{}, at(3, 0), true},
+		{"within hours", policyRule{Hours: "09:00-18:00"}, at(9, 0), true},
+		{"before hours", policyRule{Hours: "09:00-18:00"}, at(8, 59), false},
+		{"end excluded", policyRule{Hours: "09:00-18:00"}, at(18, 0), false},
+		{"whole day", policyRule{Hours: "00:00-24:00"}, at(23, 59), true},
+		{"day listed", policyRule{Days: weekdays}, at(12, 0), true},
+		{"day not listed", policyRule{Days: []string{"sun"}}, at(12, 0), false},
+		{"night, evening part", policyRule{Hours: "22:00-06:00", Days: []string{"mon"}}, at(23, 0), true},
+		{"night, morning part of the day before", policyRule{Hours: "22:00-06:00", Days: []string{"sun"}}, at(5, 59), true},
+		{"night, morning part of the day itself", policyRule{Hours: "22:00-06:00", Days: []string{"mon"}}, at(5, 59), false},
+		{"night, daytime", policyRule{Hours: "22:00-06:00"}, at(12, 0), false},
+		{"night, end excluded", policyRule{Hours: "22:00-06:00"}, at(6, 0), false},
+		{"time zone", policyRule{Hours: "09:00-18:00", Timezone: "America/New_York"}, at(15, 0), true},
+		{"time zone, outside", policyRule{Hours: "09:00-18:00", Timezone: "America/New_York"}, at(9, 0), false},
+		{"time zone moves the day", policyRule{Days: []string{"sun"}, Timezone: "America/New_York"}, at(3, 0), true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.inWindow(tt.time); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyInWindowLocalTime(t *testing.T) {
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+	time.Local = time.FixedZone("test", 10*60*60)
+
+	rule := policyRule{Hours: "09:00-18:00"}
+
+	// 09:30 local, still the night before in UTC
+	if !rule.inWindow(time.Date(2024, time.January, 1, 23, 30, 0, 0, time.UTC)) {
+		t.Error("hours not taken in the local time zone")
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	key, other := newPublicKey(t), newPublicKey(t)
+	uid := strconv.Itoa(os.Getuid())
+
+	req := policyRequest{
+		op:      "sign",
+		key:     key,
+		backend: "work",
+		peer:    peerCred{uid: os.Getuid(), pid: os.Getpid(), cid: 3},
+		time:    time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC),
+		sign:    signData{purpose: "auth"},
+	}
+	unkeyed := policyRequest{op: "lock", peer: unknownPeer, time: time.Now()}
+
+	tests := []struct {
+		name string
+		rule policyRule
+		req  policyRequest
+		want bool
+	}{
+		{"empty rule", policyRule{}, req, true},
+		{"operation", policyRule{Operations: []string{"list", "sign"}}, req, true},
+		{"other operation", policyRule{Operations: []string{"add"}}, req, false},
+		{"key", policyRule{Keys: []string{ssh.FingerprintSHA256(key)}}, req, true},
+		{"other key", policyRule{Keys: []string{ssh.FingerprintSHA256(other)}}, req, false},
+		{"keys, no key", policyRule{Keys: []string{ssh.FingerprintSHA256(key)}}, unkeyed, false},
+		{"backend", policyRule{Backends: []string{"work"}}, req, true},
+		{"other backend", policyRule{Backends: []string{"home"}}, req, false},
+		{"uid", policyRule{Users: []string{uid}}, req, true},
+		{"other uid", policyRule{Users: []string{strconv.Itoa(os.Getuid() + 1)}}, req, false},
+		{"users, unknown peer", policyRule{Users: []string{uid}}, unkeyed, false},
+		{"cid", policyRule{CIDs: []uint32{3}}, req, true},
+		{"other cid", policyRule{CIDs: []uint32{4}}, req, false},
+		{"cids, not vsock", policyRule{CIDs: []uint32{3}}, unkeyed, false},
+		{"purpose", policyRule{Purposes: []string{"auth"}}, req, true},
+		{"other purpose", policyRule{Purposes: []string{"sshsig"}}, req, false},
+		{"every field", policyRule{Operations: []string{"sign"}, Keys: []string{ssh.FingerprintSHA256(key)}, Backends: []string{"work"}, Users: []string{uid}, CIDs: []uint32{3}, Purposes: []string{"auth"}}, req, true},
+		{"every field but one", policyRule{Operations: []string{"sign"}, Keys: []string{ssh.FingerprintSHA256(key)}, Backends: []string{"home"}, Users: []string{uid}}, req, false},
+		{"within window", policyRule{Hours: "09:00-18:00", Days: []string{"mon"}, Timezone: "UTC"}, req, true},
+		{"outside window", policyRule{Hours: "09:00-18:00", Days: []string{"sun"}, Timezone: "UTC"}, req, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.matches(tt.req); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	key := newPublicKey(t)
+	req := func(op string) policyRequest {
+		return policyRequest{op: op, key: key, backend: "work", peer: unknownPeer, time: time.Now()}
+	}
+
+	tests := []struct {
+		name  string
+		rules []policyRule
+		req   policyRequest
+		want  error
+	}{
+		{"no rules", nil, req("sign"), nil},
+		{"no rule matches", []policyRule{{Operations: []string{"add"}, Action: "deny"}}, req("sign"), nil},
+		{"allowed", []policyRule{{Action: "allow"}}, req("sign"), nil},
+		{"denied", []policyRule{{Action: "deny"}}, req("sign"), errPolicyDenied},
+		{"first match decides", []policyRule{{Backends: []string{"work"}, Action: "allow"}, {Action: "deny"}}, req("sign"), nil},
+		{"later match denies", []policyRule{{Backends: []string{"home"}, Action: "allow"}, {Action: "deny"}}, req("sign"), errPolicyDenied},
+		{"held", []policyRule{{Operations: []string{"remove"}, Action: "hold"}}, req("remove"), errRemovalHeld},
+		{"listing not confirmed", []policyRule{{Action: "confirm"}}, req("list"), errPolicyDenied},
+	}
+
+	for _, tt := range tests {
+		if err := authorize(context.Background(), tt.rules, tt.req); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestPolicyRemoveAll(t *testing.T) {
+	removeAll := func(a, b policyRule) []policyRule {
+		a.Operations, b.Operations = []string{"remove-all"}, []string{"remove-all"}
+		return []policyRule{a, b}
+	}
+
+	tests := []struct {
+		name  string
+		rules []policyRule
+		err   error
+
+		// Whether each backend keeps its keys, and how many are held
+		keepA, keepB bool
+		held         int
+	}{
+		{"no rules", nil, nil, false, false, 0},
+		{"denied", []policyRule{{Operations: []string{"remove-all"}, Action: "deny"}}, errPolicyDenied, true, true, 0},
+		{"one protected", removeAll(policyRule{Backends: []string{"a"}, Action: "deny"}, policyRule{Action: "allow"}), nil, true, false, 0},
+		{"all protected", removeAll(policyRule{Backends: []string{"a", "b"}, Action: "deny"}, policyRule{Action: "allow"}), errPolicyDenied, true, true, 0},
+		{"one held", removeAll(policyRule{Backends: []string{"b"}, Action: "hold"}, policyRule{Action: "allow"}), nil, false, true, 2},
+		{"protected and held", removeAll(policyRule{Backends: []string{"a"}, Action: "deny"}, policyRule{Backends: []string{"b"}, Action: "hold"}), nil, true, true, 2},
+		{"all held", []policyRule{{Operations: []string{"remove-all"}, Action: "hold"}}, nil, true, true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newFakeAgent(t, "a", 1), newFakeAgent(t, "b", 2)
+			p := startProxy(t, a, b)
+
+			ctx := context.Background()
+			pa := &policyAgent{ExtendedAgent: p.keyring.WithContext(ctx, nil), ctx: ctx, peer: unknownPeer, rules: tt.rules}
+
+			if err := pa.RemoveAll(); !errors.Is(err, tt.err) {
+				t.Fatalf("remove all: got %v, want %v", err, tt.err)
+			}
+
+			for _, f := range []struct {
+				agent *fakeAgent
+				keep  bool
+			}{{a, tt.keepA}, {b, tt.keepB}} {
+				keys, err := f.agent.ExtendedAgent.List()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if kept := len(keys) > 0; kept != f.keep {
+					t.Errorf("backend %s kept its keys: %v, want %v", f.agent.name, kept, f.keep)
+				}
+			}
+
+			var held int
+			for _, hr := range p.keyring.held.list() {
+				held += len(hr.Keys)
+			}
+			if held != tt.held {
+				t.Errorf("%d keys held, want %d", held, tt.held)
+			}
+		})
+	}
+}
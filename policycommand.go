@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How long a policy command may take before the request is denied
+const policyCommandTimeout = 10 * time.Second
+
+type (
+	// A request as policy commands and Rego policies get it.
+	policyInput struct {
+		Operation   string      `json:"operation"`
+		Fingerprint string      `json:"fingerprint,omitempty"`
+		KeyType     string      `json:"key_type,omitempty"`
+		Backend     string      `json:"backend,omitempty"`
+		Client      *hookClient `json:"client"`
+		ClientUser  string      `json:"client_user,omitempty"`
+		CID         *int        `json:"cid,omitempty"`
+
+		// For signing requests, as hooks get them
+		Purpose   string `json:"purpose,omitempty"`
+		Namespace string `json:"namespace,omitempty"`
+		User      string `json:"user,omitempty"`
+		Service   string `json:"service,omitempty"`
+		Session   string `json:"session,omitempty"`
+
+		Destination *policyDestination `json:"destination,omitempty"`
+	}
+
+	// The host ssh bound the connection to with session-bind@openssh.com,
+	// with the names known_hosts records for it.
+	policyDestination struct {
+		HostKey    string   `json:"host_key"`
+		Hosts      []string `json:"hosts,omitempty"`
+		Forwarding bool     `json:"forwarding"`
+	}
+)
+
+// Runs the rule's command on the request and returns the action its exit
+// status stands for: 0 allow, 1 deny and 2 confirm. Anything else, the
+// command failing to run or taking too long included, denies.
+func policyCommandAction(ctx context.Context, command []string, req policyRequest) string {
+	payload, err := json.Marshal(policyInputOf(req))
+	if err != nil {
+		return "deny"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, policyCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), "SSH_AGENT_PROXY_OPERATION="+req.op)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return "allow"
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		slog.DebugContext(ctx, "policy command denied", "command", command[0], "output", strings.TrimSpace(stderr.String()))
+		return "deny"
+	case errors.As(err, &exit) && exit.ExitCode() == 2:
+		return "confirm"
+	default:
+		slog.WarnContext(ctx, "policy command failed, request denied", "command", command[0], "error", err, "output", strings.TrimSpace(stderr.String()))
+		return "deny"
+	}
+}
+
+func policyInputOf(req policyRequest) policyInput {
+	in := policyInput{
+		Operation: req.op,
+		Backend:   req.backend,
+		Client:    &hookClient{UID: req.peer.uid, PID: req.peer.pid, Exe: req.peer.exe},
+		Purpose:   req.sign.purpose,
+		Namespace: req.sign.namespace,
+		User:      req.sign.user,
+		Service:   req.sign.service,
+		Session:   hex.EncodeToString(req.sign.session),
+
+		Destination: req.dest,
+	}
+	if req.key != nil {
+		in.Fingerprint, in.KeyType = ssh.FingerprintSHA256(req.key), req.key.Type()
+	}
+	if req.peer.cid >= 0 {
+		in.CID = &req.peer.cid
+	}
+	if req.peer.uid >= 0 {
+		if u, err := user.LookupId(strconv.Itoa(req.peer.uid)); err == nil {
+			in.ClientUser = u.Username
+		}
+	}
+
+	return in
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An agent showing one client connection only the certificates whose
+// principals it is entitled to, and refusing to sign with the others. Plain
+// keys pass.
+type principalAgent struct {
+	agent.ExtendedAgent
+	ctx        context.Context
+	peer       peerCred
+	principals []string
+}
+
+var errPrincipalNotEntitled = errors.New("certificate principals not entitled")
+
+// Reports whether a certificate only names principals in entitled, "*"
+// standing for any of them. A certificate naming none is valid for every
+// principal, so it takes "*".
+func entitled(key ssh.PublicKey, principals []string) bool {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || slices.Contains(principals, "*") {
+		return true
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		return false
+	}
+
+	for _, p := range cert.ValidPrincipals {
+		if !slices.Contains(principals, p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (a *principalAgent) List() ([]*agent.Key, error) {
+	keys, err := a.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		return err != nil || !entitled(pub, a.principals)
+	}), nil
+}
+
+func (a *principalAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *principalAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	// The server hands over an *agent.Key, which isn't a certificate
+	pub, err := ssh.ParsePublicKey(key.Marshal())
+	if err != nil {
+		return nil, err
+	}
+
+	if !entitled(pub, a.principals) {
+		slog.WarnContext(a.ctx, "sign request for a certificate with principals not entitled", "uid", a.peer.uid, "pid", a.peer.pid, "exe", a.peer.exe, "fingerprint", ssh.FingerprintSHA256(key), "principals", pub.(*ssh.Certificate).ValidPrincipals)
+		return nil, errPrincipalNotEntitled
+	}
+
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
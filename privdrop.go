@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+var (
+	runAs      = flag.String("run-as", "", "once the sockets are created, switch to this user, by name or uid, and drop all capabilities")
+	runAsGroup = flag.String("run-as-group", "", "group to switch to with --run-as, by name or gid, instead of the user's primary group")
+)
+
+// Switches to the --run-as user and group and clears the capabilities the
+// proxy was started with. Only needed to create the sockets in protected
+// places; everything after that, including dialing the backends, happens as
+// the new user.
+func dropPrivileges() error {
+	if *runAs == "" {
+		return nil
+	}
+
+	u, err := user.Lookup(*runAs)
+	if err != nil {
+		if u, err = user.LookupId(*runAs); err != nil {
+			return fmt.Errorf("unknown --run-as user %q", *runAs)
+		}
+	}
+
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if *runAsGroup != "" {
+		g, err := user.LookupGroup(*runAsGroup)
+		if err != nil {
+			if g, err = user.LookupGroupId(*runAsGroup); err != nil {
+				return fmt.Errorf("unknown --run-as-group %q", *runAsGroup)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// Already switched, e.g. when started by an upgrade
+	if os.Getuid() != uid || os.Getgid() != gid {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid: %w", err)
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %w", err)
+		}
+	}
+
+	if err := clearCapabilities(); err != nil {
+		return err
+	}
+
+	slog.Info("privileges dropped", "user", u.Username, "uid", uid, "gid", gid)
+
+	return nil
+}
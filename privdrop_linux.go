@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Clears the capabilities of every thread, which switching away from root
+// already did, and keeps the proxy from gaining privileges through the
+// programs it runs.
+func clearCapabilities() error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return err
+	}
+
+	if data[0].Permitted != 0 || data[1].Permitted != 0 {
+		data = [2]unix.CapUserData{}
+
+		// Capabilities are per thread
+		_, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+		if errno == syscall.ENOTSUP {
+			return errors.New("can't drop capabilities in a cgo build, start the proxy as root instead")
+		}
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno != 0 && errno != syscall.ENOTSUP {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Only Linux has capabilities.
+func clearCapabilities() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+var profileFlag = flag.String("profile", "", "profile to start with, instead of the config file's")
+
+// A named set of backends and policy rules, such as work or personal, that
+// can be switched to at runtime. Only the profile's backends are used while
+// it is active, and its rules are applied ahead of the others.
+type profile struct {
+	Name     string       `json:"name"`
+	Backends []string     `json:"backends"`
+	Policy   []policyRule `json:"policy,omitempty"`
+}
+
+type profileStatus struct {
+	Active   string   `json:"active,omitempty"`
+	Profiles []string `json:"profiles"`
+}
+
+var (
+	profiles []profile
+
+	// nil while no profile is active
+	activeProfile atomic.Pointer[profile]
+)
+
+func init() {
+	subcommands["profile"] = cmdProfile
+
+	adminCommands["list-profiles"] = func(args []string) (any, error) {
+		return currentProfiles(), nil
+	}
+	adminCommands["set-profile"] = func(args []string) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("usage: set-profile <name|none>")
+		}
+		return nil, setProfile(args[0])
+	}
+}
+
+func (p profile) validate() error {
+	if p.Name == "" || p.Name == "none" {
+		return errors.New("needs a name other than none")
+	}
+
+	if len(p.Backends) == 0 {
+		return errors.New("no backends")
+	}
+
+	for i, rule := range p.Policy {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("policy rule %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Checks that the profiles' backends are registered, and activates the
+// profile named by --profile or the config file.
+func setupProfiles(name string) error {
+	for _, p := range profiles {
+		for _, b := range p.Backends {
+			if !pkr.hasBackend(b) {
+				return fmt.Errorf("profile %s: backend %s not registered", p.Name, b)
+			}
+		}
+	}
+
+	if *profileFlag != "" {
+		name = *profileFlag
+	}
+	if name == "" {
+		return nil
+	}
+
+	return setProfile(name)
+}
+
+// Switches to the named profile, or to none.
+func setProfile(name string) error {
+	defer pkr.cache.invalidate()
+
+	if name == "none" {
+		activeProfile.Store(nil)
+		slog.Info("profile switched", "profile", "none")
+		return nil
+	}
+
+	i := slices.IndexFunc(profiles, func(p profile) bool { return p.Name == name })
+	if i < 0 {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	activeProfile.Store(&profiles[i])
+	slog.Info("profile switched", "profile", name, "backends", profiles[i].Backends)
+
+	return nil
+}
+
+func currentProfiles() profileStatus {
+	st := profileStatus{Profiles: []string{}}
+	for _, p := range profiles {
+		st.Profiles = append(st.Profiles, p.Name)
+	}
+	if p := activeProfile.Load(); p != nil {
+		st.Active = p.Name
+	}
+
+	return st
+}
+
+// Narrows the backends a connection uses, nil for all of them, down to
+// those of the active profile.
+func profileBackends(only []string) []string {
+	p := activeProfile.Load()
+	if p == nil {
+		return only
+	}
+
+	if only == nil {
+		return p.Backends
+	}
+
+	return slices.DeleteFunc(slices.Clone(only), func(b string) bool {
+		return !slices.Contains(p.Backends, b)
+	})
+}
+
+// Returns the policy rules of the active profile.
+func profilePolicy() []policyRule {
+	if p := activeProfile.Load(); p != nil {
+		return p.Policy
+	}
+
+	return nil
+}
+
+func cmdProfile(args []string) error {
+	fs, cf := newClientFlags("profile")
+	_ = fs.Parse(args)
+
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		return adminCall(cf.adminSocket, "set-profile", fs.Args(), nil)
+	default:
+		return errors.New("usage: profile [flags] [name|none]")
+	}
+
+	var st profileStatus
+	if err := adminCall(cf.adminSocket, "list-profiles", nil, &st); err != nil {
+		return err
+	}
+
+	if cf.json {
+		return printJSON(st)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "PROFILE\tACTIVE")
+	for _, name := range st.Profiles {
+		_, _ = fmt.Fprintf(tw, "%s\t%t\n", name, name == st.Active)
+	}
+	return tw.Flush()
+}
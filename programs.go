@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+)
+
+// How many processes up from the client programs are looked for, so that
+// ssh run by git counts as git
+const programAncestors = 8
+
+// Pins the clients run by some programs to some backends, e.g. git to the
+// backend holding the GitHub key. Exes are glob patterns matched against
+// the resolved paths of the client's executable and those of the
+// processes that started it.
+type programPin struct {
+	Exes     []string `json:"exes"`
+	Backends []string `json:"backends"`
+}
+
+var programPins []programPin
+
+func (p programPin) validate() error {
+	if len(p.Exes) == 0 || len(p.Backends) == 0 {
+		return errors.New("needs exes and backends")
+	}
+
+	for _, exe := range p.Exes {
+		if !filepath.IsAbs(exe) {
+			return fmt.Errorf("exe %q isn't an absolute path", exe)
+		}
+		if _, err := filepath.Match(exe, ""); err != nil {
+			return fmt.Errorf("exe %q: %w", exe, err)
+		}
+	}
+
+	return nil
+}
+
+// Reports whether the executable matches one of the patterns.
+func (p programPin) matches(exe string) bool {
+	return slices.ContainsFunc(p.Exes, func(pattern string) bool {
+		ok, _ := filepath.Match(pattern, exe)
+		return ok
+	})
+}
+
+// Narrows the backends a frontend offers, nil for all of them, to those
+// the first pin matching the client's program names. The client itself
+// is looked at first, then the processes up from it. Clients of no pinned
+// program keep the frontend's backends.
+func pinnedBackends(peer peerCred, offered []string) ([]string, string) {
+	if len(programPins) == 0 || peer.pid <= 0 {
+		return offered, ""
+	}
+
+	exe, pid := peer.exe, peer.pid
+	for range programAncestors {
+		if exe != "" {
+			for _, p := range programPins {
+				if !p.matches(exe) {
+					continue
+				}
+
+				if offered == nil {
+					return p.Backends, exe
+				}
+
+				return slices.DeleteFunc(slices.Clone(offered), func(b string) bool {
+					return !slices.Contains(p.Backends, b)
+				}), exe
+			}
+		}
+
+		if pid = processParent(pid); pid <= 1 {
+			break
+		}
+		exe = processExe(pid)
+	}
+
+	return offered, ""
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"iter"
 	"log/slog"
 	"net"
+	"regexp"
 	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -13,144 +22,1100 @@ import (
 
 type (
 	proxyKeyring struct {
-		mu      sync.Mutex
-		sockets []string
+		mu       sync.Mutex
+		backends []backend
+		internal agent.ExtendedAgent
+		locked   atomic.Bool
+		cache    listCache
+		expiries keyExpiries
+		emulated emulatedLocks
+		held     heldRemovals
+		paired   pairedCerts
+
+		// Passphrases the backends were locked with. In-process keyrings
+		// keep the one they are given until unlocked.
+		passesMu sync.Mutex
+		passes   []*secret
+
+		// The backend that last listed each key, and every one that did, by
+		// public key blob
+		ownersMu sync.Mutex
+		owners   map[string]keySource
+	}
+
+	keySource struct {
+		backend string
+		comment string
+		holders []string
+	}
+
+	// A registered backend. The name identifies it in logs and the admin
+	// API; spec says how to reach it.
+	backend struct {
+		name     string
+		spec     string
+		priority int
+		disabled bool
+		health   *backendHealth
+
+		// Only keys with matching comments are used, if set
+		expose *regexp.Regexp
+
+		// The failover group, if any
+		group string
+	}
+
+	// The keyring as seen by one client, with backend requests canceled
+	// along with the client's context.
+	boundKeyring struct {
+		*proxyKeyring
+		ctx context.Context
+
+		// The backends the client's socket offers, nil for all of them
+		offered []string
+
+		// The only backend used, if set
+		pinned string
 	}
+
+	backendStatus struct {
+		Name      string    `json:"name"`
+		Socket    string    `json:"socket"`
+		Disabled  bool      `json:"disabled,omitempty"`
+		Locked    bool      `json:"locked,omitempty"`
+		Up        bool      `json:"up"`
+		Keys      int       `json:"keys"`
+		Error     string    `json:"error,omitempty"`
+		Since     time.Time `json:"since"`
+		LastCheck time.Time `json:"last_check"`
+
+		// Why the backend is quarantined, if it is
+		Quarantined string `json:"quarantined,omitempty"`
+
+		// Signatures made, across restarts
+		Signatures int64     `json:"signatures"`
+		LastUsed   time.Time `json:"last_used"`
+	}
+
+	keyInfo struct {
+		Type        string `json:"type"`
+		Fingerprint string `json:"fingerprint"`
+		Comment     string `json:"comment"`
+		Backend     string `json:"backend"`
+
+		// In authorized_keys format, without the comment
+		PublicKey string `json:"public_key"`
+
+		// Signatures made, across restarts
+		Signatures int64     `json:"signatures"`
+		LastUsed   time.Time `json:"last_used"`
+	}
+)
+
+var (
+	backendTimeout   = flag.Duration("backend-timeout", 0, "give up on a backend request after this long, 0 for no limit")
+	listTimeout      = flag.Duration("list-timeout", 0, "give up on a backend listing keys after this long, 0 for --backend-timeout")
+	signTimeout      = flag.Duration("sign-timeout", 0, "give up on a backend signing after this long, 0 for --backend-timeout")
+	addTimeout       = flag.Duration("add-timeout", 0, "give up on a backend adding a key after this long, 0 for --backend-timeout")
+	annotateComments = flag.Bool("annotate-comments", false, "append the backend to key comments in list replies, e.g. \"id_ed25519 [yubikey]\"")
+
+	errLocked           = errors.New("proxy is locked")
+	errDuplicateBackend = errors.New("backend already registered")
+	errNoBackends       = errors.New("no backend available")
+	errKeyNotFound      = errors.New("key not found")
 )
 
 // Returns a new proxy key ring, safe to use by multiple goroutines.
-func NewProxyKeyring(sockets []string) *proxyKeyring {
-	return &proxyKeyring{
-		sockets: sockets,
+func NewProxyKeyring(backends []backendConfig) (*proxyKeyring, error) {
+	r := &proxyKeyring{owners: map[string]keySource{}}
+
+	for _, b := range backends {
+		// The same agent given twice would list every key twice
+		if err := r.addBackend(b); errors.Is(err, errDuplicateBackend) {
+			slog.Warn("duplicate backend skipped", "socket", b.Socket, "error", err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Returns the keyring as an agent whose backend requests are canceled when
+// ctx is done, limited to the given backends unless that is nil.
+func (r *proxyKeyring) WithContext(ctx context.Context, backends []string) agent.ExtendedAgent {
+	return &boundKeyring{proxyKeyring: r, ctx: ctx, offered: backends}
+}
+
+// Returns the names of the backends the connection uses, nil for all of
+// them.
+func (r *boundKeyring) only() []string {
+	if r.pinned != "" {
+		return profileBackends([]string{r.pinned})
+	}
+
+	return profileBackends(r.offered)
+}
+
+// Adds an in-memory keyring as the last backend. It stores keys added
+// through the proxy that no socket backend accepted, honoring lifetime
+// constraints. With --keyring-file, they are kept across restarts.
+func (r *proxyKeyring) EnableInternalKeyring() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if *keyringFile == "" {
+		r.internal = newGuardedKeyring()
+		return nil
+	}
+
+	k, err := newPersistentKeyring(*keyringFile)
+	if err != nil {
+		return err
+	}
+	r.internal = k
+
+	return nil
+}
+
+// Returns the internal keyring if it is kept in a file.
+func (r *proxyKeyring) persistent() *persistentKeyring {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, _ := r.internal.(*persistentKeyring)
+	return k
+}
+
+// Adds a key straight to the internal keyring, bypassing the socket backends.
+func (r *proxyKeyring) AddInternal(key agent.AddedKey) error {
+	defer r.cache.invalidate()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.internal == nil {
+		return errors.New("internal keyring not enabled")
+	}
+
+	// Key files are read again on the next start
+	if k, ok := r.internal.(*persistentKeyring); ok {
+		return k.guardedKeyring.Add(key)
+	}
+
+	return r.internal.Add(key)
+}
+
+// Swaps a key in the internal keyring for another, such as a certificate
+// for its renewed version. The new key is added first, so it is never
+// missing from listings.
+func (r *proxyKeyring) replaceInternal(old ssh.PublicKey, key agent.AddedKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.internal == nil {
+		return errors.New("internal keyring not enabled")
+	}
+
+	if err := r.internal.Add(key); err != nil {
+		return err
+	}
+
+	return r.internal.Remove(old)
+}
+
+// Registers an additional backend.
+func (r *proxyKeyring) AddBackend(b backendConfig) error {
+	defer r.cache.invalidate()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.addBackend(b)
+}
+
+// Registers a backend, naming it after its spec when it has no name. Must
+// be called with mu held.
+func (r *proxyKeyring) addBackend(b backendConfig) error {
+	canonical := canonicalBackend(b.Socket)
+
+	if i := slices.IndexFunc(r.backends, func(other backend) bool {
+		return canonicalBackend(other.spec) == canonical
+	}); i >= 0 {
+		return fmt.Errorf("%w: %s as %s", errDuplicateBackend, b.Socket, r.backends[i].name)
+	}
+
+	if authSock != "" && canonical == canonicalBackend(authSock) {
+		return fmt.Errorf("%s: %w", b.Socket, errBackendLoop)
+	}
+
+	name := b.Name
+	if name == "" {
+		name = backendLabel(b.Socket)
+		for i := 2; r.find(name) >= 0; i++ {
+			name = fmt.Sprintf("%s-%d", backendLabel(b.Socket), i)
+		}
+	} else if r.find(name) >= 0 || name == "internal" {
+		return fmt.Errorf("backend name %s already in use", name)
+	}
+
+	var expose *regexp.Regexp
+	if b.Expose != "" {
+		var err error
+		if expose, err = regexp.Compile(b.Expose); err != nil {
+			return fmt.Errorf("backend %s: %w", name, err)
+		}
+	}
+
+	// Keep the backends sorted by priority, in the order they were added
+	i := slices.IndexFunc(r.backends, func(other backend) bool { return other.priority < b.Priority })
+	if i < 0 {
+		i = len(r.backends)
+	}
+
+	r.backends = slices.Insert(r.backends, i, backend{name: name, spec: b.Socket, priority: b.Priority, health: &backendHealth{}, expose: expose, group: b.Group})
+	slog.Info("backend added", "backend", name, "socket", b.Socket)
+
+	// Arriving while the others are locked, it stays locked with them
+	if r.lockPassphrase(func(pass []byte) { r.emulated.lock(name, pass) }) {
+		slog.Info("backend locked in the proxy until the others are unlocked", "backend", name)
+	}
+
+	return nil
+}
+
+// Unregisters a backend, given by name or spec.
+func (r *proxyKeyring) RemoveBackend(nameOrSpec string) error {
+	defer r.cache.invalidate()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.find(nameOrSpec)
+	if i < 0 {
+		return fmt.Errorf("backend %s not registered", nameOrSpec)
+	}
+
+	b := r.backends[i]
+	r.backends = slices.Delete(r.backends, i, i+1)
+	slog.Info("backend removed", "backend", b.name, "socket", b.spec)
+
+	return nil
+}
+
+// Unregisters the backends pointing at the proxy's own socket, which can
+// only be told once it is listening.
+func (r *proxyKeyring) RemoveSelf(socket string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	own := canonicalBackend(socket)
+
+	r.backends = slices.DeleteFunc(r.backends, func(b backend) bool {
+		if canonicalBackend(b.spec) != own {
+			return false
+		}
+
+		slog.Warn("backend removed", "backend", b.name, "error", errBackendLoop)
+
+		return true
+	})
+}
+
+// Takes a backend, given by name or spec, out of use or back into it. A
+// disabled backend is skipped by every request until enabled again.
+func (r *proxyKeyring) SetEnabled(nameOrSpec string, enabled bool) error {
+	defer r.cache.invalidate()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.find(nameOrSpec)
+	if i < 0 {
+		return fmt.Errorf("backend %s not registered", nameOrSpec)
+	}
+
+	r.backends[i].disabled = !enabled
+	if enabled {
+		r.backends[i].health.release(r.backends[i].name)
+	}
+	slog.Info("backend enabled", "backend", r.backends[i].name, "enabled", enabled)
+
+	return nil
+}
+
+// Returns the index of the backend with the given name or spec, or -1.
+func (r *proxyKeyring) find(nameOrSpec string) int {
+	return slices.IndexFunc(r.backends, func(b backend) bool {
+		return b.name == nameOrSpec || b.spec == nameOrSpec
+	})
+}
+
+// Reports whether a backend, or the internal keyring, goes by the name.
+func (r *proxyKeyring) hasBackend(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.find(name) >= 0 || (name == "internal" && r.internal != nil)
+}
+
+// Returns the failover group of the named backend, "" if it has none.
+func (r *proxyKeyring) groupOf(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i := r.find(name); i >= 0 {
+		return r.backends[i].group
 	}
+
+	return ""
+}
+
+// Returns a copy of the registered backends.
+func (r *proxyKeyring) Backends() []backend {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.backends)
+}
+
+// Notes which backend listed the keys.
+func (r *proxyKeyring) setOwner(backend string, keys []*agent.Key) {
+	r.ownersMu.Lock()
+	defer r.ownersMu.Unlock()
+
+	for _, k := range keys {
+		src := r.owners[string(k.Blob)]
+		if !slices.Contains(src.holders, backend) {
+			src.holders = append(slices.Clip(src.holders), backend)
+		}
+		src.backend, src.comment = backend, k.Comment
+		r.owners[string(k.Blob)] = src
+	}
+}
+
+// Returns the backend that last listed the key, "" if none did.
+func (r *proxyKeyring) owner(key ssh.PublicKey) string {
+	r.ownersMu.Lock()
+	defer r.ownersMu.Unlock()
+
+	return r.owners[string(key.Marshal())].backend
 }
 
-// Iterates over all agents in a thread-safe manner
-func (r *proxyKeyring) agents() iter.Seq[agent.ExtendedAgent] {
-	return func(yield func(agent.ExtendedAgent) bool) {
+// Returns the comment the key was last listed with, "" if it wasn't.
+func (r *proxyKeyring) keyComment(key ssh.PublicKey) string {
+	r.ownersMu.Lock()
+	defer r.ownersMu.Unlock()
+
+	return r.owners[string(key.Marshal())].comment
+}
+
+// Derives the context for one backend request, applying --backend-timeout.
+func backendContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := *backendTimeout
+	if d, ok := ctx.Value(opTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
+
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+type opTimeoutKey struct{}
+
+// Returns ctx with the timeout of the backend requests of one operation,
+// which replaces --backend-timeout unless it is 0.
+func withOpTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	if timeout <= 0 {
+		return ctx
+	}
+
+	return context.WithValue(ctx, opTimeoutKey{}, timeout)
+}
+
+// Returns the names of the given backends.
+func backendNames(backends []backend) []string {
+	names := make([]string, len(backends))
+	for i, b := range backends {
+		names[i] = b.name
+	}
+
+	return names
+}
+
+// Reports the health of every backend. Backends are probed on the spot
+// unless they are monitored in the background.
+func (r *proxyKeyring) Status() []backendStatus {
+	var res []backendStatus
+
+	for _, b := range r.Backends() {
+		st := backendStatus{Name: b.name, Socket: b.spec, Disabled: b.disabled, Locked: r.emulated.locked(b.name)}
+
+		u := backendStats(b.name)
+		st.Signatures, st.LastUsed = u.Signatures, u.LastUsed
+
+		if b.disabled {
+			res = append(res, st)
+			continue
+		}
+
+		if (*healthInterval <= 0 || !b.health.known()) && b.health.quarantine() == "" {
+			probeBackend(context.Background(), b)
+		}
+
+		b.health.fill(&st)
+		res = append(res, st)
+	}
+
+	r.mu.Lock()
+	internal := r.internal
+	r.mu.Unlock()
+
+	if internal != nil {
+		st := backendStatus{Name: "internal", Socket: "internal", Up: true}
+		if keys, err := internal.List(); err == nil {
+			st.Keys = len(keys)
+		}
+		res = append(res, st)
+	}
+
+	return res
+}
+
+// Lists the keys of every backend, noting which backend each came from.
+func (r *proxyKeyring) Keys() ([]keyInfo, error) {
+	if r.locked.Load() {
+		return nil, errLocked
+	}
+
+	var res []keyInfo
+
+	for backend, a := range r.agents(context.Background(), nil) {
+		keys, err := a.List()
+		if err != nil {
+			slog.Error("error listing", "backend", backend, "error", err)
+			continue
+		}
+
+		r.setOwner(backend, keys)
+
+		for _, k := range keys {
+			info := keyInfo{Type: k.Format, Comment: k.Comment, Backend: backend}
+			if pub, err := ssh.ParsePublicKey(k.Blob); err == nil {
+				info.Fingerprint = ssh.FingerprintSHA256(pub)
+				info.PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+			}
+
+			u := keyStats(info.Fingerprint)
+			info.Signatures, info.LastUsed = u.Signatures, u.LastUsed
+
+			res = append(res, info)
+		}
+	}
+
+	return res, nil
+}
+
+// Engages or releases the proxy-level lock. While locked, no keys are listed
+// and every mutating or signing request is refused, without touching the
+// backends' own lock state.
+func (r *proxyKeyring) SetLocked(locked bool) {
+	r.locked.Store(locked)
+	slog.Info("proxy lock", "locked", locked)
+}
+
+// Iterates over all agents, or just those of the backends named in only
+// unless it is nil, along with the backend each one belongs to. The backends
+// are copied up front, so requests to them don't hold up other clients or
+// changes to the backend list.
+func (r *proxyKeyring) agents(ctx context.Context, only []string) iter.Seq2[string, agent.ExtendedAgent] {
+	return r.agentsExcept(ctx, only, nil)
+}
+
+// Iterates like agents, but without dialing the backends for which skip,
+// unless it is nil, reports true when their turn comes.
+func (r *proxyKeyring) agentsExcept(ctx context.Context, only []string, skip func(backend) bool) iter.Seq2[string, agent.ExtendedAgent] {
+	return r.agentsArranged(ctx, only, skip, nil)
+}
+
+// Iterates like agentsExcept, in the order arrange puts the backends in
+// unless it is nil. The internal keyring comes last all the same.
+func (r *proxyKeyring) agentsArranged(ctx context.Context, only []string, skip func(backend) bool, arrange func([]backend) []backend) iter.Seq2[string, agent.ExtendedAgent] {
+	return func(yield func(string, agent.ExtendedAgent) bool) {
 		r.mu.Lock()
-		defer r.mu.Unlock()
+		backends := slices.Clone(r.backends)
+		internal := r.internal
+		r.mu.Unlock()
+
+		if arrange != nil {
+			backends = arrange(backends)
+		}
+
+		for _, b := range backends {
+			if !r.usable(b, only) || (skip != nil && skip(b)) {
+				continue
+			}
+
+			bctx, cancel := backendContext(ctx)
+			defer cancel()
 
-		for _, socket := range r.sockets {
-			conn, err := net.Dial("unix", socket)
+			a, conn, err := dialAgent(bctx, b)
 			if err != nil {
-				slog.Error("error dialing", "socket", socket, "error", err)
 				continue
-			} else {
-				defer func() { _ = conn.Close() }()
+			}
+			defer func() { _ = conn.Close() }()
 
-				if !yield(agent.NewClient(conn)) {
-					return
-				}
+			if !yield(b.name, a) {
+				return
 			}
 		}
+
+		if internal != nil && (only == nil || slices.Contains(only, "internal")) {
+			yield("internal", internal)
+		}
 	}
 }
 
+// Reports whether requests limited to the backends in only, unless it is
+// nil, go to the backend.
+func (r *proxyKeyring) usable(b backend, only []string) bool {
+	return !b.disabled && (only == nil || slices.Contains(only, b.name)) && !r.emulated.locked(b.name) && b.health.quarantine() == ""
+}
+
+// Connects to a backend, noting when it is down.
+func dialAgent(ctx context.Context, b backend) (agent.ExtendedAgent, net.Conn, error) {
+	conn, err := dialBackend(ctx, b.spec)
+	if err != nil {
+		slog.DebugContext(ctx, "backend not reached", "backend", b.name, "error", err)
+
+		// Not when the request was given up on, say by a sign race won
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			b.health.record(b.name, err)
+		}
+		return nil, nil, err
+	}
+
+	var a agent.ExtendedAgent = timedAgent{checkedAgent{agent.NewClient(traceBackend(ctx, conn, b.name)), ctx, b}, ctx, b.name}
+	if b.expose != nil {
+		a = &exposedAgent{ExtendedAgent: a, expose: b.expose}
+	}
+
+	return a, conn, nil
+}
+
 // RemoveAll removes all identities.
-func (r *proxyKeyring) RemoveAll() error {
-	for a := range r.agents() {
+func (r *boundKeyring) RemoveAll() error {
+	return r.removeAllExcept(nil)
+}
+
+// Removes all identities from the backends but the protected ones, which
+// the policy keeps ssh-add -D away from.
+func (r *boundKeyring) removeAllExcept(protected []string) error {
+	defer r.cache.invalidate()
+
+	if r.locked.Load() {
+		return errLocked
+	}
+
+	var errs []error
+
+	// Keys on tokens and in key services stay where they are
+	for backend, a := range r.agentsExcept(r.ctx, r.only(), backend.readOnly) {
+		if slices.Contains(protected, backend) {
+			slog.InfoContext(r.ctx, "remove all skipped, backend protected", "backend", backend)
+			continue
+		}
+
 		if err := a.RemoveAll(); err != nil {
-			slog.Error("remove all", "error", err)
+			slog.ErrorContext(r.ctx, "remove all", "backend", backend, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", backend, err))
+		} else if s := supervisorOf(backend); s != nil {
+			s.forget(nil)
 		}
 	}
 
-	return nil
+	r.paired.removeAllExcept(r.only(), protected)
+
+	// Keys left in protected backends may still expire
+	if protected == nil {
+		r.expiries.forget(nil)
+	}
+
+	return errors.Join(errs...)
 }
 
 // Remove removes all identities with the given public key.
-func (r *proxyKeyring) Remove(key ssh.PublicKey) error {
-	for a := range r.agents() {
+func (r *boundKeyring) Remove(key ssh.PublicKey) error {
+	defer r.cache.invalidate()
+
+	if r.locked.Load() {
+		return errLocked
+	}
+
+	if r.paired.remove(key) {
+		r.expiries.forget(key)
+		return nil
+	}
+
+	var errs []error
+
+	found, removed := false, false
+
+	for backend, a := range r.agents(r.ctx, r.only()) {
+		// Only ask the backends holding the key, or that can't tell
+		if held, err := hasKey(a, key); err == nil && !held {
+			continue
+		}
+
+		found = true
+
 		if err := a.Remove(key); err != nil {
-			slog.Error("remove", "error", err)
+			slog.ErrorContext(r.ctx, "remove", "backend", backend, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", backend, err))
+		} else {
+			slog.DebugContext(r.ctx, "key removed", "backend", backend, "fingerprint", ssh.FingerprintSHA256(key))
+			removed = true
+
+			if s := supervisorOf(backend); s != nil {
+				s.forget(key)
+			}
 		}
 	}
 
-	return nil
+	switch {
+	case !found:
+		return errKeyNotFound
+	case !removed:
+		return errors.Join(errs...)
+	default:
+		r.expiries.forget(key)
+		return nil
+	}
+}
+
+// Reports whether an agent lists the key.
+func hasKey(a agent.ExtendedAgent, key ssh.PublicKey) (bool, error) {
+	keys, err := a.List()
+	if err != nil {
+		return false, err
+	}
+
+	blob := key.Marshal()
+
+	return slices.ContainsFunc(keys, func(k *agent.Key) bool {
+		return bytes.Equal(k.Blob, blob)
+	}), nil
 }
 
 // Lock locks the agent. Sign and Remove will fail, and List will return an empty list.
-func (r *proxyKeyring) Lock(passphrase []byte) error {
-	for a := range r.agents() {
-		if err := a.Lock(passphrase); err != nil {
-			slog.Error("lock", "error", err)
+func (r *boundKeyring) Lock(passphrase []byte) error {
+	defer r.cache.invalidate()
+	defer clear(passphrase)
+	defer hideFromLogs(passphrase)()
+
+	pass := r.keepPass(passphrase)
+
+	var errs []error
+
+	for backend, a := range r.agents(r.ctx, r.only()) {
+		if err := a.Lock(pass); err != nil {
+			// The internal keyring only fails when it is locked already
+			if backend == "internal" {
+				slog.ErrorContext(r.ctx, "lock", "backend", backend, "error", err)
+				errs = append(errs, fmt.Errorf("%s: %w", backend, err))
+				continue
+			}
+
+			slog.InfoContext(r.ctx, "backend can't lock, locking it in the proxy", "backend", backend, "error", err)
+			r.emulated.lock(backend, passphrase)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func (r *proxyKeyring) Unlock(passphrase []byte) error {
-	for a := range r.agents() {
+// Unlock unlocks the backends, or releases the proxy lock instead once the
+// user confirms it.
+func (r *boundKeyring) Unlock(passphrase []byte) error {
+	defer r.cache.invalidate()
+	defer clear(passphrase)
+	defer hideFromLogs(passphrase)()
+
+	if r.locked.Load() {
+		// The passphrase of the keyring file, which the proxy waits for locked
+		if k := r.persistent(); k != nil && k.pending() {
+			if err := k.open(passphrase); err != nil {
+				slog.WarnContext(r.ctx, "keyring file not opened", "error", err)
+				return errLocked
+			}
+
+			r.SetLocked(false)
+			return nil
+		}
+
+		if checked, err := checkLockPassphrase(passphrase); checked {
+			if err != nil {
+				slog.WarnContext(r.ctx, "proxy not unlocked", "error", err)
+				return errLocked
+			}
+
+			r.SetLocked(false)
+			return nil
+		}
+
+		if err := askConfirm("Unlock ssh-agent-proxy?"); err != nil {
+			slog.WarnContext(r.ctx, "proxy unlock not confirmed", "error", err)
+			return errLocked
+		}
+
+		r.SetLocked(false)
+		return nil
+	}
+
+	unlocked, err := r.emulated.unlock(r.only(), passphrase)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for backend, a := range r.agents(r.ctx, r.only()) {
+		// Just unlocked by the proxy
+		if slices.Contains(unlocked, backend) {
+			continue
+		}
+
 		if err := a.Unlock(passphrase); err != nil {
-			slog.Error("unlock", "error", err)
+			slog.ErrorContext(r.ctx, "unlock", "backend", backend, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", backend, err))
 		}
 	}
 
-	return nil
+	// Only once every backend let go of it
+	if len(errs) == 0 && r.only() == nil {
+		r.dropPass(passphrase)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Returns a copy of a lock passphrase, kept as a secret until the backends
+// are unlocked with it.
+func (r *proxyKeyring) keepPass(passphrase []byte) []byte {
+	r.passesMu.Lock()
+	defer r.passesMu.Unlock()
+
+	for _, s := range r.passes {
+		if s.equal(passphrase) {
+			return s.bytes()
+		}
+	}
+
+	s := newSecret(passphrase)
+	r.passes = append(r.passes, s)
+
+	return s.bytes()
+}
+
+// Calls f with the passphrase the backends were last locked with, if
+// they are, reporting whether they were.
+func (r *proxyKeyring) lockPassphrase(f func([]byte)) bool {
+	r.passesMu.Lock()
+	defer r.passesMu.Unlock()
+
+	if len(r.passes) == 0 {
+		return false
+	}
+	f(r.passes[len(r.passes)-1].bytes())
+
+	return true
+}
+
+func (r *proxyKeyring) dropPass(passphrase []byte) {
+	r.passesMu.Lock()
+	defer r.passesMu.Unlock()
+
+	r.passes = slices.DeleteFunc(r.passes, func(s *secret) bool {
+		if !s.equal(passphrase) {
+			return false
+		}
+		s.destroy()
+
+		return true
+	})
+}
+
+// Zeroes the lock passphrases and hashes held, and the keys of the internal
+// keyring, on shutdown.
+func (r *proxyKeyring) WipeSecrets() {
+	r.emulated.wipe()
+
+	r.mu.Lock()
+	internal := r.internal
+	r.mu.Unlock()
+
+	if k, ok := internal.(interface{ wipe() }); ok {
+		k.wipe()
+	}
+
+	r.passesMu.Lock()
+	defer r.passesMu.Unlock()
+
+	for _, s := range r.passes {
+		s.destroy()
+	}
+	r.passes = nil
 }
 
 // List returns the identities known to the agent.
-func (r *proxyKeyring) List() ([]*agent.Key, error) {
+func (r *boundKeyring) List() ([]*agent.Key, error) {
+	if r.locked.Load() {
+		return nil, nil
+	}
+
+	if *listCacheTTL > 0 && r.only() == nil {
+		return r.cachedList(r.ctx)
+	}
+
+	return r.list(r.ctx, r.only())
+}
+
+// Merges the identities of all backends, or of those named in only unless it
+// is nil. Fails only when no backend answered.
+func (r *proxyKeyring) list(ctx context.Context, only []string) ([]*agent.Key, error) {
 	var merged []*agent.Key
+	var errs []error
 
-	for a := range r.agents() {
-		if res, err := a.List(); err != nil {
-			slog.Error("error listing", "error", err)
-		} else {
-			merged = slices.Concat(merged, res)
+	answered := false
+	listed := standIns{}
+
+	ctx = withOpTimeout(ctx, *listTimeout)
+
+	for backend, a := range r.agentsExcept(ctx, only, listed.skip) {
+		res, err := a.List()
+		if err != nil {
+			slog.Error("error listing", "backend", backend, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", backend, err))
+			continue
 		}
+
+		answered = true
+		listed.answered(r.groupOf(backend))
+		res = r.paired.appendTo(backend, appendIssuedCerts(res))
+		r.setOwner(backend, res)
+
+		if *annotateComments {
+			for _, k := range res {
+				k.Comment = fmt.Sprintf("%s [%s]", k.Comment, backend)
+			}
+		}
+
+		merged = slices.Concat(merged, res)
 	}
 
-	return merged, nil
+	// Backends the proxy keeps locked list no keys, like locked agents do
+	if !answered && len(errs) == 0 && r.emulated.anyLocked(only) {
+		return nil, nil
+	}
+
+	if !answered {
+		return nil, backendErrors(errs)
+	}
+
+	return arrangeCerts(weakKeys.filter(r.held.filter(r.expiries.filter(merged)))), nil
 }
 
 // Adds a private key to the keyring. If a certificate
-// is given, that certificate is added as public key. Note that
-// any constraints given are ignored.
-func (r *proxyKeyring) Add(key agent.AddedKey) error {
-	for a := range r.agents() {
+// is given, that certificate is added as public key. Constraints are passed
+// on to the backend, and the lifetime is also enforced by the proxy.
+func (r *boundKeyring) Add(key agent.AddedKey) error {
+	defer r.cache.invalidate()
+
+	if r.locked.Load() {
+		return errLocked
+	}
+
+	// A certificate for a key a backend holds goes with that key
+	if backend := r.pairingBackend(key); backend != "" {
+		r.pairCert(backend, key)
+		return nil
+	}
+
+	var errs []error
+	var tried []string
+
+	for backend, a := range r.agents(withOpTimeout(r.ctx, *addTimeout), r.only()) {
+		tried = append(tried, backend)
+
 		if err := a.Add(key); err != nil {
-			slog.Error("error adding", "error", err)
+			slog.ErrorContext(r.ctx, "error adding", "backend", backend, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", backend, err))
 		} else {
 			// First add that succeeds is enough
-			slog.Debug("key added", "comment", key.Comment)
+			slog.DebugContext(r.ctx, "key added", "backend", backend, "comment", key.Comment)
+
+			// The internal keyring honors lifetimes itself
+			if backend != "internal" {
+				r.trackLifetime(backend, key)
+			}
+
+			if s := supervisorOf(backend); s != nil {
+				s.remember(key)
+			}
+
 			return nil
 		}
 	}
 
-	return nil
+	slog.ErrorContext(r.ctx, "key not added", "comment", key.Comment, "tried", tried)
+
+	return backendErrors(errs)
 }
 
 // Sign returns a signature for the data.
-func (r *proxyKeyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
-	for a := range r.agents() {
-		if sig, err := a.Sign(key, data); err != nil {
-			slog.Error("sign failed", "error", err)
+func (r *boundKeyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return r.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs like Sign, passing the flags selecting the RSA
+// signature algorithm on to the backends.
+func (r *boundKeyring) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if r.locked.Load() {
+		return nil, errLocked
+	}
+
+	if r.expiries.expired(key.Marshal()) {
+		return nil, errKeyExpired
+	}
+
+	if r.held.hidden(key.Marshal()) {
+		return nil, errKeyNotFound
+	}
+
+	if err := weakKeys.check(r.ctx, key); err != nil {
+		return nil, err
+	}
+
+	sign := func(a agent.ExtendedAgent, key ssh.PublicKey) (*ssh.Signature, error) {
+		return a.SignWithFlags(key, data, flags)
+	}
+
+	if isSecurityKey(key) {
+		sign = func(a agent.ExtendedAgent, key ssh.PublicKey) (*ssh.Signature, error) {
+			return signSecurityKey(a, key, data)
+		}
+	}
+
+	// A backend holding just the plain key can sign for its certificate
+	var plain ssh.PublicKey
+	if pub, err := ssh.ParsePublicKey(key.Marshal()); err == nil {
+		if cert, ok := pub.(*ssh.Certificate); ok {
+			plain = cert.Key
+		}
+	}
+
+	if *signRace || *signDeadline > 0 {
+		stagger := *signDeadline
+		if *signRace {
+			stagger = 0
+		}
+
+		backend, sig, err := r.raceSign(key, func(a agent.ExtendedAgent) (*ssh.Signature, error) {
+			sig, err := sign(a, key)
+			if err != nil && plain != nil {
+				sig, err = sign(a, plain)
+			}
+			return sig, err
+		}, stagger)
+		if err != nil {
+			slog.ErrorContext(r.ctx, "sign failed", "error", err)
+			return nil, err
+		}
+
+		args := []any{"backend", backend, "fingerprint", ssh.FingerprintSHA256(key)}
+		slog.InfoContext(r.ctx, "key used", append(args, parseSignData(data).logArgs()...)...)
+
+		keyUses.record(key)
+		return sig, nil
+	}
+
+	var errs []error
+
+	for backend, a := range r.agentsArranged(withOpTimeout(r.ctx, *signTimeout), r.only(), nil, r.signArrangement(key)) {
+		sig, err := sign(a, key)
+		if err != nil && plain != nil {
+			sig, err = sign(a, plain)
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.ctx, "sign failed", "backend", backend, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", backend, err))
 		} else {
+			args := []any{"backend", backend, "fingerprint", ssh.FingerprintSHA256(key)}
+			slog.InfoContext(r.ctx, "key used", append(args, parseSignData(data).logArgs()...)...)
+
+			keyUses.record(key)
 			return sig, nil
 		}
 	}
 
-	return nil, nil
+	return nil, backendErrors(errs)
 }
 
 // Signers returns signers for all the known keys.
-func (r *proxyKeyring) Signers() ([]ssh.Signer, error) {
+func (r *boundKeyring) Signers() ([]ssh.Signer, error) {
 	var merged []ssh.Signer
 
-	for a := range r.agents() {
+	if r.locked.Load() {
+		return merged, nil
+	}
+
+	var errs []error
+
+	answered := false
+	listed := standIns{}
+
+	for backend, a := range r.agentsExcept(withOpTimeout(r.ctx, *listTimeout), r.only(), listed.skip) {
 		if res, err := a.Signers(); err != nil {
-			slog.Error("signers", "error", err)
+			slog.ErrorContext(r.ctx, "signers", "backend", backend, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", backend, err))
 		} else {
+			answered = true
+			listed.answered(r.groupOf(backend))
 			merged = slices.Concat(merged, res)
 		}
 	}
 
+	if !answered {
+		return nil, backendErrors(errs)
+	}
+
 	return merged, nil
 }
 
-// The keyring does not support any extensions
-func (r *proxyKeyring) Extension(extensionType string, contents []byte) ([]byte, error) {
-	return nil, agent.ErrExtensionUnsupported
+// Combines the errors of the backends a request failed on. A request that
+// reached no backend at all fails with errNoBackends.
+func backendErrors(errs []error) error {
+	if len(errs) == 0 {
+		return errNoBackends
+	}
+
+	return errors.Join(errs...)
+}
+
+// The failover groups one request got an answer from, whose other backends
+// needn't be asked.
+type standIns map[string]bool
+
+func (s standIns) skip(b backend) bool {
+	return b.group != "" && s[b.group]
+}
+
+func (s standIns) answered(group string) {
+	if group != "" {
+		s[group] = true
+	}
 }
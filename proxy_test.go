@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestListMergesBackends(t *testing.T) {
+	a := newFakeAgent(t, "a", 2)
+	b := newFakeAgent(t, "b", 1)
+	p := startProxy(t, a, b)
+
+	keys := listKeys(t, p.client(t))
+	if len(keys) != 3 {
+		t.Fatalf("got %d keys, want 3", len(keys))
+	}
+
+	comments := map[string]int{}
+	for _, k := range keys {
+		comments[k.Comment]++
+	}
+	if comments["a"] != 2 || comments["b"] != 1 {
+		t.Errorf("got keys %v, want 2 of a and 1 of b", comments)
+	}
+}
+
+func TestSignTriesBackendsInOrder(t *testing.T) {
+	a := newFakeAgent(t, "a", 1)
+	b := newFakeAgent(t, "b", 1)
+	p := startProxy(t, a, b)
+	c := p.client(t)
+
+	keys := map[string]ssh.PublicKey{}
+	for _, k := range listKeys(t, c) {
+		keys[k.Comment] = k
+	}
+
+	data := []byte("data to sign")
+
+	// b is asked once a lacks the key
+	sig, err := c.Sign(keys["b"], data)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := keys["b"].Verify(data, sig); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+
+	// but not when a holds it
+	before := b.requests.Load()
+	if _, err := c.Sign(keys["a"], data); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if n := b.requests.Load() - before; n != 0 {
+		t.Errorf("backend b got %d requests, want none", n)
+	}
+}
+
+func TestListSkipsFailingBackend(t *testing.T) {
+	a := newFakeAgent(t, "a", 1)
+	b := newFakeAgent(t, "b", 2)
+	a.setFailure(errFake)
+	p := startProxy(t, a, b)
+
+	keys := listKeys(t, p.client(t))
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want the 2 of b", len(keys))
+	}
+}
+
+func TestListSkipsSlowBackend(t *testing.T) {
+	setFlag(t, "backend-timeout", "100ms")
+
+	a := newFakeAgent(t, "a", 1)
+	b := newFakeAgent(t, "b", 1)
+	a.setDelay(time.Second)
+	p := startProxy(t, a, b)
+
+	start := time.Now()
+	keys := listKeys(t, p.client(t))
+	if len(keys) != 1 || keys[0].Comment != "b" {
+		t.Errorf("got %d keys, want the one of b", len(keys))
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("list took %v, the slow backend wasn't given up on", d)
+	}
+}
+
+func TestSignFailsWithOwner(t *testing.T) {
+	a := newFakeAgent(t, "a", 1)
+	p := startProxy(t, a)
+	c := p.client(t)
+
+	key := listKeys(t, c)[0]
+	a.setFailure(errFake)
+
+	if _, err := c.Sign(key, []byte("data")); err == nil {
+		t.Error("sign succeeded with its backend failing")
+	}
+}
+
+func TestSignUnknownKey(t *testing.T) {
+	a := newFakeAgent(t, "a", 1)
+	other := newFakeAgent(t, "other", 0)
+	key := other.addKey(t)
+	p := startProxy(t, a)
+
+	if _, err := p.client(t).Sign(key, []byte("data")); err == nil {
+		t.Error("signed with a key no backend holds")
+	}
+}
+
+func TestNoBackendReachable(t *testing.T) {
+	a := newFakeAgent(t, "a", 1)
+	a.setFailure(errFake)
+	p := startProxy(t, a)
+	c := p.client(t)
+
+	keys, err := c.List()
+	if err == nil && len(keys) != 0 {
+		t.Errorf("got %d keys from a failing backend", len(keys))
+	}
+}
+
+func TestLockUnlock(t *testing.T) {
+	a := newFakeAgent(t, "a", 1)
+	b := newFakeAgent(t, "b", 1)
+	p := startProxy(t, a, b)
+	c := p.client(t)
+
+	pass := []byte("passphrase")
+	if err := c.Lock(bytes.Clone(pass)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if keys := listKeys(t, c); len(keys) != 0 {
+		t.Errorf("got %d keys while locked", len(keys))
+	}
+
+	if err := c.Unlock([]byte("wrong")); err == nil {
+		t.Error("unlocked with the wrong passphrase")
+	}
+	if err := c.Unlock(bytes.Clone(pass)); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if keys := listKeys(t, c); len(keys) != 2 {
+		t.Errorf("got %d keys once unlocked, want 2", len(keys))
+	}
+}
+
+func TestListWhileLockEmulated(t *testing.T) {
+	a := newFakeAgent(t, "a", 1)
+	p := startProxy(t, a)
+	c := p.client(t)
+
+	// Already locked, the backend refuses the proxy's lock, which the
+	// proxy then keeps itself
+	if err := a.ExtendedAgent.Lock([]byte("other")); err != nil {
+		t.Fatalf("lock backend: %v", err)
+	}
+	if err := c.Lock([]byte("passphrase")); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	keys, err := c.List()
+	if err != nil {
+		t.Fatalf("list while locked: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got %d keys while locked", len(keys))
+	}
+}
+
+func TestRemoveAllReachesEveryBackend(t *testing.T) {
+	a := newFakeAgent(t, "a", 1)
+	b := newFakeAgent(t, "b", 2)
+	p := startProxy(t, a, b)
+	c := p.client(t)
+
+	if err := c.RemoveAll(); err != nil {
+		t.Fatalf("remove all: %v", err)
+	}
+
+	for _, f := range []*fakeAgent{a, b} {
+		if keys, _ := f.ExtendedAgent.List(); len(keys) != 0 {
+			t.Errorf("backend %s still holds %d keys", f.name, len(keys))
+		}
+	}
+}
+
+func TestRemoveAllSkipsReadOnlyBackends(t *testing.T) {
+	a := newFakeAgent(t, "a", 2)
+	p := startProxyConfigs(t, a.config(), newSignerBackend(t, "kms", 1))
+	c := p.client(t)
+
+	if err := c.RemoveAll(); err != nil {
+		t.Fatalf("remove all: %v", err)
+	}
+
+	if keys, _ := a.ExtendedAgent.List(); len(keys) != 0 {
+		t.Errorf("backend a still holds %d keys", len(keys))
+	}
+	if keys := listKeys(t, c); len(keys) != 1 {
+		t.Errorf("got %d keys, want the read-only backend's 1", len(keys))
+	}
+}
+
+func TestUserViewsLeaveRemoteClients(t *testing.T) {
+	a := newFakeAgent(t, "a", 2)
+	p := startProxy(t, a)
+	addr := p.serveTCP(t)
+
+	// A view for some other user, which clients without a uid aren't
+	saved := userViews
+	userViews = []userView{{Users: []string{"65534"}, Backends: []string{"none"}}}
+	t.Cleanup(func() { userViews = saved })
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if keys := listKeys(t, agent.NewClient(conn)); len(keys) != 2 {
+		t.Errorf("remote client got %d keys, want 2", len(keys))
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+var publishDir = flag.String("publish-dir", defaultPublishDir(), "directory holding the sockets published for containers")
+
+// A socket published for a container, in a directory of its own that is
+// bind-mounted instead of the socket itself, so the mount stays valid when
+// the socket is made again. It is kept in publish.json in that directory
+// and published again whenever the proxy starts.
+type publishedSocket struct {
+	Name     string   `json:"name"`
+	Socket   string   `json:"socket"`
+	UID      int      `json:"uid"`
+	GID      int      `json:"gid"`
+	Mode     string   `json:"mode"`
+	ReadOnly bool     `json:"read_only,omitempty"`
+	Backends []string `json:"backends,omitempty"`
+
+	listener net.Listener
+}
+
+var (
+	publishedMu sync.Mutex
+	published   = map[string]*publishedSocket{}
+
+	// Cancels the requests of published sockets' clients on shutdown
+	publishCtx = context.Background()
+)
+
+func init() {
+	subcommands["publish"] = cmdPublish
+	subcommands["unpublish"] = cmdUnpublish
+
+	adminCommands["publish"] = func(args []string) (any, error) {
+		if len(args) < 5 {
+			return nil, errors.New("usage: publish <name> <uid> <gid> <mode> <read-only> [backend...]")
+		}
+
+		p := &publishedSocket{Name: args[0], Mode: args[3]}
+		if len(args) > 5 {
+			p.Backends = args[5:]
+		}
+
+		var err error
+		if p.UID, err = strconv.Atoi(args[1]); err != nil {
+			return nil, fmt.Errorf("bad uid %q", args[1])
+		}
+		if p.GID, err = strconv.Atoi(args[2]); err != nil {
+			return nil, fmt.Errorf("bad gid %q", args[2])
+		}
+		if p.ReadOnly, err = strconv.ParseBool(args[4]); err != nil {
+			return nil, fmt.Errorf("bad read-only flag %q", args[4])
+		}
+
+		if err := publish(p, true); err != nil {
+			return nil, err
+		}
+
+		return p, nil
+	}
+
+	adminCommands["unpublish"] = func(args []string) (any, error) {
+		if len(args) != 1 {
+			return nil, errors.New("usage: unpublish <name>")
+		}
+		return nil, unpublish(args[0])
+	}
+
+	adminCommands["list-published"] = func(args []string) (any, error) {
+		publishedMu.Lock()
+		defer publishedMu.Unlock()
+
+		list := make([]*publishedSocket, 0, len(published))
+		for _, p := range published {
+			list = append(list, p)
+		}
+		slices.SortFunc(list, func(a, b *publishedSocket) int { return strings.Compare(a.Name, b.Name) })
+
+		return list, nil
+	}
+}
+
+// Returns the directory published sockets go in when none is given on the
+// command line, next to the default agent socket.
+func defaultPublishDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "ssh-agent-proxy", "containers")
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ssh-agent-proxy-%d.containers", os.Getuid()))
+}
+
+// Publishes the sockets recorded in the publish directory, taking over those
+// handed over by the proxy upgraded. Clients' requests are canceled with
+// ctx.
+func restorePublished(ctx context.Context) error {
+	publishCtx = ctx
+
+	if err := os.MkdirAll(expandPath(*publishDir), 0o700); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(expandPath(*publishDir))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(expandPath(*publishDir), e.Name(), "publish.json"))
+		if err != nil {
+			continue
+		}
+
+		p := &publishedSocket{}
+		if err := json.Unmarshal(b, p); err != nil {
+			slog.Warn("published socket", "name", e.Name(), "error", err)
+			continue
+		}
+
+		if err := publish(p, false); err != nil {
+			slog.Warn("published socket", "name", p.Name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// Listens on the published socket and serves it. record saves it to be
+// published again on the next start.
+func publish(p *publishedSocket, record bool) error {
+	if !backendNameRe.MatchString(p.Name) {
+		return fmt.Errorf("bad name %q", p.Name)
+	}
+
+	dir := filepath.Join(expandPath(*publishDir), p.Name)
+	p.Socket = filepath.Join(dir, "agent.sock")
+
+	mode, err := parseMode(p.Mode)
+	if err != nil {
+		return err
+	}
+
+	fe, err := listenerConfig{Socket: p.Socket, Backends: p.Backends, ReadOnly: p.ReadOnly}.frontend()
+	if err != nil {
+		return err
+	}
+
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+
+	if _, ok := published[p.Name]; ok {
+		return fmt.Errorf("%s is published already", p.Name)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	l := takeInherited(p.Socket)
+	if l == nil {
+		if err := removeStaleSocket(p.Socket); err != nil {
+			return err
+		}
+
+		if l, err = net.Listen("unix", p.Socket); err != nil {
+			return err
+		}
+	}
+
+	// Removed by unpublish, and not on upgrades while the new proxy uses it
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(p.Socket, mode); err != nil {
+		_ = l.Close()
+		return err
+	}
+
+	if p.UID != -1 || p.GID != -1 {
+		if err := os.Lchown(p.Socket, p.UID, p.GID); err != nil {
+			_ = l.Close()
+			return err
+		}
+	}
+
+	if record {
+		b, _ := json.MarshalIndent(p, "", "  ")
+		if err := os.WriteFile(filepath.Join(dir, "publish.json"), append(b, '\n'), 0o600); err != nil {
+			_ = l.Close()
+			return err
+		}
+	}
+
+	p.listener = l
+	published[p.Name] = p
+
+	slog.Info("socket published", "name", p.Name, "path", p.Socket, "uid", p.UID, "gid", p.GID, "read_only", p.ReadOnly, "backends", p.Backends)
+
+	go serve(publishCtx, l, fe)
+
+	return nil
+}
+
+// Stops serving a published socket and removes its directory.
+func unpublish(name string) error {
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+
+	p, ok := published[name]
+	if !ok {
+		return fmt.Errorf("%s is not published", name)
+	}
+
+	delete(published, name)
+	_ = p.listener.Close()
+
+	slog.Info("socket unpublished", "name", name)
+
+	return os.RemoveAll(filepath.Dir(p.Socket))
+}
+
+// Returns the published sockets to hand over on upgrades, by path.
+func publishedSockets() map[string]net.Listener {
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+
+	sockets := map[string]net.Listener{}
+	for _, p := range published {
+		sockets[p.Socket] = p.listener
+	}
+
+	return sockets
+}
+
+// Stops serving the published sockets on shutdown. Their directories stay
+// for the next start, which publishes them again.
+func closePublished() {
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+
+	for _, p := range published {
+		_ = p.listener.Close()
+		if !handedOff.Load() {
+			_ = os.Remove(p.Socket)
+		}
+	}
+}
+
+func cmdPublish(args []string) error {
+	fs, cf := newClientFlags("publish")
+	uid := fs.Int("uid", -1, "user owning the socket, as seen from the host, -1 to leave it")
+	gid := fs.Int("gid", -1, "group owning the socket, as seen from the host, -1 to leave it")
+	mode := fs.String("mode", "0660", "permissions of the socket")
+	ro := fs.Bool("read-only", false, "only allow listing keys and signing")
+	backends := fs.String("backends", "", "comma-separated names of the backends to offer, all by default")
+	target := fs.String("target", "/run/ssh-agent", "directory the socket is mounted on in the container")
+	_ = fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		var list []publishedSocket
+		if err := adminCall(cf.adminSocket, "list-published", nil, &list); err != nil {
+			return err
+		}
+
+		if cf.json {
+			return printJSON(list)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "NAME\tSOCKET\tUID\tGID\tREAD-ONLY\tBACKENDS")
+		for _, p := range list {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%t\t%s\n", p.Name, p.Socket, p.UID, p.GID, p.ReadOnly, strings.Join(p.Backends, ","))
+		}
+		return tw.Flush()
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: publish [flags] [name]")
+	}
+
+	callArgs := []string{fs.Arg(0), strconv.Itoa(*uid), strconv.Itoa(*gid), *mode, strconv.FormatBool(*ro)}
+	if *backends != "" {
+		callArgs = append(callArgs, strings.Split(*backends, ",")...)
+	}
+
+	var p publishedSocket
+	if err := adminCall(cf.adminSocket, "publish", callArgs, &p); err != nil {
+		return err
+	}
+
+	if cf.json {
+		return printJSON(p)
+	}
+
+	// Ready to be spliced into docker or podman run
+	fmt.Printf("-v %s:%s -e SSH_AUTH_SOCK=%s\n", filepath.Dir(p.Socket), *target, filepath.Join(*target, filepath.Base(p.Socket)))
+
+	return nil
+}
+
+func cmdUnpublish(args []string) error {
+	fs, cf := newClientFlags("unpublish")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: unpublish [flags] <name>")
+	}
+
+	return adminCall(cf.adminSocket, "unpublish", fs.Args(), nil)
+}
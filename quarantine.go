@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var quarantineAfter = flag.Int("quarantine-after", 3, "take a backend out of use after this many malformed replies in a row, until it is enabled again; 0 never does")
+
+// A backend agent watching for replies that break the agent protocol, as
+// opposed to refusals or a lost connection. The client library panics on
+// some of them, which is turned into an error here.
+type checkedAgent struct {
+	agent.ExtendedAgent
+	ctx context.Context
+	b   backend
+}
+
+// Reports whether err means the backend answered with something that isn't
+// the agent protocol.
+func isProtocolError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	for _, prefix := range []string{"agent: empty packet", "agent: unknown type tag", "agent: too many keys", "agent: malformed reply", "ssh: "} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+
+	return strings.HasSuffix(msg, "response too large")
+}
+
+// Notes the outcome of a request, counting protocol errors towards the
+// quarantine.
+func (a checkedAgent) check(op string, err *error) {
+	if v := recover(); v != nil {
+		*err = fmt.Errorf("agent: malformed reply to %s: %v", op, v)
+	}
+
+	if isProtocolError(*err) {
+		a.b.health.protocolError(a.ctx, a.b.name, *err)
+	} else if *err == nil {
+		a.b.health.protocolOK()
+	}
+}
+
+// Counts a malformed reply, quarantining the backend once there have been
+// --quarantine-after of them in a row.
+func (h *backendHealth) protocolError(ctx context.Context, name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.protocolErrors++
+	slog.WarnContext(ctx, "malformed reply from backend", "backend", name, "error", err, "count", h.protocolErrors)
+
+	if *quarantineAfter <= 0 || h.protocolErrors < *quarantineAfter || h.quarantined != "" {
+		return
+	}
+
+	h.quarantined = err.Error()
+	slog.Error("backend quarantined, enable it again once fixed", "backend", name, "errors", h.protocolErrors, "error", err)
+	fireEvent(hookEvent{Event: "backend-quarantined", Backend: name, Error: h.quarantined, Failures: h.protocolErrors})
+}
+
+func (h *backendHealth) protocolOK() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.protocolErrors = 0
+}
+
+// Returns why the backend is quarantined, or "" when it isn't.
+func (h *backendHealth) quarantine() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.quarantined
+}
+
+// Puts a quarantined backend back in use.
+func (h *backendHealth) release(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.quarantined != "" {
+		slog.Info("backend out of quarantine", "backend", name)
+	}
+	h.quarantined, h.protocolErrors = "", 0
+}
+
+func (a checkedAgent) List() (keys []*agent.Key, err error) {
+	defer a.check("list", &err)
+
+	if keys, err = a.ExtendedAgent.List(); err != nil {
+		return nil, err
+	}
+
+	return a.whenLocked(keys)
+}
+
+func (a checkedAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a checkedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (sig *ssh.Signature, err error) {
+	defer a.check("sign", &err)
+
+	sig, err = a.ExtendedAgent.SignWithFlags(key, data, flags)
+	if a.b.health.noteRefusal(a.b.name, err) && a.promptUnlock() {
+		return a.ExtendedAgent.SignWithFlags(key, data, flags)
+	}
+
+	return sig, err
+}
+
+func (a checkedAgent) Add(key agent.AddedKey) (err error) {
+	defer a.check("add", &err)
+	return a.ExtendedAgent.Add(key)
+}
+
+func (a checkedAgent) Remove(key ssh.PublicKey) (err error) {
+	defer a.check("remove", &err)
+
+	if err = a.ExtendedAgent.Remove(key); err == nil {
+		a.b.health.noteRemoved()
+	} else {
+		a.b.health.noteRefusal(a.b.name, err)
+	}
+
+	return err
+}
+
+func (a checkedAgent) RemoveAll() (err error) {
+	defer a.check("remove-all", &err)
+
+	if err = a.ExtendedAgent.RemoveAll(); err == nil {
+		a.b.health.noteRemoved()
+	}
+
+	return err
+}
+
+func (a checkedAgent) Lock(passphrase []byte) (err error) {
+	defer a.check("lock", &err)
+
+	if err = a.ExtendedAgent.Lock(passphrase); err == nil {
+		a.b.health.lockedByUs(a.b.name, true)
+	}
+
+	return err
+}
+
+func (a checkedAgent) Unlock(passphrase []byte) (err error) {
+	defer a.check("unlock", &err)
+
+	if err = a.ExtendedAgent.Unlock(passphrase); err == nil {
+		a.b.health.lockedByUs(a.b.name, false)
+	}
+
+	return err
+}
+
+func (a checkedAgent) Extension(extensionType string, contents []byte) (_ []byte, err error) {
+	defer a.check("extension", &err)
+	return a.ExtendedAgent.Extension(extensionType, contents)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type (
+	// At most Signs signatures per key in any Window, for the keys and
+	// backends given or every one when left out.
+	signQuota struct {
+		Keys     []string `json:"keys,omitempty"`
+		Backends []string `json:"backends,omitempty"`
+		Signs    int      `json:"signs"`
+		Window   string   `json:"window"`
+
+		window time.Duration
+	}
+
+	// The times of the signatures counting towards each quota, by quota and
+	// key.
+	quotaUsage struct {
+		mu    sync.Mutex
+		signs map[string][]time.Time
+	}
+
+	// An agent holding one client connection to the sign quotas.
+	quotaAgent struct {
+		agent.ExtendedAgent
+		ctx  context.Context
+		peer peerCred
+	}
+)
+
+var (
+	signQuotas []signQuota
+	quotaUsed  quotaUsage
+
+	errQuotaExceeded = errors.New("sign quota exceeded")
+)
+
+func (q *signQuota) validate() error {
+	if q.Signs < 1 {
+		return errors.New("signs must be at least 1")
+	}
+
+	d, err := time.ParseDuration(q.Window)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("bad window %q", q.Window)
+	}
+	q.window = d
+
+	return nil
+}
+
+func (q signQuota) matches(fingerprint, backend string) bool {
+	return (len(q.Keys) == 0 || slices.Contains(q.Keys, fingerprint)) &&
+		(len(q.Backends) == 0 || slices.Contains(q.Backends, backend))
+}
+
+// Counts a signature against the quota, reporting whether it was within
+// it. The returned time undoes it with refund.
+func (u *quotaUsage) take(quota int, q signQuota, fingerprint string) (time.Time, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.signs == nil {
+		u.signs = make(map[string][]time.Time)
+	}
+
+	now := time.Now()
+	k := fmt.Sprintf("%d %s", quota, fingerprint)
+
+	signs := slices.DeleteFunc(u.signs[k], func(t time.Time) bool {
+		return now.Sub(t) >= q.window
+	})
+	if len(signs) >= q.Signs {
+		u.signs[k] = signs
+		return time.Time{}, false
+	}
+
+	u.signs[k] = append(signs, now)
+
+	return now, true
+}
+
+// Takes back a signature that failed, so it doesn't count.
+func (u *quotaUsage) refund(quota int, fingerprint string, t time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	k := fmt.Sprintf("%d %s", quota, fingerprint)
+	if i := slices.Index(u.signs[k], t); i >= 0 {
+		u.signs[k] = slices.Delete(u.signs[k], i, i+1)
+	}
+}
+
+func (a *quotaAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// Signs if the first quota for the key has room left.
+func (a *quotaAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	fp, backend := ssh.FingerprintSHA256(key), pkr.owner(key)
+
+	i := slices.IndexFunc(signQuotas, func(q signQuota) bool { return q.matches(fp, backend) })
+	if i < 0 {
+		return a.ExtendedAgent.SignWithFlags(key, data, flags)
+	}
+
+	q := signQuotas[i]
+	t, ok := quotaUsed.take(i, q, fp)
+	if !ok {
+		slog.WarnContext(a.ctx, "sign quota exceeded", "fingerprint", fp, "backend", backend, "quota", i+1, "signs", q.Signs, "window", q.Window, "uid", a.peer.uid, "pid", a.peer.pid, "exe", a.peer.exe)
+		return nil, errQuotaExceeded
+	}
+
+	sig, err := a.ExtendedAgent.SignWithFlags(key, data, flags)
+	if err != nil {
+		quotaUsed.refund(i, fp, t)
+	}
+
+	return sig, err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	signRate   = flag.Int("sign-rate", 0, "maximum sign requests per minute per client, 0 for no limit")
+	signRateBy = flag.String("sign-rate-by", "uid", "what counts as one client for --sign-rate: uid or pid")
+
+	errRateLimited = errors.New("sign rate limit exceeded")
+
+	signLimiter *rateLimiter
+)
+
+// A token bucket per client, refilling at perMinute tokens a minute up to a
+// burst of perMinute.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	buckets   map[int]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// An agent applying the sign rate limit to one client connection.
+type rateLimitedAgent struct {
+	agent.ExtendedAgent
+	ctx  context.Context
+	peer peerCred
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, buckets: map[int]*bucket{}}
+}
+
+// Sets up the sign rate limiter according to the flags.
+func setupRateLimit() error {
+	if *signRate <= 0 {
+		return nil
+	}
+
+	if *signRateBy != "uid" && *signRateBy != "pid" {
+		return fmt.Errorf("bad --sign-rate-by %q, must be uid or pid", *signRateBy)
+	}
+
+	signLimiter = newRateLimiter(*signRate)
+
+	return nil
+}
+
+// Takes a token from the client's bucket, reporting whether there was one.
+func (l *rateLimiter) allow(client int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	limit := float64(l.perMinute)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: limit, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = min(limit, b.tokens+now.Sub(b.last).Minutes()*limit)
+	b.last = now
+
+	// Forget clients whose buckets have refilled, so exited pids don't pile up
+	for k, other := range l.buckets {
+		if other != b && now.Sub(other.last) > time.Minute {
+			delete(l.buckets, k)
+		}
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+func (a *rateLimitedAgent) check() error {
+	client := a.peer.uid
+	if *signRateBy == "pid" {
+		client = a.peer.pid
+	}
+
+	if signLimiter.allow(client) {
+		return nil
+	}
+
+	slog.WarnContext(a.ctx, "sign rate limit exceeded", "uid", a.peer.uid, "pid", a.peer.pid, "exe", a.peer.exe, "limit", signLimiter.perMinute)
+
+	return errRateLimited
+}
+
+func (a *rateLimitedAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *rateLimitedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := a.check(); err != nil {
+		return nil, err
+	}
+
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	readOnly       = flag.Bool("read-only", false, "make the whole proxy read-only: every socket only allows listing keys and signing, and no keys are generated")
+	readOnlySocket = flag.String("read-only-socket", "", "also listen on this path, only allowing listing keys and signing")
+
+	errReadOnly      = errors.New("socket is read-only")
+	errReadOnlyProxy = errors.New("the proxy is read-only")
+)
+
+// An agent refusing every request that changes the keys or the lock state,
+// for sockets forwarded into containers or to remote hosts.
+type readOnlyAgent struct {
+	agent.ExtendedAgent
+}
+
+// Listens on the read-only socket or a listener from the config file. Unlike
+// the agent socket these may live in a shared directory, such as one mounted
+// into a container, so only the socket itself gets the permission flags
+// applied.
+func listenShared(path string) (net.Listener, error) {
+	if l := takeInherited(path); l != nil {
+		return l, nil
+	}
+
+	mode, err := parseMode(*socketMode)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, gid, err := socketOwnership()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func (a *readOnlyAgent) Add(key agent.AddedKey) error {
+	return errReadOnly
+}
+
+func (a *readOnlyAgent) Remove(key ssh.PublicKey) error {
+	return errReadOnly
+}
+
+func (a *readOnlyAgent) RemoveAll() error {
+	return errReadOnly
+}
+
+func (a *readOnlyAgent) Lock(passphrase []byte) error {
+	return errReadOnly
+}
+
+func (a *readOnlyAgent) Unlock(passphrase []byte) error {
+	return errReadOnly
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type (
+	// Which keys' signatures are recorded, where and for whom.
+	recordingConfig struct {
+		Keys       []string `json:"keys"`
+		Dir        string   `json:"dir"`
+		Recipients []string `json:"recipients"`
+
+		recipients []age.Recipient
+	}
+
+	// A signature as it is recorded, with everything needed to tell what
+	// was signed, by whom and when.
+	signRecord struct {
+		Time        time.Time   `json:"time"`
+		Fingerprint string      `json:"fingerprint"`
+		Backend     string      `json:"backend"`
+		Client      *hookClient `json:"client"`
+		Flags       uint32      `json:"flags,omitempty"`
+		Purpose     string      `json:"purpose,omitempty"`
+		Namespace   string      `json:"namespace,omitempty"`
+		User        string      `json:"user,omitempty"`
+		Data        []byte      `json:"data"`
+		Signature   struct {
+			Format string `json:"format"`
+			Blob   []byte `json:"blob"`
+		} `json:"signature"`
+	}
+
+	// An agent recording the signatures of the designated keys before
+	// handing them out.
+	recordingAgent struct {
+		agent.ExtendedAgent
+		ctx  context.Context
+		peer peerCred
+	}
+)
+
+var (
+	recording *recordingConfig
+
+	errNotRecorded = errors.New("signature could not be recorded")
+)
+
+func (c *recordingConfig) validate() error {
+	if len(c.Keys) == 0 {
+		return errors.New("no keys")
+	}
+	if c.Dir == "" {
+		return errors.New("no dir")
+	}
+
+	rs, err := age.ParseRecipients(strings.NewReader(strings.Join(c.Recipients, "\n")))
+	if err != nil {
+		return fmt.Errorf("recipients: %w", err)
+	}
+	c.recipients = rs
+
+	return nil
+}
+
+// Writes the record encrypted to the recipients, in a file of its own.
+func (c *recordingConfig) write(rec signRecord) (string, error) {
+	dir := expandPath(c.Dir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%s.age", rec.Time.UTC().Format("20060102T150405.000000000Z"), strings.NewReplacer("/", "_", "+", "-").Replace(strings.TrimPrefix(rec.Fingerprint, "SHA256:"))[:8])
+	path := filepath.Join(dir, name)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := age.Encrypt(f, c.recipients...)
+	if err == nil {
+		err = json.NewEncoder(w).Encode(rec)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (a *recordingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// Signs, and for the recorded keys only hands out the signature once it is
+// recorded.
+func (a *recordingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	sig, err := a.ExtendedAgent.SignWithFlags(key, data, flags)
+
+	fp := ssh.FingerprintSHA256(key)
+	if err != nil || !slices.Contains(recording.Keys, fp) {
+		return sig, err
+	}
+
+	d := parseSignData(data)
+	rec := signRecord{
+		Time:        time.Now(),
+		Fingerprint: fp,
+		Backend:     pkr.owner(key),
+		Client:      &hookClient{UID: a.peer.uid, PID: a.peer.pid, Exe: a.peer.exe},
+		Flags:       uint32(flags),
+		Purpose:     d.purpose,
+		Namespace:   d.namespace,
+		User:        d.user,
+		Data:        data,
+	}
+	rec.Signature.Format, rec.Signature.Blob = sig.Format, sig.Blob
+
+	path, err := recording.write(rec)
+	if err != nil {
+		slog.ErrorContext(a.ctx, "signature not recorded, withheld", "fingerprint", fp, "error", err)
+		return nil, errNotRecorded
+	}
+
+	slog.DebugContext(a.ctx, "signature recorded", "fingerprint", fp, "path", path)
+
+	return sig, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var logRedact = flag.Bool("log-redact", true, "scrub passphrases, private keys and sign payloads from the logs; disable only to debug")
+
+// Attributes whose values are never logged, only their length.
+var redactedAttrs = []string{"passphrase", "password", "pin", "secret", "private_key", "data", "payload"}
+
+var privateKeyPEM = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----.*?(-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`)
+
+// The passphrases being handled, scrubbed wherever they show up in a log
+// record, e.g. echoed in a backend's error.
+var hidden struct {
+	mu      sync.Mutex
+	secrets []*secret
+}
+
+// Scrubs b from the logs until the returned function is called.
+func hideFromLogs(b []byte) (release func()) {
+	if len(b) == 0 {
+		return func() {}
+	}
+
+	s := newSecret(b)
+
+	hidden.mu.Lock()
+	hidden.secrets = append(hidden.secrets, s)
+	hidden.mu.Unlock()
+
+	return func() {
+		hidden.mu.Lock()
+		hidden.secrets = slices.DeleteFunc(hidden.secrets, func(h *secret) bool { return h == s })
+		hidden.mu.Unlock()
+
+		s.destroy()
+	}
+}
+
+// A slog.Handler scrubbing passphrases, private keys and raw payloads from
+// records before handing them on. Fingerprints and lengths are kept.
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h redactingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, redactString(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+
+	return redactingHandler{h.Handler.WithAttrs(redacted)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{h.Handler.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+
+	if slices.Contains(redactedAttrs, strings.ToLower(a.Key)) {
+		switch v.Kind() {
+		case slog.KindString:
+			return slog.String(a.Key, fmt.Sprintf("[redacted, %d bytes]", len(v.String())))
+		case slog.KindAny:
+			if b, ok := v.Any().([]byte); ok {
+				return slog.String(a.Key, fmt.Sprintf("[redacted, %d bytes]", len(b)))
+			}
+		}
+		return slog.String(a.Key, "[redacted]")
+	}
+
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactString(v.String()))
+
+	case slog.KindGroup:
+		group := v.Group()
+		redacted := make([]any, len(group))
+		for i, ga := range group {
+			redacted[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, redacted...)
+
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case []byte:
+			return slog.String(a.Key, fmt.Sprintf("[%d bytes]", len(x)))
+		case agent.AddedKey, *agent.AddedKey, *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, *ed25519.PrivateKey:
+			return slog.String(a.Key, "[redacted private key]")
+		case error:
+			if s := x.Error(); redactString(s) != s {
+				return slog.String(a.Key, redactString(s))
+			}
+		case fmt.Stringer:
+			if s := x.String(); redactString(s) != s {
+				return slog.String(a.Key, redactString(s))
+			}
+		}
+	}
+
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// Scrubs private keys in PEM form and the passphrases being handled from s.
+func redactString(s string) string {
+	s = privateKeyPEM.ReplaceAllStringFunc(s, func(key string) string {
+		return fmt.Sprintf("[redacted private key, %d bytes]", len(key))
+	})
+
+	hidden.mu.Lock()
+	defer hidden.mu.Unlock()
+
+	if len(hidden.secrets) == 0 {
+		return s
+	}
+
+	// Searched as bytes, so the passphrases aren't copied into strings
+	b := []byte(s)
+	changed := false
+	for _, sec := range hidden.secrets {
+		for from := 0; ; {
+			i := bytes.Index(b[from:], sec.bytes())
+			if i < 0 {
+				break
+			}
+			b = slices.Replace(b, from+i, from+i+len(sec.bytes()), []byte("[redacted]")...)
+			from += i + len("[redacted]")
+			changed = true
+		}
+	}
+	if !changed {
+		return s
+	}
+
+	return string(b)
+}
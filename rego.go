@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+const (
+	// The rule a Rego policy decides with
+	regoQuery = "data.ssh_agent_proxy.decision"
+
+	// How often policies are checked for changes, at most
+	regoCheckInterval = 2 * time.Second
+)
+
+type (
+	// A compiled Rego policy, loaded again when its files change.
+	regoPolicy struct {
+		path string
+
+		mu      sync.Mutex
+		query   rego.PreparedEvalQuery
+		stamp   string
+		checked time.Time
+	}
+
+	regoPolicySet struct {
+		mu       sync.Mutex
+		policies map[string]*regoPolicy
+	}
+)
+
+var regoPolicies regoPolicySet
+
+// Returns the policy at path, a Rego file, a directory of them or a bundle,
+// compiling it the first time.
+func (s *regoPolicySet) get(path string) (*regoPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.policies[path]; p != nil {
+		return p, nil
+	}
+
+	p := &regoPolicy{path: path}
+	if err := p.load(context.Background()); err != nil {
+		return nil, err
+	}
+
+	if s.policies == nil {
+		s.policies = make(map[string]*regoPolicy)
+	}
+	s.policies[path] = p
+
+	return p, nil
+}
+
+// Sums up the names, sizes and modification times of the policy's files,
+// which changes whenever one of them is written.
+func (p *regoPolicy) fileStamp() (string, error) {
+	var stamp string
+	err := filepath.WalkDir(p.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		stamp += fmt.Sprintf("%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+
+	return stamp, err
+}
+
+// Compiles the policy from its files. The caller holds p.mu, or has p to
+// itself.
+func (p *regoPolicy) load(ctx context.Context) error {
+	stamp, err := p.fileStamp()
+	if err != nil {
+		return err
+	}
+
+	query, err := rego.New(rego.Query(regoQuery), rego.LoadBundle(p.path)).PrepareForEval(ctx)
+	if err != nil {
+		return fmt.Errorf("rego policy %s: %w", p.path, err)
+	}
+
+	p.query, p.stamp, p.checked = query, stamp, time.Now()
+
+	return nil
+}
+
+// Returns the compiled policy, loading it again first if its files changed.
+// A policy that no longer compiles is logged and the previous one kept.
+func (p *regoPolicy) current(ctx context.Context) rego.PreparedEvalQuery {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.checked) < regoCheckInterval {
+		return p.query
+	}
+	p.checked = time.Now()
+
+	if stamp, err := p.fileStamp(); err == nil && stamp == p.stamp {
+		return p.query
+	}
+
+	if err := p.load(ctx); err != nil {
+		slog.ErrorContext(ctx, "keeping the previous policy", "error", err)
+	} else {
+		slog.InfoContext(ctx, "rego policy reloaded", "path", p.path)
+	}
+
+	return p.query
+}
+
+// Evaluates the Rego policy at path on the request and returns the action
+// its decision names. An undefined decision, or anything but allow, deny or
+// confirm, denies.
+func regoAction(ctx context.Context, path string, req policyRequest) string {
+	p, err := regoPolicies.get(path)
+	if err != nil {
+		slog.WarnContext(ctx, "rego policy failed, request denied", "error", err)
+		return "deny"
+	}
+
+	rs, err := p.current(ctx).Eval(ctx, rego.EvalInput(policyInputOf(req)))
+	if err != nil {
+		slog.WarnContext(ctx, "rego policy failed, request denied", "path", path, "error", err)
+		return "deny"
+	}
+
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		slog.DebugContext(ctx, "rego policy made no decision, request denied", "path", path)
+		return "deny"
+	}
+
+	switch decision := rs[0].Expressions[0].Value; decision {
+	case "allow", "deny", "confirm":
+		return decision.(string)
+	default:
+		slog.WarnContext(ctx, "bad rego policy decision, request denied", "path", path, "decision", decision)
+		return "deny"
+	}
+}
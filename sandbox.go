@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var noSandbox = flag.Bool("no-sandbox", false, "don't restrict the proxy once it is running, for debugging")
+
+// Restricts the running proxy to writing beneath the directories it needs:
+// those of its sockets, symlink and log file, the temporary directory, and
+// gpg-agent's for gpg: backends, and to the system calls it makes. Reading
+// and running programs stay allowed, since backends, hooks and askpass
+// helpers may live anywhere. The programs the proxy runs inherit the
+// restrictions, so with agents supervised or run for exec: backends, which
+// write where they please, there is no sandbox.
+func sandbox(ctx context.Context, paths []string, backends []backendConfig) error {
+	if *noSandbox {
+		return nil
+	}
+
+	dirs := []string{os.TempDir()}
+	for _, p := range paths {
+		dirs = append(dirs, filepath.Dir(p))
+	}
+
+	var sockets []string
+	gpg := false
+	for _, b := range backends {
+		if len(b.Command) > 0 || strings.HasPrefix(b.Socket, "exec:") {
+			slog.Warn("not sandboxed, the backend's agent is run by the proxy", "backend", b.Name)
+			return nil
+		}
+
+		if isSocketPath(b.Socket) {
+			sockets = append(sockets, expandPath(b.Socket))
+		}
+
+		if u, err := url.Parse(b.Socket); err == nil && u.Scheme == "gpg" {
+			gpg = true
+		}
+	}
+
+	if gpg {
+		dirs = append(dirs, gpgDirs(ctx)...)
+	}
+
+	slices.Sort(dirs)
+
+	return restrict(slices.Compact(dirs), sockets)
+}
+
+// Returns the files the proxy keeps writing to or removes on exit, given its
+// sockets, the agent socket first.
+func writtenPaths(sockets []string) []string {
+	// Its directory is removed on exit as well
+	paths := []string{filepath.Dir(sockets[0])}
+	for _, socket := range sockets {
+		switch {
+		case isSocketPath(socket):
+			paths = append(paths, socket)
+		case isCygwin(socket):
+			paths = append(paths, cygwinPath(socket))
+		}
+	}
+
+	// Tailnet nodes keep their state, and Tailscale's logs, in a directory
+	for _, l := range listeners {
+		if u, err := url.Parse(l.Socket); err == nil && isTailnet(l.Socket) {
+			if dir, err := tsnetStateDir(u.Hostname()); err == nil {
+				paths = append(paths, filepath.Join(dir, "tailscaled.state"))
+			}
+		}
+	}
+
+	if *usageFile != "" {
+		paths = append(paths, expandPath(*usageFile))
+	}
+
+	if *keyringFile != "" {
+		paths = append(paths, expandPath(*keyringFile))
+	}
+
+	// Recordings are written beneath it
+	if recording != nil {
+		paths = append(paths, expandPath(recording.Dir))
+	}
+
+	// Published sockets' directories are made and removed beneath it
+	paths = append(paths, expandPath(*publishDir))
+
+	if *symlinkPath != "" {
+		paths = append(paths, expandPath(*symlinkPath))
+	}
+
+	switch {
+	case logsToStdout(*logFile):
+	case *logFile == "stderr", *logFile == "syslog", *logFile == os.DevNull:
+	default:
+		paths = append(paths, *logFile)
+	}
+
+	return paths
+}
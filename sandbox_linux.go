@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Write access as Landlock knows it, by ABI version
+const (
+	landlockWrite = unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK | unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK | unix.LANDLOCK_ACCESS_FS_MAKE_SYM
+	landlockWriteV2 = landlockWrite | unix.LANDLOCK_ACCESS_FS_REFER
+	landlockWriteV3 = landlockWriteV2 | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+// Denies writing outside dirs and the system calls the proxy doesn't make.
+// Sockets can be connected to wherever they are.
+func restrict(dirs, sockets []string) error {
+	if err := restrictWrites(dirs); err != nil {
+		return err
+	}
+
+	if err := restrictSyscalls(); err != nil {
+		return err
+	}
+
+	slog.Info("sandboxed", "writable", dirs)
+
+	return nil
+}
+
+// Denies writing outside dirs with Landlock, if the kernel supports it.
+func restrictWrites(dirs []string) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		slog.Warn("sandbox not available, Landlock is not enabled", "error", errno)
+		return nil
+	}
+
+	access := uint64(landlockWrite)
+	switch {
+	case abi >= 3:
+		access = landlockWriteV3
+	case abi >= 2:
+		access = landlockWriteV2
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: access}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer func() { _ = unix.Close(int(fd)) }()
+
+	for _, dir := range dirs {
+		if err := landlockAllow(int(fd), dir, access); err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+
+	// Written to by commands run in the background and by askpass prompts
+	for _, dev := range []string{os.DevNull, "/dev/tty"} {
+		if err := landlockAllow(int(fd), dev, access&(unix.LANDLOCK_ACCESS_FS_WRITE_FILE|unix.LANDLOCK_ACCESS_FS_TRUNCATE)); err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+
+	// Landlock domains are per thread, and Go can't reach those of C code
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno == syscall.ENOTSUP {
+		return errors.New("Landlock can't sandbox cgo builds, build with CGO_ENABLED=0 or run with --no-sandbox")
+	} else if errno != 0 {
+		return errno
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func landlockAllow(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
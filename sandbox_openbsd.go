@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Restricts the proxy to writing beneath dirs and connecting to the backend
+// sockets with unveil, and to the system calls it needs with pledge.
+// Everything stays readable and programs runnable. Backends added later
+// must have their sockets beneath dirs.
+func restrict(dirs, sockets []string) error {
+	if err := unix.Unveil("/", "rx"); err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := unix.Unveil(dir, "rwc"); err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+
+	// Backend sockets are connected to, and the others written to by
+	// commands run in the background and by askpass prompts
+	for _, path := range append(sockets, os.DevNull, "/dev/tty") {
+		if err := unix.Unveil(path, "rw"); err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+
+	if err := unix.UnveilBlock(); err != nil {
+		return err
+	}
+
+	if err := unix.PledgePromises("stdio rpath wpath cpath fattr flock unix inet dns proc exec getpw tty sendfd recvfd prot_exec"); err != nil {
+		return err
+	}
+
+	slog.Info("sandboxed", "writable", dirs)
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The architecture system calls are expected from, by GOARCH
+var seccompArchs = map[string]uint32{
+	"386":      unix.AUDIT_ARCH_I386,
+	"amd64":    unix.AUDIT_ARCH_X86_64,
+	"arm":      unix.AUDIT_ARCH_ARM,
+	"arm64":    unix.AUDIT_ARCH_AARCH64,
+	"loong64":  unix.AUDIT_ARCH_LOONGARCH64,
+	"mips64le": unix.AUDIT_ARCH_MIPSEL64,
+	"ppc64le":  unix.AUDIT_ARCH_PPC64LE,
+	"riscv64":  unix.AUDIT_ARCH_RISCV64,
+	"s390x":    unix.AUDIT_ARCH_S390X,
+}
+
+// System calls the proxy, and the programs it runs, have no use for:
+// administering the system, its kernel, mounts and namespaces, and looking
+// into other processes
+var seccompDenied = []uint32{
+	unix.SYS_ACCT, unix.SYS_ADD_KEY, unix.SYS_BPF, unix.SYS_CHROOT, unix.SYS_CLOCK_SETTIME,
+	unix.SYS_DELETE_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_INIT_MODULE, unix.SYS_KCMP,
+	unix.SYS_KEXEC_LOAD, unix.SYS_KEYCTL, unix.SYS_MOUNT, unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_PERF_EVENT_OPEN, unix.SYS_PIVOT_ROOT, unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV, unix.SYS_PTRACE, unix.SYS_QUOTACTL, unix.SYS_REBOOT,
+	unix.SYS_REQUEST_KEY, unix.SYS_SETDOMAINNAME, unix.SYS_SETHOSTNAME, unix.SYS_SETNS,
+	unix.SYS_SETTIMEOFDAY, unix.SYS_SWAPOFF, unix.SYS_SWAPON, unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE, unix.SYS_USERFAULTFD,
+}
+
+// Numbers at and above this are x32 system calls on amd64, which would get
+// around the filter
+const seccompX32 = 0x40000000
+
+// Denies the system calls in seccompDenied with a seccomp filter on every
+// thread, as well as those of other architectures. Threads started by C
+// code are covered too, so this works in cgo builds.
+func restrictSyscalls() error {
+	arch, ok := seccompArchs[runtime.GOARCH]
+	if !ok {
+		slog.Warn("system calls not restricted, seccomp isn't set up for this architecture", "arch", runtime.GOARCH)
+		return nil
+	}
+
+	deny := unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+
+	filter := []unix.SockFilter{
+		// Offsets of the architecture and number in struct seccomp_data
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jf: 1, K: seccompX32},
+		{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+	}
+	for i, nr := range seccompDenied {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(len(seccompDenied) - i), K: nr})
+	}
+	filter = append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+	)
+
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// The filter can only be installed without privileges once the thread
+	// can't gain any, which the kernel then applies to every thread as well
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+
+	// Threads that couldn't be synchronized are reported by ID
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errno
+	}
+	if tid != 0 {
+		return fmt.Errorf("seccomp filter not applied to thread %d", tid)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"sync"
+)
+
+// A copy of a secret kept outside the Go heap, where the garbage collector
+// can't leave copies of it behind, in memory locked so it is never swapped
+// out. It is zeroed when destroyed. If the memory can't be locked, e.g. over
+// RLIMIT_MEMLOCK, the secret is kept anyway.
+type secret struct {
+	buf    []byte
+	mem    []byte
+	mapped bool
+}
+
+var mlockWarning sync.Once
+
+func newSecret(b []byte) *secret {
+	mem, mapped := lockedAlloc(max(len(b), 1))
+
+	s := &secret{buf: mem[:len(b):len(b)], mem: mem, mapped: mapped}
+	copy(s.buf, b)
+
+	return s
+}
+
+func (s *secret) bytes() []byte {
+	return s.buf
+}
+
+// Reports whether the secret is b, in constant time.
+func (s *secret) equal(b []byte) bool {
+	return subtle.ConstantTimeCompare(s.buf, b) == 1
+}
+
+// Zeroes the secret and releases its memory. Safe to call on nil.
+func (s *secret) destroy() {
+	if s == nil || s.mem == nil {
+		return
+	}
+
+	clear(s.mem)
+	if s.mapped {
+		lockedFree(s.mem)
+	}
+
+	s.buf, s.mem = nil, nil
+}
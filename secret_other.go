@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+// Memory can't be locked here: secrets are kept on the heap, and only
+// zeroed when destroyed.
+func lockedAlloc(n int) ([]byte, bool) {
+	return make([]byte, n), false
+}
+
+func lockedFree(mem []byte) {}
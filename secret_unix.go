@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Maps at least n bytes of memory and locks them, falling back to the heap
+// when no memory can be mapped. Reports whether it was mapped.
+func lockedAlloc(n int) ([]byte, bool) {
+	size := (n + os.Getpagesize() - 1) &^ (os.Getpagesize() - 1)
+
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return make([]byte, size), false
+	}
+
+	if err := unix.Mlock(mem); err != nil {
+		mlockWarning.Do(func() { slog.Warn("can't lock secrets into memory, they may be swapped out", "error", err) })
+	}
+
+	return mem, true
+}
+
+func lockedFree(mem []byte) {
+	_ = unix.Munlock(mem)
+	_ = unix.Munmap(mem)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	skTouchDelay  = flag.Duration("sk-touch-delay", time.Second, "remind to touch a security key when signing takes longer than this")
+	skTouchNotify = flag.Bool("sk-touch-notify", false, "show a desktop notification when a security key needs a touch")
+	skTimeout     = flag.Duration("sk-timeout", 0, "give up on security key signatures after this long, 0 to wait forever")
+)
+
+var errTouchTimeout = errors.New("timed out waiting for security key touch")
+
+// Reports whether key lives on a FIDO2 security key, where signing waits for
+// the user to touch the token.
+func isSecurityKey(key ssh.PublicKey) bool {
+	switch key.Type() {
+	case ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256, ssh.CertAlgoSKED25519v01, ssh.CertAlgoSKECDSA256v01:
+		return true
+	default:
+		return false
+	}
+}
+
+// Signs with a security key, reminding the user to touch the token if the
+// backend doesn't answer promptly instead of appearing to hang.
+func signSecurityKey(a agent.ExtendedAgent, key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	type result struct {
+		sig *ssh.Signature
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		sig, err := a.Sign(key, data)
+		done <- result{sig, err}
+	}()
+
+	remind := time.NewTimer(*skTouchDelay)
+	defer remind.Stop()
+
+	var timeout <-chan time.Time
+	if *skTimeout > 0 {
+		timeout = time.After(*skTimeout)
+	}
+
+	for {
+		select {
+		case res := <-done:
+			return res.sig, res.err
+		case <-remind.C:
+			fp := ssh.FingerprintSHA256(key)
+			slog.Warn("waiting for security key touch", "fingerprint", fp)
+			if *skTouchNotify {
+				desktopNotify("Touch your security key", "ssh-agent-proxy is waiting to sign with "+fp)
+			}
+		case <-timeout:
+			return nil, errTouchTimeout
+		}
+	}
+}
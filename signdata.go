@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// SSH_MSG_USERAUTH_REQUEST, which public key authentication data contains
+// after the session identifier
+const msgUserAuthRequest = 50
+
+// What a signature is for, as told from the data to sign.
+type signData struct {
+	// "auth" for SSH public key authentication, "sshsig" for ssh-keygen -Y
+	// signatures as made by git, or "other"
+	purpose string
+
+	// The SSHSIG namespace, such as "git" or "file"
+	namespace string
+
+	// The session, user and service authenticated to
+	session []byte
+	user    string
+	service string
+}
+
+func parseSignData(data []byte) signData {
+	// See PROTOCOL.sshsig in OpenSSH
+	if rest, ok := bytes.CutPrefix(data, []byte("SSHSIG")); ok {
+		if ns, _, ok := readString(rest); ok {
+			return signData{purpose: "sshsig", namespace: string(ns)}
+		}
+	}
+
+	// RFC 4252 section 7: session identifier, SSH_MSG_USERAUTH_REQUEST, user
+	// name, service name, "publickey", ...
+	if session, rest, ok := readString(data); ok && len(rest) > 0 && rest[0] == msgUserAuthRequest {
+		d := signData{purpose: "auth", session: session}
+
+		if user, rest, ok := readString(rest[1:]); ok {
+			d.user = string(user)
+
+			if service, _, ok := readString(rest); ok {
+				d.service = string(service)
+			}
+		}
+
+		return d
+	}
+
+	return signData{purpose: "other"}
+}
+
+// Returns the attributes to log a signature with.
+func (d signData) logArgs() []any {
+	switch d.purpose {
+	case "auth":
+		return []any{"purpose", d.purpose, "user", d.user, "service", d.service, "session", hex.EncodeToString(d.session)}
+	case "sshsig":
+		return []any{"purpose", d.purpose, "namespace", d.namespace}
+	default:
+		return []any{"purpose", d.purpose}
+	}
+}
+
+// Describes what the signature is for, e.g. "authentication as git".
+func (d signData) String() string {
+	switch d.purpose {
+	case "auth":
+		return "authentication as " + d.user
+	case "sshsig":
+		return "signing " + d.namespace + " data"
+	default:
+		return "signing"
+	}
+}
+
+// Reads an SSH string from the start of buf, returning the rest after it.
+func readString(buf []byte) (s, rest []byte, ok bool) {
+	if len(buf) < 4 {
+		return nil, nil, false
+	}
+
+	n := binary.BigEndian.Uint32(buf)
+	if uint64(n) > uint64(len(buf)-4) {
+		return nil, nil, false
+	}
+
+	return buf[4 : 4+n], buf[4+n:], true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type (
+	// A read-only agent over keys whose private halves live outside the
+	// proxy, e.g. on a hardware token or in a KMS. The keys are discovered
+	// by load on every List, so keys appearing and disappearing at the
+	// source are picked up.
+	signerAgent struct {
+		name string
+		load func() ([]agentSigner, error)
+
+		// Optional hooks implementing Lock and Unlock, which are refused
+		// otherwise.
+		lock   func(passphrase []byte) error
+		unlock func(passphrase []byte) error
+
+		mu   sync.Mutex
+		keys []agentSigner
+	}
+
+	agentSigner struct {
+		signer  ssh.Signer
+		comment string
+	}
+
+	// A crypto.Signer whose private key lives in a remote service, which
+	// signs the digests handed to it.
+	remoteSigner struct {
+		pub  crypto.PublicKey
+		sign func(digest []byte, hash crypto.Hash) ([]byte, error)
+	}
+)
+
+var (
+	errReadOnlyBackend = errors.New("operation not supported by backend")
+
+	// Backend kinds served by a signerAgent, whose keys can't be added or
+	// removed through the proxy
+	readOnlySchemes = []string{"pkcs11", "tpm", "awskms", "gcpkms", "azurekv", "vault", "keychain", "enclave"}
+)
+
+// Reports whether the backend's keys can't be added or removed through the
+// proxy. Its refusals reach the proxy as plain agent failures, so this is
+// told by its kind.
+func (b backend) readOnly() bool {
+	u, err := url.Parse(b.spec)
+	return err == nil && slices.Contains(readOnlySchemes, u.Scheme)
+}
+
+// Returns a connection to an in-process agent, so it can be used like any
+// dialed backend.
+func servePipe(a agent.Agent) net.Conn {
+	client, server := net.Pipe()
+
+	go func() {
+		_ = agent.ServeAgent(a, server)
+		_ = server.Close()
+	}()
+
+	return client
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.sign(digest, opts.HashFunc())
+}
+
+func (a *signerAgent) refresh() ([]agentSigner, error) {
+	keys, err := a.load()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", a.name, err)
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+
+	return keys, nil
+}
+
+func (a *signerAgent) find(key ssh.PublicKey) (ssh.Signer, error) {
+	wanted := key.Marshal()
+
+	a.mu.Lock()
+	keys := a.keys
+	a.mu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		for _, k := range keys {
+			if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+				return k.signer, nil
+			}
+		}
+
+		var err error
+		if keys, err = a.refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("not found")
+}
+
+func (a *signerAgent) List() ([]*agent.Key, error) {
+	keys, err := a.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*agent.Key
+	for _, k := range keys {
+		pub := k.signer.PublicKey()
+		res = append(res, &agent.Key{
+			Format:  pub.Type(),
+			Blob:    pub.Marshal(),
+			Comment: k.comment,
+		})
+	}
+
+	return res, nil
+}
+
+func (a *signerAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *signerAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	signer, err := a.find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags == 0 {
+		return signer.Sign(rand.Reader, data)
+	}
+
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("signer does not support non-default signature algorithm: %T", signer)
+	}
+
+	var algorithm string
+	switch flags {
+	case agent.SignatureFlagRsaSha256:
+		algorithm = ssh.KeyAlgoRSASHA256
+	case agent.SignatureFlagRsaSha512:
+		algorithm = ssh.KeyAlgoRSASHA512
+	default:
+		return nil, fmt.Errorf("unsupported signature flags: %d", flags)
+	}
+
+	return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+}
+
+func (a *signerAgent) Signers() ([]ssh.Signer, error) {
+	keys, err := a.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []ssh.Signer
+	for _, k := range keys {
+		res = append(res, k.signer)
+	}
+
+	return res, nil
+}
+
+func (a *signerAgent) Add(key agent.AddedKey) error {
+	return errReadOnlyBackend
+}
+
+func (a *signerAgent) Remove(key ssh.PublicKey) error {
+	return errReadOnlyBackend
+}
+
+func (a *signerAgent) RemoveAll() error {
+	return errReadOnlyBackend
+}
+
+func (a *signerAgent) Lock(passphrase []byte) error {
+	if a.lock == nil {
+		return errReadOnlyBackend
+	}
+
+	a.mu.Lock()
+	a.keys = nil
+	a.mu.Unlock()
+
+	return a.lock(passphrase)
+}
+
+func (a *signerAgent) Unlock(passphrase []byte) error {
+	if a.unlock == nil {
+		return errReadOnlyBackend
+	}
+
+	return a.unlock(passphrase)
+}
+
+func (a *signerAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
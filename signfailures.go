@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var signFailureAlert = flag.Int("sign-failure-alert", 5, "fire the sign-failures event after this many signing failures in a row for one key or one client, 0 to never")
+
+// Counts the signing failures in a row, by key and by client, reset by a
+// signature made.
+var signFailures struct {
+	mu       sync.Mutex
+	byKey    map[string]int
+	byClient map[string]int
+}
+
+// Returns what identifies a client across its connections, so that a loop
+// reconnecting for each attempt is counted as one: its executable and uid.
+func failureClient(peer peerCred) string {
+	if peer.exe == "" {
+		return peer.String()
+	}
+
+	return fmt.Sprintf("%s (uid %d)", peer.exe, peer.uid)
+}
+
+// Counts a signing request's outcome, returning the failures in a row of
+// the key and of the client when either reaches the alert threshold, or
+// one of its multiples, and 0 otherwise.
+func countSignFailure(key ssh.PublicKey, peer peerCred, failed bool) (keyFailures, clientFailures int) {
+	fp, client := ssh.FingerprintSHA256(key), failureClient(peer)
+
+	signFailures.mu.Lock()
+	defer signFailures.mu.Unlock()
+
+	if !failed {
+		delete(signFailures.byKey, fp)
+		delete(signFailures.byClient, client)
+		return 0, 0
+	}
+
+	if signFailures.byKey == nil {
+		signFailures.byKey, signFailures.byClient = map[string]int{}, map[string]int{}
+	}
+
+	signFailures.byKey[fp]++
+	signFailures.byClient[client]++
+
+	alert := func(n int) int {
+		if *signFailureAlert <= 0 || n%*signFailureAlert != 0 {
+			return 0
+		}
+		return n
+	}
+
+	return alert(signFailures.byKey[fp]), alert(signFailures.byClient[client])
+}
+
+// Fires the sign-failures event when a key or a client keeps failing to
+// sign, which tends to mean a wedged token or a runaway script.
+func (a *eventAgent) checkSignFailures(key ssh.PublicKey, d signData, err error) {
+	keyFailures, clientFailures := countSignFailure(key, a.peer, err != nil)
+	if keyFailures == 0 && clientFailures == 0 {
+		return
+	}
+
+	ev := a.signEvent("sign-failures", key, d, err)
+	ev.Failures = max(keyFailures, clientFailures)
+
+	slog.WarnContext(a.ctx, "signing keeps failing", "fingerprint", ev.Fingerprint, "backend", ev.Backend, "client", a.peer, "key_failures", keyFailures, "client_failures", clientFailures, "error", err)
+	fireEvent(ev)
+
+	if *notifySign {
+		name := pkr.keyComment(key)
+		if name == "" {
+			name = ev.Fingerprint
+		}
+		desktopNotify("SSH signing failing", fmt.Sprintf("%d signatures in a row failed with %s for %s: %v", ev.Failures, name, a.peer, err))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	signOrder = flag.String("sign-order", "priority", "which backend signs with a key several hold: priority, hardware, fastest or round-robin")
+
+	// Backend kinds whose keys live in hardware
+	hardwareSchemes = []string{"pkcs11", "tpm", "enclave"}
+
+	// How many times each key was signed with, for round-robin
+	signTurns struct {
+		mu sync.Mutex
+		by map[string]int
+	}
+)
+
+func setupSignOrder() error {
+	switch *signOrder {
+	case "priority", "hardware", "fastest", "round-robin":
+		return nil
+	default:
+		return fmt.Errorf("bad --sign-order %q, must be priority, hardware, fastest or round-robin", *signOrder)
+	}
+}
+
+// Reports whether the backend keeps its keys in hardware.
+func (b backend) hardware() bool {
+	u, err := url.Parse(b.spec)
+	return err == nil && slices.Contains(hardwareSchemes, u.Scheme)
+}
+
+// Returns the backends that listed the key, oldest first.
+func (r *proxyKeyring) holders(key ssh.PublicKey) []string {
+	r.ownersMu.Lock()
+	defer r.ownersMu.Unlock()
+
+	return r.owners[string(key.Marshal())].holders
+}
+
+// Returns a function putting the backends in the order they are asked to
+// sign with the key: by priority, or with --sign-order the backends known
+// to hold it first, in the order it asks for.
+func (r *proxyKeyring) signArrangement(key ssh.PublicKey) func([]backend) []backend {
+	if *signOrder == "priority" {
+		return nil
+	}
+
+	holders := r.holders(key)
+	if len(holders) < 2 {
+		return nil
+	}
+
+	return func(backends []backend) []backend {
+		var held, rest []backend
+		for _, b := range backends {
+			if slices.Contains(holders, b.name) {
+				held = append(held, b)
+			} else {
+				rest = append(rest, b)
+			}
+		}
+
+		switch *signOrder {
+		case "hardware":
+			slices.SortStableFunc(held, func(a, b backend) int {
+				return cmp.Compare(boolInt(b.hardware()), boolInt(a.hardware()))
+			})
+
+		case "fastest":
+			// Backends not timed yet go first, so they get timed
+			slices.SortStableFunc(held, func(a, b backend) int {
+				return cmp.Compare(meanLatency(a.name, "sign"), meanLatency(b.name, "sign"))
+			})
+
+		case "round-robin":
+			if len(held) > 0 {
+				n := nextSignTurn(key) % len(held)
+				held = slices.Concat(held[n:], held[:n])
+			}
+		}
+
+		return append(held, rest...)
+	}
+}
+
+// Returns how many times the key was signed with before, and counts this
+// time.
+func nextSignTurn(key ssh.PublicKey) int {
+	signTurns.mu.Lock()
+	defer signTurns.mu.Unlock()
+
+	if signTurns.by == nil {
+		signTurns.by = map[string]int{}
+	}
+
+	k := string(key.Marshal())
+	n := signTurns.by[k]
+	signTurns.by[k]++
+
+	return n
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
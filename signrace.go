@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	signRace     = flag.Bool("sign-race", false, "ask every backend to sign at once and take the first signature, for keys held by a slow token and a faster backend")
+	signDeadline = flag.Duration("sign-deadline", 0, "ask the next backend to sign when one hasn't after this long, still taking its signature should it come first; 0 to wait for it")
+)
+
+// The outcome of one backend's signing request.
+type raceResult struct {
+	backend string
+	sig     *ssh.Signature
+	err     error
+}
+
+// Asks the backends to sign one after the other, without waiting more than
+// stagger for one before asking the next, and returns the first signature,
+// canceling the other requests. A stagger of 0 asks them all at once.
+// Backends lacking the key just fail, and the next is asked right away.
+func (r *boundKeyring) raceSign(key ssh.PublicKey, sign func(agent.ExtendedAgent) (*ssh.Signature, error), stagger time.Duration) (string, *ssh.Signature, error) {
+	ctx, cancel := context.WithCancel(withOpTimeout(r.ctx, *signTimeout))
+	defer cancel()
+
+	r.mu.Lock()
+	backends := slices.Clone(r.backends)
+	internal := r.internal
+	r.mu.Unlock()
+
+	if arrange := r.signArrangement(key); arrange != nil {
+		backends = arrange(backends)
+	}
+
+	only := r.only()
+
+	type racer struct {
+		backend string
+		run     func()
+	}
+
+	var racers []racer
+	results := make(chan raceResult)
+
+	report := func(res raceResult) {
+		select {
+		case results <- res:
+		case <-ctx.Done():
+		}
+	}
+
+	for _, b := range backends {
+		if !r.usable(b, only) {
+			continue
+		}
+
+		racers = append(racers, racer{b.name, func() {
+			bctx, cancel := backendContext(ctx)
+			defer cancel()
+
+			a, conn, err := dialAgent(bctx, b)
+			if err != nil {
+				report(raceResult{backend: b.name, err: err})
+				return
+			}
+			defer func() { _ = conn.Close() }()
+
+			sig, err := sign(a)
+			report(raceResult{b.name, sig, err})
+		}})
+	}
+
+	if internal != nil && (only == nil || slices.Contains(only, "internal")) {
+		racers = append(racers, racer{"internal", func() {
+			sig, err := sign(internal)
+			report(raceResult{"internal", sig, err})
+		}})
+	}
+
+	if len(racers) == 0 {
+		return "", nil, errNoBackends
+	}
+
+	// The last backend asked gets until timeout to answer alone
+	started, answered := 0, 0
+	var timeout <-chan time.Time
+
+	next := func() {
+		go racers[started].run()
+		started++
+
+		timeout = nil
+		if stagger > 0 && started < len(racers) {
+			timeout = time.After(stagger)
+		}
+	}
+
+	next()
+	for stagger == 0 && started < len(racers) {
+		next()
+	}
+
+	var errs []error
+
+	for answered < started {
+		select {
+		case res := <-results:
+			answered++
+			if res.err == nil {
+				return res.backend, res.sig, nil
+			}
+
+			slog.DebugContext(r.ctx, "sign failed", "backend", res.backend, "error", res.err)
+			errs = append(errs, fmt.Errorf("%s: %w", res.backend, res.err))
+
+			if answered == started && started < len(racers) {
+				next()
+			}
+
+		case <-timeout:
+			slog.InfoContext(r.ctx, "backend slow to sign, asking the next", "backend", racers[started-1].backend, "after", stagger)
+			next()
+
+		case <-ctx.Done():
+			return "", nil, errors.Join(append(errs, ctx.Err())...)
+		}
+	}
+
+	return "", nil, backendErrors(errs)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+var (
+	socketPath    = flag.String("socket", defaultAgentSocket(), "path of the agent socket, empty for a new temporary directory")
+	socketMode    = flag.String("socket-mode", "0600", "permissions of the agent socket")
+	socketDirMode = flag.String("socket-dir-mode", "0700", "permissions of the directory holding the agent socket")
+	socketOwner   = flag.String("socket-owner", "", "user owning the agent socket and its directory, by name or uid")
+	socketGroup   = flag.String("socket-group", "", "group owning the agent socket and its directory, by name or gid")
+	symlinkPath   = flag.String("symlink", "", "keep a symlink at this path pointing at the agent socket")
+)
+
+// Returns the agent socket path used when none is given on the command line:
+// inside $XDG_RUNTIME_DIR, or the per-user temporary directory on macOS.
+// Elsewhere the shared temporary directory is all there is, so a fresh
+// directory is made in it instead.
+func defaultAgentSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "ssh-agent-proxy", "agent.sock")
+	}
+
+	if runtime.GOOS == "darwin" {
+		return filepath.Join(os.TempDir(), "ssh-agent-proxy", "agent.sock")
+	}
+
+	return ""
+}
+
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("bad permissions %q", s)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// Returns the uid and gid named by the ownership flags, -1 for those that
+// are left alone.
+func socketOwnership() (int, int, error) {
+	uid, gid := -1, -1
+
+	if *socketOwner != "" {
+		u, err := user.Lookup(*socketOwner)
+		if err != nil {
+			if u, err = user.LookupId(*socketOwner); err != nil {
+				return 0, 0, fmt.Errorf("unknown socket owner %q", *socketOwner)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if *socketGroup != "" {
+		g, err := user.LookupGroup(*socketGroup)
+		if err != nil {
+			if g, err = user.LookupGroupId(*socketGroup); err != nil {
+				return 0, 0, fmt.Errorf("unknown socket group %q", *socketGroup)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return uid, gid, nil
+}
+
+// Listens on the agent socket inside a private directory, so that nobody
+// can connect before the permission flags have been applied.
+func listenAgent(path string) (net.Listener, string, error) {
+	mode, err := parseMode(*socketMode)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dirMode, err := parseMode(*socketDirMode)
+	if err != nil {
+		return nil, "", err
+	}
+
+	uid, gid, err := socketOwnership()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var dir string
+
+	if path == "" {
+		removeStaleTempDirs()
+
+		if dir, err = os.MkdirTemp("", "ssh-agent-proxy-*"); err != nil {
+			return nil, "", err
+		}
+		path = filepath.Join(dir, "agent.sock")
+	} else {
+		dir = filepath.Dir(path)
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, "", err
+		}
+		if err := os.Chmod(dir, dirMode); err != nil {
+			return nil, "", err
+		}
+		if err := removeStaleSocket(path); err != nil {
+			return nil, "", err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, f := range []struct {
+		path string
+		mode os.FileMode
+	}{{path, mode}, {dir, dirMode}} {
+		if err := os.Chmod(f.path, f.mode); err != nil {
+			_ = l.Close()
+			return nil, "", err
+		}
+
+		if uid != -1 || gid != -1 {
+			if err := os.Chown(f.path, uid, gid); err != nil {
+				_ = l.Close()
+				return nil, "", err
+			}
+		}
+	}
+
+	return l, path, nil
+}
+
+// Removes a socket file left behind by a previous instance. Live sockets
+// are refused, so a second instance can't hijack a running one.
+func removeStaleSocket(name string) error {
+	info, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Anything else there is no leftover of the proxy's
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", name)
+	}
+
+	conn, err := net.Dial("unix", name)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket %s is in use", name)
+	}
+
+	// Not being allowed to connect says nothing about whether it's in use
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("socket %s: %w", name, err)
+	}
+
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	slog.Info("stale socket removed", "path", name)
+
+	return nil
+}
+
+// Removes the temporary directories the proxy made for its socket in runs
+// that crashed: those of the user holding nothing but a socket nobody
+// listens on.
+func removeStaleTempDirs() {
+	dirs, _ := filepath.Glob(filepath.Join(os.TempDir(), "ssh-agent-proxy-*"))
+
+	for _, dir := range dirs {
+		info, err := os.Lstat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+			continue
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) != 1 || entries[0].Name() != "agent.sock" {
+			continue
+		}
+
+		if err := removeStaleSocket(filepath.Join(dir, "agent.sock")); err == nil {
+			_ = os.Remove(dir)
+		}
+	}
+}
+
+// Points the symlink at link to target, replacing whatever was there
+// atomically so clients never see it missing.
+func linkSocket(link, target string) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", link, os.Getpid())
+
+	_ = os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
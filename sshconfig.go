@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const sshConfigName = "ssh-agent-proxy.conf"
+
+func init() {
+	subcommands["ssh-config"] = cmdSSHConfig
+}
+
+// Generates an ssh_config fragment pointing ssh at the proxy, with a Host
+// block for each destination rule naming hosts that offers only the keys
+// the rule allows. It is printed or, with --write, installed in
+// ~/.ssh/config.d along with the public keys it names.
+func cmdSSHConfig(args []string) error {
+	fs, cf := newClientFlags("ssh-config")
+	socket := fs.String("socket", "", "agent socket to point ssh at, by default the running proxy's")
+	fs.StringVar(configFile, "config", *configFile, "path of the JSON config file with the destination rules")
+	write := fs.Bool("write", false, "install the fragment in ~/.ssh/config.d instead of printing it")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return errors.New("usage: ssh-config [--socket path] [--config file] [--write]")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	if *socket == "" {
+		var st proxyStatus
+		if err := adminCall(cf.adminSocket, "status", nil, &st); err == nil {
+			*socket = st.Socket
+		} else {
+			*socket = defaultAgentSocket()
+		}
+	}
+	if *socket == "" {
+		return errors.New("no agent socket, give --socket")
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	var keys []keyInfo
+	if len(cfg.Destinations) > 0 {
+		if err := adminCall(cf.adminSocket, "list-keys", nil, &keys); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "destination rules left out, their keys are unknown: %v\n", err)
+		}
+	}
+
+	keyDir := filepath.Join(home, ".ssh", "ssh-agent-proxy")
+	fragment, keyFiles := sshConfigFragment(*socket, cfg.Destinations, keys, keyDir)
+
+	if !*write {
+		fmt.Print(fragment)
+		return nil
+	}
+
+	if err := os.MkdirAll(keyDir, 0o700); err != nil {
+		return err
+	}
+	for path, pub := range keyFiles {
+		if err := os.WriteFile(path, []byte(pub+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(home, ".ssh", "config.d", sshConfigName)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(fragment), 0o644); err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %s\n", path)
+
+	// ssh only reads it when included, ahead of any Host block
+	userConfig, _ := os.ReadFile(filepath.Join(home, ".ssh", "config"))
+	if !strings.Contains(string(userConfig), "config.d/") {
+		fmt.Printf("add this line at the top of ~/.ssh/config to use it:\n  Include config.d/*.conf\n")
+	}
+
+	return nil
+}
+
+// Returns the ssh_config fragment, and the public key files it names by
+// path, in authorized_keys format. Rules matching on host keys alone have
+// no ssh_config equivalent and are left out, as are the keys not listed.
+func sshConfigFragment(socket string, rules []destinationRule, keys []keyInfo, keyDir string) (string, map[string]string) {
+	var b strings.Builder
+	keyFiles := map[string]string{}
+
+	b.WriteString("# Generated by ssh-agent-proxy ssh-config\n")
+
+	listed := map[string]string{}
+	for _, k := range keys {
+		listed[k.Fingerprint] = k.PublicKey
+	}
+
+	for _, rule := range rules {
+		if len(rule.Hosts) == 0 || len(keys) == 0 {
+			continue
+		}
+
+		var files []string
+		for _, fp := range rule.Keys {
+			pub, ok := listed[fp]
+			if !ok {
+				continue
+			}
+
+			path := filepath.Join(keyDir, keyFileName(fp))
+			keyFiles[path] = pub
+			files = append(files, path)
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		_, _ = fmt.Fprintf(&b, "\nHost %s\n\tIdentitiesOnly yes\n", strings.Join(rule.Hosts, " "))
+		for _, path := range files {
+			_, _ = fmt.Fprintf(&b, "\tIdentityFile %s\n", sshConfigQuote(path))
+		}
+	}
+
+	_, _ = fmt.Fprintf(&b, "\nHost *\n\tIdentityAgent %s\n", sshConfigQuote(socket))
+
+	return b.String(), keyFiles
+}
+
+// Returns the name of the file holding the public key with a fingerprint,
+// made safe for file systems.
+func keyFileName(fingerprint string) string {
+	fp := strings.TrimPrefix(fingerprint, "SHA256:")
+
+	return strings.NewReplacer("/", "_", "+", "-").Replace(fp) + ".pub"
+}
+
+// Quotes an ssh_config argument holding spaces.
+func sshConfigQuote(s string) string {
+	if !strings.ContainsAny(s, " \t") {
+		return s
+	}
+
+	return `"` + s + `"`
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"time"
+)
+
+// Bounds of the pause between rounds of probing the backends at startup
+const (
+	startupMinBackoff = 250 * time.Millisecond
+	startupMaxBackoff = 10 * time.Second
+)
+
+var (
+	waitForBackends = flag.Duration("wait-for-backends", 0, "before serving clients, wait up to this long for a backend to answer, probing them with backoff")
+	failFast        = flag.Bool("fail-fast", false, "exit with an error when no backend answers at startup, after --wait-for-backends")
+
+	errNoBackendAnswered = errors.New("no backend answered")
+)
+
+// Holds off serving clients an empty keyring until a backend answers, for
+// --wait-for-backends at most. When none has by then, the proxy serves
+// anyway unless --fail-fast makes it exit.
+func awaitBackends(ctx context.Context) error {
+	if *waitForBackends <= 0 && !*failFast {
+		return nil
+	}
+
+	// Only a proxy with no backends but its own keyring has nothing to wait for
+	if len(pkr.Backends()) == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(*waitForBackends)
+	backoff := startupMinBackoff
+
+	for {
+		if anyBackendUp(ctx) {
+			return nil
+		}
+
+		wait := min(backoff, time.Until(deadline))
+		if wait <= 0 {
+			break
+		}
+
+		slog.Info("waiting for a backend to answer", "retry_in", wait)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		backoff = min(backoff*2, startupMaxBackoff)
+	}
+
+	if *failFast {
+		return errNoBackendAnswered
+	}
+
+	slog.Warn("no backend answered, serving anyway")
+
+	return nil
+}
+
+// Probes the enabled backends, reporting whether one of them answered.
+func anyBackendUp(ctx context.Context) bool {
+	for _, b := range pkr.Backends() {
+		if b.disabled || b.health.quarantine() != "" {
+			continue
+		}
+
+		probeBackend(ctx, b)
+
+		var st backendStatus
+		b.health.fill(&st)
+		if st.Up {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+var stdio = flag.Bool("stdio", false, "serve the agent protocol on stdin and stdout rather than on sockets, to the process starting the proxy")
+
+// The client of --stdio when stdin and stdout are pipes. The proxy was
+// started by it, so the parent process stands for the peer.
+type stdioConn struct {
+	in, out *os.File
+}
+
+// Serves the one client on stdin and stdout until it hangs up or a signal
+// arrives.
+func serveStdio(ctx context.Context) {
+	conn, err := openStdio()
+	check(err)
+
+	slog.Info("starting", "version", version, "commit", commit, "stdio", true, "backends", backendNames(pkr.Backends()))
+
+	handler(ctx, conn, frontend{readOnly: *readOnly, policy: policyRules})
+
+	slog.Info("shutting down")
+}
+
+// Returns the connection on stdin and stdout: stdin itself when it's a
+// socket, as handed over by socketpair, whose peer is known.
+func openStdio() (net.Conn, error) {
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		return conn, nil
+	}
+
+	// Non-blocking, the pipes take deadlines and unblock reads on close
+	for _, fd := range []int{0, 1} {
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			return nil, err
+		}
+	}
+
+	in, out := os.NewFile(0, "stdin"), os.NewFile(1, "stdout")
+	if in == nil || out == nil {
+		return nil, errors.New("no stdin or stdout to serve on")
+	}
+
+	return &stdioConn{in: in, out: out}, nil
+}
+
+func (c *stdioConn) parent() peerCred {
+	ppid := os.Getppid()
+	return peerCred{uid: os.Getuid(), pid: ppid, exe: processExe(ppid), cid: -1}
+}
+
+func (c *stdioConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *stdioConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+func (c *stdioConn) Close() error {
+	return errors.Join(c.in.Close(), c.out.Close())
+}
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.in.SetDeadline(t), c.out.SetDeadline(t))
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return c.in.SetDeadline(t) }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return c.out.SetDeadline(t) }
+
+func (c *stdioConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	// Restarts back off from one second to a minute, and start over once
+	// the agent ran for a minute
+	superviseMinBackoff = time.Second
+	superviseMaxBackoff = time.Minute
+
+	// How often an agent taken over is checked for still answering
+	superviseCheckInterval = 5 * time.Second
+)
+
+// An agent the proxy runs as a backend, restarting it when it dies and
+// giving it back its keys: those of its key files, and those added to it
+// through the proxy without a lifetime.
+type supervised struct {
+	name    string
+	socket  string
+	command []string
+	keys    []string
+
+	mu    sync.Mutex
+	added map[string]agent.AddedKey
+	pid   int
+}
+
+var (
+	supervisedMu sync.Mutex
+	supervisors  = map[string]*supervised{}
+
+	// Stops the restarts as the proxy exits
+	superviseCtx, stopSupervising = context.WithCancel(context.Background())
+)
+
+// Starts supervising the backends that have a command.
+func superviseBackends(backends []backendConfig) {
+	for _, b := range backends {
+		if len(b.Command) == 0 {
+			continue
+		}
+
+		s := &supervised{name: b.Name, socket: expandPath(b.Socket), command: b.Command, keys: b.Keys, added: map[string]agent.AddedKey{}}
+
+		supervisedMu.Lock()
+		supervisors[b.Name] = s
+		supervisedMu.Unlock()
+
+		go s.run(superviseCtx)
+	}
+}
+
+func supervisorOf(backend string) *supervised {
+	supervisedMu.Lock()
+	defer supervisedMu.Unlock()
+
+	return supervisors[backend]
+}
+
+// Keeps the agent running until ctx is done.
+func (s *supervised) run(ctx context.Context) {
+	backoff := superviseMinBackoff
+
+	// Left running by the proxy this one upgraded
+	if s.answers() {
+		s.adopt()
+		slog.Info("supervised backend taken over", "backend", s.name)
+		s.waitGone(ctx)
+	}
+
+	for ctx.Err() == nil {
+		started := time.Now()
+
+		if err := s.start(ctx); err != nil {
+			slog.Error("supervised backend not started", "backend", s.name, "error", err)
+		}
+
+		if time.Since(started) > superviseMaxBackoff {
+			backoff = superviseMinBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, superviseMaxBackoff)
+	}
+}
+
+// Reports whether the agent listens.
+func (s *supervised) answers() bool {
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+
+	return true
+}
+
+// Takes the pid of the running agent from its pid file, to stop it on exit.
+func (s *supervised) adopt() {
+	b, err := os.ReadFile(s.socket + ".pid")
+	if err != nil {
+		return
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.pid = pid
+	s.mu.Unlock()
+}
+
+// Waits for an agent that isn't the proxy's child to stop answering.
+func (s *supervised) waitGone(ctx context.Context) {
+	t := time.NewTicker(superviseCheckInterval)
+	defer t.Stop()
+
+	for s.answers() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+
+	slog.Warn("supervised backend gone", "backend", s.name)
+}
+
+// Runs the agent until it exits, giving it its keys once it listens.
+func (s *supervised) start(ctx context.Context) error {
+	if err := removeStaleSocket(s.socket); err != nil {
+		return err
+	}
+
+	args := make([]string, len(s.command))
+	for i, arg := range s.command {
+		args[i] = strings.ReplaceAll(arg, "{socket}", s.socket)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+s.socket)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	// Outlives an upgrade, and isn't stopped by ^C before the proxy is
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	var err error
+	go func() {
+		err = cmd.Wait()
+		close(exited)
+	}()
+
+	if err := waitForSocket(s.socket, exited); err != nil {
+		_ = cmd.Process.Kill()
+		<-exited
+		return err
+	}
+
+	_ = os.WriteFile(s.socket+".pid", []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o600)
+
+	s.mu.Lock()
+	s.pid = cmd.Process.Pid
+	s.mu.Unlock()
+
+	slog.Info("supervised backend started", "backend", s.name, "pid", cmd.Process.Pid)
+
+	s.restoreKeys()
+
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.pid = 0
+	s.mu.Unlock()
+
+	slog.Warn("supervised backend exited", "backend", s.name, "error", err)
+
+	return nil
+}
+
+// Adds the key files and the keys added through the proxy to the agent.
+func (s *supervised) restoreKeys() {
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		slog.Error("keys not restored", "backend", s.name, "error", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	a := agent.NewClient(conn)
+
+	for _, path := range s.keys {
+		key, err := loadKeyFile(expandPath(path))
+		if err == nil {
+			err = a.Add(key)
+		}
+		if err != nil {
+			slog.Error("key not restored", "backend", s.name, "file", path, "error", err)
+		}
+	}
+
+	s.mu.Lock()
+	added := make([]agent.AddedKey, 0, len(s.added))
+	for _, key := range s.added {
+		added = append(added, key)
+	}
+	s.mu.Unlock()
+
+	for _, key := range added {
+		if err := a.Add(key); err != nil {
+			slog.Error("key not restored", "backend", s.name, "comment", key.Comment, "error", err)
+		}
+	}
+
+	if n := len(s.keys) + len(added); n > 0 {
+		slog.Info("keys restored", "backend", s.name, "keys", n)
+	}
+}
+
+// Remembers a key added to the agent, for when it restarts. Keys with a
+// lifetime would outlive it and aren't.
+func (s *supervised) remember(key agent.AddedKey) {
+	if key.LifetimeSecs > 0 {
+		return
+	}
+
+	pub, err := publicKeyOf(key)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.added[string(pub.Marshal())] = key
+}
+
+// Forgets a key removed from the agent, every key when key is nil.
+func (s *supervised) forget(key ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key == nil {
+		clear(s.added)
+		return
+	}
+
+	delete(s.added, string(key.Marshal()))
+}
+
+// Stops the supervised agents as the proxy exits, unless it handed over to
+// an upgraded one, which takes them over.
+func stopSupervised() {
+	stopSupervising()
+
+	if handedOff.Load() {
+		return
+	}
+
+	supervisedMu.Lock()
+	defer supervisedMu.Unlock()
+
+	for _, s := range supervisors {
+		s.mu.Lock()
+		pid := s.pid
+		s.pid = 0
+		s.mu.Unlock()
+
+		if pid == 0 {
+			continue
+		}
+
+		if p, err := os.FindProcess(pid); err == nil {
+			_ = p.Signal(syscall.SIGTERM)
+		}
+
+		_ = os.Remove(s.socket)
+		_ = os.Remove(s.socket + ".pid")
+	}
+}
@@ -0,0 +1,105 @@
+// A PKCS#11 module with one slot, holding an empty token labelled "fake"
+// while the file named by FAKE_PKCS11_PRESENT exists.
+
+#include <stdlib.h>
+#include <string.h>
+
+#include "pkcs11go.h"
+
+static int initialized;
+
+static int present(void)
+{
+	const char *path = getenv("FAKE_PKCS11_PRESENT");
+	return path != NULL && access(path, F_OK) == 0;
+}
+
+static CK_RV initialize(CK_VOID_PTR args)
+{
+	if (initialized)
+		return CKR_CRYPTOKI_ALREADY_INITIALIZED;
+	initialized = 1;
+	return CKR_OK;
+}
+
+static CK_RV finalize(CK_VOID_PTR reserved)
+{
+	if (!initialized)
+		return CKR_CRYPTOKI_NOT_INITIALIZED;
+	initialized = 0;
+	return CKR_OK;
+}
+
+static CK_RV get_slot_list(CK_BBOOL token_present, CK_SLOT_ID_PTR slots, CK_ULONG_PTR count)
+{
+	CK_ULONG n = token_present && !present() ? 0 : 1;
+
+	if (slots != NULL) {
+		if (*count < n)
+			return CKR_BUFFER_TOO_SMALL;
+		if (n > 0)
+			slots[0] = 0;
+	}
+	*count = n;
+	return CKR_OK;
+}
+
+static CK_RV get_token_info(CK_SLOT_ID slot, CK_TOKEN_INFO_PTR info)
+{
+	if (!present())
+		return CKR_TOKEN_NOT_PRESENT;
+
+	memset(info, 0, sizeof(*info));
+	memset(info->label, ' ', sizeof(info->label));
+	memcpy(info->label, "fake", 4);
+	return CKR_OK;
+}
+
+static CK_RV open_session(CK_SLOT_ID slot, CK_FLAGS flags, CK_VOID_PTR app, CK_NOTIFY notify, CK_SESSION_HANDLE_PTR session)
+{
+	if (!present())
+		return CKR_TOKEN_NOT_PRESENT;
+
+	*session = 1;
+	return CKR_OK;
+}
+
+static CK_RV close_session(CK_SESSION_HANDLE session)
+{
+	return CKR_OK;
+}
+
+static CK_RV find_objects_init(CK_SESSION_HANDLE session, CK_ATTRIBUTE_PTR template, CK_ULONG count)
+{
+	return present() ? CKR_OK : CKR_DEVICE_REMOVED;
+}
+
+static CK_RV find_objects(CK_SESSION_HANDLE session, CK_OBJECT_HANDLE_PTR objects, CK_ULONG max, CK_ULONG_PTR count)
+{
+	*count = 0;
+	return CKR_OK;
+}
+
+static CK_RV find_objects_final(CK_SESSION_HANDLE session)
+{
+	return CKR_OK;
+}
+
+static CK_FUNCTION_LIST functions = {
+	.version = {2, 20},
+	.C_Initialize = initialize,
+	.C_Finalize = finalize,
+	.C_GetSlotList = get_slot_list,
+	.C_GetTokenInfo = get_token_info,
+	.C_OpenSession = open_session,
+	.C_CloseSession = close_session,
+	.C_FindObjectsInit = find_objects_init,
+	.C_FindObjects = find_objects,
+	.C_FindObjectsFinal = find_objects_final,
+};
+
+CK_RV C_GetFunctionList(CK_FUNCTION_LIST_PTR_PTR list)
+{
+	*list = &functions;
+	return CKR_OK;
+}
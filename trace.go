@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log/slog"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var traceProtocol = flag.Bool("trace-protocol", false, "log the agent protocol messages exchanged with clients and backends, decoded, at debug level; passphrases and private keys are left out")
+
+// The largest message traced, like the agent server's limit. Tracing stops
+// on a connection sending a larger one.
+const maxTracedMessage = 16 << 20
+
+// Agent protocol message types, from draft-miller-ssh-agent.
+var agentMessageNames = map[byte]string{
+	5:  "failure",
+	6:  "success",
+	11: "request-identities",
+	12: "identities-answer",
+	13: "sign-request",
+	14: "sign-response",
+	17: "add-identity",
+	18: "remove-identity",
+	19: "remove-all-identities",
+	20: "add-smartcard-key",
+	21: "remove-smartcard-key",
+	22: "lock",
+	23: "unlock",
+	25: "add-id-constrained",
+	26: "add-smartcard-key-constrained",
+	27: "extension",
+	28: "extension-failure",
+}
+
+// A connection logging the agent messages read from and written to it.
+type protocolTracer struct {
+	io.ReadWriter
+	in, out messageSplitter
+}
+
+// Splits a stream into agent messages on their length prefix.
+type messageSplitter struct {
+	buf    []byte
+	broken bool
+	log    func(msg []byte)
+}
+
+// Traces a client connection, whose requests are read and replies written.
+func traceClient(ctx context.Context, rw io.ReadWriter, peer peerCred) io.ReadWriter {
+	if !*traceProtocol {
+		return rw
+	}
+
+	return newProtocolTracer(ctx, rw, "request", "reply", "side", "client", "pid", peer.pid)
+}
+
+// Traces a backend connection, whose requests are written and replies read.
+func traceBackend(ctx context.Context, rw io.ReadWriter, backend string) io.ReadWriter {
+	if !*traceProtocol {
+		return rw
+	}
+
+	return newProtocolTracer(ctx, rw, "reply", "request", "side", "backend", "backend", backend)
+}
+
+func newProtocolTracer(ctx context.Context, rw io.ReadWriter, read, written string, args ...any) *protocolTracer {
+	logger := slog.With(args...)
+
+	logFunc := func(direction string) func([]byte) {
+		return func(msg []byte) {
+			logger.DebugContext(ctx, "agent message", append([]any{"direction", direction, "length", len(msg)}, describeMessage(msg)...)...)
+		}
+	}
+
+	return &protocolTracer{
+		ReadWriter: rw,
+		in:         messageSplitter{log: logFunc(read)},
+		out:        messageSplitter{log: logFunc(written)},
+	}
+}
+
+func (t *protocolTracer) Read(p []byte) (int, error) {
+	n, err := t.ReadWriter.Read(p)
+	t.in.feed(p[:n])
+
+	return n, err
+}
+
+func (t *protocolTracer) Write(p []byte) (int, error) {
+	n, err := t.ReadWriter.Write(p)
+	t.out.feed(p[:n])
+
+	return n, err
+}
+
+// Logs the messages p completes. The bytes kept meanwhile, which may be
+// private keys being added, are zeroed once logged.
+func (s *messageSplitter) feed(p []byte) {
+	if s.broken {
+		return
+	}
+
+	s.buf = append(s.buf, p...)
+
+	for len(s.buf) >= 4 {
+		n := int(binary.BigEndian.Uint32(s.buf))
+		if n > maxTracedMessage {
+			slog.Debug("agent message too large to trace, tracing stopped", "length", n)
+			clear(s.buf)
+			s.buf, s.broken = nil, true
+			return
+		}
+
+		if len(s.buf) < 4+n {
+			return
+		}
+
+		s.log(s.buf[4 : 4+n])
+
+		clear(s.buf[:4+n])
+		s.buf = s.buf[4+n:]
+	}
+
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+}
+
+// Returns the attributes to log an agent message with: its type and what
+// it is about, such as key fingerprints, but no secrets.
+func describeMessage(msg []byte) []any {
+	if len(msg) == 0 {
+		return []any{"type", "empty"}
+	}
+
+	name, ok := agentMessageNames[msg[0]]
+	if !ok {
+		return []any{"type", msg[0]}
+	}
+	args := []any{"type", name}
+	body := msg[1:]
+
+	switch msg[0] {
+	case 12:
+		if len(body) < 4 {
+			break
+		}
+		count := binary.BigEndian.Uint32(body)
+		args = append(args, "keys", count)
+
+		var fingerprints []string
+		rest := body[4:]
+		for range count {
+			blob, r, ok := readString(rest)
+			if !ok {
+				break
+			}
+			_, r, ok = readString(r)
+			if !ok {
+				break
+			}
+			rest = r
+			fingerprints = append(fingerprints, blobFingerprint(blob))
+		}
+		args = append(args, "fingerprints", fingerprints)
+
+	case 13:
+		blob, rest, ok := readString(body)
+		if !ok {
+			break
+		}
+		args = append(args, "fingerprint", blobFingerprint(blob))
+
+		data, rest, ok := readString(rest)
+		if !ok {
+			break
+		}
+		args = append(args, "data_length", len(data), "purpose", parseSignData(data).purpose)
+
+		if len(rest) >= 4 {
+			args = append(args, "flags", binary.BigEndian.Uint32(rest))
+		}
+
+	case 14:
+		sig, _, ok := readString(body)
+		if !ok {
+			break
+		}
+		if format, _, ok := readString(sig); ok {
+			args = append(args, "format", string(format))
+		}
+
+	case 17, 25:
+		// The private key follows its type, and is never looked at
+		if keyType, _, ok := readString(body); ok {
+			args = append(args, "key_type", string(keyType))
+		}
+
+	case 18:
+		if blob, _, ok := readString(body); ok {
+			args = append(args, "fingerprint", blobFingerprint(blob))
+		}
+
+	case 20, 21, 26:
+		// The PIN follows the reader
+		if reader, _, ok := readString(body); ok {
+			args = append(args, "reader", string(reader))
+		}
+
+	case 22, 23:
+		if pass, _, ok := readString(body); ok {
+			args = append(args, "passphrase_length", len(pass))
+		}
+
+	case 27:
+		if ext, _, ok := readString(body); ok {
+			args = append(args, "extension", string(ext))
+		}
+	}
+
+	return args
+}
+
+// Returns the fingerprint of a key blob, or its type should it not parse,
+// as for keys unknown to the ssh package.
+func blobFingerprint(blob []byte) string {
+	key, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		if keyType, _, ok := readString(blob); ok {
+			return string(keyType)
+		}
+		return "unparsable"
+	}
+
+	return ssh.FingerprintSHA256(key)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// A terminal UI over the admin socket: backends and their health, the keys
+// they offer, the latest requests, and keys to enable and disable backends
+// and lock the proxy.
+type tui struct {
+	socket string
+
+	status   proxyStatus
+	backends []backendStatus
+	keys     []keyInfo
+	events   []hookEvent
+	err      error
+
+	selected int
+	message  string
+}
+
+func init() {
+	subcommands["tui"] = cmdTUI
+}
+
+func cmdTUI(args []string) error {
+	fs, cf := newClientFlags("tui")
+	interval := fs.Duration("interval", time.Second, "how often to refresh")
+	_ = fs.Parse(args)
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("needs a terminal")
+	}
+
+	old, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = term.Restore(int(os.Stdin.Fd()), old) }()
+
+	// The alternate screen leaves the shell's output as it was on exit
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+
+	t := &tui{socket: cf.adminSocket}
+
+	tick := time.NewTicker(*interval)
+	defer tick.Stop()
+
+	for {
+		t.refresh()
+		t.draw()
+
+		select {
+		case key, ok := <-keys:
+			if !ok || !t.handle(key) {
+				return nil
+			}
+		case <-tick.C:
+		}
+	}
+}
+
+// Fetches everything shown from the proxy, keeping the last state shown
+// when it can't be reached.
+func (t *tui) refresh() {
+	var (
+		st       proxyStatus
+		backends []backendStatus
+		keys     []keyInfo
+		events   []hookEvent
+	)
+
+	if t.err = adminCall(t.socket, "status", nil, &st); t.err != nil {
+		return
+	}
+
+	// A locked proxy lists no keys
+	var keysErr error
+	if !st.Locked {
+		keysErr = adminCall(t.socket, "list-keys", nil, &keys)
+	}
+
+	t.err = errors.Join(
+		adminCall(t.socket, "list-backends", nil, &backends),
+		keysErr,
+		adminCall(t.socket, "recent-events", nil, &events),
+	)
+	if t.err != nil {
+		return
+	}
+
+	t.status, t.backends, t.keys, t.events = st, backends, keys, events
+	t.selected = max(0, min(t.selected, len(t.backends)-1))
+}
+
+// Acts on a key press, returning false to quit.
+func (t *tui) handle(key string) bool {
+	t.message = ""
+
+	var err error
+
+	switch key {
+	case "q", "\x03", "\x1b":
+		return false
+	case "k", "\x1b[A", "\x1bOA":
+		t.selected = max(0, t.selected-1)
+	case "j", "\x1b[B", "\x1bOB":
+		t.selected = min(len(t.backends)-1, t.selected+1)
+	case "e":
+		if t.selected >= len(t.backends) {
+			break
+		}
+
+		b := t.backends[t.selected]
+		command := "disable-backend"
+		if b.Disabled {
+			command = "enable-backend"
+		}
+
+		if err = adminCall(t.socket, command, []string{b.Name}, nil); err == nil {
+			t.message = fmt.Sprintf("%s: %sd", b.Name, strings.TrimSuffix(command, "-backend"))
+		}
+	case "l":
+		command := "lock"
+		if t.status.Locked {
+			command = "unlock"
+		}
+
+		if err = adminCall(t.socket, command, nil, nil); err == nil {
+			t.message = command + "ed"
+		}
+	}
+
+	if err != nil {
+		t.message = err.Error()
+	}
+
+	return true
+}
+
+func (t *tui) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	locked := "unlocked"
+	if t.status.Locked {
+		locked = "LOCKED"
+	}
+
+	lines := []string{
+		fmt.Sprintf("ssh-agent-proxy  %s  %s  clients %d (peak %d)", t.status.Socket, locked, t.status.Clients, t.status.PeakClients),
+		"",
+	}
+
+	// The selected backend is highlighted once the lines are clipped
+	highlight := len(lines) + 1 + t.selected
+
+	lines = append(lines, table("BACKEND\tSOCKET\tSTATUS\tSINCE\tKEYS\tERROR", len(t.backends), func(i int) string {
+		b := t.backends[i]
+		return fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%s", b.Name, b.Socket, b.state(), sinceString(b.Since), b.Keys, b.Error)
+	})...)
+	lines = append(lines, "")
+
+	lines = append(lines, table("TYPE\tFINGERPRINT\tCOMMENT\tBACKEND", len(t.keys), func(i int) string {
+		k := t.keys[i]
+		return fmt.Sprintf("%s\t%s\t%s\t%s", k.Type, k.Fingerprint, k.Comment, k.Backend)
+	})...)
+	lines = append(lines, "")
+
+	// Latest first, so that the oldest are cut off on small terminals
+	events := slices.Clone(t.events)
+	slices.Reverse(events)
+
+	lines = append(lines, table("TIME\tEVENT\tBACKEND\tFINGERPRINT\tCLIENT\tERROR", len(events), func(i int) string {
+		ev := events[i]
+
+		client := "-"
+		if ev.Client != nil {
+			client = fmt.Sprintf("%s[%d]", filepath.Base(ev.Client.Exe), ev.Client.PID)
+		}
+
+		return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s", ev.Time.Local().Format(time.TimeOnly), ev.Event, ev.Backend, ev.Fingerprint, client, ev.Error)
+	})...)
+
+	footer := "↑/↓ select  e enable/disable  l lock/unlock  q quit"
+	switch {
+	case t.err != nil:
+		footer += "  [" + strings.ReplaceAll(t.err.Error(), "\n", "; ") + "]"
+	case t.message != "":
+		footer += "  [" + t.message + "]"
+	}
+
+	lines = lines[:min(len(lines), height-1)]
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+
+	for i, line := range lines {
+		line = clip(line, width)
+		if i == highlight && len(t.backends) > 0 {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		b.WriteString(line + "\x1b[K\r\n")
+	}
+
+	b.WriteString("\x1b[J\x1b[" + fmt.Sprint(height) + "H" + clip(footer, width))
+
+	fmt.Print(b.String())
+}
+
+// Lays out a header and n rows in aligned columns.
+func table(header string, n int, row func(i int) string) []string {
+	var buf bytes.Buffer
+
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, header)
+	for i := range n {
+		_, _ = fmt.Fprintln(tw, row(i))
+	}
+	_ = tw.Flush()
+
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// Cuts the line off at the terminal's width.
+func clip(line string, width int) string {
+	if r := []rune(line); len(r) > width {
+		return string(r[:width])
+	}
+
+	return line
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var usageFile = flag.String("usage-file", defaultUsageFile(), "where key usage statistics are kept across restarts, empty to only keep them in memory")
+
+// How often changed statistics are written out
+const usageSaveInterval = time.Minute
+
+type (
+	// How often a key or backend signed, and when it last did. For keys,
+	// the backend that last signed with it.
+	usageCount struct {
+		Signatures int64     `json:"signatures"`
+		LastUsed   time.Time `json:"last_used"`
+		Backend    string    `json:"backend,omitempty"`
+	}
+
+	// Keys are by fingerprint, backends by name.
+	usageStats struct {
+		Keys     map[string]*usageCount `json:"keys"`
+		Backends map[string]*usageCount `json:"backends"`
+	}
+)
+
+var (
+	usageMu    sync.Mutex
+	usage      = usageStats{Keys: map[string]*usageCount{}, Backends: map[string]*usageCount{}}
+	usageDirty bool
+)
+
+// Returns $XDG_STATE_HOME/ssh-agent-proxy/usage.json, in ~/.local/state by
+// default.
+func defaultUsageFile() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(dir, "ssh-agent-proxy", "usage.json")
+}
+
+// Reads the statistics kept by the last run, making the directory they are
+// kept in for this one.
+func loadUsage() error {
+	if *usageFile == "" {
+		return nil
+	}
+
+	path := expandPath(*usageFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	if err := json.Unmarshal(b, &usage); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Older files may lack either
+	if usage.Keys == nil {
+		usage.Keys = map[string]*usageCount{}
+	}
+	if usage.Backends == nil {
+		usage.Backends = map[string]*usageCount{}
+	}
+
+	return nil
+}
+
+// Counts a signature made with the key by the backend.
+func recordUsage(fingerprint, backend string) {
+	now := time.Now()
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	count := func(m map[string]*usageCount, name string) *usageCount {
+		c, ok := m[name]
+		if !ok {
+			c = &usageCount{}
+			m[name] = c
+		}
+		c.Signatures++
+		c.LastUsed = now
+		return c
+	}
+
+	count(usage.Keys, fingerprint).Backend = backend
+	if backend != "" {
+		count(usage.Backends, backend)
+	}
+
+	usageDirty = true
+}
+
+// Returns the statistics of a key and of a backend, zero when they never
+// signed.
+func keyStats(fingerprint string) usageCount {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	if c, ok := usage.Keys[fingerprint]; ok {
+		return *c
+	}
+	return usageCount{}
+}
+
+func backendStats(name string) usageCount {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	if c, ok := usage.Backends[name]; ok {
+		return *c
+	}
+	return usageCount{}
+}
+
+// Writes the statistics out if they changed, replacing the file at once so
+// that a crash can't leave half of it.
+func saveUsage() error {
+	if *usageFile == "" {
+		return nil
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	if !usageDirty {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := expandPath(*usageFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	usageDirty = false
+
+	return nil
+}
+
+// Saves the statistics as the proxy exits, unless it handed over to an
+// upgraded one, which has taken them over.
+func saveUsageOnExit() {
+	if handedOff.Load() {
+		return
+	}
+
+	if err := saveUsage(); err != nil {
+		slog.Warn("usage statistics not saved", "error", err)
+	}
+}
+
+// Saves the statistics every minute until ctx is done.
+func persistUsage(ctx context.Context) {
+	t := time.NewTicker(usageSaveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := saveUsage(); err != nil {
+			slog.Warn("usage statistics not saved", "error", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The keys other local users connecting to the proxy get to see. Users
+// listed in no view can't connect at all, while the user running the proxy
+// always sees every key.
+type userView struct {
+	// User names or uids
+	Users []string `json:"users"`
+
+	// Key fingerprints, and names of backends whose keys are all visible
+	Keys     []string `json:"keys,omitempty"`
+	Backends []string `json:"backends,omitempty"`
+
+	// If set, the only principals the users' certificates may name
+	Principals []string `json:"principals,omitempty"`
+}
+
+// An agent restricting one client connection to the keys of its user's view.
+type userAgent struct {
+	agent.ExtendedAgent
+	ctx  context.Context
+	view *userView
+	peer peerCred
+}
+
+var (
+	userViews []userView
+
+	errKeyNotVisible = errors.New("key not visible to this user")
+)
+
+func (v userView) validate() error {
+	if len(v.Users) == 0 {
+		return errors.New("no users")
+	}
+
+	if len(v.Keys) == 0 && len(v.Backends) == 0 {
+		return errors.New("needs keys or backends")
+	}
+
+	return nil
+}
+
+// Returns the view of a client, nil if it may see every key. Reports false
+// if the client may not connect.
+func userViewFor(peer peerCred) (*userView, bool) {
+	if len(userViews) == 0 || peer.uid == os.Getuid() {
+		return nil, true
+	}
+
+	for i, v := range userViews {
+		if slices.ContainsFunc(v.Users, peer.isUser) {
+			return &userViews[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Reports whether the view includes the key, or the key a certificate
+// certifies.
+func (v *userView) visible(key ssh.PublicKey) bool {
+	if slices.Contains(v.Backends, pkr.owner(key)) {
+		return true
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	return slices.Contains(v.Keys, ssh.FingerprintSHA256(key))
+}
+
+func (a *userAgent) List() ([]*agent.Key, error) {
+	keys, err := a.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		return err != nil || !a.view.visible(pub)
+	}), nil
+}
+
+func (a *userAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *userAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	// The server hands over an *agent.Key, which isn't a certificate
+	pub, err := ssh.ParsePublicKey(key.Marshal())
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.view.visible(pub) {
+		slog.WarnContext(a.ctx, "sign request for a key outside the user's view", "uid", a.peer.uid, "pid", a.peer.pid, "exe", a.peer.exe, "fingerprint", ssh.FingerprintSHA256(key))
+		return nil, errKeyNotVisible
+	}
+
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
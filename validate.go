@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+)
+
+var checkOnly = flag.Bool("check", false, "check the config file, backends and sockets without starting, exiting non-zero on problems")
+
+func init() {
+	subcommands["validate"] = cmdValidate
+}
+
+func cmdValidate(args []string) error {
+	_ = flag.CommandLine.Parse(args)
+
+	return validateSetup()
+}
+
+// Checks the config file and flags the proxy would start with, printing
+// what is wrong with them. Unlike doctor, nothing is dialed: the backends
+// need not be running.
+func validateSetup() error {
+	// Registering backends logs them
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	d := &diagnosis{}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		d.fail("config", "", "%v", err)
+		cfg = &proxyConfig{}
+	} else if *configFile != "" {
+		if _, err := os.Stat(*configFile); err == nil {
+			d.ok("config", "%s parses", *configFile)
+		}
+	}
+
+	backends := cfg.Backends
+	for _, arg := range flag.Args() {
+		backends = append(backends, parseBackendArg(arg))
+	}
+
+	if len(backends) == 0 && !*internalKeyring && len(keyFiles) == 0 && *keyringFile == "" && *fallbackAgent == "" {
+		d.fail("backends", "give backends as arguments or in the config file", "none configured")
+	}
+
+	kr := &proxyKeyring{owners: map[string]keySource{}}
+
+	for _, b := range backends {
+		name := b.Name
+		if name == "" {
+			name = backendLabel(b.Socket)
+		}
+		subject := "backend " + name
+
+		if err := validateBackendSpec(b.Socket); err != nil {
+			d.fail(subject, "", "%s: %v", b.Socket, err)
+			continue
+		}
+
+		if err := kr.addBackend(b); errors.Is(err, errDuplicateBackend) {
+			d.warn(subject, "remove one of them; the proxy skips the second", "%v", err)
+		} else if err != nil {
+			d.fail(subject, "", "%v", err)
+		} else {
+			d.ok(subject, "%s", b.Socket)
+		}
+	}
+
+	for _, p := range cfg.Profiles {
+		for _, b := range p.Backends {
+			if !kr.hasBackend(b) {
+				d.fail("profile "+p.Name, "", "backend %s not configured", b)
+			}
+		}
+	}
+
+	active := cfg.Profile
+	if *profileFlag != "" {
+		active = *profileFlag
+	}
+	if active != "" && active != "none" && !slices.ContainsFunc(cfg.Profiles, func(p profile) bool { return p.Name == active }) {
+		d.fail("profile", "", "unknown profile %q", active)
+	}
+
+	for i, l := range cfg.Listeners {
+		for _, b := range l.Backends {
+			if !kr.hasBackend(b) {
+				d.fail(fmt.Sprintf("listener %d", i+1), "", "backend %s not configured", b)
+			}
+		}
+	}
+
+	for _, path := range keyFiles {
+		if _, err := os.Stat(expandPath(path)); err != nil {
+			d.fail("key file", "", "%v", err)
+		}
+	}
+
+	d.checkSockets(cfg)
+
+	if d.failed {
+		return errors.New("problems found")
+	}
+
+	return nil
+}
+
+// Checks a backend spec without dialing it: that the proxy knows its scheme
+// and that it names what the scheme needs.
+func validateBackendSpec(spec string) error {
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme == "" {
+		if spec == "" {
+			return errors.New("no socket")
+		}
+		return nil
+	}
+
+	switch u.Scheme {
+	case "unix", "cygwin":
+		if u.Path == "" && u.Opaque == "" {
+			return errors.New("no socket path")
+		}
+	case "tcp", "tls":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return fmt.Errorf("%s backends need a host and port: %w", u.Scheme, err)
+		}
+	case "ws", "wss", "ssh", "vsock":
+		if u.Host == "" {
+			return fmt.Errorf("%s backends need a host", u.Scheme)
+		}
+	case "gpg", "wsl", "pkcs11", "tpm", "awskms", "gcpkms", "azurekv", "vault", "keychain", "enclave", "forwarded":
+	default:
+		return fmt.Errorf("unsupported backend scheme %q", u.Scheme)
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How long a service may take to hand over a user's keys
+const upstreamTimeout = 15 * time.Second
+
+// How the keys of the proxy and of one account on a service differ.
+type upstreamReport struct {
+	Service string `json:"service"`
+	User    string `json:"user"`
+
+	// Keys the proxy has that the account lacks, and the other way round
+	NotRegistered []keyInfo `json:"not_registered"`
+	NotInAgent    []string  `json:"not_in_agent"`
+}
+
+func init() {
+	subcommands["verify-upstream"] = cmdVerifyUpstream
+}
+
+// Compares the keys the proxy lists with those registered on GitHub and
+// GitLab, exiting with 1 when they differ.
+func cmdVerifyUpstream(args []string) error {
+	fs, cf := newClientFlags("verify-upstream")
+	github := fs.String("github", "", "GitHub user whose keys to compare")
+	gitlab := fs.String("gitlab", "", "GitLab user whose keys to compare")
+	githubURL := fs.String("github-url", "https://github.com", "base URL of GitHub")
+	gitlabURL := fs.String("gitlab-url", "https://gitlab.com", "base URL of GitLab, for self-hosted instances")
+	backends := fs.String("backend", "", "comma-separated names of the backends to compare the keys of, all by default")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 0 || (*github == "" && *gitlab == "") {
+		return errors.New("usage: verify-upstream [flags] --github <user> --gitlab <user>")
+	}
+
+	var keys []keyInfo
+	if err := adminCall(cf.adminSocket, "list-keys", nil, &keys); err != nil {
+		return err
+	}
+
+	var only []string
+	if *backends != "" {
+		only = strings.Split(*backends, ",")
+	}
+
+	// Services register keys, not certificates
+	keys = slices.DeleteFunc(keys, func(k keyInfo) bool {
+		return k.PublicKey == "" || strings.Contains(k.Type, "-cert-v") || (only != nil && !slices.Contains(only, k.Backend))
+	})
+
+	var reports []upstreamReport
+	for _, account := range []struct{ service, user, base string }{
+		{"github", *github, *githubURL},
+		{"gitlab", *gitlab, *gitlabURL},
+	} {
+		if account.user == "" {
+			continue
+		}
+
+		registered, err := fetchUpstreamKeys(strings.TrimSuffix(account.base, "/") + "/" + account.user + ".keys")
+		if err != nil {
+			return fmt.Errorf("%s: %w", account.service, err)
+		}
+
+		reports = append(reports, compareUpstream(account.service, account.user, keys, registered))
+	}
+
+	if cf.json {
+		if err := printJSON(reports); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, r := range reports {
+			if len(r.NotRegistered) == 0 && len(r.NotInAgent) == 0 {
+				_, _ = fmt.Fprintf(tw, "%s\t%s\tin sync\t\n", r.Service, r.User)
+			}
+			for _, k := range r.NotRegistered {
+				_, _ = fmt.Fprintf(tw, "%s\t%s\tnot registered\t%s %s (%s)\n", r.Service, r.User, k.Fingerprint, k.Comment, k.Backend)
+			}
+			for _, fp := range r.NotInAgent {
+				_, _ = fmt.Fprintf(tw, "%s\t%s\tnot in agent\t%s\n", r.Service, r.User, fp)
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range reports {
+		if len(r.NotRegistered) > 0 || len(r.NotInAgent) > 0 {
+			os.Exit(1)
+		}
+	}
+
+	return nil
+}
+
+// Fetches the public keys an account registered, as the service publishes
+// them in authorized_keys format, by fingerprint.
+func fetchUpstreamKeys(url string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, res.Status)
+	}
+
+	var fps []string
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(sc.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+		fps = append(fps, ssh.FingerprintSHA256(pub))
+	}
+
+	return fps, sc.Err()
+}
+
+func compareUpstream(service, user string, keys []keyInfo, registered []string) upstreamReport {
+	r := upstreamReport{Service: service, User: user, NotRegistered: []keyInfo{}, NotInAgent: []string{}}
+
+	for _, k := range keys {
+		if !slices.Contains(registered, k.Fingerprint) && !slices.ContainsFunc(r.NotRegistered, func(o keyInfo) bool { return o.Fingerprint == k.Fingerprint }) {
+			r.NotRegistered = append(r.NotRegistered, k)
+		}
+	}
+
+	for _, fp := range registered {
+		if !slices.ContainsFunc(keys, func(k keyInfo) bool { return k.Fingerprint == fp }) {
+			r.NotInAgent = append(r.NotInAgent, fp)
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=...
+// -X main.buildDate=...". Whatever is left empty is filled in from the
+// build information Go embeds in the binary.
+var (
+	version   string
+	commit    string
+	buildDate string
+
+	showVersion = flag.Bool("version", false, "print version information and exit")
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+
+	if version == "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if commit == "" {
+				commit = s.Value
+			}
+		case "vcs.time":
+			// The commit time, the closest thing to a build date available
+			if buildDate == "" {
+				buildDate = s.Value
+			}
+		case "vcs.modified":
+			if s.Value == "true" && commit != "" {
+				commit += "-dirty"
+			}
+		}
+	}
+
+	if version == "" {
+		version = "dev"
+	}
+}
+
+func versionString() string {
+	return fmt.Sprintf("ssh-agent-proxy %s (commit %s, built %s, %s %s/%s)",
+		version, orUnknown(commit), orUnknown(buildDate), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+
+	return s
+}
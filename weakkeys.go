@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The shortest RSA keys not considered weak unless configured otherwise
+const defaultMinRSABits = 2048
+
+// What is done about keys with weak algorithms or sizes from any backend:
+// DSA keys, and RSA keys shorter than MinRSABits. Legacy keys, say in an
+// old forwarded agent, are either warned about or kept from clients.
+type weakKeyPolicy struct {
+	// warn or refuse
+	Action     string `json:"action"`
+	MinRSABits int    `json:"min_rsa_bits,omitempty"`
+
+	// Fingerprints of weak keys used anyway
+	Exempt []string `json:"exempt,omitempty"`
+
+	// Fingerprints already warned about when listed
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+var (
+	weakKeys *weakKeyPolicy
+
+	errWeakKey = errors.New("key algorithm or size too weak")
+)
+
+func (p *weakKeyPolicy) validate() error {
+	if p.Action != "warn" && p.Action != "refuse" {
+		return fmt.Errorf("unknown action %q", p.Action)
+	}
+
+	if p.MinRSABits < 0 {
+		return errors.New("min_rsa_bits can't be negative")
+	}
+	if p.MinRSABits == 0 {
+		p.MinRSABits = defaultMinRSABits
+	}
+
+	return nil
+}
+
+// Tells what makes a key, or the key a certificate certifies, weak, "" if
+// nothing does.
+func (p *weakKeyPolicy) weakness(key ssh.PublicKey) string {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	switch key.Type() {
+	case ssh.KeyAlgoDSA:
+		return "dsa"
+	case ssh.KeyAlgoRSA:
+		ck, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return ""
+		}
+		if pub, ok := ck.CryptoPublicKey().(*rsa.PublicKey); ok && pub.N.BitLen() < p.MinRSABits {
+			return fmt.Sprintf("rsa %d bits", pub.N.BitLen())
+		}
+	}
+
+	return ""
+}
+
+// Returns what makes a key weak, "" if it isn't or is exempt.
+func (p *weakKeyPolicy) applies(key ssh.PublicKey) string {
+	if p == nil {
+		return ""
+	}
+
+	why := p.weakness(key)
+	if why == "" || slices.Contains(p.Exempt, ssh.FingerprintSHA256(key)) {
+		return ""
+	}
+
+	return why
+}
+
+// Leaves out of a listing the weak keys the policy refuses, warning once
+// about each weak key listed.
+func (p *weakKeyPolicy) filter(keys []*agent.Key) []*agent.Key {
+	if p == nil {
+		return keys
+	}
+
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			return false
+		}
+
+		why := p.applies(pub)
+		if why == "" {
+			return false
+		}
+
+		fp := ssh.FingerprintSHA256(pub)
+
+		p.mu.Lock()
+		first := !p.warned[fp]
+		if p.warned == nil {
+			p.warned = map[string]bool{}
+		}
+		p.warned[fp] = true
+		p.mu.Unlock()
+
+		if first {
+			slog.Warn("weak key listed by a backend", "fingerprint", fp, "comment", k.Comment, "weakness", why, "action", p.Action)
+		}
+
+		return p.Action == "refuse"
+	})
+}
+
+// Refuses signing with a weak key, or warns about it, as the policy says.
+func (p *weakKeyPolicy) check(ctx context.Context, key ssh.PublicKey) error {
+	if p == nil {
+		return nil
+	}
+
+	pub, err := ssh.ParsePublicKey(key.Marshal())
+	if err != nil {
+		return nil
+	}
+
+	why := p.applies(pub)
+	if why == "" {
+		return nil
+	}
+
+	if p.Action == "refuse" {
+		slog.WarnContext(ctx, "sign request with a weak key refused", "fingerprint", ssh.FingerprintSHA256(pub), "weakness", why)
+		return errWeakKey
+	}
+
+	slog.WarnContext(ctx, "signing with a weak key", "fingerprint", ssh.FingerprintSHA256(pub), "weakness", why)
+
+	return nil
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agent connections carried over WebSocket (RFC 6455), for networks that
+// only let HTTP through, e.g. behind corporate proxies. The agent stream is
+// sent as binary frames; frame boundaries mean nothing to it.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Largest frame accepted, well above the largest agent message
+const wsMaxFrame = 1 << 24
+
+const (
+	wsContinuation = 0x0
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// A WebSocket connection read and written as a plain stream. Control frames
+// are answered as they arrive.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// Clients mask the frames they send, servers mustn't
+	client bool
+
+	readMu sync.Mutex
+	left   int64
+	mask   [4]byte
+	masked bool
+	pos    int
+
+	writeMu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for c.left == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.left -= int64(n)
+
+	return n, err
+}
+
+// Reads frame headers up to the next data frame.
+func (c *wsConn) nextFrame() error {
+	var h [2]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return err
+	}
+
+	op := h[0] & 0x0f
+	masked := h[1]&0x80 != 0
+	n := int64(h[1] & 0x7f)
+
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return err
+		}
+		n = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return err
+		}
+		n = int64(binary.BigEndian.Uint64(b[:]))
+	}
+
+	if n < 0 || n > wsMaxFrame {
+		return errors.New("websocket: frame too large")
+	}
+
+	if masked == c.client {
+		return errors.New("websocket: frame masked wrongly")
+	}
+
+	c.masked, c.pos = masked, 0
+	if masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case wsBinary, wsContinuation:
+		c.left = n
+		return nil
+	case wsPing, wsPong, wsClose:
+	default:
+		return fmt.Errorf("websocket: unexpected opcode %d", op)
+	}
+
+	if n > 125 {
+		return errors.New("websocket: control frame too large")
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	c.unmask(payload)
+
+	switch op {
+	case wsPing:
+		return c.writeFrame(wsPong, payload)
+	case wsClose:
+		// Echo the status code, and that's the end of it
+		_ = c.writeFrame(wsClose, payload[:min(len(payload), 2)])
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+
+	for i := range p {
+		p[i] ^= c.mask[c.pos%4]
+		c.pos++
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.writeFrameLocked(op, payload)
+}
+
+func (c *wsConn) writeFrameLocked(op byte, payload []byte) error {
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !c.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	}
+
+	_, err := c.Conn.Write(frame)
+
+	return err
+}
+
+// Says goodbye with a close frame, unless a write is stuck, which closing
+// is meant to abort.
+func (c *wsConn) Close() error {
+	if c.writeMu.TryLock() {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = c.writeFrameLocked(wsClose, []byte{0x03, 0xe8})
+		c.writeMu.Unlock()
+	}
+
+	return c.Conn.Close()
+}
+
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Dials ws://host/path or wss://host/path, a relay serving the agent
+// protocol over WebSocket, through the proxy in HTTPS_PROXY or HTTP_PROXY
+// if one applies. token-file names a file holding the bearer token to send,
+// ca the certificates to verify a wss server with instead of the system
+// roots.
+func dialWebSocket(ctx context.Context, u *url.URL) (net.Conn, error) {
+	q := u.Query()
+
+	var token []byte
+	if file := q.Get("token-file"); file != "" {
+		b, err := os.ReadFile(expandPath(file))
+		if err != nil {
+			return nil, err
+		}
+		token = bytes.TrimSpace(b)
+	}
+
+	target := &url.URL{Scheme: "http", Host: u.Host, Path: u.Path}
+	if u.Scheme == "wss" {
+		target.Scheme = "https"
+	}
+
+	// The rest of the query is the relay's
+	q.Del("token-file")
+	q.Del("ca")
+	target.RawQuery = q.Encode()
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: target})
+	if err != nil {
+		return nil, err
+	}
+
+	dialAddr := addr
+	if proxy != nil {
+		if proxy.Scheme != "http" {
+			return nil, fmt.Errorf("unsupported proxy %s, only http:// proxies are", proxy.Redacted())
+		}
+
+		dialAddr = proxy.Host
+		if proxy.Port() == "" {
+			dialAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		}
+	}
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", dialAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := wsHandshake(ctx, conn, u, target, addr, proxy, token)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+func wsHandshake(ctx context.Context, conn net.Conn, u, target *url.URL, addr string, proxy *url.URL, token []byte) (net.Conn, error) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if proxy != nil {
+		if err := proxyConnect(conn, proxy, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if u.Scheme == "wss" {
+		cfg := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+
+		if ca := u.Query().Get("ca"); ca != "" {
+			pem, err := os.ReadFile(expandPath(ca))
+			if err != nil {
+				return nil, err
+			}
+
+			cfg.RootCAs = x509.NewCertPool()
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", ca)
+			}
+		}
+
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("User-Agent", "ssh-agent-proxy/"+version)
+	if token != nil {
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("websocket %s: %s", u.Redacted(), resp.Status)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, fmt.Errorf("websocket %s: bad handshake", u.Redacted())
+	}
+
+	return &wsConn{Conn: conn, r: br, client: true}, nil
+}
+
+// Asks the HTTP proxy conn is connected to for a tunnel to addr.
+func proxyConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy %s: %s", proxy.Redacted(), resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return fmt.Errorf("proxy %s: unexpected data after CONNECT", proxy.Redacted())
+	}
+
+	return nil
+}
+
+// Serves the agent protocol over WebSocket on a TCP port, to clients that
+// send the bearer token. wss:// listeners speak TLS.
+type wsListener struct {
+	tcp   net.Listener
+	srv   *http.Server
+	path  string
+	token []byte
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listens on ws://host:port/path or wss://host:port/path, unless it was
+// handed over by the proxy upgraded.
+func listenWebSocket(l listenerConfig) (net.Listener, error) {
+	u, err := url.Parse(l.Socket)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := os.ReadFile(expandPath(l.TokenFile))
+	if err != nil {
+		return nil, err
+	}
+
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 {
+		return nil, fmt.Errorf("%s is empty", l.TokenFile)
+	}
+
+	var cfg *tls.Config
+	if u.Scheme == "wss" {
+		cert, err := tls.LoadX509KeyPair(expandPath(l.TLSCert), expandPath(l.TLSKey))
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate: %w", err)
+		}
+
+		cfg = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	tcp, err := listenTCP(l.Socket, u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &wsListener{
+		tcp:   tcp,
+		path:  u.Path,
+		token: token,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	if wl.path == "" {
+		wl.path = "/"
+	}
+
+	wl.srv = &http.Server{
+		Handler:           wl,
+		ReadHeaderTimeout: handshakeTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+	}
+
+	inner := tcp
+	if cfg != nil {
+		inner = tls.NewListener(tcp, cfg)
+	}
+
+	go func() {
+		if err := wl.srv.Serve(inner); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("websocket listener", "socket", l.Socket, "error", err)
+		}
+	}()
+
+	return wl, nil
+}
+
+// Upgrades authorized requests for the listener's path and hands the
+// connections to Accept.
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, append([]byte("Bearer "), l.token...)) != 1 {
+		slog.Warn("websocket client not authorized, connection rejected", "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		slog.Error("websocket upgrade", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	// The server's header timeout no longer applies
+	_ = conn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- &wsConn{Conn: conn, r: rw.Reader}:
+	case <-l.done:
+		_ = conn.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.srv.Close()
+	})
+
+	return err
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.tcp.Addr()
+}
+
+// Returns a copy of the TCP socket, to hand it over on upgrades.
+func (l *wsListener) File() (*os.File, error) {
+	return tcpFile(l.tcp)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+// Splits the command line at the first "--" into the proxy's own arguments
+// and a command to run under the proxy.
+func splitCommand(args []string) ([]string, []string) {
+	if i := slices.Index(args, "--"); i >= 0 {
+		return args[:i], args[i+1:]
+	}
+
+	return args, nil
+}
+
+// Reports whether a flag was given on the command line.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+
+	return given
+}
+
+// Runs command with SSH_AUTH_SOCK pointing at the proxy and returns its
+// exit status. Interrupts from the terminal are left to the command, which
+// shares the process group; termination signals are passed on to it.
+func runCommand(command []string) int {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+authSock, fmt.Sprintf("SSH_AGENT_PID=%d", os.Getpid()))
+
+	signal.Ignore(syscall.SIGINT, syscall.SIGQUIT)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "ssh-agent-proxy: %v\n", err)
+		return 127
+	}
+
+	slog.Info("command started", "command", command[0], "pid", cmd.Process.Pid)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	go func() {
+		for sig := range sigs {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+
+	slog.Info("command exited", "command", command[0], "state", cmd.ProcessState)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+
+	if err != nil {
+		return 1
+	}
+
+	return 0
+}
+
+// Closes the listeners, which removes their sockets, along with the agent
+// socket's directory and the symlink to it when they are left empty or
+// dangling.
+func removeSockets(listeners ...net.Listener) {
+	closePublished()
+
+	for _, l := range listeners {
+		if l != nil {
+			_ = l.Close()
+		}
+	}
+
+	// Still in use by the new proxy
+	if handedOff.Load() {
+		return
+	}
+
+	_ = os.Remove(filepath.Dir(authSock))
+
+	if *symlinkPath != "" {
+		link := expandPath(*symlinkPath)
+		if target, err := os.Readlink(link); err == nil && target == authSock {
+			_ = os.Remove(link)
+		}
+	}
+}